@@ -0,0 +1,20 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"github.com/nlevankov/backend-trainee-assignment/models"
+	"github.com/nlevankov/backend-trainee-assignment/views"
+)
+
+// newAdminHandler serves the internal endpoints, it's listened to on AdminAddr apart from the API
+// and has nothing else of the process (its flags, the environment) exposed
+func newAdminHandler(services *models.Services) http.Handler {
+	r := mux.NewRouter()
+	r.HandleFunc("/debug/cache", func(w http.ResponseWriter, r *http.Request) {
+		views.Render(w, r, services.CacheStats(), http.StatusOK, nil)
+	}).Methods(http.MethodGet)
+	return r
+}
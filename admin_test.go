@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/nlevankov/backend-trainee-assignment/models"
+)
+
+func TestAdminHandler(t *testing.T) {
+	services := &models.Services{}
+
+	cases := []struct {
+		h      http.Handler
+		method string
+		path   string
+		status int
+	}{
+		{newAdminHandler(services), http.MethodGet, "/debug/cache", http.StatusOK},
+		{newAdminHandler(services), http.MethodPost, "/debug/cache", http.StatusMethodNotAllowed},
+		// nothing else of the process is exposed, neither there nor by the API
+		{newAdminHandler(services), http.MethodGet, "/debug/vars", http.StatusNotFound},
+		{newHTTPHandler(testConfig(), services), http.MethodGet, "/debug/vars", http.StatusNotFound},
+		{newHTTPHandler(testConfig(), services), http.MethodGet, "/debug/cache", http.StatusNotFound},
+	}
+
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		c.h.ServeHTTP(w, httptest.NewRequest(c.method, c.path, nil))
+		if w.Code != c.status {
+			t.Errorf("%s %s: got %d, want %d", c.method, c.path, w.Code, c.status)
+		}
+	}
+}
+
+func TestAdminAddrValidation(t *testing.T) {
+	for addr, ok := range map[string]bool{"": true, "127.0.0.1:9100": true, ":9100": true, "127.0.0.1": false} {
+		cfg := DefaultConfig()
+		cfg.AdminAddr = addr
+		err := cfg.Validate()
+		if ok != (err == nil) || !ok && !strings.Contains(err.Error(), "admin_addr") {
+			t.Errorf("%q: got %v", addr, err)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/nlevankov/backend-trainee-assignment/controllers"
+	"github.com/nlevankov/backend-trainee-assignment/models"
+)
+
+// runArchive detaches the messages' partitions of the months before -before, exports each of them
+// into a gzipped JSONL file of -dir and drops it
+func runArchive(args []string) int {
+	fs := flag.NewFlagSet("archive", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s archive -before 2006-01 [flags]\n\n"+
+			"The chats whose messages are archived report that in the %s header.\n\n",
+			os.Args[0], controllers.HistoryArchivedHeader)
+		fs.PrintDefaults()
+	}
+	before := fs.String("before", "", "the first `month` which isn't archived, e.g. 2006-01")
+	dir := fs.String("dir", "archive", "the `directory` the partitions are exported to")
+	configFlags := RegisterConfigFlags(fs)
+	fs.Parse(args)
+
+	month, err := time.Parse("2006-01", *before)
+	if err != nil || fs.NArg() != 0 {
+		fs.Usage()
+		return 2
+	}
+
+	cfg, err := LoadConfig(configFlags)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid config:\n%v\n", err)
+		return 1
+	}
+	if err := os.MkdirAll(*dir, 0755); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	services, err := newServices(cfg, false)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer services.Close()
+
+	archived, err := services.ArchiveMessagePartitions(context.Background(), month,
+		func(p models.MessagePartition, rows *models.MessageRows) error {
+			return writeArchive(filepath.Join(*dir, p.Name+".jsonl.gz"), rows)
+		})
+	for _, p := range archived {
+		fmt.Printf("Archived %s [%s, %s)\n", p.Name, p.From.Format("2006-01-02"), p.To.Format("2006-01-02"))
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if len(archived) == 0 {
+		fmt.Println("Nothing to archive")
+	}
+	return 0
+}
+
+// writeArchive writes the messages into a temporary file and renames it once it's synced,
+// so the file either holds the whole partition or doesn't exist
+func writeArchive(path string, rows *models.MessageRows) (err error) {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+
+	zw := gzip.NewWriter(f)
+	enc := json.NewEncoder(zw)
+	for rows.Next() {
+		msg, err := rows.Message()
+		if err != nil {
+			return err
+		}
+		if err := enc.Encode(msg); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// keepMessagePartitions creates the messages' partitions of the upcoming months right away and then every interval
+// until ctx is done. It gives up if the storage isn't partitioned.
+func keepMessagePartitions(ctx context.Context, services *models.Services, ahead int, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		created, err := services.CreateMessagePartitions(ctx, time.Now(), ahead)
+		for _, p := range created {
+			log.Printf("Created the messages' partition %s", p.Name)
+		}
+		if errors.Is(err, models.ErrMessagesNotPartitioned) {
+			log.Printf("%v, the messages' partitions aren't created; see storage/upgrade_partitioning.sql", err)
+			return
+		}
+		if err != nil {
+			log.Printf("Can't create the messages' partitions: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -1,61 +1,709 @@
 package main
 
 import (
+	"bytes"
+	"errors"
+	"flag"
 	"fmt"
-	"github.com/caarlos0/env/v6"
-	"log"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+
+	"github.com/nlevankov/backend-trainee-assignment/middleware"
+	"github.com/nlevankov/backend-trainee-assignment/models"
+	"github.com/nlevankov/backend-trainee-assignment/views"
 )
 
+// The config is layered: DefaultConfig, then the file (-config or APP_CONFIG_FILE, YAML or TOML),
+// then the env vars, then the flags. Every field is named by its tags: yaml/toml in the file,
+// env in the environment, the flag's name is the file's key path with dashes, e.g. -database-host.
+// The fields marked with secret:"true" are redacted by -print-config.
+
 type PostgresConfig struct {
-	Host     string `env:"APP_STORAGE_HOST" envDefault:"database"`
-	Port     int    `env:"APP_STORAGE_PORT" envDefault:"5432"`
-	User     string `env:"APP_STORAGE_USER" envDefault:"postgres"`
-	Password string `env:"APP_STORAGE_PWD" envDefault:"123"`
-	Name     string `env:"APP_STORAGE_DBNAME" envDefault:"bta_dev"`
+	// Engine is "postgres" or "sqlite", the latter keeps the storage in the DSN's file and ignores the rest
+	// of the connection's fields; it suits the local development and the small deployments
+	Engine string `env:"APP_STORAGE_ENGINE" yaml:"engine" toml:"engine"`
+
+	// DSN is an alternative to the rest of the fields, they are ignored if it is set
+	DSN      string `env:"APP_STORAGE_DSN" yaml:"dsn" toml:"dsn" secret:"true"`
+	Host     string `env:"APP_STORAGE_HOST" yaml:"host" toml:"host"`
+	Port     int    `env:"APP_STORAGE_PORT" yaml:"port" toml:"port"`
+	User     string `env:"APP_STORAGE_USER" yaml:"user" toml:"user"`
+	Password string `env:"APP_STORAGE_PWD" yaml:"password" toml:"password" secret:"true"`
+	Name     string `env:"APP_STORAGE_DBNAME" yaml:"dbname" toml:"dbname"`
+
+	// SSLMode is one of sslModes, the certificates' files are optional, see the lib/pq docs
+	SSLMode     string `env:"APP_STORAGE_SSLMODE" yaml:"sslmode" toml:"sslmode"`
+	SSLRootCert string `env:"APP_STORAGE_SSLROOTCERT" yaml:"sslrootcert" toml:"sslrootcert"`
+	SSLCert     string `env:"APP_STORAGE_SSLCERT" yaml:"sslcert" toml:"sslcert"`
+	SSLKey      string `env:"APP_STORAGE_SSLKEY" yaml:"sslkey" toml:"sslkey"`
+
+	// the pool of the connections, see models.WithPool
+	MaxOpenConns    int           `env:"APP_STORAGE_MAX_OPEN_CONNS" yaml:"max_open_conns" toml:"max_open_conns"`
+	MaxIdleConns    int           `env:"APP_STORAGE_MAX_IDLE_CONNS" yaml:"max_idle_conns" toml:"max_idle_conns"`
+	ConnMaxLifetime time.Duration `env:"APP_STORAGE_CONN_MAX_LIFETIME" yaml:"conn_max_lifetime" toml:"conn_max_lifetime"`
+	ConnMaxIdleTime time.Duration `env:"APP_STORAGE_CONN_MAX_IDLE_TIME" yaml:"conn_max_idle_time" toml:"conn_max_idle_time"`
+
+	// StatementTimeout is set as statement_timeout of every connection, the requests' transactions get the time
+	// left until the request's deadline instead if it is shorter (see models.WithStatementTimeout), 0 means no timeout
+	StatementTimeout time.Duration `env:"APP_STORAGE_STATEMENT_TIMEOUT" yaml:"statement_timeout" toml:"statement_timeout"`
+
+	// Replicas are the DSNs of the read replicas, the read-only queries are spread among the healthy ones,
+	// see models.WithReplicas. They share the pool's settings and the statement timeout with the primary.
+	Replicas             []string      `env:"APP_STORAGE_REPLICAS" envSeparator:"," yaml:"replicas" toml:"replicas" secret:"true"`
+	ReplicaCheckInterval time.Duration `env:"APP_STORAGE_REPLICA_CHECK_INTERVAL" yaml:"replica_check_interval" toml:"replica_check_interval"`
 }
 
+var sslModes = []string{"disable", "require", "verify-ca", "verify-full"}
+
 type Config struct {
-	IP                            string `env:"APP_IP" envDefault:""`
-	Port                          uint   `env:"APP_PORT" envDefault:"9000"`
-	StorageConnNumOfAttempts      uint   `env:"APP_RETRY_NUM" envDefault:"5"`
-	StorageConnIntervalBWAttempts uint   `env:"APP_RETRY_INTERVAL" envDefault:"3"`
-	Logmode                       bool   `env:"APP_LOGMODE" envDefault:"false"`
+	IP                            string `env:"APP_IP" yaml:"ip" toml:"ip"`
+	Port                          uint   `env:"APP_PORT" yaml:"port" toml:"port"`
+	GRPCPort                      uint   `env:"APP_GRPC_PORT" yaml:"grpc_port" toml:"grpc_port"` // 0 disables the gRPC API
+	StorageConnNumOfAttempts      uint   `env:"APP_RETRY_NUM" yaml:"retry_num" toml:"retry_num"`
+	StorageConnIntervalBWAttempts uint   `env:"APP_RETRY_INTERVAL" yaml:"retry_interval" toml:"retry_interval"`
+	Logmode                       bool   `env:"APP_LOGMODE" yaml:"logmode" toml:"logmode"`
+	ErrorFormat                   string `env:"APP_ERROR_FORMAT" yaml:"error_format" toml:"error_format"`
+	CompressionThreshold          int    `env:"APP_COMPRESSION_THRESHOLD" yaml:"compression_threshold" toml:"compression_threshold"` // in bytes
+
+	// BodyLimit is the default limit of a request body's size in bytes, BodyLimits overrides it for the routes,
+	// e.g. APP_BODY_LIMITS="/users/add=4096,/v1/users=4096"
+	BodyLimit  int64      `env:"APP_BODY_LIMIT" yaml:"body_limit" toml:"body_limit"`
+	BodyLimits BodyLimits `env:"APP_BODY_LIMITS" yaml:"body_limits" toml:"body_limits"`
+
+	// RateLimit is the default rate in requests per second (0 means no limit) with the RateBurst burst,
+	// RateLimits overrides it for the routes, e.g. APP_RATELIMIT_ROUTES="/messages/add=10:20".
+	// RateKeys are ip, route and user, the last one needs RateUserHeader, which an authenticating proxy must set
+	RateLimit      float64    `env:"APP_RATELIMIT_RATE" yaml:"ratelimit_rate" toml:"ratelimit_rate"`
+	RateBurst      int        `env:"APP_RATELIMIT_BURST" yaml:"ratelimit_burst" toml:"ratelimit_burst"`
+	RateLimits     RateLimits `env:"APP_RATELIMIT_ROUTES" yaml:"ratelimit_routes" toml:"ratelimit_routes"`
+	RateKeys       []string   `env:"APP_RATELIMIT_KEYS" envSeparator:"," yaml:"ratelimit_keys" toml:"ratelimit_keys"`
+	RateUserHeader string     `env:"APP_RATELIMIT_USER_HEADER" yaml:"ratelimit_user_header" toml:"ratelimit_user_header"`
+	RateTrustProxy bool       `env:"APP_RATELIMIT_TRUST_PROXY" yaml:"ratelimit_trust_proxy" toml:"ratelimit_trust_proxy"`
+
+	// RequestTimeout is the deadline of a request's queries to the storage, 0 means no deadline
+	RequestTimeout time.Duration `env:"APP_REQUEST_TIMEOUT" yaml:"request_timeout" toml:"request_timeout"`
+
+	// ShutdownTimeout is how long the gRPC calls in flight are waited for on exit, the streams are ended right away
+	ShutdownTimeout time.Duration `env:"APP_SHUTDOWN_TIMEOUT" yaml:"shutdown_timeout" toml:"shutdown_timeout"`
+
+	// IdempotencyTTL is how long the outcomes of the creating requests are kept by their idempotency keys
+	IdempotencyTTL time.Duration `env:"APP_IDEMPOTENCY_TTL" yaml:"idempotency_ttl" toml:"idempotency_ttl"`
+
+	// RecordFile is the JSONL file the requests and the responses are appended to as traces for the replay
+	// command, empty means no recording. The bodies larger than BodyLimit aren't recorded.
+	RecordFile string `env:"APP_RECORD_FILE" yaml:"record_file" toml:"record_file"`
+
+	// MessagePartitionsAhead is how many months after the current one have their messages' partitions created in advance,
+	// the job creating them runs every MessagePartitionsInterval, 0 disables it
+	MessagePartitionsAhead    int           `env:"APP_MESSAGE_PARTITIONS_AHEAD" yaml:"message_partitions_ahead" toml:"message_partitions_ahead"`
+	MessagePartitionsInterval time.Duration `env:"APP_MESSAGE_PARTITIONS_INTERVAL" yaml:"message_partitions_interval" toml:"message_partitions_interval"`
+
+	// CacheSize is how many entries of each kind (memberships, chats, users' chats) are cached for CacheTTL,
+	// a list of the user's chats counts as the rows it is loaded from, 0 disables the cache, see models.WithCache
+	CacheSize int           `env:"APP_CACHE_SIZE" yaml:"cache_size" toml:"cache_size"`
+	CacheTTL  time.Duration `env:"APP_CACHE_TTL" yaml:"cache_ttl" toml:"cache_ttl"`
 
-	Database PostgresConfig
+	// AdminAddr is the host:port of the internal HTTP server with the cache's counters, empty disables it.
+	// It isn't guarded, so it must not be reachable from outside.
+	AdminAddr string `env:"APP_ADMIN_ADDR" yaml:"admin_addr" toml:"admin_addr"`
+
+	TLS TLSConfig `yaml:"tls" toml:"tls"`
+
+	Database PostgresConfig `yaml:"database" toml:"database"`
 }
 
+func DefaultConfig() Config {
+	return Config{
+		Port:                          9000,
+		GRPCPort:                      9090,
+		StorageConnNumOfAttempts:      5,
+		StorageConnIntervalBWAttempts: 3,
+		ErrorFormat:                   string(views.ErrorFormatEnvelope),
+		CompressionThreshold:          1024,
+		BodyLimit:                     1048576,
+		BodyLimits:                    BodyLimits{"/users/add": 4096, "/v1/users": 4096},
+		RateBurst:                     20,
+		RateLimits: RateLimits{
+			"/messages/add":           {PerSecond: 10, Burst: 20},
+			"/v1/chats/{id}/messages": {PerSecond: 10, Burst: 20},
+		},
+		RateKeys:        []string{string(middleware.RateKeyIP), string(middleware.RateKeyRoute)},
+		RequestTimeout:  30 * time.Second,
+		ShutdownTimeout: 10 * time.Second,
+		IdempotencyTTL:  24 * time.Hour,
+
+		MessagePartitionsAhead:    3,
+		MessagePartitionsInterval: 12 * time.Hour,
+		CacheSize:                 10000,
+		CacheTTL:                  time.Minute,
+		AdminAddr:                 "127.0.0.1:9100",
+		TLS: TLSConfig{
+			Port:           9443,
+			ClientAuth:     "none",
+			ReloadInterval: 10 * time.Second,
+			PlainHTTP:      plainHTTPRedirect,
+		},
+		Database: PostgresConfig{
+			Engine:   enginePostgres,
+			Host:     "database",
+			Port:     5432,
+			User:     "postgres",
+			Password: "123",
+			Name:     "bta_dev",
+			SSLMode:  "disable",
+
+			MaxOpenConns:     20,
+			MaxIdleConns:     10,
+			ConnMaxLifetime:  30 * time.Minute,
+			ConnMaxIdleTime:  5 * time.Minute,
+			StatementTimeout: 30 * time.Second,
+
+			ReplicaCheckInterval: 5 * time.Second,
+		},
+	}
+}
+
+// BodyLimits maps the routes' paths (as they are in the API specification) to the limits of the request bodies' sizes
+type BodyLimits map[string]int64
+
+func parseBodyLimits(v string) (interface{}, error) {
+	limits := make(BodyLimits)
+	for _, pair := range strings.Split(v, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("%q must be in form <path>=<bytes>", pair)
+		}
+		limit, err := strconv.ParseInt(strings.TrimSpace(kv[1]), 10, 64)
+		if err != nil || limit <= 0 {
+			return nil, fmt.Errorf("%q: the limit must be a positive integer", pair)
+		}
+		limits[strings.TrimSpace(kv[0])] = limit
+	}
+	return limits, nil
+}
+
+// RateLimits maps the routes' paths (as they are in the API specification) to their rates
+type RateLimits map[string]middleware.Rate
+
+func parseRateLimits(v string) (interface{}, error) {
+	limits := make(RateLimits)
+	for _, pair := range strings.Split(v, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("%q must be in form <path>=<rate>:<burst>", pair)
+		}
+		rb := strings.SplitN(kv[1], ":", 2)
+		if len(rb) != 2 {
+			return nil, fmt.Errorf("%q must be in form <path>=<rate>:<burst>", pair)
+		}
+		rate, err := strconv.ParseFloat(strings.TrimSpace(rb[0]), 64)
+		if err != nil || rate < 0 {
+			return nil, fmt.Errorf("%q: the rate must be a non-negative number", pair)
+		}
+		burst, err := strconv.Atoi(strings.TrimSpace(rb[1]))
+		if err != nil || burst <= 0 {
+			return nil, fmt.Errorf("%q: the burst must be a positive integer", pair)
+		}
+		limits[strings.TrimSpace(kv[0])] = middleware.Rate{PerSecond: rate, Burst: burst}
+	}
+	return limits, nil
+}
+
+// configParsers parse the values of the custom types from the env vars and the flags
+var configParsers = map[reflect.Type]func(v string) (interface{}, error){
+	reflect.TypeOf(BodyLimits{}): parseBodyLimits,
+	reflect.TypeOf(RateLimits{}): parseRateLimits,
+}
+
+const (
+	enginePostgres = "postgres"
+	engineSQLite   = "sqlite"
+)
+
 func (c PostgresConfig) Dialect() string {
-	return "postgres"
+	if c.Engine == engineSQLite {
+		return models.DialectSQLite
+	}
+	return models.DialectPostgres
 }
 func (c PostgresConfig) ConnectionInfo() string {
-	if c.Password == "" {
-		return fmt.Sprintf("host=%s port=%d user=%s dbname=%s "+
-			"sslmode=disable", c.Host, c.Port, c.User, c.Name)
+	if c.Engine == engineSQLite {
+		return sqliteConnectionInfo(c.DSN)
+	}
+	if c.DSN != "" {
+		return c.withStatementTimeout(c.DSN)
 	}
-	return fmt.Sprintf("host=%s port=%d user=%s password=%s "+
-		"dbname=%s sslmode=disable", c.Host, c.Port, c.User,
-		c.Password, c.Name)
+	info := fmt.Sprintf("host=%s port=%d user=%s dbname=%s sslmode=%s",
+		c.Host, c.Port, c.User, c.Name, c.SSLMode)
+	if c.Password != "" {
+		info += " password=" + c.Password
+	}
+	for _, p := range [][2]string{{"sslrootcert", c.SSLRootCert}, {"sslcert", c.SSLCert}, {"sslkey", c.SSLKey}} {
+		if p[1] != "" {
+			info += " " + p[0] + "=" + p[1]
+		}
+	}
+	return c.withStatementTimeout(info)
 }
 
-func LoadConfig() Config {
-	cfg := Config{}
-	if err := env.Parse(&cfg); err != nil {
-		log.Fatal("Can't parse env variables into config structure")
-		panic(err)
+// ReplicasConnectionInfo returns the replicas' DSNs with the statement timeout
+func (c PostgresConfig) ReplicasConnectionInfo() []string {
+	infos := make([]string, len(c.Replicas))
+	for i, dsn := range c.Replicas {
+		infos[i] = c.withStatementTimeout(dsn)
 	}
+	return infos
+}
 
-	if cfg.Port == 0 {
-		log.Fatal("HTTP port can't be 0")
+// sqliteParams are added to the SQLite DSN unless it has them: the writers wait for each other instead of failing,
+// the transactions take the write lock at once, so they don't fail to upgrade a read lock, the foreign keys
+// are enforced as in Postgres and the times are written in the format which sorts as text (see models.newStorage).
+// The names starting with _ are the DSN's parameters, the rest are the pragmas set by its _pragma parameters.
+var sqliteParams = [][2]string{
+	{"busy_timeout", "_pragma=busy_timeout(5000)"},
+	{"journal_mode", "_pragma=journal_mode(WAL)"},
+	{"foreign_keys", "_pragma=foreign_keys(1)"},
+	{"_txlock", "_txlock=immediate"},
+	{"_time_format", "_time_format=sqlite"},
+}
+
+// sqliteConnectionInfo adds sqliteParams to the DSN, the DSN with the malformed query is returned as it is,
+// the driver reports it
+func sqliteConnectionInfo(dsn string) string {
+	file, rawQuery, _ := strings.Cut(dsn, "?")
+	q, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return dsn
 	}
-	if cfg.StorageConnNumOfAttempts == 0 {
-		log.Fatal("A number of attempts can't be 0 (Storage reconnection parameter)")
+
+	has := make(map[string]bool)
+	for name := range q {
+		has[name] = true
 	}
-	if cfg.StorageConnIntervalBWAttempts == 0 {
-		log.Fatal("An interval between attempts can't be 0 (Storage reconnection parameter)")
+	// e.g. busy_timeout(5000) or busy_timeout=5000
+	for _, pragma := range q["_pragma"] {
+		name, _, _ := strings.Cut(pragma, "(")
+		name, _, _ = strings.Cut(name, "=")
+		has[strings.ToLower(strings.TrimSpace(name))] = true
 	}
 
-	fmt.Println("Successfully loaded .config")
+	var params []string
+	if rawQuery != "" {
+		params = append(params, rawQuery)
+	}
+	for _, p := range sqliteParams {
+		if !has[p[0]] {
+			params = append(params, p[1])
+		}
+	}
+	return file + "?" + strings.Join(params, "&")
+}
 
-	return cfg
+// withStatementTimeout adds statement_timeout to the DSN in any of the forms lib/pq supports,
+// the ones the DSN already has are left as they are
+func (c PostgresConfig) withStatementTimeout(dsn string) string {
+	if c.StatementTimeout <= 0 || strings.Contains(dsn, "statement_timeout") {
+		return dsn
+	}
+	ms := strconv.FormatInt(c.StatementTimeout.Milliseconds(), 10)
 
+	if u, err := url.Parse(dsn); err == nil && (u.Scheme == "postgres" || u.Scheme == "postgresql") {
+		q := u.Query()
+		q.Set("statement_timeout", ms)
+		u.RawQuery = q.Encode()
+		return u.String()
+	}
+	return dsn + " statement_timeout=" + ms
+}
+
+// Clients identifies the clients of the requests, the idempotency keys are scoped by them
+func (c Config) Clients() middleware.Clients {
+	return middleware.Clients{UserHeader: c.RateUserHeader, TrustProxy: c.RateTrustProxy}
+}
+
+// RateLimiter builds the rate limiter, it returns nil if there are no limits
+func (c Config) RateLimiter(store middleware.RateStore) *middleware.RateLimiter {
+	limited := c.RateLimit > 0
+	for _, rate := range c.RateLimits {
+		limited = limited || rate.PerSecond > 0
+	}
+	if !limited {
+		return nil
+	}
+
+	keys := make([]middleware.RateKey, len(c.RateKeys))
+	for i, k := range c.RateKeys {
+		keys[i] = middleware.RateKey(k)
+	}
+
+	return &middleware.RateLimiter{
+		Store:        store,
+		Default:      middleware.Rate{PerSecond: c.RateLimit, Burst: c.RateBurst},
+		Routes:       c.RateLimits,
+		Keys:         keys,
+		UserHeader:   c.RateUserHeader,
+		TrustProxy:   c.RateTrustProxy,
+		PathTemplate: specPathOnly,
+	}
+}
+
+// configField is a leaf field of the config
+type configField struct {
+	value  reflect.Value
+	key    string // the key path in the file, e.g. database.host
+	env    string
+	secret bool
+}
+
+func (f configField) flagName() string {
+	return strings.NewReplacer(".", "-", "_", "-").Replace(f.key)
+}
+
+func configFields(v reflect.Value, prefix string) []configField {
+	var fields []configField
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		key := prefix + sf.Tag.Get("yaml")
+		if sf.Type.Kind() == reflect.Struct && sf.Type != reflect.TypeOf(time.Time{}) {
+			fields = append(fields, configFields(v.Field(i), key+".")...)
+			continue
+		}
+		fields = append(fields, configField{
+			value:  v.Field(i),
+			key:    key,
+			env:    strings.SplitN(sf.Tag.Get("env"), ",", 2)[0],
+			secret: sf.Tag.Get("secret") == "true",
+		})
+	}
+	return fields
+}
+
+// ConfigFlags are the command-line counterparts of the config's fields
+type ConfigFlags struct {
+	file   *string
+	print  *bool
+	values map[string]*configFlag
+}
+
+type configFlag struct {
+	value  string
+	set    bool
+	isBool bool
+}
+
+func (f *configFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	return f.value
+}
+
+func (f *configFlag) Set(s string) error {
+	f.value = s
+	f.set = true
+	return nil
+}
+
+func (f *configFlag) IsBoolFlag() bool {
+	return f.isBool
+}
+
+// RegisterConfigFlags defines a flag for every field of the config and
+// the -config and -print-config flags in fs, it is meant to be called before fs.Parse.
+func RegisterConfigFlags(fs *flag.FlagSet) *ConfigFlags {
+	cf := &ConfigFlags{
+		file:   fs.String("config", os.Getenv("APP_CONFIG_FILE"), "a YAML or TOML config `file`, APP_CONFIG_FILE"),
+		print:  fs.Bool("print-config", false, "print the effective config with the secrets redacted and exit"),
+		values: make(map[string]*configFlag),
+	}
+
+	cfg := DefaultConfig()
+	for _, f := range configFields(reflect.ValueOf(&cfg).Elem(), "") {
+		v := &configFlag{isBool: f.value.Kind() == reflect.Bool}
+		cf.values[f.key] = v
+		fs.Var(v, f.flagName(), fmt.Sprintf("overrides %s (default %s)", f.env, formatConfigValue(f.value)))
+	}
+	return cf
+}
+
+// PrintConfig reports whether -print-config is provided
+func (cf *ConfigFlags) PrintConfig() bool {
+	return *cf.print
+}
+
+// LoadConfig loads the config layer by layer, the returned error lists every invalid field
+func LoadConfig(cf *ConfigFlags) (Config, error) {
+	cfg := DefaultConfig()
+
+	if *cf.file != "" {
+		if err := loadConfigFile(*cf.file, &cfg); err != nil {
+			return cfg, fmt.Errorf("can't load the config file %s: %w", *cf.file, err)
+		}
+	}
+
+	var errs []error
+	fields := configFields(reflect.ValueOf(&cfg).Elem(), "")
+	for _, f := range fields {
+		// the env vars without values leave the fields intact
+		if v := os.Getenv(f.env); f.env != "" && v != "" {
+			if err := setConfigValue(f.value, v); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %v", f.env, err))
+			}
+		}
+	}
+	for _, f := range fields {
+		if v := cf.values[f.key]; v != nil && v.set {
+			if err := setConfigValue(f.value, v.value); err != nil {
+				errs = append(errs, fmt.Errorf("-%s: %v", f.flagName(), err))
+			}
+		}
+	}
+	if err := cfg.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+
+	return cfg, errors.Join(errs...)
+}
+
+func loadConfigFile(path string, cfg *Config) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(bytes.NewReader(b))
+		dec.KnownFields(true)
+		if err := dec.Decode(cfg); err != nil && err != io.EOF {
+			return err
+		}
+	case ".toml":
+		md, err := toml.Decode(string(b), cfg)
+		if err != nil {
+			return err
+		}
+		if undecoded := md.Undecoded(); len(undecoded) != 0 {
+			return fmt.Errorf("unknown keys %v", undecoded)
+		}
+	default:
+		return fmt.Errorf("unknown format %q, use .yaml, .yml or .toml", filepath.Ext(path))
+	}
+
+	return nil
+}
+
+// setConfigValue parses the value of the env var or the flag into the field
+func setConfigValue(v reflect.Value, s string) error {
+	if parse, ok := configParsers[v.Type()]; ok {
+		parsed, err := parse(s)
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(parsed))
+		return nil
+	}
+
+	if v.Type() == reflect.TypeOf(time.Duration(0)) {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		i, err := strconv.ParseInt(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(i)
+	case reflect.Uint:
+		u, err := strconv.ParseUint(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetUint(u)
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	case reflect.Slice:
+		v.Set(reflect.ValueOf(strings.Split(s, ",")))
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+	return nil
+}
+
+// Validate checks all the fields and reports all the invalid ones at once
+func (c Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, a ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, a...))
+		}
+	}
+
+	check(c.Port != 0, "port: HTTP port can't be 0")
+	check(c.StorageConnNumOfAttempts != 0, "retry_num: a number of attempts can't be 0 (Storage reconnection parameter)")
+	check(c.StorageConnIntervalBWAttempts != 0, "retry_interval: an interval between attempts can't be 0 (Storage reconnection parameter)")
+	check(c.CompressionThreshold >= 0, "compression_threshold: a compression threshold can't be negative")
+	check(c.BodyLimit > 0, "body_limit: a limit of a request body's size must be positive")
+	for path, limit := range c.BodyLimits {
+		check(limit > 0, "body_limits: the limit of %s must be positive", path)
+	}
+	check(c.RateLimit >= 0, "ratelimit_rate: a rate limit can't be negative")
+	check(c.RateBurst > 0, "ratelimit_burst: a burst must be positive")
+	for path, rate := range c.RateLimits {
+		check(rate.PerSecond >= 0 && rate.Burst > 0, "ratelimit_routes: the rate of %s can't be negative and the burst must be positive", path)
+	}
+	for _, k := range c.RateKeys {
+		switch middleware.RateKey(k) {
+		case middleware.RateKeyUser:
+			check(c.RateUserHeader != "", "ratelimit_keys: %q needs ratelimit_user_header, the header "+
+				"an authenticating proxy identifies the user by", k)
+		case middleware.RateKeyIP, middleware.RateKeyRoute:
+		default:
+			check(false, "ratelimit_keys: unknown rate limiting key %q, use %q, %q or %q", k,
+				middleware.RateKeyUser, middleware.RateKeyIP, middleware.RateKeyRoute)
+		}
+	}
+	check(c.RequestTimeout >= 0, "request_timeout: a request timeout can't be negative")
+	check(c.ShutdownTimeout >= 0, "shutdown_timeout: a shutdown timeout can't be negative")
+	check(c.IdempotencyTTL > 0, "idempotency_ttl: an idempotency key's TTL must be positive")
+	check(c.MessagePartitionsAhead >= 0, "message_partitions_ahead: a number of months can't be negative")
+	check(c.MessagePartitionsInterval >= 0, "message_partitions_interval: an interval can't be negative")
+	check(c.CacheSize >= 0, "cache_size: a cache size can't be negative")
+	check(c.CacheSize == 0 || c.CacheTTL > 0, "cache_ttl: a cache TTL must be positive")
+	if c.AdminAddr != "" {
+		_, _, err := net.SplitHostPort(c.AdminAddr)
+		check(err == nil, "admin_addr: %q isn't host:port", c.AdminAddr)
+	}
+	check(c.ErrorFormat == string(views.ErrorFormatEnvelope) || c.ErrorFormat == string(views.ErrorFormatProblem),
+		"error_format: unknown error format %q, use %q or %q", c.ErrorFormat, views.ErrorFormatEnvelope, views.ErrorFormatProblem)
+	errs = append(errs, c.TLS.validate()...)
+	check(c.Database.MaxOpenConns >= 0 && c.Database.MaxIdleConns >= 0,
+		"database.max_open_conns: the numbers of connections can't be negative")
+	check(c.Database.MaxOpenConns == 0 || c.Database.MaxIdleConns <= c.Database.MaxOpenConns,
+		"database.max_idle_conns: there can't be more idle connections than database.max_open_conns")
+	check(c.Database.ConnMaxLifetime >= 0 && c.Database.ConnMaxIdleTime >= 0,
+		"database.conn_max_lifetime: the connections' lifetimes can't be negative")
+	check(c.Database.StatementTimeout >= 0, "database.statement_timeout: a statement timeout can't be negative")
+	for i, dsn := range c.Database.Replicas {
+		check(strings.TrimSpace(dsn) != "", "database.replicas: the DSN #%d is empty", i+1)
+	}
+	check(len(c.Database.Replicas) == 0 || c.Database.ReplicaCheckInterval > 0,
+		"database.replica_check_interval: an interval between the replicas' health checks must be positive")
+	check(c.Database.Engine == enginePostgres || c.Database.Engine == engineSQLite,
+		"database.engine: unknown storage engine %q, use %q or %q", c.Database.Engine, enginePostgres, engineSQLite)
+	if c.Database.Engine == engineSQLite {
+		check(c.Database.DSN != "", "database.dsn: the SQLite database file must be set")
+		check(len(c.Database.Replicas) == 0, "database.replicas: SQLite has no replicas")
+	} else if c.Database.DSN == "" {
+		validMode := false
+		for _, m := range sslModes {
+			validMode = validMode || c.Database.SSLMode == m
+		}
+		check(validMode, "database.sslmode: unknown SSL mode %q, use one of %v", c.Database.SSLMode, sslModes)
+		check(c.Database.SSLCert == "" == (c.Database.SSLKey == ""), "database.sslcert: a client certificate and its key go together")
+		check(c.Database.Host != "", "database.host: a storage host can't be empty unless database.dsn is set")
+		check(c.Database.Port > 0, "database.port: a storage port must be positive")
+		check(c.Database.Name != "", "database.dbname: a storage name can't be empty unless database.dsn is set")
+	}
+
+	return errors.Join(errs...)
+}
+
+const redacted = "******"
+
+var dsnPassword = regexp.MustCompile(`(password=)('(?:[^'\\]|\\.)*'|\S+)`)
+
+// Redacted returns the copy of the config with the secrets replaced, the DSNs keep everything except the passwords
+func (c Config) Redacted() Config {
+	for _, f := range configFields(reflect.ValueOf(&c).Elem(), "") {
+		if !f.secret {
+			continue
+		}
+		if dsns, ok := f.value.Interface().([]string); ok {
+			// the slice is shared with the original config, so it's replaced rather than modified
+			redactedDSNs := make([]string, len(dsns))
+			for i, dsn := range dsns {
+				redactedDSNs[i] = redactDSN(dsn)
+			}
+			f.value.Set(reflect.ValueOf(redactedDSNs))
+			continue
+		}
+		if f.value.String() == "" {
+			continue
+		}
+		if f.key != "database.dsn" {
+			f.value.SetString(redacted)
+			continue
+		}
+		f.value.SetString(redactDSN(f.value.String()))
+	}
+	// the maps are shared with the original config, but they hold no secrets
+	return c
+}
+
+func redactDSN(dsn string) string {
+	if u, err := url.Parse(dsn); err == nil && u.User != nil {
+		return u.Redacted()
+	}
+	return dsnPassword.ReplaceAllString(dsn, "${1}"+redacted)
+}
+
+// PrintConfig writes the effective config in YAML with the secrets redacted, it can be used as the config file
+func PrintConfig(w io.Writer, c Config) error {
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(c.Redacted()); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+func formatConfigValue(v reflect.Value) string {
+	switch x := v.Interface().(type) {
+	case BodyLimits, RateLimits:
+		b, _ := yaml.Marshal(x)
+		return strings.TrimSpace(strings.ReplaceAll(string(b), "\n", " "))
+	case []string:
+		return strings.Join(x, ",")
+	}
+	if s := fmt.Sprint(v.Interface()); s != "" {
+		return s
+	}
+	return `""`
 }
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// loadTestConfig loads the config from the file with the content (none if it is empty) and the args
+func loadTestConfig(t *testing.T, file string, args ...string) (Config, error) {
+	t.Helper()
+
+	if file != "" {
+		path := filepath.Join(t.TempDir(), "config.yaml")
+		if err := os.WriteFile(path, []byte(file), 0600); err != nil {
+			t.Fatal(err)
+		}
+		args = append([]string{"-config", path}, args...)
+	}
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	cf := RegisterConfigFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	return LoadConfig(cf)
+}
+
+func TestLoadConfigLayers(t *testing.T) {
+	t.Setenv("APP_BODY_LIMIT", "2000")
+	t.Setenv("APP_COMPRESSION_THRESHOLD", "200")
+	t.Setenv("APP_CACHE_SIZE", "") // an env var without a value leaves the field intact
+
+	cfg, err := loadTestConfig(t, `
+port: 1000
+body_limit: 1000
+compression_threshold: 100
+cache_size: 10
+database:
+  host: file-host
+`, "-compression-threshold", "300", "-database-host", "flag-host")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	def := DefaultConfig()
+	for _, c := range []struct {
+		name      string
+		got, want interface{}
+	}{
+		{"default", cfg.GRPCPort, def.GRPCPort},
+		{"file over default", cfg.Port, uint(1000)},
+		{"file over empty env", cfg.CacheSize, 10},
+		{"env over file", cfg.BodyLimit, int64(2000)},
+		{"flag over env", cfg.CompressionThreshold, 300},
+		{"flag over file", cfg.Database.Host, "flag-host"},
+	} {
+		if c.got != c.want {
+			t.Errorf("%s: got %v, want %v", c.name, c.got, c.want)
+		}
+	}
+}
+
+// TestLoadConfigCollectsErrors checks that the invalid values of every layer are reported at once
+func TestLoadConfigCollectsErrors(t *testing.T) {
+	t.Setenv("APP_PORT", "port")
+	t.Setenv("APP_CACHE_TTL", "long")
+	t.Setenv("APP_RATELIMIT_BURST", "0")
+
+	_, err := loadTestConfig(t, "", "-body-limit", "large")
+	if err == nil {
+		t.Fatal("no error")
+	}
+	for _, want := range []string{"APP_PORT", "APP_CACHE_TTL", "-body-limit", "ratelimit_burst"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("%q isn't reported in %q", want, err)
+		}
+	}
+}
+
+func TestLoadConfigFileErrors(t *testing.T) {
+	if _, err := loadTestConfig(t, "no_such_key: 1"); err == nil || !strings.Contains(err.Error(), "no_such_key") {
+		t.Errorf("unknown key: got %v", err)
+	}
+}
+
+func TestPrintConfigRedacts(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Database.Password = "secret-password"
+	cfg.Database.DSN = "postgres://app:secret-dsn@db:5432/bta?sslmode=disable"
+	cfg.Database.Replicas = []string{"host=replica user=app password='secret replica' dbname=bta"}
+
+	var out bytes.Buffer
+	if err := PrintConfig(&out, cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	printed := out.String()
+	if strings.Contains(printed, "secret") {
+		t.Errorf("a secret is printed:\n%s", printed)
+	}
+	for _, want := range []string{"password: '" + redacted + "'", "postgres://app:xxxxx@db:5432/bta?sslmode=disable",
+		"host=replica user=app password=" + redacted + " dbname=bta"} {
+		if !strings.Contains(printed, want) {
+			t.Errorf("%q isn't printed:\n%s", want, printed)
+		}
+	}
+
+	if cfg.Database.Replicas[0] != "host=replica user=app password='secret replica' dbname=bta" {
+		t.Errorf("the config itself is redacted: %v", cfg.Database.Replicas)
+	}
+}
+
+func TestSQLiteConnectionInfo(t *testing.T) {
+	const defaults = "_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_pragma=foreign_keys(1)" +
+		"&_txlock=immediate&_time_format=sqlite"
+
+	cases := []struct {
+		dsn, want string
+	}{
+		{"bta.db", "bta.db?" + defaults},
+		{"file:bta.db?mode=rwc", "file:bta.db?mode=rwc&" + defaults},
+		// the names in the path aren't the parameters
+		{"/data/foreign_keys/_txlock.db", "/data/foreign_keys/_txlock.db?" + defaults},
+		{"bta.db?_pragma=busy_timeout%3D100&_pragma=Journal_Mode(DELETE)&_txlock=deferred",
+			"bta.db?_pragma=busy_timeout%3D100&_pragma=Journal_Mode(DELETE)&_txlock=deferred" +
+				"&_pragma=foreign_keys(1)&_time_format=sqlite"},
+		// the value of another parameter isn't the parameter
+		{"bta.db?vfs=_time_format", "bta.db?vfs=_time_format&" + defaults},
+		{"bta.db?" + defaults, "bta.db?" + defaults},
+		{"bta.db?_pragma=%zz", "bta.db?_pragma=%zz"},
+	}
+
+	for _, c := range cases {
+		if got := sqliteConnectionInfo(c.dsn); got != c.want {
+			t.Errorf("%s:\ngot  %s\nwant %s", c.dsn, got, c.want)
+		}
+	}
+}
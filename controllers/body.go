@@ -0,0 +1,274 @@
+package controllers
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+
+	"github.com/golang/gddo/httputil/header"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// DefaultBodyLimit is the limit of a request body's size unless the route is wrapped with LimitBody.
+const DefaultBodyLimit int64 = 1 << 20
+
+type bodyLimitKey struct{}
+
+// LimitBody sets the limit of the request body's size for the handler, it applies to the decompressed body as well.
+func LimitBody(limit int64, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		h(w, r.WithContext(context.WithValue(r.Context(), bodyLimitKey{}, limit)))
+	}
+}
+
+func bodyLimit(r *http.Request) int64 {
+	if limit, ok := r.Context().Value(bodyLimitKey{}).(int64); ok {
+		return limit
+	}
+	return DefaultBodyLimit
+}
+
+// transcoder converts a request body of some content type into JSON, so every content type
+// is decoded by the same decoder into the same structs and results in the same errors.
+type transcoder func(body io.Reader, dst interface{}) (io.Reader, error)
+
+var transcoders = map[string]transcoder{
+	"application/json":        func(body io.Reader, dst interface{}) (io.Reader, error) { return body, nil },
+	formContentType:           formToJSON,
+	"application/msgpack":     msgpackToJSON,
+	"application/x-msgpack":   msgpackToJSON,
+	"application/vnd.msgpack": msgpackToJSON,
+}
+
+// BodyContentTypes lists the supported content types of request bodies.
+var BodyContentTypes = []string{"application/json", "application/x-www-form-urlencoded", "application/msgpack"}
+
+// decompress returns the request body decoded according to the Content-Encoding header
+func decompress(w http.ResponseWriter, r *http.Request, limit int64) (io.Reader, error) {
+	encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding")))
+
+	var body io.ReadCloser
+	var err error
+	switch encoding {
+	case "", "identity":
+		return r.Body, nil
+	case "gzip", "x-gzip":
+		body, err = gzip.NewReader(r.Body)
+	case "deflate":
+		body, err = zlib.NewReader(r.Body)
+	default:
+		msg := "Content-Encoding header must be one of: gzip, deflate, identity"
+		return nil, &malformedRequest{status: http.StatusUnsupportedMediaType, msg: msg, code: codeUnsupportedContentEncoding,
+			details: map[string]interface{}{"content_encoding": encoding}}
+	}
+	if err != nil {
+		if isTooLarge(err) {
+			return nil, err
+		}
+		msg := fmt.Sprintf("Request body is not valid %s data", encoding)
+		return nil, &malformedRequest{status: http.StatusBadRequest, msg: msg, code: codeBodyInvalidEncoding}
+	}
+
+	// защита от "zip-бомб": распакованное тело ограничено так же, как и сжатое
+	return http.MaxBytesReader(w, body, limit), nil
+}
+
+// formToJSON converts the form into a JSON object, the values of the fields which are slices in dst
+// become arrays of strings, all the others become strings, which suits the ",string" fields.
+func formToJSON(body io.Reader, dst interface{}) (io.Reader, error) {
+	b, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 0 {
+		return bytes.NewReader(nil), nil
+	}
+
+	pairs, err := parseForm(string(b))
+	if err != nil {
+		return nil, err
+	}
+
+	arrays := sliceFields(dst)
+	obj := make(map[string]interface{}, len(pairs))
+	positions := make(map[string]int64, len(pairs))
+	for _, p := range pairs {
+		_, seen := obj[p.key]
+		switch {
+		case arrays[p.key]:
+			vs, _ := obj[p.key].([]string)
+			obj[p.key] = append(vs, p.value)
+		case seen:
+			msg := fmt.Sprintf("Request body contains several values for the '%s' field (at position %d)", p.key, p.position)
+			return nil, &malformedRequest{status: http.StatusBadRequest, msg: msg, code: codeBodyInvalidValue, field: p.key,
+				details: map[string]interface{}{"position": p.position, "content_type": formContentType}}
+		default:
+			obj[p.key] = p.value
+		}
+		if !seen {
+			positions[p.key] = p.position
+		}
+	}
+
+	j, err := marshalJSON(obj)
+	if err != nil {
+		return nil, err
+	}
+	return &formBody{Reader: j, positions: positions}, nil
+}
+
+const formContentType = "application/x-www-form-urlencoded"
+
+type formPair struct {
+	key, value string
+	position   int64 // the offset of the pair in the body
+}
+
+// parseForm is url.ParseQuery which keeps the order and the positions of the pairs,
+// so the errors point at the pair they are caused by
+func parseForm(form string) ([]formPair, error) {
+	var pairs []formPair
+	var position int64
+	for _, pair := range strings.Split(form, "&") {
+		start := position
+		position += int64(len(pair)) + 1
+		if pair == "" {
+			continue
+		}
+
+		key, value, _ := strings.Cut(pair, "=")
+		var err error
+		if strings.Contains(pair, ";") {
+			err = errors.New("invalid semicolon separator")
+		}
+		if err == nil {
+			key, err = url.QueryUnescape(key)
+		}
+		if err == nil {
+			value, err = url.QueryUnescape(value)
+		}
+		if err != nil {
+			msg := fmt.Sprintf("Request body contains badly-formed form data (at position %d)", start)
+			return nil, &malformedRequest{status: http.StatusBadRequest, msg: msg, code: codeBodyMalformed,
+				details: map[string]interface{}{"position": start, "content_type": formContentType}}
+		}
+
+		pairs = append(pairs, formPair{key: key, value: value, position: start})
+	}
+	return pairs, nil
+}
+
+// formBody is the JSON a form is converted into, the errors of its decoding refer to the form's fields
+// rather than to the JSON, see locate
+type formBody struct {
+	*bytes.Reader
+	positions map[string]int64
+}
+
+// locate replaces the offset in the JSON with the position of the field's pair in the form
+func (fb *formBody) locate(mr *malformedRequest) {
+	if _, ok := mr.details["position"]; !ok || mr.code != codeBodyInvalidValue {
+		return
+	}
+
+	position, ok := fb.positions[mr.field]
+	if !ok {
+		delete(mr.details, "position")
+		mr.msg = "Request body contains an invalid value"
+		return
+	}
+	mr.details["position"] = position
+	mr.details["content_type"] = formContentType
+	mr.msg = fmt.Sprintf("Request body contains an invalid value for the '%s' field (at position %d)", mr.field, position)
+}
+
+// sliceFields returns the JSON names of the slice fields of the struct dst points to
+func sliceFields(dst interface{}) map[string]bool {
+	t := reflect.TypeOf(dst)
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	fields := make(map[string]bool)
+	if t.Kind() != reflect.Struct {
+		return fields
+	}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := f.Name
+		if tag := strings.Split(f.Tag.Get("json"), ",")[0]; tag != "" {
+			name = tag
+		}
+		if f.Type.Kind() == reflect.Slice {
+			fields[name] = true
+		}
+	}
+	return fields
+}
+
+func msgpackToJSON(body io.Reader, dst interface{}) (io.Reader, error) {
+	b, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 0 {
+		return bytes.NewReader(nil), nil
+	}
+
+	br := bytes.NewReader(b)
+	var v interface{}
+	if err = msgpack.NewDecoder(br).Decode(&v); err != nil {
+		msg := "Request body contains badly-formed MessagePack"
+		return nil, &malformedRequest{status: http.StatusBadRequest, msg: msg, code: codeBodyMalformed}
+	}
+	if br.Len() != 0 {
+		msg := "Request body must only contain a single MessagePack object"
+		return nil, &malformedRequest{status: http.StatusBadRequest, msg: msg, code: codeBodyMultipleObjects}
+	}
+
+	return marshalJSON(v)
+}
+
+func marshalJSON(v interface{}) (*bytes.Reader, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		msg := "Request body contains values which can't be represented in JSON"
+		return nil, &malformedRequest{status: http.StatusBadRequest, msg: msg, code: codeBodyMalformed}
+	}
+	return bytes.NewReader(b), nil
+}
+
+func contentType(r *http.Request) string {
+	if r.Header.Get("Content-Type") == "" {
+		return "application/json"
+	}
+	value, _ := header.ParseValueAndParams(r.Header, "Content-Type")
+	return value
+}
+
+func isTooLarge(err error) bool {
+	var maxBytesError *http.MaxBytesError
+	return errors.As(err, &maxBytesError)
+}
+
+// formatSize formats the number of bytes the way people write it, e.g. 1MB
+func formatSize(n int64) string {
+	switch {
+	case n >= 1<<20 && n%(1<<20) == 0:
+		return fmt.Sprintf("%dMB", n>>20)
+	case n >= 1<<10 && n%(1<<10) == 0:
+		return fmt.Sprintf("%dKB", n>>10)
+	default:
+		return fmt.Sprintf("%d bytes", n)
+	}
+}
@@ -0,0 +1,263 @@
+package controllers
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/vmihailenco/msgpack/v5"
+
+	"github.com/nlevankov/backend-trainee-assignment/models"
+	"github.com/nlevankov/backend-trainee-assignment/views"
+)
+
+// the structs the request bodies are decoded into
+func bodyDestinations() []interface{} {
+	return []interface{}{
+		&models.User{},
+		&models.ChatQueryParams{},
+		&models.Message{},
+		&models.MessageLookup{},
+		&[]*models.User{},
+		&[]*models.Message{},
+	}
+}
+
+func decodeTestBody(contentType, contentEncoding string, body []byte, limit int64, dst interface{}) error {
+	r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body))
+	r.Header.Set("Content-Type", contentType)
+	r.Header.Set("Content-Encoding", contentEncoding)
+	h := LimitBody(limit, func(w http.ResponseWriter, req *http.Request) { r = req })
+	h(httptest.NewRecorder(), r)
+
+	return decodeBody(httptest.NewRecorder(), r, dst)
+}
+
+// checkBodyError fails unless err is nil or a malformedRequest with one of BodyErrorCodes
+func checkBodyError(t *testing.T, err error) {
+	t.Helper()
+	if err == nil {
+		return
+	}
+
+	var mr *malformedRequest
+	if !errors.As(err, &mr) {
+		t.Fatalf("%T %v isn't classified", err, err)
+	}
+	if mr.status >= http.StatusInternalServerError {
+		t.Fatalf("%v results in %d", err, mr.status)
+	}
+	for _, code := range BodyErrorCodes[mr.status] {
+		if code == mr.code {
+			return
+		}
+	}
+	t.Fatalf("%v results in %d %s, which isn't listed in BodyErrorCodes", err, mr.status, mr.code)
+}
+
+func gzipped(s string) []byte {
+	var b bytes.Buffer
+	zw := gzip.NewWriter(&b)
+	zw.Write([]byte(s))
+	zw.Close()
+	return b.Bytes()
+}
+
+func packed(v interface{}) []byte {
+	b, err := msgpack.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+var fuzzContentTypes = []string{"application/json", "application/x-www-form-urlencoded", "application/msgpack"}
+var fuzzContentEncodings = []string{"", "gzip", "deflate"}
+
+// FuzzDecodeBody checks that no body makes decodeBody panic or fail with anything but a client error
+func FuzzDecodeBody(f *testing.F) {
+	f.Add(uint8(0), uint8(0), []byte(`{"username":"alice"}`))
+	f.Add(uint8(0), uint8(0), []byte(`{"name":"general","users":["1","2"],"user":"1"}`))
+	f.Add(uint8(0), uint8(0), []byte(`{"chat":"1","author":"2","text":"hi","client_msg_id":"m"}`))
+	f.Add(uint8(0), uint8(0), []byte(`[{"username":"a"},null,{"username":5}]`))
+	f.Add(uint8(0), uint8(0), []byte(`{"chats":["1",null,"x"],"limit":3}`))
+	f.Add(uint8(0), uint8(0), []byte(`{"users":["99999999999999999999"]}{}`))
+	f.Add(uint8(1), uint8(0), []byte("name=general&users=1&users=2"))
+	f.Add(uint8(1), uint8(0), []byte("username=%zz"))
+	f.Add(uint8(2), uint8(0), packed(map[string]interface{}{"username": "alice"}))
+	f.Add(uint8(2), uint8(0), packed(map[interface{}]interface{}{1: 2.5}))
+	f.Add(uint8(0), uint8(1), gzipped(`{"username":"alice"}`))
+	f.Add(uint8(0), uint8(1), []byte("not gzip"))
+
+	f.Fuzz(func(t *testing.T, contentType, contentEncoding uint8, body []byte) {
+		ct := fuzzContentTypes[int(contentType)%len(fuzzContentTypes)]
+		ce := fuzzContentEncodings[int(contentEncoding)%len(fuzzContentEncodings)]
+		for _, dst := range bodyDestinations() {
+			checkBodyError(t, decodeTestBody(ct, ce, body, 4096, dst))
+		}
+	})
+}
+
+func TestBodyErrorTaxonomy(t *testing.T) {
+	cases := []struct {
+		name            string
+		contentType     string
+		contentEncoding string
+		body            []byte
+		dst             interface{}
+		status          int
+		code            string
+		field           string
+	}{
+		{"unsupported content type", "text/plain", "", []byte(`{}`), &models.User{},
+			http.StatusUnsupportedMediaType, codeUnsupportedContentType, ""},
+		{"unsupported content encoding", "application/json", "br", []byte(`{}`), &models.User{},
+			http.StatusUnsupportedMediaType, codeUnsupportedContentEncoding, ""},
+		{"invalid gzip header", "application/json", "gzip", []byte("not gzip"), &models.User{},
+			http.StatusBadRequest, codeBodyInvalidEncoding, ""},
+		{"invalid gzip checksum", "application/json", "gzip", corruptChecksum(gzipped(`{}`)), &models.User{},
+			http.StatusBadRequest, codeBodyInvalidEncoding, ""},
+		{"invalid deflate header", "application/json", "deflate", []byte("not zlib"), &models.User{},
+			http.StatusBadRequest, codeBodyInvalidEncoding, ""},
+		{"syntax error", "application/json", "", []byte(`{"username" "a"}`), &models.User{},
+			http.StatusBadRequest, codeBodyMalformed, ""},
+		{"truncated JSON", "application/json", "", []byte(`{"username":`), &models.User{},
+			http.StatusBadRequest, codeBodyMalformed, ""},
+		{"badly-formed form", "application/x-www-form-urlencoded", "", []byte("a=%zz"), &models.User{},
+			http.StatusBadRequest, codeBodyMalformed, ""},
+		{"badly-formed MessagePack", "application/msgpack", "", []byte{0xc1}, &models.User{},
+			http.StatusBadRequest, codeBodyMalformed, ""},
+		{"MessagePack without JSON representation", "application/msgpack", "",
+			packed(map[interface{}]interface{}{1: 2}), &models.User{}, http.StatusBadRequest, codeBodyMalformed, ""},
+		{"invalid value", "application/json", "", []byte(`{"username":5}`), &models.User{},
+			http.StatusBadRequest, codeBodyInvalidValue, "username"},
+		{"invalid string-encoded value", "application/json", "", []byte(`{"user":"x"}`), &models.ChatQueryParams{},
+			http.StatusBadRequest, codeBodyInvalidValue, "user"},
+		{"array instead of object", "application/json", "", []byte(`[1]`), &models.User{},
+			http.StatusBadRequest, codeBodyInvalidValue, ""},
+		{"several form values", "application/x-www-form-urlencoded", "", []byte("username=a&username=b"), &models.User{},
+			http.StatusBadRequest, codeBodyInvalidValue, "username"},
+		{"unknown field", "application/json", "", []byte(`{"user\"name":"a"}`), &models.User{},
+			http.StatusBadRequest, codeBodyUnknownField, `user"name`},
+		{"empty body", "application/json", "", nil, &models.User{},
+			http.StatusBadRequest, codeBodyEmpty, ""},
+		{"empty form", "application/x-www-form-urlencoded", "", nil, &models.User{},
+			http.StatusBadRequest, codeBodyEmpty, ""},
+		{"too large body", "application/json", "", []byte(`{"username":"` + strings.Repeat("a", 100) + `"}`), &models.User{},
+			http.StatusRequestEntityTooLarge, codeBodyTooLarge, ""},
+		{"too large decompressed body", "application/json", "gzip", gzipped(`{"username":"` + strings.Repeat("a", 1000) + `"}`),
+			&models.User{}, http.StatusRequestEntityTooLarge, codeBodyTooLarge, ""},
+		{"invalid id", "application/json", "", []byte(`{"users":["abc"]}`), &models.ChatQueryParams{},
+			http.StatusBadRequest, codeBodyInvalidNumber, ""},
+		{"too large id", "application/json", "", []byte(`{"users":["18446744073709551616"]}`), &models.ChatQueryParams{},
+			http.StatusBadRequest, codeBodyInvalidNumber, ""},
+		{"multiple objects", "application/json", "", []byte(`{"username":"a"}{}`), &models.User{},
+			http.StatusBadRequest, codeBodyMultipleObjects, ""},
+		{"multiple MessagePack objects", "application/msgpack", "", append(packed(map[string]string{}), 0xc0), &models.User{},
+			http.StatusBadRequest, codeBodyMultipleObjects, ""},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			err := decodeTestBody(c.contentType, c.contentEncoding, c.body, 64, c.dst)
+			var mr *malformedRequest
+			if !errors.As(err, &mr) {
+				t.Fatalf("got %T %v, want malformedRequest", err, err)
+			}
+			if mr.status != c.status || mr.code != c.code || mr.field != c.field {
+				t.Errorf("got %d %s '%s', want %d %s '%s'", mr.status, mr.code, mr.field, c.status, c.code, c.field)
+			}
+			checkBodyError(t, err)
+		})
+	}
+}
+
+func corruptChecksum(b []byte) []byte {
+	b = append([]byte(nil), b...)
+	b[len(b)-8] ^= 0xff
+	return b
+}
+
+// TestJSONErrorTexts fails if encoding/json changes the texts classifyBodyError relies on
+func TestJSONErrorTexts(t *testing.T) {
+	dec := json.NewDecoder(strings.NewReader(`{"a\"b":1}`))
+	dec.DisallowUnknownFields()
+	err := dec.Decode(&struct{}{})
+
+	field, ok := unknownField(err)
+	if !ok || field != `a"b` {
+		t.Errorf("the unknown field isn't recognized in %q", err)
+	}
+}
+
+func TestClassifyBodyErrorNeverFails(t *testing.T) {
+	errs := []error{
+		errors.New("connection reset by peer"),
+		fmt.Errorf("wrapped: %w", io.ErrClosedPipe),
+		errors.New(jsonInvalidStringTagPrefix + `trying to unmarshal "x" into uint`),
+	}
+	for _, err := range errs {
+		checkBodyError(t, classifyBodyError(err, 64))
+	}
+
+	mr := classifyBodyError(errors.New(jsonInvalidStringTagPrefix+`trying to unmarshal "x" into uint`), 64)
+	if mr.code != codeBodyInvalidString || mr.msg != `trying to unmarshal 'x' into uint` {
+		t.Errorf("got %s %q", mr.code, mr.msg)
+	}
+}
+
+func TestFormErrorPositions(t *testing.T) {
+	cases := []struct {
+		name     string
+		body     string
+		dst      interface{}
+		code     string
+		field    string
+		position interface{}
+	}{
+		{"badly-formed pair", "a=1&username=%zz", &models.User{}, codeBodyMalformed, "", int64(4)},
+		{"semicolon", "username=a;b", &models.User{}, codeBodyMalformed, "", int64(0)},
+		{"several values", "username=a&username=b", &models.User{}, codeBodyInvalidValue, "username", int64(11)},
+		{"invalid value", "name=x&user=abc", &models.ChatQueryParams{}, codeBodyInvalidValue, "user", int64(7)},
+		{"object instead of array", "username=a", &[]*models.User{}, codeBodyInvalidValue, "", nil},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			err := decodeTestBody(formContentType, "", []byte(c.body), 64, c.dst)
+			var mr *malformedRequest
+			if !errors.As(err, &mr) {
+				t.Fatalf("got %T %v, want malformedRequest", err, err)
+			}
+			if mr.code != c.code || mr.field != c.field || mr.details["position"] != c.position {
+				t.Errorf("got %s '%s' at %v, want %s '%s' at %v", mr.code, mr.field, mr.details["position"],
+					c.code, c.field, c.position)
+			}
+			if c.position != nil && !strings.Contains(mr.msg, fmt.Sprintf("(at position %d)", c.position)) {
+				t.Errorf("the message %q doesn't point at the position", mr.msg)
+			}
+		})
+	}
+}
+
+// TestFormErrorsAreLocalized checks that the positions in a form let the catalogs use their precise messages
+func TestFormErrorsAreLocalized(t *testing.T) {
+	err := decodeTestBody(formContentType, "", []byte("a=1&username=%zz"), 64, &models.User{})
+
+	r := httptest.NewRequest(http.MethodPost, "/", nil)
+	r.Header.Set("Accept-Language", "ru")
+	w := httptest.NewRecorder()
+	views.Render(w, r, nil, http.StatusBadRequest, err)
+
+	want := "Тело запроса в формате application/x-www-form-urlencoded содержит некорректные данные (позиция 4)"
+	if !strings.Contains(w.Body.String(), want) {
+		t.Errorf("got %s, want %q", w.Body.String(), want)
+	}
+}
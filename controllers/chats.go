@@ -7,31 +7,36 @@ import (
 )
 
 type Chats struct {
-	cs models.ChatService
+	cs   models.ChatService
+	idem *Idempotency
 }
 
-func NewChats(cs models.ChatService) *Chats {
+// NewChats creates the controller, idem may be nil, then Idempotency-Key is ignored
+func NewChats(cs models.ChatService, idem *Idempotency) *Chats {
 	return &Chats{
-		cs: cs,
+		cs:   cs,
+		idem: idem,
 	}
 }
 
 func (c *Chats) Create(w http.ResponseWriter, r *http.Request) {
 	var cqp models.ChatQueryParams
 
-	err := decodeJSONBody(w, r, &cqp)
+	err := decodeBody(w, r, &cqp)
 	if err != nil {
-		classificateErrorAndRenderView(w, err)
+		classificateErrorAndRenderView(w, r, err)
 		return
 	}
 
-	result, statusCode, err := c.cs.Create(&cqp)
+	result, statusCode, err := idempotent(c.idem, w, r, nil, &cqp, func() (uint, int, error) {
+		return c.cs.Create(r.Context(), &cqp)
+	})
 	if err != nil {
-		views.RenderJSON(w, nil, statusCode, err)
+		views.Render(w, r, nil, statusCode, err)
 		return
 	}
 
-	views.RenderJSON(w, result, statusCode, nil)
+	views.Render(w, r, result, statusCode, nil)
 
 	return
 }
@@ -39,19 +44,50 @@ func (c *Chats) Create(w http.ResponseWriter, r *http.Request) {
 func (c *Chats) ByUserID(w http.ResponseWriter, r *http.Request) {
 	var cqp models.ChatQueryParams
 
-	err := decodeJSONBody(w, r, &cqp)
+	err := decodeBody(w, r, &cqp)
 	if err != nil {
-		classificateErrorAndRenderView(w, err)
+		classificateErrorAndRenderView(w, r, err)
 		return
 	}
 
-	result, statusCode, err := c.cs.ByUserID(cqp.UserID)
+	c.renderList(w, r, cqp.UserID)
+
+	return
+}
+
+// ListByUser is the /v1 counterpart of ByUserID, the user is taken from the path.
+func (c *Chats) ListByUser(w http.ResponseWriter, r *http.Request) {
+	userID, err := pathID(r, "id")
 	if err != nil {
-		views.RenderJSON(w, nil, statusCode, err)
+		classificateErrorAndRenderView(w, r, err)
 		return
 	}
 
-	views.RenderJSON(w, result, statusCode, nil)
+	c.renderList(w, r, userID)
 
 	return
 }
+
+// renderList renders the user's chats for ByUserID and ListByUser, a conditional request is answered
+// by the list's version first, so the list isn't loaded if the client already has it
+func (c *Chats) renderList(w http.ResponseWriter, r *http.Request, userID *uint) {
+	if isConditional(r) {
+		version, statusCode, err := c.cs.VersionByUserID(r.Context(), userID)
+		if err != nil {
+			views.Render(w, r, nil, statusCode, err)
+			return
+		}
+		if views.NotModified(w, r, version.Tag, version.LastModified) {
+			return
+		}
+	}
+
+	result, statusCode, err := c.cs.ByUserID(r.Context(), userID)
+	if err != nil {
+		views.Render(w, r, nil, statusCode, err)
+		return
+	}
+
+	version := models.ChatsVersion(result)
+	views.RenderConditional(w, r, result, version.Tag, version.LastModified)
+}
@@ -1,21 +1,59 @@
 package controllers
 
 import (
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"log"
+	"math"
 	"net/http"
 	"strconv"
 	"strings"
 
-	"github.com/golang/gddo/httputil/header"
+	"github.com/gorilla/mux"
+	"github.com/nlevankov/backend-trainee-assignment/models"
 	"github.com/nlevankov/backend-trainee-assignment/views"
 )
 
 type malformedRequest struct {
-	status int
-	msg    string
+	status  int
+	msg     string
+	code    string
+	field   string
+	details map[string]interface{}
+}
+
+const (
+	codeUnsupportedContentType     = "UNSUPPORTED_CONTENT_TYPE"
+	codeUnsupportedContentEncoding = "UNSUPPORTED_CONTENT_ENCODING"
+	codeBodyInvalidEncoding        = "BODY_INVALID_ENCODING"
+	codeBodyMalformed              = "BODY_MALFORMED"
+	codeBodyInvalidValue           = "BODY_INVALID_VALUE"
+	codeBodyUnknownField           = "BODY_UNKNOWN_FIELD"
+	codeBodyEmpty                  = "BODY_EMPTY"
+	codeBodyTooLarge               = "BODY_TOO_LARGE"
+	codeBodyInvalidNumber          = "BODY_INVALID_NUMBER"
+	codeBodyInvalidString          = "BODY_INVALID_STRING_VALUE"
+	codeBodyMultipleObjects        = "BODY_MULTIPLE_OBJECTS"
+	codePathInvalidValue           = "PATH_INVALID_VALUE"
+	codeQueryInvalidValue          = "QUERY_INVALID_VALUE"
+)
+
+// BodyErrorCodes lists the codes which decoding of a request body may result in, keyed by HTTP status.
+var BodyErrorCodes = map[int][]string{
+	http.StatusBadRequest: {codeBodyMalformed, codeBodyInvalidValue, codeBodyUnknownField, codeBodyEmpty,
+		codeBodyInvalidNumber, codeBodyInvalidString, codeBodyMultipleObjects, codeBodyInvalidEncoding},
+	http.StatusRequestEntityTooLarge: {codeBodyTooLarge},
+	http.StatusUnsupportedMediaType:  {codeUnsupportedContentType, codeUnsupportedContentEncoding},
+}
+
+// ParamErrorCodes lists the codes which parsing of path and query parameters may result in, keyed by HTTP status.
+var ParamErrorCodes = map[int][]string{
+	http.StatusBadRequest: {codePathInvalidValue, codeQueryInvalidValue},
 }
 
 func (mr *malformedRequest) Error() string {
@@ -26,89 +64,271 @@ func (mr *malformedRequest) Public() string {
 	return mr.Error()
 }
 
+func (mr *malformedRequest) Code() string {
+	return mr.code
+}
+
+func (mr *malformedRequest) Field() string {
+	return mr.field
+}
+
+func (mr *malformedRequest) Details() map[string]interface{} {
+	return mr.details
+}
+
 // it assumes that err != nil
-func classificateErrorAndRenderView(w http.ResponseWriter, err error) {
+func classificateErrorAndRenderView(w http.ResponseWriter, r *http.Request, err error) {
 	var mr *malformedRequest
 	if errors.As(err, &mr) {
-		views.RenderJSON(w, nil, mr.status, err)
+		views.Render(w, r, nil, mr.status, err)
 	} else {
-		views.RenderJSON(w, nil, http.StatusInternalServerError, err)
+		views.Render(w, r, nil, http.StatusInternalServerError, err)
+	}
+}
+
+// isConditional reports whether the request has the preconditions which let a list be answered
+// with 304 Not Modified, only then is it worth to query the list's version before loading it
+func isConditional(r *http.Request) bool {
+	return r.Header.Get("If-None-Match") != "" || r.Header.Get("If-Modified-Since") != ""
+}
+
+// pathID parses the path variable as an id, the route's pattern is expected to let only digits through.
+// The ids greater than models.MaxID are rejected rather than sent to the storage.
+func pathID(r *http.Request, name string) (*uint, error) {
+	s := mux.Vars(r)[name]
+	v, err := strconv.ParseUint(s, 10, 64)
+	if err != nil || v > models.MaxID {
+		msg := fmt.Sprintf("Path parameter '%s' must be an unsigned integer not greater than %d", name, models.MaxID)
+		return nil, &malformedRequest{status: http.StatusBadRequest, msg: msg, code: codePathInvalidValue, field: name,
+			details: map[string]interface{}{"value": s, "max": models.MaxID}}
 	}
+
+	id := uint(v)
+	return &id, nil
 }
 
+// queryUint parses the optional 32-bit query parameter, it returns nil if the parameter isn't provided
+func queryUint(r *http.Request, name string) (*uint, error) {
+	s := r.URL.Query().Get(name)
+	if s == "" {
+		return nil, nil
+	}
+
+	v, err := strconv.ParseUint(s, 10, 32)
+	if err != nil {
+		msg := fmt.Sprintf("Query parameter '%s' must be an unsigned integer not greater than %d", name, uint32(math.MaxUint32))
+		return nil, &malformedRequest{status: http.StatusBadRequest, msg: msg, code: codeQueryInvalidValue, field: name,
+			details: map[string]interface{}{"value": s, "max": uint32(math.MaxUint32)}}
+	}
+
+	u := uint(v)
+	return &u, nil
+}
+
+// queryBool parses the optional boolean query parameter, it returns false if the parameter isn't provided
+func queryBool(r *http.Request, name string) (bool, error) {
+	s := r.URL.Query().Get(name)
+	if s == "" {
+		return false, nil
+	}
+
+	v, err := strconv.ParseBool(s)
+	if err != nil {
+		msg := fmt.Sprintf("Query parameter '%s' must be a boolean", name)
+		return false, &malformedRequest{status: http.StatusBadRequest, msg: msg, code: codeQueryInvalidValue, field: name,
+			details: map[string]interface{}{"value": s}}
+	}
+
+	return v, nil
+}
+
+// batchItems describes the outcomes of the batch's items, it returns nil (not a nil slice, so the error
+// is rendered without a result) if the batch hasn't been processed
+func batchItems(w http.ResponseWriter, r *http.Request, items []models.BatchItem) interface{} {
+	if items == nil {
+		return nil
+	}
+
+	result := make([]*views.BatchItem, len(items))
+	for i, item := range items {
+		result[i] = views.NewBatchItem(w, r, item.ID, item.StatusCode, item.Err)
+	}
+	return result
+}
+
+// decodeBody decodes the request body of any of BodyContentTypes, compressed or not, into dst.
+// The other content types are converted into JSON first, so the same checks apply to all of them.
+//
 // возможно существует пакет, который реализует эти стандартные проверки
-//  решение взял отсюда: https://www.alexedwards.net/blog/how-to-properly-parse-a-json-request-body
-func decodeJSONBody(w http.ResponseWriter, r *http.Request, dst interface{}) error {
-	if r.Header.Get("Content-Type") != "" {
-		value, _ := header.ParseValueAndParams(r.Header, "Content-Type")
-		if value != "application/json" {
-			msg := "Content-Type header is not application/json"
-			return &malformedRequest{status: http.StatusUnsupportedMediaType, msg: msg}
+// решение взял отсюда: https://www.alexedwards.net/blog/how-to-properly-parse-a-json-request-body
+func decodeBody(w http.ResponseWriter, r *http.Request, dst interface{}) error {
+	value := contentType(r)
+	transcode, ok := transcoders[value]
+	if !ok {
+		msg := "Content-Type header must be one of: " + strings.Join(BodyContentTypes, ", ")
+		return &malformedRequest{status: http.StatusUnsupportedMediaType, msg: msg, code: codeUnsupportedContentType,
+			details: map[string]interface{}{"content_type": value}}
+	}
+
+	limit := bodyLimit(r)
+	r.Body = http.MaxBytesReader(w, r.Body, limit)
+
+	body, err := decompress(w, r, limit)
+	var transcoded io.Reader
+	if err == nil {
+		transcoded, err = transcode(body, dst)
+	}
+	if err == nil {
+		err = decodeJSON(transcoded, dst)
+	}
+	if err != nil {
+		mr := classifyBodyError(err, limit)
+		if fb, ok := transcoded.(*formBody); ok {
+			fb.locate(mr)
 		}
+		return mr
 	}
 
-	r.Body = http.MaxBytesReader(w, r.Body, 1048576)
+	return nil
+}
 
-	dec := json.NewDecoder(r.Body)
+func decodeJSON(body io.Reader, dst interface{}) error {
+	dec := json.NewDecoder(body)
 	dec.DisallowUnknownFields()
 
-	err := dec.Decode(&dst)
-	if err != nil {
-		var syntaxError *json.SyntaxError
-		var unmarshalTypeError *json.UnmarshalTypeError
-		var numError *strconv.NumError
-
-		switch {
-		case errors.As(err, &syntaxError):
-			msg := fmt.Sprintf("Request body contains badly-formed JSON (at position %d)", syntaxError.Offset)
-			return &malformedRequest{status: http.StatusBadRequest, msg: msg}
-
-		case errors.Is(err, io.ErrUnexpectedEOF):
-			msg := fmt.Sprintf("Request body contains badly-formed JSON")
-			return &malformedRequest{status: http.StatusBadRequest, msg: msg}
-
-		case errors.As(err, &unmarshalTypeError):
-			msg := fmt.Sprintf("Request body contains an invalid value for the '%s' field (at position %d)", unmarshalTypeError.Field, unmarshalTypeError.Offset)
-			return &malformedRequest{status: http.StatusBadRequest, msg: msg}
-
-		case strings.HasPrefix(err.Error(), "json: unknown field "):
-			fieldName := strings.TrimPrefix(err.Error(), "json: unknown field ")
-			fieldNameWOQuotes := strings.Trim(fieldName, "\"")
-			msg := fmt.Sprintf("Request body contains unknown field '%s'", fieldNameWOQuotes)
-			return &malformedRequest{status: http.StatusBadRequest, msg: msg}
-
-		case errors.Is(err, io.EOF):
-			msg := "Request body must not be empty"
-			return &malformedRequest{status: http.StatusBadRequest, msg: msg}
-
-		case err.Error() == "http: request body too large":
-			msg := "Request body must not be larger than 1MB"
-			return &malformedRequest{status: http.StatusRequestEntityTooLarge, msg: msg}
-
-			//todo пока так, наверняка можно что-то по лучше придумать, но это по крайней мере лучше,
-			//  чем 500-ая ошибка
-		case errors.As(err, &numError):
-			typeName := strings.TrimPrefix(numError.Func, "Parse")
-			msg := fmt.Sprintf("Trying to parse '%s' into %v", numError.Num, typeName)
-			return &malformedRequest{status: http.StatusBadRequest, msg: msg}
-
-			//todo пока так, наверняка можно что-то по лучше придумать, но это по крайней мере лучше,
-			//  чем 500-ая ошибка
-		case strings.HasPrefix(err.Error(), "json: invalid use of ,string struct tag, "):
-			msg := strings.TrimPrefix(err.Error(), "json: invalid use of ,string struct tag, ")
-			msg = strings.ReplaceAll(msg, "\"", "'")
-			return &malformedRequest{status: http.StatusBadRequest, msg: msg}
-
-		default:
-			return err
-		}
+	if err := dec.Decode(&dst); err != nil {
+		return err
 	}
 
-	err = dec.Decode(&struct{}{})
-	if err != io.EOF {
+	var syntaxError *json.SyntaxError
+	var unmarshalTypeError *json.UnmarshalTypeError
+	err := dec.Decode(&struct{}{})
+	_, isUnknownField := unknownField(err)
+
+	switch {
+	case err == io.EOF:
+		return nil
+
+	case err == nil, isUnknownField, errors.As(err, &syntaxError), errors.As(err, &unmarshalTypeError),
+		errors.Is(err, io.ErrUnexpectedEOF):
 		msg := "Request body must only contain a single JSON object"
-		return &malformedRequest{status: http.StatusBadRequest, msg: msg}
+		return &malformedRequest{status: http.StatusBadRequest, msg: msg, code: codeBodyMultipleObjects}
+
+	default:
+		// the rest of the body can't be read, e.g. the compressed one turns out to be corrupted or too large
+		return err
+	}
+}
+
+// encoding/json has no types for the errors below, so they are recognized by their texts,
+// TestJSONErrorTexts fails if a Go release changes the text of the unknown field error.
+// The recent releases report misuse of the ",string" struct tag as *json.UnmarshalTypeError,
+// the older ones - by the text below.
+const (
+	jsonUnknownFieldPrefix     = "json: unknown field "
+	jsonInvalidStringTagPrefix = "json: invalid use of ,string struct tag, "
+)
+
+// unknownField returns the name of the field which DisallowUnknownFields has rejected
+func unknownField(err error) (string, bool) {
+	if err == nil || !strings.HasPrefix(err.Error(), jsonUnknownFieldPrefix) {
+		return "", false
+	}
+	name := strings.TrimPrefix(err.Error(), jsonUnknownFieldPrefix)
+	if unquoted, err := strconv.Unquote(name); err == nil {
+		return unquoted, true
 	}
+	return strings.Trim(name, "\""), true
+}
 
-	return nil
+// invalidStringTag returns the reason why the value of a ",string" field can't be decoded
+func invalidStringTag(err error) (string, bool) {
+	if err == nil || !strings.HasPrefix(err.Error(), jsonInvalidStringTagPrefix) {
+		return "", false
+	}
+	return strings.ReplaceAll(strings.TrimPrefix(err.Error(), jsonInvalidStringTagPrefix), "\"", "'"), true
+}
+
+// classifyBodyError converts the errors of reading and decoding of the body into malformedRequest,
+// every one of them results in a code of BodyErrorCodes. The errors it doesn't know are logged and reported
+// as BODY_MALFORMED rather than 500, since no body must make the app fail.
+func classifyBodyError(err error, limit int64) *malformedRequest {
+	var syntaxError *json.SyntaxError
+	var unmarshalTypeError *json.UnmarshalTypeError
+	var numError *strconv.NumError
+	var corruptInputError flate.CorruptInputError
+	var mr *malformedRequest
+
+	if errors.As(err, &mr) {
+		return mr
+	}
+	if field, ok := unknownField(err); ok {
+		msg := fmt.Sprintf("Request body contains unknown field '%s'", field)
+		return &malformedRequest{status: http.StatusBadRequest, msg: msg, code: codeBodyUnknownField, field: field}
+	}
+	if reason, ok := invalidStringTag(err); ok {
+		return &malformedRequest{status: http.StatusBadRequest, msg: reason, code: codeBodyInvalidString,
+			details: map[string]interface{}{"reason": reason}}
+	}
+
+	switch {
+	case errors.As(err, &syntaxError):
+		msg := fmt.Sprintf("Request body contains badly-formed JSON (at position %d)", syntaxError.Offset)
+		return &malformedRequest{status: http.StatusBadRequest, msg: msg, code: codeBodyMalformed,
+			details: map[string]interface{}{"position": syntaxError.Offset}}
+
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		msg := "Request body contains badly-formed JSON"
+		return &malformedRequest{status: http.StatusBadRequest, msg: msg, code: codeBodyMalformed}
+
+	case errors.As(err, &unmarshalTypeError):
+		if unmarshalTypeError.Field == "" {
+			msg := fmt.Sprintf("Request body contains an invalid value (at position %d)", unmarshalTypeError.Offset)
+			return &malformedRequest{status: http.StatusBadRequest, msg: msg, code: codeBodyInvalidValue,
+				details: map[string]interface{}{"position": unmarshalTypeError.Offset}}
+		}
+		msg := fmt.Sprintf("Request body contains an invalid value for the '%s' field (at position %d)", unmarshalTypeError.Field, unmarshalTypeError.Offset)
+		return &malformedRequest{status: http.StatusBadRequest, msg: msg, code: codeBodyInvalidValue,
+			field: unmarshalTypeError.Field, details: map[string]interface{}{"position": unmarshalTypeError.Offset}}
+
+	case errors.Is(err, io.EOF):
+		msg := "Request body must not be empty"
+		return &malformedRequest{status: http.StatusBadRequest, msg: msg, code: codeBodyEmpty}
+
+	case isTooLarge(err):
+		msg := "Request body must not be larger than " + formatSize(limit)
+		return &malformedRequest{status: http.StatusRequestEntityTooLarge, msg: msg, code: codeBodyTooLarge,
+			details: map[string]interface{}{"limit": limit}}
+
+	case errors.Is(err, gzip.ErrChecksum), errors.Is(err, gzip.ErrHeader), errors.Is(err, zlib.ErrChecksum),
+		errors.Is(err, zlib.ErrHeader), errors.As(err, &corruptInputError):
+		msg := "Request body is not valid compressed data"
+		return &malformedRequest{status: http.StatusBadRequest, msg: msg, code: codeBodyInvalidEncoding}
+
+	// the ids in the arrays are parsed by models.stringID
+	case errors.As(err, &numError):
+		typeName := strings.TrimPrefix(numError.Func, "Parse")
+		msg := fmt.Sprintf("Trying to parse '%s' into %v", numError.Num, typeName)
+		return &malformedRequest{status: http.StatusBadRequest, msg: msg, code: codeBodyInvalidNumber,
+			details: map[string]interface{}{"value": numError.Num, "type": typeName}}
+
+	default:
+		log.Printf("Unclassified error of decoding a request body: %v", err)
+		msg := "Request body can't be decoded"
+		return &malformedRequest{status: http.StatusBadRequest, msg: msg, code: codeBodyMalformed}
+	}
+}
+
+// ReadPrimaryHeader makes the request read from the primary storage rather than a replica if it's true,
+// the clients send it to see their own writes the replicas may lag behind
+const ReadPrimaryHeader = "X-Read-Primary"
+
+// ReadYourWrites is the middleware honoring ReadPrimaryHeader, see models.ReadPrimary
+func ReadYourWrites(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if primary, _ := strconv.ParseBool(r.Header.Get(ReadPrimaryHeader)); primary {
+			r = r.WithContext(models.ReadPrimary(r.Context()))
+		}
+		next.ServeHTTP(w, r)
+	})
 }
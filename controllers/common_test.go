@@ -0,0 +1,78 @@
+package controllers
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestPathID(t *testing.T) {
+	cases := []struct {
+		value string
+		want  uint
+		ok    bool
+	}{
+		{"0", 0, true},
+		{"42", 42, true},
+		{"2147483647", 2147483647, true},
+		{"2147483648", 0, false},
+		{"1099511627776", 0, false},
+		{"99999999999999999999", 0, false},
+		{"", 0, false},
+	}
+
+	for _, c := range cases {
+		r := mux.SetURLVars(httptest.NewRequest(http.MethodGet, "/", nil), map[string]string{"id": c.value})
+		id, err := pathID(r, "id")
+		if c.ok {
+			if err != nil || *id != c.want {
+				t.Errorf("%q: got %v, %v, want %d", c.value, id, err, c.want)
+			}
+			continue
+		}
+
+		var mr *malformedRequest
+		if !errors.As(err, &mr) || mr.status != http.StatusBadRequest || mr.code != codePathInvalidValue || mr.field != "id" {
+			t.Errorf("%q: got %v, %v, want 400 %s", c.value, id, err, codePathInvalidValue)
+		}
+	}
+}
+
+func TestQueryUint(t *testing.T) {
+	cases := []struct {
+		query string
+		want  *uint
+		ok    bool
+	}{
+		{"", nil, true},
+		{"limit=", nil, true},
+		{"limit=5", uintPtr(5), true},
+		{"limit=4294967295", uintPtr(4294967295), true},
+		{"limit=4294967296", nil, false},
+		{"limit=1099511627776", nil, false},
+		{"limit=-1", nil, false},
+		{"limit=x", nil, false},
+	}
+
+	for _, c := range cases {
+		v, err := queryUint(httptest.NewRequest(http.MethodGet, "/?"+c.query, nil), "limit")
+		if c.ok {
+			if err != nil || (v == nil) != (c.want == nil) || (v != nil && *v != *c.want) {
+				t.Errorf("%q: got %v, %v, want %v", c.query, v, err, c.want)
+			}
+			continue
+		}
+
+		var mr *malformedRequest
+		if !errors.As(err, &mr) || mr.status != http.StatusBadRequest || mr.code != codeQueryInvalidValue || mr.field != "limit" {
+			t.Errorf("%q: got %v, %v, want 400 %s", c.query, v, err, codeQueryInvalidValue)
+		}
+	}
+}
+
+func uintPtr(v uint) *uint {
+	return &v
+}
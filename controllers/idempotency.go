@@ -0,0 +1,172 @@
+package controllers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/nlevankov/backend-trainee-assignment/models"
+)
+
+// IdempotencyRecord is the outcome of a successful creating request.
+type IdempotencyRecord struct {
+	ID         uint
+	StatusCode int
+}
+
+// IdempotencyStore keeps the outcomes of the creating requests by their idempotency keys,
+// the in-process MemoryIdempotencyStore is enough for a single instance.
+type IdempotencyStore interface {
+	// Reserve reserves the key for the request with the fingerprint of its payload. If the request with
+	// the key has already succeeded, its record is returned. It fails with models.ErrIdempotencyKeyInProgress
+	// if another request holds the key and with models.ErrIdempotencyKeyReused if the payloads differ.
+	Reserve(key, fingerprint string) (*IdempotencyRecord, error)
+	// Complete stores the outcome of the request holding the key.
+	Complete(key string, rec IdempotencyRecord)
+	// Release frees the key of the failed request, so it can be retried.
+	Release(key string)
+}
+
+// Idempotency makes the creating requests idempotent.
+type Idempotency struct {
+	Store IdempotencyStore
+	// Client identifies the client of the request, the keys of different clients don't collide.
+	// It should be the authenticated user where there is one.
+	Client func(r *http.Request) string
+}
+
+const maxIdempotencyKeyLen = 255
+
+// idempotent runs create unless the request with the same idempotency key (the Idempotency-Key header
+// or the clientKey from the body) has already succeeded, then its outcome is replayed.
+// Only the successful outcomes are kept, the failed requests can be retried with the same key.
+func idempotent(idem *Idempotency, w http.ResponseWriter, r *http.Request, clientKey *string, payload interface{},
+	create func() (uint, int, error)) (uint, int, error) {
+
+	key := r.Header.Get("Idempotency-Key")
+	if key == "" && clientKey != nil {
+		key = *clientKey
+	}
+	if idem == nil || key == "" {
+		return create()
+	}
+	if len(key) > maxIdempotencyKeyLen {
+		return 0, http.StatusBadRequest, models.ErrIdempotencyKeyTooLong
+	}
+
+	// ключи действуют в пределах клиента и маршрута, иначе чужой запрос с тем же ключом получил бы
+	// результат первого или отказ
+	key = idem.Client(r) + " " + r.Method + " " + r.URL.Path + " " + key
+	store := idem.Store
+
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return 0, http.StatusInternalServerError, err
+	}
+	sum := sha256.Sum256(b)
+
+	rec, err := store.Reserve(key, hex.EncodeToString(sum[:]))
+	if err != nil {
+		if err == models.ErrIdempotencyKeyReused {
+			return 0, http.StatusUnprocessableEntity, err
+		}
+		return 0, http.StatusConflict, err
+	}
+	if rec != nil {
+		w.Header().Set("Idempotent-Replayed", "true")
+		return rec.ID, rec.StatusCode, nil
+	}
+
+	id, statusCode, err := create()
+	if err != nil {
+		store.Release(key)
+		return id, statusCode, err
+	}
+
+	store.Complete(key, IdempotencyRecord{ID: id, StatusCode: statusCode})
+	return id, statusCode, nil
+}
+
+var _ IdempotencyStore = &MemoryIdempotencyStore{}
+
+// MemoryIdempotencyStore is the in-process IdempotencyStore, the keys expire after the TTL.
+type MemoryIdempotencyStore struct {
+	ttl time.Duration
+	now func() time.Time
+
+	mu        sync.Mutex
+	entries   map[string]*idempotencyEntry
+	lastSweep time.Time
+}
+
+type idempotencyEntry struct {
+	fingerprint string
+	done        bool
+	rec         IdempotencyRecord
+	expires     time.Time
+}
+
+func NewMemoryIdempotencyStore(ttl time.Duration) *MemoryIdempotencyStore {
+	return &MemoryIdempotencyStore{
+		ttl:     ttl,
+		now:     time.Now,
+		entries: make(map[string]*idempotencyEntry),
+	}
+}
+
+func (s *MemoryIdempotencyStore) Reserve(key, fingerprint string) (*IdempotencyRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	s.sweep(now)
+
+	if e, ok := s.entries[key]; ok && now.Before(e.expires) {
+		if e.fingerprint != fingerprint {
+			return nil, models.ErrIdempotencyKeyReused
+		}
+		if !e.done {
+			return nil, models.ErrIdempotencyKeyInProgress
+		}
+		rec := e.rec
+		return &rec, nil
+	}
+
+	s.entries[key] = &idempotencyEntry{fingerprint: fingerprint, expires: now.Add(s.ttl)}
+	return nil, nil
+}
+
+func (s *MemoryIdempotencyStore) Complete(key string, rec IdempotencyRecord) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if e, ok := s.entries[key]; ok {
+		e.done = true
+		e.rec = rec
+		e.expires = s.now().Add(s.ttl)
+	}
+}
+
+func (s *MemoryIdempotencyStore) Release(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.entries, key)
+}
+
+// it assumes that s.mu is locked
+func (s *MemoryIdempotencyStore) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < time.Minute {
+		return
+	}
+	s.lastSweep = now
+
+	for key, e := range s.entries {
+		if !now.Before(e.expires) {
+			delete(s.entries, key)
+		}
+	}
+}
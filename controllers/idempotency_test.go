@@ -0,0 +1,151 @@
+package controllers
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/nlevankov/backend-trainee-assignment/models"
+)
+
+// testIdempotency returns the Idempotency whose clients are told apart by X-Client and whose store's clock
+// is moved by the returned function
+func testIdempotency(ttl time.Duration) (*Idempotency, func(time.Duration)) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	store := NewMemoryIdempotencyStore(ttl)
+	store.now = func() time.Time { return now }
+	return &Idempotency{
+		Store:  store,
+		Client: func(r *http.Request) string { return r.Header.Get("X-Client") },
+	}, func(d time.Duration) { now = now.Add(d) }
+}
+
+// idempotentCall makes a creating request with the key, the created ids are counted by created
+type idempotentCall struct {
+	idem    *Idempotency
+	created uint
+}
+
+func (c *idempotentCall) do(client, key string, payload interface{}) (uint, int, bool, error) {
+	r := httptest.NewRequest(http.MethodPost, "/v1/users", nil)
+	r.Header.Set("X-Client", client)
+	if key != "" {
+		r.Header.Set("Idempotency-Key", key)
+	}
+	w := httptest.NewRecorder()
+	id, statusCode, err := idempotent(c.idem, w, r, nil, payload, func() (uint, int, error) {
+		c.created++
+		return c.created, http.StatusOK, nil
+	})
+	return id, statusCode, w.Header().Get("Idempotent-Replayed") == "true", err
+}
+
+func TestIdempotentReplays(t *testing.T) {
+	idem, _ := testIdempotency(time.Hour)
+	call := &idempotentCall{idem: idem}
+
+	id, statusCode, replayed, err := call.do("a", "k", "alice")
+	if id != 1 || statusCode != http.StatusOK || err != nil || replayed {
+		t.Fatalf("first request: got %d, %d, %v, replayed %v", id, statusCode, err, replayed)
+	}
+	id, statusCode, replayed, err = call.do("a", "k", "alice")
+	if id != 1 || statusCode != http.StatusOK || err != nil || !replayed {
+		t.Errorf("retry: got %d, %d, %v, replayed %v, want the first outcome replayed", id, statusCode, err, replayed)
+	}
+
+	if id, _, replayed, _ = call.do("a", "", "alice"); id != 2 || replayed {
+		t.Errorf("no key: got %d, replayed %v, want a new one", id, replayed)
+	}
+	if id, _, replayed, _ = call.do("a", "k2", "alice"); id != 3 || replayed {
+		t.Errorf("another key: got %d, replayed %v, want a new one", id, replayed)
+	}
+}
+
+func TestIdempotentKeyReused(t *testing.T) {
+	idem, _ := testIdempotency(time.Hour)
+	call := &idempotentCall{idem: idem}
+
+	call.do("a", "k", "alice")
+	_, statusCode, _, err := call.do("a", "k", "bob")
+	if statusCode != http.StatusUnprocessableEntity || !errors.Is(err, models.ErrIdempotencyKeyReused) {
+		t.Errorf("got %d, %v, want %d %v", statusCode, err, http.StatusUnprocessableEntity, models.ErrIdempotencyKeyReused)
+	}
+	if call.created != 1 {
+		t.Errorf("%d created, want 1", call.created)
+	}
+}
+
+// TestIdempotentKeysAreScoped checks that the same key of another client is a different key
+func TestIdempotentKeysAreScoped(t *testing.T) {
+	idem, _ := testIdempotency(time.Hour)
+	call := &idempotentCall{idem: idem}
+
+	call.do("a", "k", "alice")
+	id, statusCode, replayed, err := call.do("b", "k", "bob")
+	if id != 2 || statusCode != http.StatusOK || err != nil || replayed {
+		t.Errorf("another client: got %d, %d, %v, replayed %v, want a new one", id, statusCode, err, replayed)
+	}
+	if id, _, replayed, _ := call.do("b", "k", "bob"); id != 2 || !replayed {
+		t.Errorf("another client's retry: got %d, replayed %v", id, replayed)
+	}
+}
+
+func TestIdempotentKeyExpires(t *testing.T) {
+	idem, advance := testIdempotency(time.Hour)
+	call := &idempotentCall{idem: idem}
+
+	call.do("a", "k", "alice")
+	advance(time.Hour - time.Second)
+	if id, _, replayed, _ := call.do("a", "k", "alice"); id != 1 || !replayed {
+		t.Errorf("before the TTL: got %d, replayed %v", id, replayed)
+	}
+
+	advance(time.Hour)
+	if id, _, replayed, err := call.do("a", "k", "bob"); id != 2 || err != nil || replayed {
+		t.Errorf("after the TTL: got %d, %v, replayed %v, want the key to be free", id, err, replayed)
+	}
+}
+
+func TestIdempotentFailureReleasesKey(t *testing.T) {
+	idem, _ := testIdempotency(time.Hour)
+	r := httptest.NewRequest(http.MethodPost, "/v1/users", nil)
+	r.Header.Set("Idempotency-Key", "k")
+
+	_, _, err := idempotent(idem, httptest.NewRecorder(), r, nil, "alice", func() (uint, int, error) {
+		// the key is held while the request is in flight
+		_, statusCode, err := idempotent(idem, httptest.NewRecorder(), r, nil, "alice", func() (uint, int, error) {
+			t.Error("a concurrent request with the key is run")
+			return 0, http.StatusOK, nil
+		})
+		if statusCode != http.StatusConflict || !errors.Is(err, models.ErrIdempotencyKeyInProgress) {
+			t.Errorf("concurrent request: got %d, %v", statusCode, err)
+		}
+		return 0, http.StatusServiceUnavailable, errors.New("failed")
+	})
+	if err == nil {
+		t.Fatal("the failure isn't returned")
+	}
+
+	id, _, err := idempotent(idem, httptest.NewRecorder(), r, nil, "alice", func() (uint, int, error) {
+		return 7, http.StatusOK, nil
+	})
+	if id != 7 || err != nil {
+		t.Errorf("retry after the failure: got %d, %v", id, err)
+	}
+}
+
+func TestIdempotentKeyTooLong(t *testing.T) {
+	idem, _ := testIdempotency(time.Hour)
+	call := &idempotentCall{idem: idem}
+
+	key := make([]byte, maxIdempotencyKeyLen+1)
+	for i := range key {
+		key[i] = 'k'
+	}
+	if _, statusCode, _, err := call.do("a", string(key), "alice"); statusCode != http.StatusBadRequest ||
+		!errors.Is(err, models.ErrIdempotencyKeyTooLong) || call.created != 0 {
+		t.Errorf("got %d, %v", statusCode, err)
+	}
+}
@@ -7,31 +7,36 @@ import (
 )
 
 type Message struct {
-	ms models.MessageService
+	ms   models.MessageService
+	idem *Idempotency
 }
 
-func NewMessages(ms models.MessageService) *Message {
+// NewMessages creates the controller, idem may be nil, then neither Idempotency-Key nor client_msg_id are taken into account
+func NewMessages(ms models.MessageService, idem *Idempotency) *Message {
 	return &Message{
-		ms: ms,
+		ms:   ms,
+		idem: idem,
 	}
 }
 
 func (m *Message) Create(w http.ResponseWriter, r *http.Request) {
 	var msg models.Message
 
-	err := decodeJSONBody(w, r, &msg)
+	err := decodeBody(w, r, &msg)
 	if err != nil {
-		classificateErrorAndRenderView(w, err)
+		classificateErrorAndRenderView(w, r, err)
 		return
 	}
 
-	result, statusCode, err := m.ms.Create(&msg)
+	result, statusCode, err := idempotent(m.idem, w, r, msg.ClientMsgID, &msg, func() (uint, int, error) {
+		return m.ms.Create(r.Context(), &msg)
+	})
 	if err != nil {
-		views.RenderJSON(w, nil, statusCode, err)
+		views.Render(w, r, nil, statusCode, err)
 		return
 	}
 
-	views.RenderJSON(w, result, statusCode, nil)
+	views.Render(w, r, result, statusCode, nil)
 
 	return
 }
@@ -39,19 +44,156 @@ func (m *Message) Create(w http.ResponseWriter, r *http.Request) {
 func (m *Message) ByChatID(w http.ResponseWriter, r *http.Request) {
 	var msg models.Message
 
-	err := decodeJSONBody(w, r, &msg)
+	err := decodeBody(w, r, &msg)
 	if err != nil {
-		classificateErrorAndRenderView(w, err)
+		classificateErrorAndRenderView(w, r, err)
 		return
 	}
 
-	result, statusCode, err := m.ms.ByChatID(msg.ChatID)
+	m.renderList(w, r, msg.ChatID, nil)
+
+	return
+}
+
+// CreateInChat is the /v1 counterpart of Create, the chat is taken from the path, the body may repeat it.
+func (m *Message) CreateInChat(w http.ResponseWriter, r *http.Request) {
+	chatID, err := pathID(r, "id")
+	if err != nil {
+		classificateErrorAndRenderView(w, r, err)
+		return
+	}
+
+	var msg models.Message
+
+	err = decodeBody(w, r, &msg)
+	if err != nil {
+		classificateErrorAndRenderView(w, r, err)
+		return
+	}
+	if msg.ChatID != nil && *msg.ChatID != *chatID {
+		views.Render(w, r, nil, http.StatusBadRequest, models.ErrMessageChatIsNotInPath)
+		return
+	}
+	msg.ChatID = chatID
+
+	result, statusCode, err := idempotent(m.idem, w, r, msg.ClientMsgID, &msg, func() (uint, int, error) {
+		return m.ms.Create(r.Context(), &msg)
+	})
+	if err != nil {
+		views.Render(w, r, nil, statusCode, err)
+		return
+	}
+
+	views.Render(w, r, result, statusCode, nil)
+
+	return
+}
+
+// ListByChat is the /v1 counterpart of ByChatID, the chat is taken from the path and the optional limit from the query.
+func (m *Message) ListByChat(w http.ResponseWriter, r *http.Request) {
+	chatID, err := pathID(r, "id")
+	if err != nil {
+		classificateErrorAndRenderView(w, r, err)
+		return
+	}
+
+	limit, err := queryUint(r, "limit")
+	if err != nil {
+		classificateErrorAndRenderView(w, r, err)
+		return
+	}
+
+	m.renderList(w, r, chatID, limit)
+
+	return
+}
+
+// HistoryArchivedHeader is the header the lists of the chat's messages carry once the chat's earlier messages
+// are archived, the messages created before the time in it aren't listed.
+const HistoryArchivedHeader = "History-Archived-Before"
+
+// renderList renders the chat's messages for ByChatID and ListByChat, a conditional request is answered
+// by the list's version first, so the list isn't loaded if the client already has it
+func (m *Message) renderList(w http.ResponseWriter, r *http.Request, chatID *uint, limit *uint) {
+	if isConditional(r) {
+		version, statusCode, err := m.ms.VersionByChatID(r.Context(), chatID, limit)
+		if err != nil {
+			views.Render(w, r, nil, statusCode, err)
+			return
+		}
+		if views.NotModified(w, r, version.Tag, version.LastModified) {
+			return
+		}
+	}
+
+	history, statusCode, err := m.ms.ByChatID(r.Context(), chatID, limit)
+	if err != nil {
+		views.Render(w, r, nil, statusCode, err)
+		return
+	}
+
+	if history.ArchivedBefore != nil {
+		w.Header().Set(HistoryArchivedHeader, history.ArchivedBefore.UTC().Format(http.TimeFormat))
+	}
+	version := models.MessagesVersion(history.Messages)
+	views.RenderConditional(w, r, history.Messages, version.Tag, version.LastModified)
+}
+
+// CreateBatch creates the messages from the array in the body, all or none of them unless ?partial=true,
+// the outcome of each message is reported in the same order.
+func (m *Message) CreateBatch(w http.ResponseWriter, r *http.Request) {
+	partial, err := queryBool(r, "partial")
 	if err != nil {
-		views.RenderJSON(w, nil, statusCode, err)
+		classificateErrorAndRenderView(w, r, err)
 		return
 	}
 
-	views.RenderJSON(w, result, statusCode, nil)
+	var msgs []*models.Message
+
+	err = decodeBody(w, r, &msgs)
+	if err != nil {
+		classificateErrorAndRenderView(w, r, err)
+		return
+	}
+
+	items, statusCode, err := m.ms.CreateBatch(r.Context(), msgs, !partial)
+	views.Render(w, r, batchItems(w, r, items), statusCode, err)
+
+	return
+}
+
+// Lookup returns the messages of several chats at once, the outcome of each chat is reported in the same order.
+func (m *Message) Lookup(w http.ResponseWriter, r *http.Request) {
+	var ml models.MessageLookup
+
+	err := decodeBody(w, r, &ml)
+	if err != nil {
+		classificateErrorAndRenderView(w, r, err)
+		return
+	}
+
+	chatIDs, statusCode, err := ml.ChatIDs()
+	if err != nil {
+		views.Render(w, r, nil, statusCode, err)
+		return
+	}
+
+	items, statusCode, err := m.ms.ByChatIDs(r.Context(), chatIDs, ml.Limit)
+	if err != nil {
+		views.Render(w, r, nil, statusCode, err)
+		return
+	}
+
+	result := make([]*views.BatchItem, len(items))
+	for i, item := range items {
+		var msgs []*models.Message
+		if item.History != nil {
+			msgs = item.History.Messages
+		}
+		result[i] = views.NewBatchItem(w, r, msgs, item.StatusCode, item.Err)
+	}
+
+	views.Render(w, r, result, http.StatusOK, nil)
 
 	return
 }
@@ -7,31 +7,59 @@ import (
 )
 
 type Users struct {
-	us models.UserService
+	us   models.UserService
+	idem *Idempotency
 }
 
-func NewUsers(us models.UserService) *Users {
+// NewUsers creates the controller, idem may be nil, then Idempotency-Key is ignored
+func NewUsers(us models.UserService, idem *Idempotency) *Users {
 	return &Users{
-		us: us,
+		us:   us,
+		idem: idem,
 	}
 }
 
 func (u *Users) Create(w http.ResponseWriter, r *http.Request) {
 	var user models.User
 
-	err := decodeJSONBody(w, r, &user)
+	err := decodeBody(w, r, &user)
 	if err != nil {
-		classificateErrorAndRenderView(w, err)
+		classificateErrorAndRenderView(w, r, err)
 		return
 	}
 
-	result, statusCode, err := u.us.Create(&user)
+	result, statusCode, err := idempotent(u.idem, w, r, nil, &user, func() (uint, int, error) {
+		return u.us.Create(r.Context(), &user)
+	})
 	if err != nil {
-		views.RenderJSON(w, nil, statusCode, err)
+		views.Render(w, r, nil, statusCode, err)
 		return
 	}
 
-	views.RenderJSON(w, result, statusCode, nil)
+	views.Render(w, r, result, statusCode, nil)
+
+	return
+}
+
+// CreateBatch creates the users from the array in the body, all or none of them unless ?partial=true,
+// the outcome of each user is reported in the same order.
+func (u *Users) CreateBatch(w http.ResponseWriter, r *http.Request) {
+	partial, err := queryBool(r, "partial")
+	if err != nil {
+		classificateErrorAndRenderView(w, r, err)
+		return
+	}
+
+	var users []*models.User
+
+	err = decodeBody(w, r, &users)
+	if err != nil {
+		classificateErrorAndRenderView(w, r, err)
+		return
+	}
+
+	items, statusCode, err := u.us.CreateBatch(r.Context(), users, !partial)
+	views.Render(w, r, batchItems(w, r, items), statusCode, err)
 
 	return
 }
@@ -0,0 +1,149 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/nlevankov/backend-trainee-assignment/models"
+	"github.com/nlevankov/backend-trainee-assignment/views"
+)
+
+// fakeUsers fails the batch's users without a name, the whole batch if it is atomic
+type fakeUsers struct {
+	models.UserService
+	atomic bool
+}
+
+func (fu *fakeUsers) CreateBatch(ctx context.Context, users []*models.User, atomic bool) ([]models.BatchItem, int, error) {
+	fu.atomic = atomic
+
+	items := make([]models.BatchItem, len(users))
+	failed := false
+	for i, user := range users {
+		if user.Name == nil || *user.Name == "" {
+			items[i] = models.BatchItem{StatusCode: http.StatusBadRequest, Err: models.ErrUserNameIsEmpty}
+			failed = true
+			continue
+		}
+		items[i] = models.BatchItem{ID: uint(i + 1), StatusCode: http.StatusOK}
+	}
+	if !atomic || !failed {
+		return items, http.StatusOK, nil
+	}
+
+	for i := range items {
+		if items[i].Err == nil {
+			items[i] = models.BatchItem{StatusCode: http.StatusFailedDependency, Err: models.ErrBatchItemRolledBack}
+		}
+	}
+	return items, http.StatusUnprocessableEntity, models.ErrBatchFailed
+}
+
+// batchOutcomes describes the rendered items as "<status> <code or id>"
+type batchOutcomes []struct {
+	Status    int
+	Result    *uint
+	ErrorInfo *struct{ Code string }
+}
+
+func (bo batchOutcomes) String() string {
+	outcomes := make([]string, len(bo))
+	for i, item := range bo {
+		switch {
+		case item.ErrorInfo != nil:
+			outcomes[i] = fmt.Sprintf("%d %s", item.Status, item.ErrorInfo.Code)
+		case item.Result != nil:
+			outcomes[i] = fmt.Sprintf("%d %d", item.Status, *item.Result)
+		default:
+			outcomes[i] = fmt.Sprintf("%d", item.Status)
+		}
+	}
+	return strings.Join(outcomes, ", ")
+}
+
+func createUsers(query, body string) (*fakeUsers, *httptest.ResponseRecorder) {
+	fu := &fakeUsers{}
+	r := httptest.NewRequest(http.MethodPost, "/v1/users/batch"+query, strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	NewUsers(fu, nil).CreateBatch(w, r)
+	return fu, w
+}
+
+func TestCreateBatchModes(t *testing.T) {
+	body := `[{"username":"alice"},{"username":""},{"username":"carol"}]`
+
+	cases := []struct {
+		query  string
+		atomic bool
+		status int
+		code   string
+		items  string
+	}{
+		{"", true, http.StatusUnprocessableEntity, "BATCH_FAILED",
+			"424 BATCH_ITEM_ROLLED_BACK, 400 USER_NAME_EMPTY, 424 BATCH_ITEM_ROLLED_BACK"},
+		{"?partial=false", true, http.StatusUnprocessableEntity, "BATCH_FAILED",
+			"424 BATCH_ITEM_ROLLED_BACK, 400 USER_NAME_EMPTY, 424 BATCH_ITEM_ROLLED_BACK"},
+		{"?partial=true", false, http.StatusOK, "", "200 1, 400 USER_NAME_EMPTY, 200 3"},
+	}
+
+	for _, c := range cases {
+		fu, w := createUsers(c.query, body)
+		if fu.atomic != c.atomic {
+			t.Errorf("%q: atomic is %v, want %v", c.query, fu.atomic, c.atomic)
+		}
+
+		var resp struct {
+			Result    batchOutcomes
+			ErrorInfo *struct{ Code string }
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		code := ""
+		if resp.ErrorInfo != nil {
+			code = resp.ErrorInfo.Code
+		}
+		if w.Code != c.status || code != c.code {
+			t.Errorf("%q: got %d %s, want %d %s", c.query, w.Code, code, c.status, c.code)
+		}
+		if got := resp.Result.String(); got != c.items {
+			t.Errorf("%q: got the items %s, want %s", c.query, got, c.items)
+		}
+	}
+}
+
+// TestCreateBatchProblem checks that the failed batch's items are reported in problem+json too
+func TestCreateBatchProblem(t *testing.T) {
+	defer views.SetErrorFormat(views.ErrorFormatEnvelope)
+	views.SetErrorFormat(views.ErrorFormatProblem)
+
+	_, w := createUsers("", `[{"username":"alice"},{"username":""}]`)
+
+	var problem struct {
+		Status int
+		Code   string
+		Result batchOutcomes
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &problem); err != nil {
+		t.Fatal(err)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/problem+json" || problem.Status != http.StatusUnprocessableEntity ||
+		problem.Code != "BATCH_FAILED" {
+		t.Errorf("got %s %d %s", ct, problem.Status, problem.Code)
+	}
+	if got, want := problem.Result.String(), "424 BATCH_ITEM_ROLLED_BACK, 400 USER_NAME_EMPTY"; got != want {
+		t.Errorf("got the items %s, want %s", got, want)
+	}
+
+	// the errors without a result have no result member
+	_, w = createUsers("?partial=maybe", `[]`)
+	if w.Code != http.StatusBadRequest || strings.Contains(w.Body.String(), `"result"`) {
+		t.Errorf("got %s", w.Body)
+	}
+}
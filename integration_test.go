@@ -0,0 +1,932 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/nlevankov/backend-trainee-assignment/models"
+)
+
+// The integration tests run the app's HTTP handler against a throwaway Postgres: the one BTA_TEST_DSN points to
+// (WARNING: its public schema is dropped) or the one started with initdb and pg_ctl from PATH or PG_BIN.
+// If there is neither, or with BTA_TEST_ENGINE=sqlite, they run against SQLite in a temporary file instead;
+// BTA_TEST_ENGINE=postgres makes the tests which need the storage skipped rather than run against SQLite.
+
+var testStorage struct {
+	services *models.Services
+	db       *sql.DB
+	dialect  string
+	dsn      string
+	skip     string // why the tests which need the storage are skipped
+}
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+
+	stop := setUpTestStorage()
+	code := m.Run()
+	stop()
+
+	os.Exit(code)
+}
+
+func setUpTestStorage() (stop func()) {
+	stop = func() {}
+	if testing.Short() {
+		testStorage.skip = "the storage isn't started in the short mode"
+		return stop
+	}
+
+	dialect, driver, dsn := models.DialectPostgres, "postgres", os.Getenv("BTA_TEST_DSN")
+	engine := os.Getenv("BTA_TEST_ENGINE")
+	if engine != engineSQLite && dsn == "" {
+		var err error
+		dsn, stop, err = startPostgres()
+		if err != nil {
+			if engine == enginePostgres {
+				testStorage.skip = "neither BTA_TEST_DSN is set nor Postgres can be started: " + err.Error()
+				return func() {}
+			}
+			log.Printf("Running the integration tests against SQLite, Postgres can't be started: %v", err)
+			engine = engineSQLite
+		}
+	}
+	if engine == engineSQLite {
+		dir, err := os.MkdirTemp("", "bta-sqlite")
+		if err != nil {
+			testStorage.skip = "can't create the SQLite storage: " + err.Error()
+			return func() {}
+		}
+		dialect, driver, dsn = models.DialectSQLite, "sqlite", sqliteConnectionInfo(filepath.Join(dir, "bta.db"))
+		stop = func() { os.RemoveAll(dir) }
+	}
+
+	services, err := models.NewServices(
+		models.WithGorm(dialect, dsn, 1, 1),
+		models.WithUser(),
+		models.WithChat(),
+		models.WithMessage(),
+		models.WithSetSchema(true),
+	)
+	if err != nil {
+		testStorage.skip = "can't connect to the test storage: " + err.Error()
+		return stop
+	}
+
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		services.Close()
+		testStorage.skip = "can't connect to the test storage: " + err.Error()
+		return stop
+	}
+
+	testStorage.services = services
+	testStorage.db = db
+	testStorage.dialect = dialect
+	testStorage.dsn = dsn
+	// the closure mustn't call stop itself, stop becomes the closure once it's returned
+	stopStorage := stop
+	return func() {
+		db.Close()
+		services.Close()
+		stopStorage()
+	}
+}
+
+// startPostgres starts a cluster in a temporary directory, it listens only on a unix socket there
+func startPostgres() (string, func(), error) {
+	initdb, pgCtl := "initdb", "pg_ctl"
+	if bin := os.Getenv("PG_BIN"); bin != "" {
+		initdb, pgCtl = filepath.Join(bin, initdb), filepath.Join(bin, pgCtl)
+	}
+	if _, err := exec.LookPath(initdb); err != nil {
+		return "", nil, err
+	}
+
+	dir, err := os.MkdirTemp("", "bta-pg")
+	if err != nil {
+		return "", nil, err
+	}
+	data := filepath.Join(dir, "data")
+
+	out, err := exec.Command(initdb, "-D", data, "-U", "postgres", "-A", "trust", "--no-sync").CombinedOutput()
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", nil, fmt.Errorf("%v: %s", err, out)
+	}
+
+	// the port is a part of the socket's name, so a free one is taken anyway
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", nil, err
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	opts := fmt.Sprintf("-p %d -k %s -c listen_addresses='' -c fsync=off", port, dir)
+	out, err = exec.Command(pgCtl, "-D", data, "-l", filepath.Join(dir, "log"), "-o", opts, "-w", "start").CombinedOutput()
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", nil, fmt.Errorf("%v: %s", err, out)
+	}
+
+	stop := func() {
+		if out, err := exec.Command(pgCtl, "-D", data, "-m", "immediate", "stop").CombinedOutput(); err != nil {
+			log.Printf("Can't stop the test storage: %v: %s", err, out)
+		}
+		os.RemoveAll(dir)
+	}
+
+	dsn := fmt.Sprintf("host=%s port=%d user=postgres dbname=postgres sslmode=disable", dir, port)
+	return dsn, stop, nil
+}
+
+// resetTestStorage brings the storage back to testdata/fixtures.sql, it skips the test if there is no storage
+func resetTestStorage(t testing.TB) {
+	t.Helper()
+	if testStorage.services == nil {
+		t.Skip(testStorage.skip)
+	}
+
+	fixtures, err := os.ReadFile(filepath.Join("testdata", "fixtures.sql"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reset := "TRUNCATE users, chats, chats_users, messages RESTART IDENTITY CASCADE"
+	if testStorage.dialect == models.DialectSQLite {
+		reset = "DELETE FROM messages; DELETE FROM chats_users; DELETE FROM chats; DELETE FROM users; DELETE FROM sqlite_sequence"
+		// the ids SQLite generates follow the inserted ones anyway, and it has no sequences
+		fixtures = sqliteSetval.ReplaceAll(fixtures, nil)
+	}
+
+	if _, err = testStorage.db.Exec(reset); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = testStorage.db.Exec(string(fixtures)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+var sqliteSetval = regexp.MustCompile(`(?m)^SELECT setval\(.*$`)
+
+func testConfig() Config {
+	cfg := DefaultConfig()
+	cfg.RateLimits = nil
+	return cfg
+}
+
+// newTestHandler returns the app's handler, without the storage the services are nil,
+// which is enough for the requests which fail before reaching them
+func newTestHandler() http.Handler {
+	services := testStorage.services
+	if services == nil {
+		services = &models.Services{}
+	}
+	return newHTTPHandler(testConfig(), services)
+}
+
+// newCachedTestHandler returns the app's handler with the cache, its services connect to the test storage
+// on their own, so the cache is empty and isn't shared with the other tests
+func newCachedTestHandler(t *testing.T) (http.Handler, *models.Services) {
+	t.Helper()
+
+	services, err := models.NewServices(
+		models.WithGorm(testStorage.dialect, testStorage.dsn, 1, 1),
+		models.WithCache(100, time.Minute),
+		models.WithUser(),
+		models.WithChat(),
+		models.WithMessage(),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(services.Close)
+	return newHTTPHandler(testConfig(), services), services
+}
+
+type apiCase struct {
+	name   string
+	method string
+	path   string
+	body   string
+	header map[string]string // Content-Type is application/json unless it is set here
+
+	status int
+	code   string // the expected ErrorInfo.Code, none means no error is expected
+	field  string
+	check  func(t *testing.T, resp *apiResponse)
+}
+
+type apiResponse struct {
+	Result    json.RawMessage
+	Error     *string
+	ErrorInfo *struct {
+		Code    string
+		Field   *string
+		Details map[string]interface{}
+	}
+
+	status int
+	header http.Header
+}
+
+func (c apiCase) do(t *testing.T, h http.Handler) *apiResponse {
+	t.Helper()
+
+	req := httptest.NewRequest(c.method, c.path, strings.NewReader(c.body))
+	if c.body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for k, v := range c.header {
+		req.Header.Set(k, v)
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	resp := &apiResponse{status: rec.Code, header: rec.Header()}
+	if rec.Code != http.StatusNotModified {
+		if err := json.Unmarshal(rec.Body.Bytes(), resp); err != nil {
+			t.Fatalf("can't decode the response %q: %v", rec.Body.String(), err)
+		}
+	}
+	return resp
+}
+
+func (c apiCase) run(t *testing.T, h http.Handler) {
+	t.Helper()
+
+	resp := c.do(t, h)
+	if resp.status != c.status {
+		t.Errorf("status is %d, want %d (error: %v)", resp.status, c.status, resp.errorCode())
+	}
+	if code := resp.errorCode(); code != c.code {
+		t.Errorf("error code is %q, want %q", code, c.code)
+	}
+	if c.field != "" && (resp.ErrorInfo == nil || resp.ErrorInfo.Field == nil || *resp.ErrorInfo.Field != c.field) {
+		t.Errorf("error field isn't %q: %+v", c.field, resp.ErrorInfo)
+	}
+	if c.check != nil {
+		c.check(t, resp)
+	}
+}
+
+func (r *apiResponse) errorCode() string {
+	if r.ErrorInfo == nil {
+		return ""
+	}
+	return r.ErrorInfo.Code
+}
+
+func (r *apiResponse) decode(t *testing.T, v interface{}) {
+	t.Helper()
+	if err := json.Unmarshal(r.Result, v); err != nil {
+		t.Fatalf("can't decode the result %s: %v", r.Result, err)
+	}
+}
+
+func resultID(want uint) func(t *testing.T, resp *apiResponse) {
+	return func(t *testing.T, resp *apiResponse) {
+		var id uint
+		resp.decode(t, &id)
+		if id != want {
+			t.Errorf("id is %d, want %d", id, want)
+		}
+	}
+}
+
+func chatNames(want ...string) func(t *testing.T, resp *apiResponse) {
+	return func(t *testing.T, resp *apiResponse) {
+		var chats []*models.Chat
+		resp.decode(t, &chats)
+		var names []string
+		for _, chat := range chats {
+			names = append(names, *chat.Name)
+		}
+		if strings.Join(names, ",") != strings.Join(want, ",") {
+			t.Errorf("chats are %v, want %v", names, want)
+		}
+	}
+}
+
+func messageTexts(want ...string) func(t *testing.T, resp *apiResponse) {
+	return func(t *testing.T, resp *apiResponse) {
+		var msgs []*models.Message
+		resp.decode(t, &msgs)
+		var texts []string
+		for _, msg := range msgs {
+			texts = append(texts, *msg.Text)
+		}
+		if strings.Join(texts, ",") != strings.Join(want, ",") {
+			t.Errorf("messages are %v, want %v", texts, want)
+		}
+	}
+}
+
+// batchStatuses checks the statuses and the error codes of the batch's items, "200" stands for a success
+func batchStatuses(want ...string) func(t *testing.T, resp *apiResponse) {
+	return func(t *testing.T, resp *apiResponse) {
+		var items []struct {
+			Status    int
+			ErrorInfo *struct{ Code string }
+		}
+		resp.decode(t, &items)
+		var got []string
+		for _, item := range items {
+			if item.ErrorInfo != nil {
+				got = append(got, fmt.Sprintf("%d %s", item.Status, item.ErrorInfo.Code))
+			} else {
+				got = append(got, fmt.Sprint(item.Status))
+			}
+		}
+		if strings.Join(got, ",") != strings.Join(want, ",") {
+			t.Errorf("items are %v, want %v", got, want)
+		}
+	}
+}
+
+func TestMalformedRequests(t *testing.T) {
+	h := newTestHandler()
+
+	cases := []apiCase{
+		{name: "unknown endpoint", method: "GET", path: "/nope",
+			status: http.StatusNotFound, code: "ENDPOINT_NOT_FOUND"},
+		{name: "wrong method", method: "GET", path: "/users/add",
+			status: http.StatusNotFound, code: "METHOD_NOT_ALLOWED"},
+
+		{name: "unsupported content type", method: "POST", path: "/users/add", body: `{"username":"dave"}`,
+			header: map[string]string{"Content-Type": "text/plain"},
+			status: http.StatusUnsupportedMediaType, code: "UNSUPPORTED_CONTENT_TYPE"},
+		{name: "unsupported content encoding", method: "POST", path: "/users/add", body: `{"username":"dave"}`,
+			header: map[string]string{"Content-Encoding": "br"},
+			status: http.StatusUnsupportedMediaType, code: "UNSUPPORTED_CONTENT_ENCODING"},
+		{name: "invalid compressed body", method: "POST", path: "/users/add", body: "not gzip",
+			header: map[string]string{"Content-Encoding": "gzip"},
+			status: http.StatusBadRequest, code: "BODY_INVALID_ENCODING"},
+		{name: "badly-formed JSON", method: "POST", path: "/users/add", body: `{"username" "dave"}`,
+			status: http.StatusBadRequest, code: "BODY_MALFORMED"},
+		{name: "truncated JSON", method: "POST", path: "/users/add", body: `{"username":`,
+			status: http.StatusBadRequest, code: "BODY_MALFORMED"},
+		{name: "badly-formed form", method: "POST", path: "/users/add", body: "username=%zz",
+			header: map[string]string{"Content-Type": "application/x-www-form-urlencoded"},
+			status: http.StatusBadRequest, code: "BODY_MALFORMED"},
+		{name: "badly-formed MessagePack", method: "POST", path: "/users/add", body: "\xc1",
+			header: map[string]string{"Content-Type": "application/msgpack"},
+			status: http.StatusBadRequest, code: "BODY_MALFORMED"},
+		{name: "invalid value", method: "POST", path: "/users/add", body: `{"username":5}`,
+			status: http.StatusBadRequest, code: "BODY_INVALID_VALUE", field: "username"},
+		{name: "unknown field", method: "POST", path: "/users/add", body: `{"name":"dave"}`,
+			status: http.StatusBadRequest, code: "BODY_UNKNOWN_FIELD", field: "name"},
+		{name: "empty body", method: "POST", path: "/users/add",
+			header: map[string]string{"Content-Type": "application/json"},
+			status: http.StatusBadRequest, code: "BODY_EMPTY"},
+		{name: "too large body", method: "POST", path: "/users/add",
+			body:   `{"username":"` + strings.Repeat("a", 5000) + `"}`,
+			status: http.StatusRequestEntityTooLarge, code: "BODY_TOO_LARGE"},
+		{name: "invalid number", method: "POST", path: "/chats/add", body: `{"name":"new","users":["abc"]}`,
+			status: http.StatusBadRequest, code: "BODY_INVALID_NUMBER"},
+		// encoding/json of the recent Go versions reports them as type errors rather than as the misuse of ",string"
+		{name: "invalid string-encoded value", method: "POST", path: "/chats/get", body: `{"user":"x"}`,
+			status: http.StatusBadRequest, code: "BODY_INVALID_VALUE", field: "user"},
+		{name: "multiple objects", method: "POST", path: "/users/add", body: `{"username":"dave"}{}`,
+			status: http.StatusBadRequest, code: "BODY_MULTIPLE_OBJECTS"},
+
+		{name: "invalid path value", method: "GET", path: "/v1/users/99999999999999999999999/chats",
+			status: http.StatusBadRequest, code: "PATH_INVALID_VALUE", field: "id"},
+		{name: "id out of the storage's range", method: "GET", path: "/v1/users/1099511627776/chats",
+			status: http.StatusBadRequest, code: "PATH_INVALID_VALUE", field: "id"},
+		{name: "invalid query value", method: "GET", path: "/v1/chats/1/messages?limit=x",
+			status: http.StatusBadRequest, code: "QUERY_INVALID_VALUE", field: "limit"},
+		{name: "invalid batch mode", method: "POST", path: "/v1/users/batch?partial=maybe", body: `[]`,
+			status: http.StatusBadRequest, code: "QUERY_INVALID_VALUE", field: "partial"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			c.run(t, h)
+		})
+	}
+}
+
+func TestEndpoints(t *testing.T) {
+	cases := []apiCase{
+		// users
+
+		{name: "create user", method: "POST", path: "/users/add", body: `{"username":"dave"}`,
+			status: http.StatusOK, check: resultID(4)},
+		{name: "create user from form", method: "POST", path: "/users/add", body: "username=dave",
+			header: map[string]string{"Content-Type": "application/x-www-form-urlencoded"},
+			status: http.StatusOK, check: resultID(4)},
+		{name: "create user with empty name", method: "POST", path: "/users/add", body: `{"username":""}`,
+			status: http.StatusBadRequest, code: "USER_NAME_EMPTY", field: "username"},
+		{name: "create user without name", method: "POST", path: "/users/add", body: `{}`,
+			status: http.StatusBadRequest, code: "USER_NAME_NULL", field: "username"},
+		{name: "create existing user", method: "POST", path: "/users/add", body: `{"username":"alice"}`,
+			status: http.StatusConflict, code: "USER_ALREADY_EXISTS", field: "username"},
+		{name: "v1 create user", method: "POST", path: "/v1/users", body: `{"username":"dave"}`,
+			status: http.StatusOK, check: resultID(4)},
+
+		{name: "create users", method: "POST", path: "/v1/users/batch", body: `[{"username":"dave"},{"username":"erin"}]`,
+			status: http.StatusOK, check: batchStatuses("200", "200")},
+		{name: "create users with invalid one", method: "POST", path: "/v1/users/batch",
+			body:   `[{"username":"dave"},{"username":""},{"username":"alice"}]`,
+			status: http.StatusUnprocessableEntity, code: "BATCH_FAILED",
+			check: batchStatuses("424 BATCH_ITEM_ROLLED_BACK", "400 USER_NAME_EMPTY", "424 BATCH_ITEM_ROLLED_BACK")},
+		{name: "create users with existing one", method: "POST", path: "/v1/users/batch",
+			body:   `[{"username":"dave"},{"username":"alice"}]`,
+			status: http.StatusUnprocessableEntity, code: "BATCH_FAILED",
+			check: batchStatuses("424 BATCH_ITEM_ROLLED_BACK", "409 USER_ALREADY_EXISTS")},
+		{name: "create users partially", method: "POST", path: "/v1/users/batch?partial=true",
+			body:   `[{"username":"dave"},null,{"username":"alice"}]`,
+			status: http.StatusOK, check: batchStatuses("200", "400 BATCH_ITEM_NULL", "409 USER_ALREADY_EXISTS")},
+		{name: "create no users", method: "POST", path: "/v1/users/batch", body: `[]`,
+			status: http.StatusBadRequest, code: "BATCH_EMPTY"},
+
+		// chats
+
+		{name: "create chat", method: "POST", path: "/chats/add", body: `{"name":"new","users":["1","2","2"]}`,
+			status: http.StatusOK, check: resultID(3)},
+		{name: "create chat with empty name", method: "POST", path: "/chats/add", body: `{"name":"","users":["1"]}`,
+			status: http.StatusBadRequest, code: "CHAT_NAME_EMPTY", field: "name"},
+		{name: "create chat without name", method: "POST", path: "/chats/add", body: `{"users":["1"]}`,
+			status: http.StatusBadRequest, code: "CHAT_NAME_NULL", field: "name"},
+		{name: "create chat without users", method: "POST", path: "/chats/add", body: `{"name":"new"}`,
+			status: http.StatusBadRequest, code: "CHAT_USERS_NULL", field: "users"},
+		{name: "create chat with no users", method: "POST", path: "/chats/add", body: `{"name":"new","users":[]}`,
+			status: http.StatusBadRequest, code: "CHAT_USERS_EMPTY", field: "users"},
+		{name: "create chat with null user", method: "POST", path: "/chats/add", body: `{"name":"new","users":[null]}`,
+			status: http.StatusBadRequest, code: "CHAT_USERS_CONTAIN_NULL", field: "users"},
+		{name: "create existing chat", method: "POST", path: "/chats/add", body: `{"name":"general","users":["1"]}`,
+			status: http.StatusConflict, code: "CHAT_ALREADY_EXISTS", field: "name"},
+		{name: "create chat with unknown user", method: "POST", path: "/chats/add", body: `{"name":"new","users":["1","99"]}`,
+			status: http.StatusConflict, code: "CHAT_USERS_NOT_FOUND", field: "users"},
+		{name: "create chat with user out of range", method: "POST", path: "/chats/add", body: `{"name":"new","users":["1","2147483648"]}`,
+			status: http.StatusBadRequest, code: "CHAT_USERS_OUT_OF_RANGE", field: "users"},
+		{name: "v1 create chat", method: "POST", path: "/v1/chats", body: `{"name":"new","users":["3"]}`,
+			status: http.StatusOK, check: resultID(3)},
+
+		{name: "list user's chats", method: "POST", path: "/chats/get", body: `{"user":"1"}`,
+			status: http.StatusOK, check: chatNames("general", "random")},
+		{name: "list chats of user without chats", method: "POST", path: "/chats/get", body: `{"user":"3"}`,
+			status: http.StatusOK, check: chatNames()},
+		{name: "list chats without user", method: "POST", path: "/chats/get", body: `{}`,
+			status: http.StatusBadRequest, code: "CHAT_USER_NULL", field: "user"},
+		{name: "list chats of unknown user", method: "POST", path: "/chats/get", body: `{"user":"99"}`,
+			status: http.StatusNotFound, code: "USER_NOT_FOUND"},
+		{name: "list chats of user out of range", method: "POST", path: "/chats/get", body: `{"user":"18446744073709551615"}`,
+			status: http.StatusBadRequest, code: "CHAT_USER_OUT_OF_RANGE", field: "user"},
+		{name: "v1 list user's chats", method: "GET", path: "/v1/users/2/chats",
+			status: http.StatusOK, check: chatNames("general")},
+		{name: "v1 list chats of unknown user", method: "GET", path: "/v1/users/99/chats",
+			status: http.StatusNotFound, code: "USER_NOT_FOUND"},
+
+		// messages
+
+		{name: "create message", method: "POST", path: "/messages/add", body: `{"chat":"1","author":"2","text":"hey"}`,
+			status: http.StatusOK, check: resultID(3)},
+		{name: "create message with client's id and time", method: "POST", path: "/messages/add",
+			body:   `{"ID":1000,"chat":"1","author":"2","text":"hey","CreatedAt":"2099-01-01T00:00:00Z"}`,
+			status: http.StatusOK, check: resultID(3)},
+		{name: "create message without chat", method: "POST", path: "/messages/add", body: `{"author":"2","text":"hey"}`,
+			status: http.StatusBadRequest, code: "MESSAGE_CHAT_NULL", field: "chat"},
+		{name: "create message without author", method: "POST", path: "/messages/add", body: `{"chat":"1","text":"hey"}`,
+			status: http.StatusBadRequest, code: "MESSAGE_AUTHOR_NULL", field: "author"},
+		{name: "create message without text", method: "POST", path: "/messages/add", body: `{"chat":"1","author":"2"}`,
+			status: http.StatusBadRequest, code: "MESSAGE_TEXT_NULL", field: "text"},
+		{name: "create empty message", method: "POST", path: "/messages/add", body: `{"chat":"1","author":"2","text":""}`,
+			status: http.StatusBadRequest, code: "MESSAGE_TEXT_EMPTY", field: "text"},
+		{name: "create message in unknown chat", method: "POST", path: "/messages/add", body: `{"chat":"99","author":"2","text":"hey"}`,
+			status: http.StatusNotFound, code: "CHAT_NOT_FOUND", field: "chat"},
+		{name: "create message by unknown user", method: "POST", path: "/messages/add", body: `{"chat":"1","author":"99","text":"hey"}`,
+			status: http.StatusNotFound, code: "USER_NOT_FOUND"},
+		{name: "create message by outsider", method: "POST", path: "/messages/add", body: `{"chat":"1","author":"3","text":"hey"}`,
+			status: http.StatusUnauthorized, code: "USER_NOT_IN_CHAT", field: "author"},
+		{name: "create message in chat out of range", method: "POST", path: "/messages/add", body: `{"chat":"2147483648","author":"2","text":"hey"}`,
+			status: http.StatusBadRequest, code: "MESSAGE_CHAT_OUT_OF_RANGE", field: "chat"},
+		{name: "create message by author out of range", method: "POST", path: "/messages/add",
+			body:   `{"chat":"1","author":"2147483648","text":"hey"}`,
+			header: map[string]string{"Accept-Language": "ru"},
+			status: http.StatusBadRequest, code: "MESSAGE_AUTHOR_OUT_OF_RANGE", field: "author",
+			check: func(t *testing.T, resp *apiResponse) {
+				if resp.Error == nil || *resp.Error != "'author' не может быть больше 2147483647" {
+					t.Errorf("got %v", resp.Error)
+				}
+			}},
+		{name: "v1 create message", method: "POST", path: "/v1/chats/2/messages", body: `{"author":"1","text":"hey"}`,
+			status: http.StatusOK, check: resultID(3)},
+		{name: "v1 create message repeating chat", method: "POST", path: "/v1/chats/2/messages", body: `{"chat":"2","author":"1","text":"hey"}`,
+			status: http.StatusOK, check: resultID(3)},
+		{name: "v1 create message in other chat", method: "POST", path: "/v1/chats/2/messages", body: `{"chat":"1","author":"1","text":"hey"}`,
+			status: http.StatusBadRequest, code: "MESSAGE_CHAT_MISMATCH", field: "chat"},
+
+		{name: "create messages", method: "POST", path: "/v1/messages/batch",
+			body:   `[{"chat":"1","author":"1","text":"a"},{"chat":"2","author":"1","text":"b"}]`,
+			status: http.StatusOK, check: batchStatuses("200", "200")},
+		{name: "create messages with outsider's one", method: "POST", path: "/v1/messages/batch",
+			body:   `[{"chat":"1","author":"1","text":"a"},{"chat":"2","author":"2","text":"b"}]`,
+			status: http.StatusUnprocessableEntity, code: "BATCH_FAILED",
+			check: batchStatuses("424 BATCH_ITEM_ROLLED_BACK", "401 USER_NOT_IN_CHAT")},
+		{name: "create messages with one out of range", method: "POST", path: "/v1/messages/batch",
+			body:   `[{"chat":"1","author":"1","text":"a"},{"chat":"4294967296","author":"1","text":"b"}]`,
+			status: http.StatusUnprocessableEntity, code: "BATCH_FAILED",
+			check: batchStatuses("424 BATCH_ITEM_ROLLED_BACK", "400 MESSAGE_CHAT_OUT_OF_RANGE")},
+		{name: "create messages partially", method: "POST", path: "/v1/messages/batch?partial=1",
+			body:   `[{"chat":"1","author":"1","text":"a"},{"chat":"1","author":"1"}]`,
+			status: http.StatusOK, check: batchStatuses("200", "400 MESSAGE_TEXT_NULL")},
+
+		{name: "list chat's messages", method: "POST", path: "/messages/get", body: `{"chat":"1"}`,
+			status: http.StatusOK, check: messageTexts("hi", "hello")},
+		{name: "list messages of empty chat", method: "POST", path: "/messages/get", body: `{"chat":"2"}`,
+			status: http.StatusOK, check: messageTexts()},
+		{name: "list messages without chat", method: "POST", path: "/messages/get", body: `{}`,
+			status: http.StatusBadRequest, code: "MESSAGE_CHAT_NULL", field: "chat"},
+		// there is the user 3, but not the chat
+		{name: "list messages of unknown chat", method: "POST", path: "/messages/get", body: `{"chat":"3"}`,
+			status: http.StatusNotFound, code: "CHAT_NOT_FOUND", field: "chat"},
+		{name: "v1 list latest messages", method: "GET", path: "/v1/chats/1/messages?limit=1",
+			status: http.StatusOK, check: messageTexts("hello")},
+		{name: "v1 list messages with zero limit", method: "GET", path: "/v1/chats/1/messages?limit=0",
+			status: http.StatusBadRequest, code: "MESSAGE_LIMIT_INVALID", field: "limit"},
+		{name: "look messages up", method: "POST", path: "/v1/messages/lookup", body: `{"chats":["1","3"]}`,
+			status: http.StatusOK, check: batchStatuses("200", "404 CHAT_NOT_FOUND")},
+		{name: "look messages up with chat out of range", method: "POST", path: "/v1/messages/lookup", body: `{"chats":["1","2147483648"]}`,
+			status: http.StatusOK, check: batchStatuses("200", "400 MESSAGE_CHAT_OUT_OF_RANGE")},
+		{name: "look latest messages up", method: "POST", path: "/v1/messages/lookup", body: `{"chats":["1","1"],"limit":1}`,
+			status: http.StatusOK, check: batchStatuses("200", "200")},
+		{name: "look messages up with zero limit", method: "POST", path: "/v1/messages/lookup", body: `{"chats":["1"],"limit":0}`,
+			status: http.StatusBadRequest, code: "MESSAGE_LIMIT_INVALID", field: "limit"},
+		{name: "look messages up in too many chats", method: "POST", path: "/v1/messages/lookup",
+			body:   `{"chats":[` + strings.Repeat(`"1",`, models.MaxBatchSize) + `"1"]}`,
+			header: map[string]string{"Accept-Language": "ru"},
+			status: http.StatusBadRequest, code: "BATCH_TOO_LARGE",
+			check: func(t *testing.T, resp *apiResponse) {
+				if resp.Error == nil || *resp.Error != "Пакет не может содержать больше 1000 элементов" {
+					t.Errorf("got %v", resp.Error)
+				}
+			}},
+		{name: "look messages up with null chat", method: "POST", path: "/v1/messages/lookup", body: `{"chats":[null]}`,
+			status: http.StatusBadRequest, code: "BATCH_ITEM_NULL"},
+
+		{name: "API specification", method: "GET", path: "/openapi.json", status: http.StatusOK},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			resetTestStorage(t)
+			c.run(t, newTestHandler())
+		})
+	}
+}
+
+func TestIdempotentCreation(t *testing.T) {
+	resetTestStorage(t)
+	h := newTestHandler()
+
+	create := apiCase{method: "POST", path: "/v1/users", body: `{"username":"dave"}`,
+		header: map[string]string{"Idempotency-Key": "k1"}, status: http.StatusOK, check: resultID(4)}
+	create.run(t, h)
+
+	replay := create.do(t, h)
+	if replay.status != http.StatusOK || replay.header.Get("Idempotent-Replayed") != "true" {
+		t.Errorf("the retry isn't replayed: %d %v", replay.status, replay.header)
+	}
+	resultID(4)(t, replay)
+
+	reused := create
+	reused.body, reused.status, reused.code, reused.check = `{"username":"erin"}`, http.StatusUnprocessableEntity, "IDEMPOTENCY_KEY_REUSED", nil
+	reused.run(t, h)
+
+	tooLong := create
+	tooLong.header = map[string]string{"Idempotency-Key": strings.Repeat("k", 256)}
+	tooLong.status, tooLong.code, tooLong.check = http.StatusBadRequest, "IDEMPOTENCY_KEY_TOO_LONG", nil
+	tooLong.run(t, h)
+
+	msg := apiCase{method: "POST", path: "/messages/add", body: `{"chat":"1","author":"1","text":"a","client_msg_id":"m1"}`,
+		status: http.StatusOK, check: resultID(3)}
+	msg.run(t, h)
+	msg.run(t, h)
+}
+
+// TestConditionalLists checks that the version a conditional request is answered by before loading a list
+// matches the validators the loaded list is rendered with
+func TestConditionalLists(t *testing.T) {
+	resetTestStorage(t)
+	h := newTestHandler()
+
+	lists := []apiCase{
+		{method: "GET", path: "/v1/chats/1/messages"},
+		{method: "GET", path: "/v1/chats/1/messages?limit=1"},
+		{method: "GET", path: "/v1/users/1/chats"},
+		{method: "GET", path: "/v1/users/3/chats"},
+		{method: "POST", path: "/messages/get", body: `{"chat":"1"}`},
+		{method: "POST", path: "/chats/get", body: `{"user":"1"}`},
+	}
+	etags := make([]string, len(lists))
+	for i, list := range lists {
+		resp := list.do(t, h)
+		etags[i] = resp.header.Get("ETag")
+		if resp.status != http.StatusOK || etags[i] == "" {
+			t.Fatalf("%s %s: status %d, no validators in %v", list.method, list.path, resp.status, resp.header)
+		}
+
+		headers := []map[string]string{
+			{"If-None-Match": etags[i]},
+			{"If-None-Match": `"other", ` + etags[i]},
+			{"If-None-Match": "*"},
+		}
+		if lastModified := resp.header.Get("Last-Modified"); lastModified != "" {
+			headers = append(headers, map[string]string{"If-Modified-Since": lastModified})
+		}
+		for _, header := range headers {
+			list.header = header
+			if resp := list.do(t, h); resp.status != http.StatusNotModified || resp.header.Get("ETag") == "" {
+				t.Errorf("%s %s with %v: status is %d, want %d with the validators",
+					list.method, list.path, header, resp.status, http.StatusNotModified)
+			}
+		}
+	}
+
+	send := apiCase{method: "POST", path: "/v1/chats/1/messages", body: `{"author":"1","text":"new"}`, status: http.StatusOK}
+	send.run(t, h)
+
+	for i, list := range lists {
+		want := http.StatusOK
+		if strings.Contains(list.path, "/users/3/") {
+			want = http.StatusNotModified // the chat isn't theirs
+		}
+		list.header = map[string]string{"If-None-Match": etags[i]}
+		if resp := list.do(t, h); resp.status != want {
+			t.Errorf("%s %s after a new message: status is %d, want %d", list.method, list.path, resp.status, want)
+		}
+	}
+
+	unknown := apiCase{method: "GET", path: "/v1/users/42/chats", header: map[string]string{"If-None-Match": "*"},
+		status: http.StatusNotFound, code: "USER_NOT_FOUND"}
+	unknown.run(t, h)
+}
+
+func TestChatsOrderedByActivity(t *testing.T) {
+	resetTestStorage(t)
+	h := newTestHandler()
+
+	list := apiCase{method: "POST", path: "/chats/get", body: `{"user":"1"}`, status: http.StatusOK}
+	list.check = chatNames("general", "random")
+	list.run(t, h)
+
+	send := apiCase{method: "POST", path: "/messages/add", body: `{"chat":"2","author":"1","text":"hey"}`,
+		status: http.StatusOK, check: resultID(3)}
+	send.run(t, h)
+
+	list.check = func(t *testing.T, resp *apiResponse) {
+		chatNames("random", "general")(t, resp)
+
+		var chats []*models.Chat
+		resp.decode(t, &chats)
+		if id := chats[0].LastMessageID; id == nil || *id != 3 || chats[0].LastMessageAt == nil {
+			t.Errorf("the last message of %s isn't 3: %v", *chats[0].Name, id)
+		}
+	}
+	list.run(t, h)
+}
+
+// TestCacheInvalidation checks every way the cached lists of the users' chats are invalidated
+func TestCacheInvalidation(t *testing.T) {
+	list := func(user string) apiCase {
+		return apiCase{method: "POST", path: "/chats/get", body: `{"user":"` + user + `"}`, status: http.StatusOK}
+	}
+
+	t.Run("new chat", func(t *testing.T) {
+		resetTestStorage(t)
+		h, _ := newCachedTestHandler(t)
+
+		bob := list("2")
+		bob.check = chatNames("general")
+		bob.run(t, h)
+		bob.run(t, h)
+
+		create := apiCase{method: "POST", path: "/chats/add", body: `{"name":"new","users":["2","3"]}`,
+			status: http.StatusOK, check: resultID(3)}
+		create.run(t, h)
+		bob.check = chatNames("general", "new")
+		bob.run(t, h)
+	})
+
+	t.Run("new message", func(t *testing.T) {
+		resetTestStorage(t)
+		h, _ := newCachedTestHandler(t)
+
+		alice := list("1")
+		alice.check = chatNames("general", "random")
+		alice.run(t, h)
+
+		send := apiCase{method: "POST", path: "/messages/add", body: `{"chat":"2","author":"1","text":"hey"}`,
+			status: http.StatusOK, check: resultID(3)}
+		send.run(t, h)
+		alice.check = chatNames("random", "general")
+		alice.run(t, h)
+	})
+
+	t.Run("new messages in a batch", func(t *testing.T) {
+		resetTestStorage(t)
+		h, _ := newCachedTestHandler(t)
+
+		alice := list("1")
+		alice.check = chatNames("general", "random")
+		alice.run(t, h)
+
+		batch := apiCase{method: "POST", path: "/v1/messages/batch?partial=1",
+			body:   `[{"chat":"2","author":"1","text":"a"},{"chat":"1","author":"3","text":"b"}]`,
+			status: http.StatusOK, check: batchStatuses("200", "401 USER_NOT_IN_CHAT")}
+		batch.run(t, h)
+		alice.check = chatNames("random", "general")
+		alice.run(t, h)
+	})
+
+	t.Run("X-Read-Primary", func(t *testing.T) {
+		resetTestStorage(t)
+		h, _ := newCachedTestHandler(t)
+
+		alice := list("1")
+		alice.check = chatNames("general", "random")
+		alice.run(t, h)
+
+		// the other instances' writes aren't seen until the TTL passes, unless the client asks for the primary
+		if _, err := testStorage.db.Exec(`UPDATE chats SET name = 'renamed' WHERE id = 2`); err != nil {
+			t.Fatal(err)
+		}
+		alice.run(t, h)
+		alice.header = map[string]string{"X-Read-Primary": "true"}
+		alice.check = chatNames("general", "renamed")
+		alice.run(t, h)
+		alice.header = nil
+		alice.run(t, h)
+	})
+
+	t.Run("archive", func(t *testing.T) {
+		resetTestStorage(t)
+		if testStorage.dialect != models.DialectPostgres {
+			t.Skip("SQLite has no partitions to archive")
+		}
+		h, services := newCachedTestHandler(t)
+
+		alice := list("1")
+		alice.check = chatNames("general", "random")
+		alice.run(t, h)
+
+		export := func(p models.MessagePartition, rows *models.MessageRows) error { return nil }
+		before := time.Date(2020, 2, 1, 0, 0, 0, 0, time.UTC)
+		if _, err := services.ArchiveMessagePartitions(context.Background(), before, export); err != nil {
+			t.Fatal(err)
+		}
+
+		alice.check = func(t *testing.T, resp *apiResponse) {
+			var chats []*models.Chat
+			resp.decode(t, &chats)
+			if len(chats) != 2 || chats[0].ArchivedBefore == nil || !chats[0].ArchivedBefore.Equal(before) {
+				t.Errorf("the archive boundary of general isn't %v: %+v", before, chats)
+			}
+		}
+		alice.run(t, h)
+	})
+}
+
+// seedBenchChats adds n chats of alice and bob to the fixtures with 5 messages in each, the chats' last activity
+// is kept the way createMessage keeps it
+func seedBenchChats(b *testing.B, n int) {
+	b.Helper()
+
+	tx, err := testStorage.db.Begin()
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+	for i := 1; i <= n; i++ {
+		var chatID, messageID int64
+		err := tx.QueryRow(`INSERT INTO chats (name, created_at) VALUES ($1, $2) RETURNING id`,
+			fmt.Sprintf("bench-%d", i), now).Scan(&chatID)
+		if err == nil {
+			_, err = tx.Exec(`INSERT INTO chats_users (chat_id, user_id) VALUES ($1, 1), ($1, 2)`, chatID)
+		}
+		// the latest message is the last one
+		latest := now.Add(-time.Duration(i) * time.Minute)
+		for m := 4; m >= 0 && err == nil; m-- {
+			err = tx.QueryRow(`INSERT INTO messages (chat_id, user_id, text, created_at) VALUES ($1, 1, $2, $3) RETURNING id`,
+				chatID, fmt.Sprintf("message %d", m), latest.Add(-time.Duration(m)*time.Minute)).Scan(&messageID)
+		}
+		if err == nil {
+			_, err = tx.Exec(`UPDATE chats SET last_message_at = $1, last_message_id = $2 WHERE id = $3`,
+				latest, messageID, chatID)
+		}
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		b.Fatal(err)
+	}
+}
+
+// chatsByUserIDPerChat loads the chats the way ByUserID did before the chats had their last activity:
+// the ids are ordered by the latest message, then every chat is loaded by a query of its own
+func chatsByUserIDPerChat(db *gorm.DB, userID uint) ([]*models.Chat, error) {
+	var ids []uint
+	err := db.Raw(`SELECT id FROM (SELECT max(messages.created_at) AS latest, chats.id FROM chats
+		LEFT JOIN messages ON chats.id = messages.chat_id
+		WHERE chats.id IN (SELECT chat_id FROM chats_users WHERE user_id = ?)
+		GROUP BY chats.id ORDER BY latest DESC NULLS LAST) AS ordered`, userID).
+		Pluck("id", &ids).Error
+	if err != nil {
+		return nil, err
+	}
+
+	chats := make([]*models.Chat, len(ids))
+	for i, id := range ids {
+		var chat models.Chat
+		err := db.Preload("Users").
+			Preload("Messages", func(db *gorm.DB) *gorm.DB { return db.Order("messages.created_at DESC") }).
+			Where("id = ?", id).First(&chat).Error
+		if err != nil {
+			return nil, err
+		}
+		chats[i] = &chat
+	}
+	return chats, nil
+}
+
+// BenchmarkChatsByUserID compares ByUserID with the loading of the chats one by one it has replaced, the user is
+// in n chats with 5 messages in each. The number of ByUserID's queries doesn't depend on n, so its time per chat
+// should fall as n grows. It runs on the test storage, see BTA_TEST_ENGINE.
+func BenchmarkChatsByUserID(b *testing.B) {
+	userID := uint(1)
+	ctx := context.Background()
+	var db *gorm.DB
+	load := map[string]func() ([]*models.Chat, error){
+		"preloaded": func() ([]*models.Chat, error) {
+			chats, _, err := testStorage.services.Chat.ByUserID(ctx, &userID)
+			return chats, err
+		},
+		"per-chat": func() ([]*models.Chat, error) {
+			return chatsByUserIDPerChat(db, userID)
+		},
+	}
+
+	for _, n := range []int{10, 100, 1000} {
+		seeded := false
+		for _, name := range []string{"per-chat", "preloaded"} {
+			b.Run(fmt.Sprintf("chats=%d/%s", n, name), func(b *testing.B) {
+				// the function is run again for every b.N, the chats are seeded once for both loaders
+				if !seeded {
+					resetTestStorage(b)
+					seedBenchChats(b, n)
+					seeded = true
+				}
+				if db == nil {
+					var err error
+					if db, err = gorm.Open(testStorage.dialect, testStorage.db); err != nil {
+						b.Fatal(err)
+					}
+				}
+
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					chats, err := load[name]()
+					if err != nil {
+						b.Fatal(err)
+					}
+					// alice is in the fixtures' chats too
+					if len(chats) != n+2 {
+						b.Fatalf("got %d chats, want %d", len(chats), n+2)
+					}
+				}
+				b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*n), "ns/chat")
+			})
+		}
+	}
+}
+
+func TestStartPostgresReportsMissingBinaries(t *testing.T) {
+	t.Setenv("PG_BIN", t.TempDir())
+	if _, _, err := startPostgres(); !errors.Is(err, exec.ErrNotFound) && !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("err is %v, want a missing binary", err)
+	}
+}
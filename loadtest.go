@@ -0,0 +1,468 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/nlevankov/backend-trainee-assignment/middleware"
+	"github.com/nlevankov/backend-trainee-assignment/models"
+)
+
+// the endpoints the load is driven against, in the order they are reported
+var loadEndpoints = []string{"/messages/add", "/messages/get", "/chats/get"}
+
+// maxLoadRate is the highest -rate, the ticker which paces the requests can't tick more often than every microsecond
+const maxLoadRate = 1e6
+
+// maxRateLimitedShare is the share of the rate limited requests above which the run measures the server's
+// rate limiter rather than the server, then the loadtest exits with 1
+const maxRateLimitedShare = 0.5
+
+// runLoadTest creates users and chats through the public API of a running server, then sends the mix
+// of the requests to it and reports the latencies and the errors per endpoint, it returns the exit code
+func runLoadTest(args []string) int {
+	fs := flag.NewFlagSet("loadtest", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s loadtest [flags]\n\n"+
+			"WARNING: the users and the chats it creates are left in the storage.\n\n"+
+			"By default the server limits /messages/add per IP to 10 req/s, so a run from one host measures\n"+
+			"the rejections. Run the server with the limits off:\n"+
+			"  APP_RATELIMIT_ROUTES='/messages/add=0:1,/v1/chats/{id}/messages=0:1'\n"+
+			"or keyed by the user this tool sends in -user-header:\n"+
+			"  APP_RATELIMIT_KEYS=user,route APP_RATELIMIT_USER_HEADER=X-User-ID\n"+
+			"The run fails if more than %.0f%% of the requests are rejected with %s.\n\n",
+			os.Args[0], 100*maxRateLimitedShare, middleware.CodeRateLimited)
+		fs.PrintDefaults()
+	}
+
+	lt := loadTest{client: http.DefaultClient, out: os.Stdout}
+	fs.StringVar(&lt.target, "target", "http://localhost:9000", "the `URL` of a running server")
+	fs.IntVar(&lt.users, "users", 100, "the number of users to create")
+	fs.IntVar(&lt.chats, "chats", 50, "the number of chats to create")
+	fs.IntVar(&lt.members, "members", 5, "the number of users in every chat")
+	fs.DurationVar(&lt.duration, "duration", 30*time.Second, "how long to send the requests")
+	fs.IntVar(&lt.concurrency, "concurrency", 10, "the number of concurrent clients")
+	fs.Float64Var(&lt.rate, "rate", 0, "the total rate in requests per second, 0 means as fast as possible")
+	mix := fs.String("mix", "/messages/add=5,/messages/get=3,/chats/get=2", "the endpoints' `weights`")
+	fs.StringVar(&lt.userHeader, "user-header", "X-User-ID", "the `header` the acting user is sent in, "+
+		"for the server's rate limits keyed by user, empty means none")
+	fs.Parse(args)
+
+	if fs.NArg() != 0 {
+		fs.Usage()
+		return 2
+	}
+
+	var err error
+	if lt.mix, err = parseLoadMix(*mix); err == nil {
+		err = lt.validate()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	lt.target = strings.TrimSuffix(lt.target, "/")
+	lt.client = &http.Client{
+		Timeout:   time.Minute,
+		Transport: &http.Transport{MaxIdleConnsPerHost: lt.concurrency},
+	}
+
+	if err := lt.setUp(context.Background()); err != nil {
+		fmt.Fprintf(os.Stderr, "Can't create the users and the chats: %v\n", err)
+		return 1
+	}
+	if !lt.run() {
+		return 1
+	}
+	return 0
+}
+
+type loadTest struct {
+	client *http.Client
+	out    io.Writer
+
+	target      string
+	users       int
+	chats       int
+	members     int
+	duration    time.Duration
+	concurrency int
+	rate        float64
+	mix         []loadWeight
+	userHeader  string
+
+	// what setUp has created, the members of a chat are the users' indexes
+	userIDs     []uint
+	chatIDs     []uint
+	chatMembers [][]int
+}
+
+type loadWeight struct {
+	endpoint string
+	weight   int
+}
+
+// parseLoadMix parses the weights of the endpoints, e.g. "/messages/add=5,/chats/get=1"
+func parseLoadMix(s string) ([]loadWeight, error) {
+	var mix []loadWeight
+	for _, pair := range strings.Split(s, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("-mix: %q isn't endpoint=weight", pair)
+		}
+
+		endpoint := strings.TrimSpace(kv[0])
+		known := false
+		for _, e := range loadEndpoints {
+			known = known || e == endpoint
+		}
+		if !known {
+			return nil, fmt.Errorf("-mix: unknown endpoint %q, use %s", endpoint, strings.Join(loadEndpoints, ", "))
+		}
+
+		weight, err := strconv.Atoi(strings.TrimSpace(kv[1]))
+		if err != nil || weight < 0 {
+			return nil, fmt.Errorf("-mix: the weight of %s must be a non-negative integer", endpoint)
+		}
+		if weight > 0 {
+			mix = append(mix, loadWeight{endpoint: endpoint, weight: weight})
+		}
+	}
+
+	if len(mix) == 0 {
+		return nil, errors.New("-mix: no endpoint has a positive weight")
+	}
+	return mix, nil
+}
+
+func (lt *loadTest) validate() error {
+	var errs []error
+	if lt.users < 1 {
+		errs = append(errs, errors.New("-users: at least one user is required"))
+	}
+	if lt.chats < 1 {
+		errs = append(errs, errors.New("-chats: at least one chat is required"))
+	}
+	if lt.members < 1 || lt.members > lt.users {
+		errs = append(errs, errors.New("-members: it must be between 1 and -users"))
+	}
+	if lt.duration <= 0 {
+		errs = append(errs, errors.New("-duration: it must be positive"))
+	}
+	if lt.concurrency < 1 {
+		errs = append(errs, errors.New("-concurrency: at least one client is required"))
+	}
+	if lt.rate < 0 || lt.rate > maxLoadRate {
+		errs = append(errs, fmt.Errorf("-rate: it must be between 0 and %.0f", float64(maxLoadRate)))
+	}
+	return errors.Join(errs...)
+}
+
+// loadResponse is the envelope of the responses, the rest of the formats aren't requested
+type loadResponse struct {
+	Result    json.RawMessage
+	ErrorInfo *struct{ Code string }
+}
+
+// post sends the JSON body and returns the decoded response, err is non-nil only if there is no response
+func (lt *loadTest) post(ctx context.Context, path, user string, body interface{}) (int, *loadResponse, error) {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, lt.target+path, bytes.NewReader(b))
+	if err != nil {
+		return 0, nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	if lt.userHeader != "" && user != "" {
+		req.Header.Set(lt.userHeader, user)
+	}
+
+	resp, err := lt.client.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+
+	// the rest is read for the connection to be reused
+	var res loadResponse
+	err = json.NewDecoder(resp.Body).Decode(&res)
+	io.Copy(io.Discard, resp.Body)
+	if err != nil {
+		return resp.StatusCode, nil, nil
+	}
+	return resp.StatusCode, &res, nil
+}
+
+func (res *loadResponse) errorCode() string {
+	if res == nil || res.ErrorInfo == nil {
+		return ""
+	}
+	return res.ErrorInfo.Code
+}
+
+// setUp creates the users in batches and the chats of random users, the names are unique to the run
+func (lt *loadTest) setUp(ctx context.Context) error {
+	prefix := fmt.Sprintf("loadtest-%d", time.Now().UnixNano())
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+
+	for start := 0; start < lt.users; start += models.MaxBatchSize {
+		end := start + models.MaxBatchSize
+		if end > lt.users {
+			end = lt.users
+		}
+
+		var batch []map[string]string
+		for i := start; i < end; i++ {
+			batch = append(batch, map[string]string{"username": fmt.Sprintf("%s-user-%d", prefix, i)})
+		}
+
+		status, res, err := lt.post(ctx, "/v1/users/batch", "", batch)
+		if err != nil {
+			return err
+		}
+		if status != http.StatusOK || res == nil {
+			return fmt.Errorf("POST /v1/users/batch: %d %s", status, res.errorCode())
+		}
+
+		var items []struct{ Result uint }
+		if err := json.Unmarshal(res.Result, &items); err != nil {
+			return fmt.Errorf("POST /v1/users/batch: %v", err)
+		}
+		for _, item := range items {
+			lt.userIDs = append(lt.userIDs, item.Result)
+		}
+	}
+	fmt.Fprintf(lt.out, "Created %d users\n", len(lt.userIDs))
+
+	for i := 0; i < lt.chats; i++ {
+		members := rnd.Perm(lt.users)[:lt.members]
+		users := make([]string, len(members))
+		for j, m := range members {
+			users[j] = fmt.Sprint(lt.userIDs[m])
+		}
+
+		body := map[string]interface{}{"name": fmt.Sprintf("%s-chat-%d", prefix, i), "users": users}
+		status, res, err := lt.post(ctx, "/chats/add", users[0], body)
+		if err != nil {
+			return err
+		}
+		if status != http.StatusOK || res == nil {
+			return fmt.Errorf("POST /chats/add: %d %s", status, res.errorCode())
+		}
+
+		var id uint
+		if err := json.Unmarshal(res.Result, &id); err != nil {
+			return fmt.Errorf("POST /chats/add: %v", err)
+		}
+		lt.chatIDs = append(lt.chatIDs, id)
+		lt.chatMembers = append(lt.chatMembers, members)
+	}
+	fmt.Fprintf(lt.out, "Created %d chats of %d users\n", len(lt.chatIDs), lt.members)
+
+	return nil
+}
+
+// loadSample is the outcome of a request, code is the error's code, the status or the transport error
+type loadSample struct {
+	endpoint string
+	latency  time.Duration
+	code     string
+}
+
+// run sends the requests and reports them, it returns false if the server's rate limiter has rejected most of them
+func (lt *loadTest) run() bool {
+	ctx, cancel := context.WithTimeout(context.Background(), lt.duration)
+	defer cancel()
+
+	// the tokens of the rate, the clients take one before every request
+	var tokens <-chan time.Time
+	if lt.rate > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / lt.rate))
+		defer ticker.Stop()
+		tokens = ticker.C
+	}
+
+	fmt.Fprintf(lt.out, "Sending the requests for %v with %d clients\n", lt.duration, lt.concurrency)
+
+	samples := make([][]loadSample, lt.concurrency)
+	start := time.Now()
+
+	var wg sync.WaitGroup
+	for i := 0; i < lt.concurrency; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(time.Now().UnixNano() + int64(i)))
+
+			for {
+				if tokens != nil {
+					select {
+					case <-tokens:
+					case <-ctx.Done():
+						return
+					}
+				}
+				s := lt.request(ctx, rnd)
+				// the requests cut short by the end of the run aren't counted
+				if ctx.Err() != nil {
+					return
+				}
+				samples[i] = append(samples[i], s)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	return lt.report(samples, time.Since(start))
+}
+
+// request sends a request to an endpoint chosen by the weights on behalf of a random member of a random chat
+func (lt *loadTest) request(ctx context.Context, rnd *rand.Rand) loadSample {
+	total := 0
+	for _, w := range lt.mix {
+		total += w.weight
+	}
+	n := rnd.Intn(total)
+	endpoint := lt.mix[0].endpoint
+	for _, w := range lt.mix {
+		if n < w.weight {
+			endpoint = w.endpoint
+			break
+		}
+		n -= w.weight
+	}
+
+	chat := rnd.Intn(len(lt.chatIDs))
+	members := lt.chatMembers[chat]
+	chatID := fmt.Sprint(lt.chatIDs[chat])
+	userID := fmt.Sprint(lt.userIDs[members[rnd.Intn(len(members))]])
+
+	var body interface{}
+	switch endpoint {
+	case "/messages/add":
+		body = map[string]string{"chat": chatID, "author": userID, "text": fmt.Sprintf("load %d", rnd.Int63())}
+	case "/messages/get":
+		body = map[string]string{"chat": chatID}
+	case "/chats/get":
+		body = map[string]string{"user": userID}
+	}
+
+	began := time.Now()
+	status, res, err := lt.post(ctx, endpoint, userID, body)
+	s := loadSample{endpoint: endpoint, latency: time.Since(began)}
+	switch {
+	case err != nil:
+		s.code = "transport error"
+	case status != http.StatusOK:
+		s.code = res.errorCode()
+		if s.code == "" {
+			s.code = strconv.Itoa(status)
+		}
+	}
+	return s
+}
+
+// report prints the rates, the latencies and the errors of the requests, the rate limited ones are counted apart
+// from the errors, it returns false if they are more than maxRateLimitedShare of all the requests
+func (lt *loadTest) report(samples [][]loadSample, elapsed time.Duration) bool {
+	total := 0
+	for _, ss := range samples {
+		total += len(ss)
+	}
+	// the ticker drops the ticks while all the clients wait for the responses, so the rate may fall short of -rate
+	achieved := float64(total) / elapsed.Seconds()
+	if lt.rate > 0 {
+		fmt.Fprintf(lt.out, "Sent %d requests, %.1f req/s of %.1f\n", total, achieved, lt.rate)
+	} else {
+		fmt.Fprintf(lt.out, "Sent %d requests, %.1f req/s\n", total, achieved)
+	}
+
+	latencies := make(map[string][]time.Duration)
+	errs := make(map[string]map[string]int)
+	limited := make(map[string]int)
+	limitedTotal := 0
+	for _, ss := range samples {
+		for _, s := range ss {
+			latencies[s.endpoint] = append(latencies[s.endpoint], s.latency)
+			if s.code == middleware.CodeRateLimited {
+				limited[s.endpoint]++
+				limitedTotal++
+			} else if s.code != "" {
+				if errs[s.endpoint] == nil {
+					errs[s.endpoint] = make(map[string]int)
+				}
+				errs[s.endpoint][s.code]++
+			}
+		}
+	}
+
+	tw := tabwriter.NewWriter(lt.out, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "endpoint\trequests\treq/s\terrors\trate limited\tp50\tp90\tp99\tmax\t")
+	for _, endpoint := range loadEndpoints {
+		ls := latencies[endpoint]
+		if len(ls) == 0 {
+			continue
+		}
+		sort.Slice(ls, func(i, j int) bool { return ls[i] < ls[j] })
+
+		failed := 0
+		for _, n := range errs[endpoint] {
+			failed += n
+		}
+
+		fmt.Fprintf(tw, "%s\t%d\t%.1f\t%.2f%%\t%.2f%%\t%v\t%v\t%v\t%v\t\n", endpoint, len(ls),
+			float64(len(ls))/elapsed.Seconds(), 100*float64(failed)/float64(len(ls)),
+			100*float64(limited[endpoint])/float64(len(ls)),
+			percentile(ls, 50), percentile(ls, 90), percentile(ls, 99), percentile(ls, 100))
+	}
+	tw.Flush()
+
+	for _, endpoint := range loadEndpoints {
+		codes := make([]string, 0, len(errs[endpoint]))
+		for code := range errs[endpoint] {
+			codes = append(codes, code)
+		}
+		sort.Strings(codes)
+		for _, code := range codes {
+			fmt.Fprintf(lt.out, "%s: %d x %s\n", endpoint, errs[endpoint][code], code)
+		}
+	}
+
+	if total > 0 && float64(limitedTotal)/float64(total) > maxRateLimitedShare {
+		fmt.Fprintf(lt.out, "FAILED: %d of %d requests are rejected with %s, the latencies are the rate limiter's, "+
+			"turn the server's limits off (see -h)\n", limitedTotal, total, middleware.CodeRateLimited)
+		return false
+	}
+	return true
+}
+
+// percentile returns the nearest-rank percentile of the sorted latencies
+func percentile(sorted []time.Duration, p int) time.Duration {
+	i := (len(sorted)*p+99)/100 - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i].Round(time.Microsecond)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseLoadMix(t *testing.T) {
+	cases := []struct {
+		mix  string
+		want []loadWeight
+		err  string
+	}{
+		{"/messages/add=5,/chats/get=1", []loadWeight{{"/messages/add", 5}, {"/chats/get", 1}}, ""},
+		{" /messages/get = 2 ,, ", []loadWeight{{"/messages/get", 2}}, ""},
+		{"/messages/add=0,/chats/get=3", []loadWeight{{"/chats/get", 3}}, ""},
+		{"/messages/add", nil, "isn't endpoint=weight"},
+		{"/users/add=1", nil, "unknown endpoint"},
+		{"/chats/get=-1", nil, "non-negative integer"},
+		{"/chats/get=x", nil, "non-negative integer"},
+		{"/chats/get=0", nil, "no endpoint has a positive weight"},
+		{"", nil, "no endpoint has a positive weight"},
+	}
+
+	for _, c := range cases {
+		mix, err := parseLoadMix(c.mix)
+		if c.err != "" {
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Errorf("%q: got %v, want %q", c.mix, err, c.err)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(mix, c.want) {
+			t.Errorf("%q: got %v, %v, want %v", c.mix, mix, err, c.want)
+		}
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	var sorted []time.Duration
+	for i := 1; i <= 10; i++ {
+		sorted = append(sorted, time.Duration(i)*time.Millisecond)
+	}
+
+	cases := []struct {
+		sorted []time.Duration
+		p      int
+		want   time.Duration
+	}{
+		{sorted, 50, 5 * time.Millisecond},
+		{sorted, 90, 9 * time.Millisecond},
+		{sorted, 99, 10 * time.Millisecond},
+		{sorted, 100, 10 * time.Millisecond},
+		{sorted, 0, time.Millisecond},
+		{sorted[:1], 50, time.Millisecond},
+		{[]time.Duration{1500 * time.Nanosecond, 2 * time.Second}, 50, 2 * time.Microsecond},
+	}
+
+	for _, c := range cases {
+		if got := percentile(c.sorted, c.p); got != c.want {
+			t.Errorf("p%d of %v: got %v, want %v", c.p, c.sorted, got, c.want)
+		}
+	}
+}
+
+func TestLoadTestValidateRate(t *testing.T) {
+	lt := loadTest{users: 1, chats: 1, members: 1, duration: time.Second, concurrency: 1}
+	for _, rate := range []float64{0, 1, maxLoadRate} {
+		lt.rate = rate
+		if err := lt.validate(); err != nil {
+			t.Errorf("%v: %v", rate, err)
+		}
+	}
+	// the ticker panics on the rates above 1e9
+	for _, rate := range []float64{-1, maxLoadRate + 1, 2e9} {
+		lt.rate = rate
+		if err := lt.validate(); err == nil || !strings.Contains(err.Error(), "-rate") {
+			t.Errorf("%v: got %v", rate, err)
+		}
+	}
+}
+
+func TestLoadTestReportRate(t *testing.T) {
+	var out bytes.Buffer
+	lt := loadTest{out: &out, rate: 100}
+	samples := [][]loadSample{
+		{{endpoint: "/chats/get", latency: time.Millisecond}},
+		{{endpoint: "/chats/get", latency: 2 * time.Millisecond, code: "STORAGE_TIMEOUT"}},
+	}
+	lt.report(samples, time.Second)
+
+	for _, want := range []string{"Sent 2 requests, 2.0 req/s of 100.0\n", "/chats/get: 1 x STORAGE_TIMEOUT\n"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("%q isn't reported in:\n%s", want, out.String())
+		}
+	}
+}
+
+func TestLoadTestReportRateLimited(t *testing.T) {
+	cases := []struct {
+		limited int
+		ok      bool
+	}{
+		{0, true},
+		{2, true},
+		{3, false},
+	}
+
+	for _, c := range cases {
+		var out bytes.Buffer
+		lt := loadTest{out: &out}
+		samples := [][]loadSample{{{endpoint: "/chats/get", latency: time.Millisecond, code: "STORAGE_TIMEOUT"}}}
+		for i := 0; i < 4; i++ {
+			s := loadSample{endpoint: "/messages/add", latency: time.Millisecond}
+			if i < c.limited {
+				s.code = "RATE_LIMITED"
+			}
+			samples[0] = append(samples[0], s)
+		}
+
+		if ok := lt.report(samples, time.Second); ok != c.ok {
+			t.Errorf("%d of 5 rate limited: got %v", c.limited, ok)
+		}
+		// the rate limited requests aren't errors
+		if strings.Contains(out.String(), "x RATE_LIMITED") {
+			t.Errorf("%d of 5 rate limited: they are reported as errors:\n%s", c.limited, out.String())
+		}
+		// the columns are aligned with the spaces
+		table := strings.Join(strings.Fields(out.String()), " ")
+		for _, want := range []string{
+			fmt.Sprintf("/messages/add 4 4.0 0.00%% %.2f%%", 25*float64(c.limited)),
+			"/chats/get 1 1.0 100.00% 0.00%",
+		} {
+			if !strings.Contains(table, want) {
+				t.Errorf("%d of 5 rate limited: %q isn't reported in:\n%s", c.limited, want, out.String())
+			}
+		}
+	}
+}
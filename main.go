@@ -1,71 +1,142 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
-	"github.com/gorilla/mux"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"sync"
 	"syscall"
 
+	"github.com/gorilla/mux"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+
 	"github.com/nlevankov/backend-trainee-assignment/controllers"
+	"github.com/nlevankov/backend-trainee-assignment/middleware"
 	"github.com/nlevankov/backend-trainee-assignment/models"
+	"github.com/nlevankov/backend-trainee-assignment/rpc"
 	"github.com/nlevankov/backend-trainee-assignment/views"
 )
 
 func main() {
 
+	// subcommands
+
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "replay":
+			os.Exit(runReplay(os.Args[2:]))
+		case "loadtest":
+			os.Exit(runLoadTest(os.Args[2:]))
+		case "archive":
+			os.Exit(runArchive(os.Args[2:]))
+		}
+	}
+
 	// flags' initialization
 
 	setSchemaFlagPtr := flag.Bool("setschema", false, "WARNING: it is destructive action. Provide this flag "+
 		"to initialize the storage.")
+	configFlags := RegisterConfigFlags(flag.CommandLine)
 
 	flag.Parse()
 
 	// the app's config's initialization
 
-	cfg := LoadConfig()
+	cfg, err := LoadConfig(configFlags)
+	if err != nil {
+		log.Fatalf("Invalid config:\n%v", err)
+	}
+	if configFlags.PrintConfig() {
+		must(PrintConfig(os.Stdout, cfg))
+		return
+	}
+	fmt.Println("Successfully loaded .config")
+	views.SetErrorFormat(views.ErrorFormat(cfg.ErrorFormat))
+	views.SetCompressionThreshold(cfg.CompressionThreshold)
 
 	// creating services
 
-	services, err := models.NewServices(
-		models.WithGorm(cfg.Database.Dialect(), cfg.Database.ConnectionInfo(), int(cfg.StorageConnNumOfAttempts), cfg.StorageConnIntervalBWAttempts),
-		models.WithLogMode(cfg.Logmode),
-		models.WithUser(),
-		models.WithChat(),
-		models.WithMessage(),
-		models.WithSetSchema(*setSchemaFlagPtr),
-	)
+	services, err := newServices(cfg, *setSchemaFlagPtr)
 	must(err)
 	defer services.Close()
 
-	r := mux.NewRouter()
-
-	// initializing controllers
+	// в SQLite партиций нет
+	if cfg.MessagePartitionsInterval > 0 && cfg.Database.Dialect() == models.DialectPostgres {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go keepMessagePartitions(ctx, services, cfg.MessagePartitionsAhead, cfg.MessagePartitionsInterval)
+	}
 
-	usersC := controllers.NewUsers(services.User)
-	chatsC := controllers.NewChats(services.Chat)
-	messageC := controllers.NewMessages(services.Message)
+	var r http.Handler = newHTTPHandler(cfg, services)
+	if cfg.RecordFile != "" {
+		recordFile, err := os.OpenFile(cfg.RecordFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		must(err)
+		defer recordFile.Close()
 
-	r.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
-		views.RenderJSON(w, nil, http.StatusNotFound, models.ErrNoSuchEndpointExists)
-	})
-	r.MethodNotAllowedHandler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
-		views.RenderJSON(w, nil, http.StatusNotFound, models.ErrNoSuchHTTPMethod)
-	})
-	r.HandleFunc("/users/add", usersC.Create).Methods(http.MethodPost)
-	r.HandleFunc("/chats/add", chatsC.Create).Methods(http.MethodPost)
-	r.HandleFunc("/messages/add", messageC.Create).Methods(http.MethodPost)
-	r.HandleFunc("/chats/get", chatsC.ByUserID).Methods(http.MethodPost)
-	r.HandleFunc("/messages/get", messageC.ByChatID).Methods(http.MethodPost)
+		r = middleware.NewRecorder(recordFile, cfg.BodyLimit).Middleware(r)
+		fmt.Printf("Recording the requests to %v\n", cfg.RecordFile)
+	}
 
+	// при включенном TLS обычный HTTP по умолчанию только перенаправляет на HTTPS
 	addr := fmt.Sprintf(cfg.IP+":%d", cfg.Port)
-	go func() {
-		must(http.ListenAndServe(addr, r))
-	}()
+	switch {
+	case !cfg.TLS.Enabled() || cfg.TLS.PlainHTTP == plainHTTPServe:
+		go func() {
+			must(http.ListenAndServe(addr, r))
+		}()
+		fmt.Printf("Started HTTP server on %v\n", addr)
+	case cfg.TLS.PlainHTTP == plainHTTPRedirect:
+		go func() {
+			must(http.ListenAndServe(addr, redirectToHTTPS(cfg.TLS.Port)))
+		}()
+		fmt.Printf("Started HTTP server on %v, it redirects to HTTPS\n", addr)
+	}
+
+	if cfg.AdminAddr != "" {
+		go func() {
+			must(http.ListenAndServe(cfg.AdminAddr, newAdminHandler(services)))
+		}()
+		fmt.Printf("Started admin HTTP server on %v\n", cfg.AdminAddr)
+	}
+
+	var grpcOpts []grpc.ServerOption
+	if cfg.RequestTimeout > 0 {
+		grpcOpts = append(grpcOpts, rpc.WithTimeout(cfg.RequestTimeout))
+	}
+	if cfg.TLS.Enabled() {
+		tlsConfig, err := cfg.TLS.ServerTLSConfig()
+		must(err)
+		grpcOpts = append(grpcOpts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+
+		tlsAddr := fmt.Sprintf(cfg.IP+":%d", cfg.TLS.Port)
+		srv := &http.Server{Addr: tlsAddr, Handler: r, TLSConfig: tlsConfig}
+		go func() {
+			// сертификаты берутся из TLSConfig
+			must(srv.ListenAndServeTLS("", ""))
+		}()
+
+		fmt.Printf("Started HTTPS server on %v\n", tlsAddr)
+	}
+
+	if cfg.GRPCPort != 0 {
+		grpcAddr := fmt.Sprintf(cfg.IP+":%d", cfg.GRPCPort)
+		lis, err := net.Listen("tcp", grpcAddr)
+		must(err)
+
+		grpcServer := rpc.NewServer(services, grpcOpts...)
+		defer grpcServer.Shutdown(cfg.ShutdownTimeout)
+		go func() {
+			must(grpcServer.Serve(lis))
+		}()
+
+		fmt.Printf("Started gRPC server on %v\n", grpcAddr)
+	}
 
 	var n sync.WaitGroup
 	n.Add(1)
@@ -77,11 +148,49 @@ func main() {
 		n.Done()
 	}()
 
-	fmt.Printf("Started HTTP server on %v\nSend SIGINT or SIGTERM to exit\n", addr)
+	fmt.Println("Send SIGINT or SIGTERM to exit")
 
 	n.Wait()
 }
 
+func newServices(cfg Config, setSchema bool) (*models.Services, error) {
+	return models.NewServices(
+		models.WithGorm(cfg.Database.Dialect(), cfg.Database.ConnectionInfo(), int(cfg.StorageConnNumOfAttempts), cfg.StorageConnIntervalBWAttempts),
+		models.WithReplicas(cfg.Database.Dialect(), cfg.Database.ReplicasConnectionInfo(), cfg.Database.ReplicaCheckInterval),
+		models.WithPool(cfg.Database.MaxOpenConns, cfg.Database.MaxIdleConns,
+			cfg.Database.ConnMaxLifetime, cfg.Database.ConnMaxIdleTime),
+		models.WithStatementTimeout(cfg.Database.StatementTimeout),
+		models.WithLogMode(cfg.Logmode),
+		models.WithCache(cfg.CacheSize, cfg.CacheTTL),
+		models.WithUser(),
+		models.WithChat(),
+		models.WithMessage(),
+		models.WithSetSchema(setSchema),
+	)
+}
+
+// newHTTPHandler initializes the controllers and the router with the middlewares the config asks for
+func newHTTPHandler(cfg Config, services *models.Services) *mux.Router {
+	idem := &controllers.Idempotency{
+		Store:  controllers.NewMemoryIdempotencyStore(cfg.IdempotencyTTL),
+		Client: cfg.Clients().ID,
+	}
+	usersC := controllers.NewUsers(services.User, idem)
+	chatsC := controllers.NewChats(services.Chat, idem)
+	messageC := controllers.NewMessages(services.Message, idem)
+
+	r := newRouter(limitBodies(apiRoutes(usersC, chatsC, messageC), cfg.BodyLimit, cfg.BodyLimits))
+	r.Use(controllers.ReadYourWrites)
+	if rl := cfg.RateLimiter(middleware.NewMemoryStore()); rl != nil {
+		r.Use(rl.Middleware)
+	}
+	if cfg.RequestTimeout > 0 {
+		r.Use(middleware.Timeout(cfg.RequestTimeout))
+	}
+
+	return r
+}
+
 func must(err error) {
 	if err != nil {
 		panic(err)
@@ -0,0 +1,184 @@
+// Package middleware contains HTTP middlewares which are applied to the router's routes.
+package middleware
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/nlevankov/backend-trainee-assignment/views"
+)
+
+// RateStore keeps the token buckets, the in-process MemoryStore is enough for a single instance,
+// a shared one (e.g. on top of Redis) is needed for several.
+type RateStore interface {
+	// Take takes a token from the bucket of the key, which holds up to burst tokens and is refilled
+	// at rate tokens per second. If there is no token, ok is false and retryAfter is the time until there is one.
+	Take(key string, rate float64, burst int) (ok bool, retryAfter time.Duration, err error)
+}
+
+// Rate is a limit of a token bucket.
+type Rate struct {
+	PerSecond float64 `yaml:"per_second" toml:"per_second"`
+	Burst     int     `yaml:"burst" toml:"burst"`
+}
+
+// RateKey is a part of the bucket's key.
+type RateKey string
+
+const (
+	// RateKeyUser keys the buckets by the user taken from RateLimiter.UserHeader, by IP if there is none.
+	// Anyone can send any header, so it is only meant for the header an authenticating proxy sets,
+	// otherwise a client escapes the limit by changing the user in every request.
+	RateKeyUser RateKey = "user"
+	// RateKeyIP keys the buckets by the client's IP
+	RateKeyIP RateKey = "ip"
+	// RateKeyRoute keys the buckets by the route, so every route has its own bucket
+	RateKeyRoute RateKey = "route"
+)
+
+type RateLimiter struct {
+	Store RateStore
+	// Default applies to the routes without their own rate, zero PerSecond means no limit
+	Default Rate
+	// Routes maps the routes' paths (as they are in the API specification) to their rates
+	Routes map[string]Rate
+	// Keys the buckets are keyed by, e.g. ip and route means every client has a bucket for every route
+	Keys []RateKey
+	// UserHeader is the header identifying the authenticated user, it must be set (and overwritten if the client
+	// sent it) by an authenticating proxy in front of the app, since the app has no authentication. Empty means
+	// the users aren't known, then RateKeyUser keys the buckets by IP.
+	UserHeader string
+	// TrustProxy makes the client's IP be taken from X-Forwarded-For
+	TrustProxy bool
+	// PathTemplate converts the router's path template into the one the Routes are keyed by, may be nil
+	PathTemplate func(string) string
+}
+
+// Middleware responds with 429 Too Many Requests and Retry-After when the bucket of the request is empty.
+// It is meant for mux.Router.Use, since it needs the matched route.
+func (rl *RateLimiter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := rl.routePath(r)
+		rate, ok := rl.Routes[route]
+		if !ok {
+			rate = rl.Default
+		}
+		if rate.PerSecond <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		allowed, retryAfter, err := rl.Store.Take(rl.key(r, route), rate.PerSecond, rate.Burst)
+		if err != nil {
+			// хранилище недоступно - лучше пропустить запрос, чем отказать всем
+			log.Println(err)
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !allowed {
+			secs := int(math.Ceil(retryAfter.Seconds()))
+			if secs < 1 {
+				secs = 1
+			}
+			w.Header().Set("Retry-After", strconv.Itoa(secs))
+			views.Render(w, r, nil, http.StatusTooManyRequests, &rateLimited{retryAfter: secs})
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (rl *RateLimiter) routePath(r *http.Request) string {
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return ""
+	}
+	path, err := route.GetPathTemplate()
+	if err != nil {
+		return ""
+	}
+	if rl.PathTemplate != nil {
+		path = rl.PathTemplate(path)
+	}
+	return path
+}
+
+func (rl *RateLimiter) key(r *http.Request, route string) string {
+	clients := Clients{UserHeader: rl.UserHeader, TrustProxy: rl.TrustProxy}
+
+	parts := make([]string, 0, len(rl.Keys))
+	for _, k := range rl.Keys {
+		switch k {
+		case RateKeyUser:
+			parts = append(parts, clients.ID(r))
+		case RateKeyIP:
+			parts = append(parts, "ip:"+clients.IP(r))
+		case RateKeyRoute:
+			parts = append(parts, "route:"+r.Method+" "+route)
+		}
+	}
+	return strings.Join(parts, "|")
+}
+
+// Clients identifies the clients of the requests, the same way the RateLimiter with the same UserHeader
+// and TrustProxy does.
+type Clients struct {
+	UserHeader string
+	TrustProxy bool
+}
+
+// ID returns the authenticated user of the request (see RateLimiter.UserHeader) or the client's IP if there is none
+func (c Clients) ID(r *http.Request) string {
+	if c.UserHeader != "" {
+		if user := r.Header.Get(c.UserHeader); user != "" {
+			return "user:" + user
+		}
+	}
+	return "ip:" + c.IP(r)
+}
+
+// IP returns the client's IP, it is taken from X-Forwarded-For if TrustProxy
+func (c Clients) IP(r *http.Request) string {
+	if c.TrustProxy {
+		if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+			return strings.TrimSpace(strings.Split(xff, ",")[0])
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// CodeRateLimited is the code of the error the requests are rejected with.
+const CodeRateLimited = "RATE_LIMITED"
+
+type rateLimited struct {
+	retryAfter int
+}
+
+func (e *rateLimited) Error() string {
+	return fmt.Sprintf("Too many requests, retry in %d second(s)", e.retryAfter)
+}
+
+func (e *rateLimited) Public() string {
+	return e.Error()
+}
+
+func (e *rateLimited) Code() string {
+	return CodeRateLimited
+}
+
+func (e *rateLimited) Details() map[string]interface{} {
+	return map[string]interface{}{"retry_after": e.retryAfter}
+}
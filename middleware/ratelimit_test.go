@@ -0,0 +1,103 @@
+package middleware
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestRateLimiterKey(t *testing.T) {
+	cases := []struct {
+		name   string
+		rl     RateLimiter
+		header map[string]string
+		want   string
+	}{
+		{"ip and route", RateLimiter{Keys: []RateKey{RateKeyIP, RateKeyRoute}}, nil, "ip:192.0.2.1|route:GET /r"},
+		{"user", RateLimiter{Keys: []RateKey{RateKeyUser}, UserHeader: "X-User"},
+			map[string]string{"X-User": "7"}, "user:7"},
+		{"no user", RateLimiter{Keys: []RateKey{RateKeyUser}, UserHeader: "X-User"}, nil, "ip:192.0.2.1"},
+		// without the header of an authenticating proxy the user can't be trusted
+		{"no user header", RateLimiter{Keys: []RateKey{RateKeyUser}},
+			map[string]string{"X-User-ID": "7"}, "ip:192.0.2.1"},
+		{"untrusted proxy", RateLimiter{Keys: []RateKey{RateKeyIP}},
+			map[string]string{"X-Forwarded-For": "198.51.100.1"}, "ip:192.0.2.1"},
+		{"trusted proxy", RateLimiter{Keys: []RateKey{RateKeyIP}, TrustProxy: true},
+			map[string]string{"X-Forwarded-For": "198.51.100.1, 192.0.2.1"}, "ip:198.51.100.1"},
+	}
+
+	for _, c := range cases {
+		r := httptest.NewRequest(http.MethodGet, "/r", nil)
+		for k, v := range c.header {
+			r.Header.Set(k, v)
+		}
+		if got := c.rl.key(r, "/r"); got != c.want {
+			t.Errorf("%s: got %q, want %q", c.name, got, c.want)
+		}
+	}
+}
+
+func TestRateLimiterMiddleware(t *testing.T) {
+	store, advance := newTestStore()
+	rl := &RateLimiter{
+		Store:   store,
+		Default: Rate{PerSecond: 0.5, Burst: 2},
+		Routes:  map[string]Rate{"/free": {}},
+		Keys:    []RateKey{RateKeyIP, RateKeyRoute},
+	}
+
+	router := mux.NewRouter()
+	ok := func(w http.ResponseWriter, r *http.Request) {}
+	router.HandleFunc("/limited/{id}", ok)
+	router.HandleFunc("/free", ok)
+	router.Use(rl.Middleware)
+
+	do := func(path, remoteAddr string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		r.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	for i := 0; i < 2; i++ {
+		if w := do("/limited/1", "192.0.2.1:1000"); w.Code != http.StatusOK {
+			t.Fatalf("request %d of the burst: status %d", i+1, w.Code)
+		}
+	}
+
+	// the route's bucket is shared by its paths, the ports of a client don't matter
+	w := do("/limited/2", "192.0.2.1:2000")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "2" {
+		t.Fatalf("got %d with Retry-After %q, want %d with 2", w.Code, w.Header().Get("Retry-After"),
+			http.StatusTooManyRequests)
+	}
+	var body struct {
+		ErrorInfo struct {
+			Code    string
+			Details map[string]interface{}
+		}
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || body.ErrorInfo.Code != CodeRateLimited ||
+		body.ErrorInfo.Details["retry_after"] != float64(2) {
+		t.Errorf("got %s, want %s with retry_after", w.Body, CodeRateLimited)
+	}
+
+	if w := do("/limited/1", "192.0.2.2:1000"); w.Code != http.StatusOK {
+		t.Errorf("another client: status %d", w.Code)
+	}
+	for i := 0; i < 5; i++ {
+		if w := do("/free", "192.0.2.1:1000"); w.Code != http.StatusOK {
+			t.Fatalf("the unlimited route: status %d", w.Code)
+		}
+	}
+
+	advance(2 * time.Second)
+	if w := do("/limited/1", "192.0.2.1:1000"); w.Code != http.StatusOK {
+		t.Errorf("after Retry-After: status %d", w.Code)
+	}
+}
@@ -0,0 +1,81 @@
+package middleware
+
+import (
+	"sync"
+	"time"
+)
+
+var _ RateStore = &MemoryStore{}
+
+// MemoryStore is the in-process RateStore.
+type MemoryStore struct {
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+type bucket struct {
+	tokens float64
+	burst  int
+	rate   float64
+	last   time.Time
+}
+
+// sweepInterval is how often the buckets which have refilled completely are dropped,
+// a full bucket is the same as a missing one
+const sweepInterval = time.Minute
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		buckets: make(map[string]*bucket),
+		now:     time.Now,
+	}
+}
+
+func (s *MemoryStore) Take(key string, rate float64, burst int) (bool, time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	s.sweep(now)
+
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(burst), last: now}
+		s.buckets[key] = b
+	}
+	b.rate, b.burst = rate, burst
+	b.refill(now)
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0, nil
+	}
+
+	retryAfter := time.Duration((1 - b.tokens) / rate * float64(time.Second))
+	return false, retryAfter, nil
+}
+
+func (b *bucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > float64(b.burst) {
+		b.tokens = float64(b.burst)
+	}
+	b.last = now
+}
+
+// it assumes that s.mu is locked
+func (s *MemoryStore) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < sweepInterval {
+		return
+	}
+	s.lastSweep = now
+
+	for key, b := range s.buckets {
+		b.refill(now)
+		if b.tokens >= float64(b.burst) {
+			delete(s.buckets, key)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package middleware
+
+import (
+	"testing"
+	"time"
+)
+
+// newTestStore returns a MemoryStore whose clock is moved by the returned function
+func newTestStore() (*MemoryStore, func(time.Duration)) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	s := NewMemoryStore()
+	s.now = func() time.Time { return now }
+	return s, func(d time.Duration) { now = now.Add(d) }
+}
+
+func TestMemoryStoreBurst(t *testing.T) {
+	s, _ := newTestStore()
+
+	for i := 0; i < 3; i++ {
+		if ok, _, _ := s.Take("k", 1, 3); !ok {
+			t.Fatalf("request %d of the burst is rejected", i+1)
+		}
+	}
+	ok, retryAfter, err := s.Take("k", 1, 3)
+	if ok || err != nil {
+		t.Fatalf("got %v, %v after the burst, want a rejection", ok, err)
+	}
+	if retryAfter != time.Second {
+		t.Errorf("retry after %v, want 1s", retryAfter)
+	}
+
+	if ok, _, _ := s.Take("other", 1, 3); !ok {
+		t.Error("the buckets of the keys aren't separate")
+	}
+}
+
+func TestMemoryStoreRefill(t *testing.T) {
+	s, advance := newTestStore()
+
+	for i := 0; i < 2; i++ {
+		s.Take("k", 4, 2)
+	}
+
+	advance(100 * time.Millisecond) // 0.4 of a token
+	ok, retryAfter, _ := s.Take("k", 4, 2)
+	if ok {
+		t.Fatal("a partial token is taken")
+	}
+	if want := 150 * time.Millisecond; retryAfter < want-time.Millisecond || retryAfter > want+time.Millisecond {
+		t.Errorf("retry after %v, want %v", retryAfter, want)
+	}
+
+	advance(retryAfter + time.Microsecond)
+	if ok, _, _ := s.Take("k", 4, 2); !ok {
+		t.Error("the token isn't refilled in Retry-After")
+	}
+
+	// the bucket doesn't hold more than burst however long it is idle
+	advance(time.Hour)
+	for i := 0; i < 2; i++ {
+		if ok, _, _ := s.Take("k", 4, 2); !ok {
+			t.Fatalf("request %d is rejected after the refill", i+1)
+		}
+	}
+	if ok, _, _ := s.Take("k", 4, 2); ok {
+		t.Error("the bucket is refilled beyond the burst")
+	}
+}
+
+func TestMemoryStoreSweep(t *testing.T) {
+	s, advance := newTestStore()
+
+	s.Take("idle", 10, 1)
+	s.Take("busy", 0.001, 5)
+	advance(sweepInterval)
+	s.Take("new", 10, 1)
+
+	if _, ok := s.buckets["idle"]; ok {
+		t.Error("the refilled bucket isn't swept")
+	}
+	if _, ok := s.buckets["busy"]; !ok {
+		t.Error("the bucket which isn't full is swept")
+	}
+}
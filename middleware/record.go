@@ -0,0 +1,175 @@
+package middleware
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/andybalholm/brotli"
+)
+
+// Trace is a recorded request along with the response to it, a line of a JSONL file the replay command reads.
+// The bodies which aren't valid UTF-8 (e.g. compressed or MessagePack ones) are base64-encoded.
+type Trace struct {
+	Method string            `json:"method"`
+	Path   string            `json:"path"` // along with the query
+	Header map[string]string `json:"header,omitempty"`
+
+	Body         string `json:"body,omitempty"`
+	BodyEncoding string `json:"body_encoding,omitempty"` // "base64" or none
+
+	Status           int    `json:"status"`
+	Response         string `json:"response,omitempty"`
+	ResponseEncoding string `json:"response_encoding,omitempty"` // "base64" or none
+}
+
+const traceBase64 = "base64"
+
+// DecodeBody returns the request's body as it was sent
+func (t *Trace) DecodeBody() ([]byte, error) {
+	return decodeTraceBody(t.Body, t.BodyEncoding)
+}
+
+// DecodeResponse returns the response's body, it's always uncompressed
+func (t *Trace) DecodeResponse() ([]byte, error) {
+	return decodeTraceBody(t.Response, t.ResponseEncoding)
+}
+
+func decodeTraceBody(s, encoding string) ([]byte, error) {
+	if encoding == traceBase64 {
+		return base64.StdEncoding.DecodeString(s)
+	}
+	return []byte(s), nil
+}
+
+func encodeTraceBody(b []byte) (string, string) {
+	if utf8.Valid(b) {
+		return string(b), ""
+	}
+	return base64.StdEncoding.EncodeToString(b), traceBase64
+}
+
+// the headers which don't make it to the traces: the credentials, and Accept-Encoding,
+// since the responses are recorded uncompressed
+var untracedHeaders = map[string]bool{
+	"Authorization":   true,
+	"Cookie":          true,
+	"Accept-Encoding": true,
+}
+
+// Recorder writes the requests and the responses to them as JSONL traces.
+type Recorder struct {
+	// MaxBodySize is the size of the largest body to record, the requests with larger ones
+	// (and the responses larger than that) are passed through without being recorded
+	MaxBodySize int64
+
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func NewRecorder(w io.Writer, maxBodySize int64) *Recorder {
+	return &Recorder{MaxBodySize: maxBodySize, enc: json.NewEncoder(w)}
+}
+
+func (rec *Recorder) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(io.LimitReader(r.Body, rec.MaxBodySize+1))
+		if err != nil || int64(len(body)) > rec.MaxBodySize {
+			// the handler gets the body untouched and reports the error if there is one
+			r.Body = readCloser{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+			next.ServeHTTP(w, r)
+			return
+		}
+		r.Body = readCloser{bytes.NewReader(body), r.Body}
+
+		rw := &recordingWriter{ResponseWriter: w, status: http.StatusOK, limit: rec.MaxBodySize}
+		next.ServeHTTP(rw, r)
+		if rw.truncated {
+			return
+		}
+
+		response, err := decodeContent(rw.Header().Get("Content-Encoding"), rw.body.Bytes())
+		if err != nil {
+			log.Printf("Can't record the response to %s %s: %v", r.Method, r.URL, err)
+			return
+		}
+
+		t := Trace{Method: r.Method, Path: r.URL.RequestURI(), Status: rw.status}
+		t.Body, t.BodyEncoding = encodeTraceBody(body)
+		t.Response, t.ResponseEncoding = encodeTraceBody(response)
+		for name, values := range r.Header {
+			if !untracedHeaders[name] {
+				if t.Header == nil {
+					t.Header = make(map[string]string)
+				}
+				t.Header[name] = strings.Join(values, ", ")
+			}
+		}
+
+		rec.mu.Lock()
+		defer rec.mu.Unlock()
+		if err := rec.enc.Encode(&t); err != nil {
+			log.Printf("Can't record the request %s %s: %v", r.Method, r.URL, err)
+		}
+	})
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// recordingWriter keeps a copy of the response unless it's larger than limit
+type recordingWriter struct {
+	http.ResponseWriter
+	status    int
+	body      bytes.Buffer
+	limit     int64
+	truncated bool
+}
+
+func (w *recordingWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *recordingWriter) Write(b []byte) (int, error) {
+	if !w.truncated {
+		if int64(w.body.Len()+len(b)) > w.limit {
+			w.truncated = true
+			w.body = bytes.Buffer{}
+		} else {
+			w.body.Write(b)
+		}
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// decodeContent uncompresses the response in any of the encodings views compresses them with
+func decodeContent(encoding string, b []byte) ([]byte, error) {
+	var zr io.Reader
+	switch encoding {
+	case "", "identity":
+		return b, nil
+	case "gzip":
+		gr, err := gzip.NewReader(bytes.NewReader(b))
+		if err != nil {
+			return nil, err
+		}
+		defer gr.Close()
+		zr = gr
+	case "br":
+		zr = brotli.NewReader(bytes.NewReader(b))
+	default:
+		return nil, fmt.Errorf("unknown content encoding %q", encoding)
+	}
+	return io.ReadAll(zr)
+}
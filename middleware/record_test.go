@@ -0,0 +1,156 @@
+package middleware
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+)
+
+// compressed returns the body in the encoding
+func compressed(t *testing.T, encoding, body string) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	var zw io.WriteCloser
+	switch encoding {
+	case "gzip":
+		zw = gzip.NewWriter(&buf)
+	case "br":
+		zw = brotli.NewWriter(&buf)
+	default:
+		return []byte(body)
+	}
+	if _, err := io.WriteString(zw, body); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// record serves the request by the handler through the recorder and returns the recorded traces
+func record(t *testing.T, maxBodySize int64, h http.HandlerFunc, r *http.Request) (*httptest.ResponseRecorder, []Trace) {
+	t.Helper()
+
+	var out bytes.Buffer
+	w := httptest.NewRecorder()
+	NewRecorder(&out, maxBodySize).Middleware(h).ServeHTTP(w, r)
+
+	var traces []Trace
+	dec := json.NewDecoder(&out)
+	for dec.More() {
+		var tr Trace
+		if err := dec.Decode(&tr); err != nil {
+			t.Fatal(err)
+		}
+		traces = append(traces, tr)
+	}
+	return w, traces
+}
+
+func TestRecorderDecodesResponses(t *testing.T) {
+	const response = `{"result":"1"}`
+
+	for _, encoding := range []string{"", "identity", "gzip", "br"} {
+		h := func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			if string(body) != `{"username":"alice"}` {
+				t.Errorf("%q: the handler got %q", encoding, body)
+			}
+			if encoding != "" {
+				w.Header().Set("Content-Encoding", encoding)
+			}
+			w.WriteHeader(http.StatusCreated)
+			w.Write(compressed(t, encoding, response))
+		}
+
+		r := httptest.NewRequest(http.MethodPost, "/v1/users?pretty=1", strings.NewReader(`{"username":"alice"}`))
+		r.Header.Set("Content-Type", "application/json")
+		r.Header.Set("Authorization", "Bearer secret")
+		r.Header.Set("Accept-Encoding", encoding)
+
+		w, traces := record(t, 1<<10, h, r)
+		if !bytes.Equal(w.Body.Bytes(), compressed(t, encoding, response)) {
+			t.Errorf("%q: the client got %q", encoding, w.Body)
+		}
+		if len(traces) != 1 {
+			t.Fatalf("%q: got %d traces", encoding, len(traces))
+		}
+
+		tr := traces[0]
+		got, err := tr.DecodeResponse()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tr.Method != http.MethodPost || tr.Path != "/v1/users?pretty=1" || tr.Status != http.StatusCreated ||
+			tr.Body != `{"username":"alice"}` || string(got) != response {
+			t.Errorf("%q: got %+v", encoding, tr)
+		}
+		if len(tr.Header) != 1 || tr.Header["Content-Type"] != "application/json" {
+			t.Errorf("%q: got the headers %v", encoding, tr.Header)
+		}
+	}
+}
+
+func TestRecorderBinaryBodies(t *testing.T) {
+	body := []byte{0x81, 0xa1, 'x', 0xff}
+	h := func(w http.ResponseWriter, r *http.Request) {
+		w.Write(body)
+	}
+
+	_, traces := record(t, 1<<10, h, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body)))
+	if len(traces) != 1 {
+		t.Fatalf("got %d traces", len(traces))
+	}
+	tr := traces[0]
+	if tr.BodyEncoding != traceBase64 || tr.ResponseEncoding != traceBase64 {
+		t.Errorf("got the encodings %q and %q", tr.BodyEncoding, tr.ResponseEncoding)
+	}
+	gotBody, _ := tr.DecodeBody()
+	gotResponse, _ := tr.DecodeResponse()
+	if !bytes.Equal(gotBody, body) || !bytes.Equal(gotResponse, body) {
+		t.Errorf("got %q and %q", gotBody, gotResponse)
+	}
+}
+
+func TestRecorderSkips(t *testing.T) {
+	cases := []struct {
+		name     string
+		body     string
+		response string
+		encoding string
+	}{
+		{"large body", strings.Repeat("x", 11), "ok", ""},
+		{"large response", "ok", strings.Repeat("x", 11), ""},
+		{"unknown encoding", "ok", "ok", "zstd"},
+	}
+
+	for _, c := range cases {
+		h := func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			if string(body) != c.body {
+				t.Errorf("%s: the handler got %q", c.name, body)
+			}
+			if c.encoding != "" {
+				w.Header().Set("Content-Encoding", c.encoding)
+			}
+			w.Write([]byte(c.response))
+		}
+
+		w, traces := record(t, 10, h, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(c.body)))
+		if w.Body.String() != c.response {
+			t.Errorf("%s: the client got %q", c.name, w.Body)
+		}
+		if len(traces) != 0 {
+			t.Errorf("%s: got the traces %+v", c.name, traces)
+		}
+	}
+}
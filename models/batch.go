@@ -0,0 +1,164 @@
+package models
+
+import (
+	"fmt"
+	"github.com/jinzhu/gorm"
+	"net/http"
+)
+
+// MaxBatchSize is the maximum number of items in a batch
+const MaxBatchSize = 1000
+
+// BatchItem is the outcome of creating one item of a batch, it is in the same order as the items
+type BatchItem struct {
+	ID         uint
+	StatusCode int
+	Err        error
+}
+
+// MessageHistoryItem is the outcome of looking one chat's messages up, it is in the same order as the chats
+type MessageHistoryItem struct {
+	History    *MessageHistory
+	StatusCode int
+	Err        error
+}
+
+var ErrBatchIsTooLarge modelError = modelError(fmt.Sprintf("The batch can't contain more than %d items", MaxBatchSize))
+
+const (
+	ErrBatchIsEmpty    modelError = "The batch can't be empty"
+	ErrBatchItemIsNull modelError = "The batch can't contain null(s)"
+
+	ErrBatchFailed         modelError = "Some items of the batch failed, none of them is created"
+	ErrBatchItemRolledBack modelError = "The item isn't created because other items of the batch failed"
+)
+
+func init() {
+	describeErrors(map[modelError]errorDescriptor{
+		ErrBatchIsEmpty:    {code: "BATCH_EMPTY"},
+		ErrBatchIsTooLarge: {code: "BATCH_TOO_LARGE", details: map[string]interface{}{"max": MaxBatchSize}},
+		ErrBatchItemIsNull: {code: "BATCH_ITEM_NULL"},
+
+		ErrBatchFailed:         {code: "BATCH_FAILED"},
+		ErrBatchItemRolledBack: {code: "BATCH_ITEM_ROLLED_BACK"},
+	})
+}
+
+// MessageLookup is the body of the lookup of several chats' messages
+type MessageLookup struct {
+	Chats []*stringID `json:"chats"`
+	Limit *uint       `json:"limit"`
+}
+
+// ChatIDs checks the size of the lookup and returns the ids of the chats
+func (ml *MessageLookup) ChatIDs() ([]*uint, int, error) {
+	if len(ml.Chats) == 0 {
+		return nil, http.StatusBadRequest, ErrBatchIsEmpty
+	}
+	if len(ml.Chats) > MaxBatchSize {
+		return nil, http.StatusBadRequest, ErrBatchIsTooLarge
+	}
+
+	ids := make([]*uint, len(ml.Chats))
+	for i, id := range ml.Chats {
+		if id == nil {
+			return nil, http.StatusBadRequest, ErrBatchItemIsNull
+		}
+		v := uint(*id)
+		ids[i] = &v
+	}
+	return ids, http.StatusOK, nil
+}
+
+// validateBatch validates n items with validate, it returns the outcomes of the invalid items and
+// the indexes of the valid ones. In the atomic mode the batch fails if any item is invalid.
+func validateBatch(n int, atomic bool, validate func(i int) (int, error)) ([]BatchItem, []int, int, error) {
+	if n == 0 {
+		return nil, nil, http.StatusBadRequest, ErrBatchIsEmpty
+	}
+	if n > MaxBatchSize {
+		return nil, nil, http.StatusBadRequest, ErrBatchIsTooLarge
+	}
+
+	items := make([]BatchItem, n)
+	valid := make([]int, 0, n)
+	for i := range items {
+		statusCode, err := validate(i)
+		if err != nil {
+			items[i] = BatchItem{StatusCode: statusCode, Err: err}
+			continue
+		}
+		valid = append(valid, i)
+	}
+
+	if atomic && len(valid) < n {
+		rollBack(items, valid)
+		return items, nil, http.StatusUnprocessableEntity, ErrBatchFailed
+	}
+
+	return items, valid, http.StatusOK, nil
+}
+
+// mergeBatch puts the outcomes of the valid items back in their places
+func mergeBatch(items []BatchItem, valid []int, created []BatchItem) {
+	for j, i := range valid {
+		if j < len(created) {
+			items[i] = created[j]
+		}
+	}
+}
+
+// createBatch creates the items one by one with create, in one transaction in the atomic mode.
+// If an item fails with an internal error, the storage fails or the request is canceled in the atomic mode,
+// the error is returned as is.
+func createBatch(db *gorm.DB, n int, atomic bool, create func(db *gorm.DB, i int) (uint, int, error)) ([]BatchItem, int, error) {
+	items := make([]BatchItem, n)
+
+	if !atomic {
+		for i := range items {
+			id, statusCode, err := create(db, i)
+			items[i] = BatchItem{ID: id, StatusCode: statusCode, Err: err}
+		}
+		return items, http.StatusOK, nil
+	}
+
+	tx := db.Begin()
+	if tx.Error != nil {
+		statusCode, err := storageFailure(contextOf(db), tx.Error)
+		return nil, statusCode, err
+	}
+
+	for i := range items {
+		id, statusCode, err := create(tx, i)
+		if err != nil {
+			tx.Rollback()
+			if statusCode >= http.StatusInternalServerError || statusCode == StatusClientClosedRequest {
+				return nil, statusCode, err
+			}
+
+			others := make([]int, 0, n-1)
+			for j := range items {
+				if j != i {
+					others = append(others, j)
+				}
+			}
+			items[i] = BatchItem{StatusCode: statusCode, Err: err}
+			rollBack(items, others)
+			return items, http.StatusUnprocessableEntity, ErrBatchFailed
+		}
+		items[i] = BatchItem{ID: id, StatusCode: statusCode}
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		statusCode, err := storageFailure(contextOf(db), err)
+		return nil, statusCode, err
+	}
+
+	return items, http.StatusOK, nil
+}
+
+func rollBack(items []BatchItem, idx []int) {
+	for _, i := range idx {
+		items[i] = BatchItem{StatusCode: http.StatusFailedDependency, Err: ErrBatchItemRolledBack}
+	}
+}
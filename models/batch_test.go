@@ -0,0 +1,76 @@
+package models
+
+import (
+	"net/http"
+	"testing"
+)
+
+// validateEven fails the odd items
+func validateEven(i int) (int, error) {
+	if i%2 == 1 {
+		return http.StatusBadRequest, ErrMessageTextIsEmpty
+	}
+	return http.StatusOK, nil
+}
+
+func TestValidateBatchAtomic(t *testing.T) {
+	items, valid, statusCode, err := validateBatch(3, true, validateEven)
+	if statusCode != http.StatusUnprocessableEntity || err != ErrBatchFailed || valid != nil {
+		t.Fatalf("got %d, %v, valid %v", statusCode, err, valid)
+	}
+
+	want := []BatchItem{
+		{StatusCode: http.StatusFailedDependency, Err: ErrBatchItemRolledBack},
+		{StatusCode: http.StatusBadRequest, Err: ErrMessageTextIsEmpty},
+		{StatusCode: http.StatusFailedDependency, Err: ErrBatchItemRolledBack},
+	}
+	for i := range want {
+		if items[i] != want[i] {
+			t.Errorf("item %d: got %+v, want %+v", i, items[i], want[i])
+		}
+	}
+
+	if _, valid, statusCode, err = validateBatch(2, true, func(int) (int, error) { return http.StatusOK, nil }); err != nil ||
+		statusCode != http.StatusOK || len(valid) != 2 {
+		t.Errorf("valid batch: got %d, %v, valid %v", statusCode, err, valid)
+	}
+}
+
+func TestValidateBatchPartial(t *testing.T) {
+	items, valid, statusCode, err := validateBatch(3, false, validateEven)
+	if statusCode != http.StatusOK || err != nil {
+		t.Fatalf("got %d, %v", statusCode, err)
+	}
+	if len(valid) != 2 || valid[0] != 0 || valid[1] != 2 {
+		t.Fatalf("valid %v, want [0 2]", valid)
+	}
+
+	mergeBatch(items, valid, []BatchItem{{ID: 10, StatusCode: http.StatusOK}, {ID: 11, StatusCode: http.StatusOK}})
+	want := []BatchItem{
+		{ID: 10, StatusCode: http.StatusOK},
+		{StatusCode: http.StatusBadRequest, Err: ErrMessageTextIsEmpty},
+		{ID: 11, StatusCode: http.StatusOK},
+	}
+	for i := range want {
+		if items[i] != want[i] {
+			t.Errorf("item %d: got %+v, want %+v", i, items[i], want[i])
+		}
+	}
+}
+
+func TestValidateBatchSize(t *testing.T) {
+	for _, c := range []struct {
+		n   int
+		err error
+	}{
+		{0, ErrBatchIsEmpty},
+		{MaxBatchSize + 1, ErrBatchIsTooLarge},
+	} {
+		for _, atomic := range []bool{true, false} {
+			items, _, statusCode, err := validateBatch(c.n, atomic, validateEven)
+			if statusCode != http.StatusBadRequest || err != c.err || items != nil {
+				t.Errorf("%d items, atomic %v: got %d, %v", c.n, atomic, statusCode, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,434 @@
+package models
+
+import (
+	"container/list"
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Кэш внутри процесса (WithCache) хранит то, что читается на каждый запрос, а меняется редко:
+// членство пользователей в чатах (с ним /messages/add обходится без трех запросов), существующие чаты (с ними
+// проверка нового автора не ищет чат) и списки чатов пользователей. Членство и чаты только добавляются, так что
+// они не устаревают; списки чатов сбрасываются при создании чата (у его участников) и при новом сообщении
+// (у всех, чей список содержит этот чат), а место в кэше занимают по числу загруженных строк. Изменения,
+// сделанные другими экземплярами приложения, видны через TTL. Граница архива (archived_before) не кэшируется: ее меняет
+// команда archive в другом процессе, и она читается вместе с сообщениями.
+
+// CacheStats are the counters of one of the caches, see Services.CacheStats
+type CacheStats struct {
+	Size     int     `json:"size"`
+	Hits     uint64  `json:"hits"`
+	Misses   uint64  `json:"misses"`
+	HitRatio float64 `json:"hit_ratio"`
+}
+
+// lruCache keeps the entries of up to size total cost for ttl each, evicting the least recently used ones
+type lruCache[K comparable, V any] struct {
+	mu    sync.Mutex
+	size  int
+	ttl   time.Duration
+	order *list.List // of *lruEntry, the most recently used first
+	items map[K]*list.Element
+	used  int // the total cost of the entries
+
+	// cost returns the cost of the value, every entry costs 1 if it's nil. The value which costs more than size
+	// isn't cached.
+	cost func(value V) int
+
+	// onEvict is called with mu locked for every entry which leaves the cache
+	onEvict func(key K, value V)
+
+	hits, misses atomic.Uint64
+}
+
+type lruEntry[K comparable, V any] struct {
+	key     K
+	value   V
+	cost    int
+	expires time.Time
+}
+
+func newLRUCache[K comparable, V any](size int, ttl time.Duration) *lruCache[K, V] {
+	return &lruCache[K, V]{
+		size:  size,
+		ttl:   ttl,
+		order: list.New(),
+		items: make(map[K]*list.Element),
+	}
+}
+
+func (c *lruCache[K, V]) get(key K) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[key]; ok {
+		e := el.Value.(*lruEntry[K, V])
+		if time.Now().Before(e.expires) {
+			c.order.MoveToFront(el)
+			c.hits.Add(1)
+			return e.value, true
+		}
+		c.removeElement(el)
+	}
+
+	c.misses.Add(1)
+	var zero V
+	return zero, false
+}
+
+func (c *lruCache[K, V]) add(key K, value V) {
+	c.addIf(key, value, nil)
+}
+
+// addIf adds the entry unless ok returns false, ok is called with mu locked
+func (c *lruCache[K, V]) addIf(key K, value V, ok func() bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, exists := c.items[key]; exists {
+		c.removeElement(el)
+	}
+	cost := 1
+	if c.cost != nil {
+		cost = c.cost(value)
+	}
+	if cost > c.size || ok != nil && !ok() {
+		return
+	}
+
+	c.items[key] = c.order.PushFront(&lruEntry[K, V]{key: key, value: value, cost: cost, expires: time.Now().Add(c.ttl)})
+	c.used += cost
+
+	for c.used > c.size {
+		c.removeElement(c.order.Back())
+	}
+}
+
+func (c *lruCache[K, V]) remove(key K) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[key]; ok {
+		c.removeElement(el)
+	}
+}
+
+func (c *lruCache[K, V]) purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for c.order.Len() > 0 {
+		c.removeElement(c.order.Back())
+	}
+}
+
+// it assumes that c.mu is locked
+func (c *lruCache[K, V]) removeElement(el *list.Element) {
+	e := c.order.Remove(el).(*lruEntry[K, V])
+	delete(c.items, e.key)
+	c.used -= e.cost
+	if c.onEvict != nil {
+		c.onEvict(e.key, e.value)
+	}
+}
+
+func (c *lruCache[K, V]) stats() CacheStats {
+	c.mu.Lock()
+	size := c.order.Len()
+	c.mu.Unlock()
+
+	s := CacheStats{Size: size, Hits: c.hits.Load(), Misses: c.misses.Load()}
+	if s.Hits+s.Misses > 0 {
+		s.HitRatio = float64(s.Hits) / float64(s.Hits+s.Misses)
+	}
+	return s
+}
+
+type membership struct {
+	chatID, userID uint
+}
+
+// storageCache is shared by the chats' and the messages' services, so the changes made through one of them
+// invalidate what the other has cached
+type storageCache struct {
+	members *lruCache[membership, struct{}]
+	// the chats known to exist, the membership check of a new author doesn't look its chat up then
+	chats *lruCache[uint, struct{}]
+	// the users' chats, see ChatDB.ByUserID, a list costs as many rows as it has loaded, see listCost
+	lists *lruCache[uint, []*Chat]
+
+	// listed maps the chats to the users whose cached lists have them. epoch is incremented by every invalidation
+	// of the lists, the list read before it isn't cached. Both are guarded by mu, which is locked inside lists.mu.
+	mu     sync.Mutex
+	listed map[uint]map[uint]struct{}
+	epoch  uint64
+}
+
+func newStorageCache(size int, ttl time.Duration) *storageCache {
+	c := &storageCache{
+		members: newLRUCache[membership, struct{}](size, ttl),
+		chats:   newLRUCache[uint, struct{}](size, ttl),
+		lists:   newLRUCache[uint, []*Chat](size, ttl),
+		listed:  make(map[uint]map[uint]struct{}),
+	}
+	c.lists.cost = listCost
+	c.lists.onEvict = c.unlist
+	return c
+}
+
+// listCost is the number of the rows the list is loaded from: the chats with their users and messages,
+// so the lists of the chats with long histories take their share of the cache
+func listCost(chats []*Chat) int {
+	cost := 1
+	for _, chat := range chats {
+		cost += 1 + len(chat.Users) + len(chat.Messages)
+	}
+	return cost
+}
+
+func (c *storageCache) listsEpoch() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.epoch
+}
+
+// addList caches the user's chats unless the lists were invalidated since epoch, when they were read,
+// the chats exist anyway
+func (c *storageCache) addList(userID uint, chats []*Chat, epoch uint64) {
+	for _, chat := range chats {
+		c.chats.add(*chat.ID, struct{}{})
+	}
+
+	c.lists.addIf(userID, chats, func() bool {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		if c.epoch != epoch {
+			return false
+		}
+		for _, chat := range chats {
+			if c.listed[*chat.ID] == nil {
+				c.listed[*chat.ID] = make(map[uint]struct{})
+			}
+			c.listed[*chat.ID][userID] = struct{}{}
+		}
+		return true
+	})
+}
+
+// unlist is the lists' onEvict
+func (c *storageCache) unlist(userID uint, chats []*Chat) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, chat := range chats {
+		delete(c.listed[*chat.ID], userID)
+		if len(c.listed[*chat.ID]) == 0 {
+			delete(c.listed, *chat.ID)
+		}
+	}
+}
+
+// chatChanged invalidates the lists of the users who have the chat in them
+func (c *storageCache) chatChanged(chatID uint) {
+	c.mu.Lock()
+	c.epoch++
+	users := c.listed[chatID]
+	delete(c.listed, chatID)
+	c.mu.Unlock()
+
+	for userID := range users {
+		c.lists.remove(userID)
+	}
+}
+
+// chatCreated caches the new chat's members and invalidates their lists
+func (c *storageCache) chatCreated(chatID uint, userIDs []uint) {
+	c.mu.Lock()
+	c.epoch++
+	c.mu.Unlock()
+
+	c.chats.add(chatID, struct{}{})
+	for _, userID := range userIDs {
+		c.members.add(membership{chatID: chatID, userID: userID}, struct{}{})
+		c.lists.remove(userID)
+	}
+}
+
+// historyArchived invalidates everything the archival of the messages changes
+func (c *storageCache) historyArchived() {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	c.epoch++
+	c.mu.Unlock()
+
+	c.lists.purge()
+}
+
+func (c *storageCache) isMember(chatID, userID uint) bool {
+	_, ok := c.members.get(membership{chatID: chatID, userID: userID})
+	return ok
+}
+
+func (c *storageCache) chatExists(chatID uint) bool {
+	_, ok := c.chats.get(chatID)
+	return ok
+}
+
+func (c *storageCache) stats() map[string]CacheStats {
+	if c == nil {
+		return nil
+	}
+	return map[string]CacheStats{
+		"members": c.members.stats(),
+		"chats":   c.chats.stats(),
+		"lists":   c.lists.stats(),
+	}
+}
+
+type knownMemberKey struct{}
+
+// withKnownMember makes createMessage skip the lookups of the chat, the author and the membership
+// if isMember reports the author is in the chat
+func withKnownMember(ctx context.Context, isMember func(chatID, userID uint) bool) context.Context {
+	return context.WithValue(ctx, knownMemberKey{}, isMember)
+}
+
+func knownMember(ctx context.Context) func(chatID, userID uint) bool {
+	isMember, _ := ctx.Value(knownMemberKey{}).(func(chatID, userID uint) bool)
+	return isMember
+}
+
+type knownChatKey struct{}
+
+// withKnownChat makes checkMembership skip the lookup of the chat if exists reports it exists
+func withKnownChat(ctx context.Context, exists func(chatID uint) bool) context.Context {
+	return context.WithValue(ctx, knownChatKey{}, exists)
+}
+
+func knownChat(ctx context.Context) func(chatID uint) bool {
+	exists, _ := ctx.Value(knownChatKey{}).(func(chatID uint) bool)
+	return exists
+}
+
+var _ ChatDB = &chatCache{}
+
+// chatCache serves the users' chats from storageCache
+type chatCache struct {
+	ChatDB
+	cache *storageCache
+}
+
+func newChatCache(cdb ChatDB, cache *storageCache) *chatCache {
+	return &chatCache{
+		ChatDB: cdb,
+		cache:  cache,
+	}
+}
+
+func (cc *chatCache) Create(ctx context.Context, cqp *ChatQueryParams) (uint, int, error) {
+	id, statusCode, err := cc.ChatDB.Create(ctx, cqp)
+	if err == nil {
+		userIDs := make([]uint, len(cqp.UserIDs))
+		for i, userID := range cqp.UserIDs {
+			userIDs[i] = uint(*userID)
+		}
+		cc.cache.chatCreated(id, userIDs)
+	}
+	return id, statusCode, err
+}
+
+// ByUserID reads the storage if ctx is marked with ReadPrimary, the result is cached anyway. The lists are read
+// from the primary: a replica may not have replayed the writes which invalidated them yet, and a list it served
+// would outlive them for the whole TTL.
+func (cc *chatCache) ByUserID(ctx context.Context, userID *uint) ([]*Chat, int, error) {
+	if !readsPrimary(ctx) {
+		if chats, ok := cc.cache.lists.get(*userID); ok {
+			// the callers may reorder the slice, but not the chats
+			return append([]*Chat(nil), chats...), http.StatusOK, nil
+		}
+	}
+
+	epoch := cc.cache.listsEpoch()
+	chats, statusCode, err := cc.ChatDB.ByUserID(ReadPrimary(ctx), userID)
+	if err == nil {
+		cc.cache.addList(*userID, append([]*Chat(nil), chats...), epoch)
+	}
+	return chats, statusCode, err
+}
+
+var _ MessageDB = &messageCache{}
+
+// messageCache checks the authors' membership with storageCache
+type messageCache struct {
+	MessageDB
+	cache *storageCache
+}
+
+func newMessageCache(mdb MessageDB, cache *storageCache) *messageCache {
+	return &messageCache{
+		MessageDB: mdb,
+		cache:     cache,
+	}
+}
+
+// known passes what the cache knows to the membership checks
+func (mc *messageCache) known(ctx context.Context) context.Context {
+	return withKnownChat(withKnownMember(ctx, mc.cache.isMember), mc.cache.chatExists)
+}
+
+func (mc *messageCache) Create(ctx context.Context, msg *Message) (uint, int, error) {
+	id, statusCode, err := mc.MessageDB.Create(mc.known(ctx), msg)
+	if err == nil {
+		mc.messageCreated(msg)
+	} else {
+		mc.checked(*msg.ChatID, err)
+	}
+	return id, statusCode, err
+}
+
+func (mc *messageCache) CreateBatch(ctx context.Context, msgs []*Message, atomic bool) ([]BatchItem, int, error) {
+	items, statusCode, err := mc.MessageDB.CreateBatch(mc.known(ctx), msgs, atomic)
+	for i, item := range items {
+		if item.Err == nil {
+			mc.messageCreated(msgs[i])
+		} else if msgs[i] != nil && msgs[i].ChatID != nil {
+			mc.checked(*msgs[i].ChatID, item.Err)
+		}
+	}
+	return items, statusCode, err
+}
+
+func (mc *messageCache) messageCreated(msg *Message) {
+	mc.cache.chats.add(*msg.ChatID, struct{}{})
+	mc.cache.members.add(membership{chatID: *msg.ChatID, userID: *msg.UserID}, struct{}{})
+	mc.cache.chatChanged(*msg.ChatID)
+}
+
+// checked caches the chat if the membership check has failed after finding it
+func (mc *messageCache) checked(chatID uint, err error) {
+	if err == ErrMessageUserDoesntExist || err == ErrMessageUserIsNotInChat {
+		mc.cache.chats.add(chatID, struct{}{})
+	}
+}
+
+func (mc *messageCache) CheckMember(ctx context.Context, chatid *uint, userid *uint) (int, error) {
+	if mc.cache.isMember(*chatid, *userid) {
+		return http.StatusOK, nil
+	}
+
+	statusCode, err := mc.MessageDB.CheckMember(mc.known(ctx), chatid, userid)
+	if err == nil {
+		mc.cache.chats.add(*chatid, struct{}{})
+		mc.cache.members.add(membership{chatID: *chatid, userID: *userid}, struct{}{})
+	} else {
+		mc.checked(*chatid, err)
+	}
+	return statusCode, err
+}
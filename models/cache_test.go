@@ -0,0 +1,281 @@
+package models
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestLRUCacheEviction(t *testing.T) {
+	c := newLRUCache[int, string](2, time.Minute)
+	var evicted []int
+	c.onEvict = func(key int, value string) { evicted = append(evicted, key) }
+
+	c.add(1, "a")
+	c.add(2, "b")
+	// 1 becomes the most recently used, so 2 is evicted by 3
+	if v, ok := c.get(1); !ok || v != "a" {
+		t.Fatalf("got %q %v", v, ok)
+	}
+	c.add(3, "c")
+
+	if _, ok := c.get(2); ok {
+		t.Error("the least recently used entry isn't evicted")
+	}
+	for _, key := range []int{1, 3} {
+		if _, ok := c.get(key); !ok {
+			t.Errorf("%d is evicted", key)
+		}
+	}
+	if len(evicted) != 1 || evicted[0] != 2 {
+		t.Errorf("onEvict got %v", evicted)
+	}
+
+	if s := c.stats(); s.Size != 2 || s.Hits != 3 || s.Misses != 1 || s.HitRatio != 0.75 {
+		t.Errorf("got %+v", s)
+	}
+}
+
+func TestLRUCacheTTL(t *testing.T) {
+	c := newLRUCache[int, string](2, 50*time.Millisecond)
+	var evicted []int
+	c.onEvict = func(key int, value string) { evicted = append(evicted, key) }
+
+	c.add(1, "a")
+	if _, ok := c.get(1); !ok {
+		t.Fatal("the entry isn't cached")
+	}
+	time.Sleep(60 * time.Millisecond)
+	if _, ok := c.get(1); ok {
+		t.Error("the expired entry is served")
+	}
+	if s := c.stats(); s.Size != 0 || len(evicted) != 1 {
+		t.Errorf("the expired entry is kept: %+v, evicted %v", s, evicted)
+	}
+
+	// the replaced entry gets the full TTL again
+	c.add(2, "b")
+	time.Sleep(30 * time.Millisecond)
+	c.add(2, "b")
+	time.Sleep(30 * time.Millisecond)
+	if _, ok := c.get(2); !ok {
+		t.Error("the replaced entry expires with the old TTL")
+	}
+}
+
+func TestLRUCacheCost(t *testing.T) {
+	c := newLRUCache[int, string](5, time.Minute)
+	c.cost = func(value string) int { return len(value) }
+
+	c.add(1, "aa")
+	c.add(2, "bbb")
+	c.add(3, "cc")
+	// 1 is evicted for 3 to fit
+	if _, ok := c.get(1); ok {
+		t.Error("the cache exceeds its size")
+	}
+	if c.used != 5 {
+		t.Errorf("the cost is %d, want 5", c.used)
+	}
+
+	// the value which costs more than the whole cache isn't cached and evicts nothing
+	c.add(4, "dddddd")
+	if _, ok := c.get(4); ok {
+		t.Error("the too costly value is cached")
+	}
+	if s := c.stats(); s.Size != 2 || c.used != 5 {
+		t.Errorf("got %+v, the cost is %d", s, c.used)
+	}
+
+	c.remove(2)
+	if c.used != 2 {
+		t.Errorf("the cost of the removed value is kept: %d", c.used)
+	}
+}
+
+func testChats(ids ...uint) []*Chat {
+	chats := make([]*Chat, len(ids))
+	for i := range ids {
+		chats[i] = &Chat{ID: &ids[i]}
+	}
+	return chats
+}
+
+func TestStorageCacheLists(t *testing.T) {
+	c := newStorageCache(10, time.Minute)
+
+	// the lists read before an invalidation aren't cached
+	epoch := c.listsEpoch()
+	c.chatChanged(42)
+	c.addList(1, testChats(1, 2), epoch)
+	if _, ok := c.lists.get(1); ok {
+		t.Error("the list read before the invalidation is cached")
+	}
+
+	c.addList(1, testChats(1, 2), c.listsEpoch())
+	c.addList(2, testChats(2, 3), c.listsEpoch())
+	c.addList(3, testChats(3), c.listsEpoch())
+
+	// a new message in the chat 2 invalidates the lists which have it
+	c.chatChanged(2)
+	for userID, want := range map[uint]bool{1: false, 2: false, 3: true} {
+		if _, ok := c.lists.get(userID); ok != want {
+			t.Errorf("the list of %d: cached is %v, want %v", userID, ok, want)
+		}
+	}
+	if len(c.listed) != 1 || len(c.listed[3]) != 1 {
+		t.Errorf("the invalidated lists are still listed: %v", c.listed)
+	}
+
+	// a new chat invalidates its members' lists and makes them its members
+	c.addList(1, testChats(1), c.listsEpoch())
+	c.chatCreated(4, []uint{1, 2})
+	if _, ok := c.lists.get(1); ok {
+		t.Error("the list of the new chat's member isn't invalidated")
+	}
+	if !c.isMember(4, 1) || !c.isMember(4, 2) || c.isMember(4, 3) {
+		t.Error("the new chat's members aren't cached")
+	}
+
+	c.historyArchived()
+	if s := c.lists.stats(); s.Size != 0 || len(c.listed) != 0 {
+		t.Errorf("the lists aren't purged: %+v, listed %v", s, c.listed)
+	}
+
+	for _, chatID := range []uint{1, 2, 3, 4} {
+		if !c.chatExists(chatID) {
+			t.Errorf("the listed or created chat %d isn't known", chatID)
+		}
+	}
+	if c.chatExists(42) {
+		t.Error("the chat which is only changed is known")
+	}
+
+	var none *storageCache
+	none.historyArchived()
+	if none.stats() != nil {
+		t.Error("nil storageCache has stats")
+	}
+}
+
+func TestStorageCacheUnlistsEvicted(t *testing.T) {
+	// a list of one chat costs 2
+	c := newStorageCache(2, time.Minute)
+	c.addList(1, testChats(1), c.listsEpoch())
+	c.addList(2, testChats(2), c.listsEpoch())
+
+	if len(c.listed) != 1 || len(c.listed[2]) != 1 {
+		t.Errorf("the evicted list is still listed: %v", c.listed)
+	}
+}
+
+func TestStorageCacheListCost(t *testing.T) {
+	c := newStorageCache(10, time.Minute)
+
+	// the messages and the users count
+	chats := testChats(1, 2)
+	chats[0].Users = []*User{{}, {}}
+	chats[1].Messages = make([]*Message, 3)
+	if cost := listCost(chats); cost != 8 {
+		t.Errorf("got %d, want 8", cost)
+	}
+	c.addList(1, chats, c.listsEpoch())
+	if _, ok := c.lists.get(1); !ok {
+		t.Error("the list isn't cached")
+	}
+
+	// the list which doesn't fit isn't cached and isn't listed
+	chats = testChats(3)
+	chats[0].Messages = make([]*Message, 10)
+	c.addList(2, chats, c.listsEpoch())
+	if _, ok := c.lists.get(2); ok {
+		t.Error("the too large list is cached")
+	}
+	if _, ok := c.listed[3]; ok {
+		t.Error("the chat of the too large list is listed")
+	}
+}
+
+// fakeMessageDB fails the membership checks with err
+type fakeMessageDB struct {
+	MessageDB
+	err      error
+	knewChat bool
+}
+
+func (f *fakeMessageDB) CheckMember(ctx context.Context, chatid *uint, userid *uint) (int, error) {
+	f.knewChat = knownChat(ctx)(*chatid)
+	return http.StatusNotFound, f.err
+}
+
+func TestMessageCacheKnowsChats(t *testing.T) {
+	cache := newStorageCache(10, time.Minute)
+	mdb := &fakeMessageDB{}
+	mc := newMessageCache(mdb, cache)
+	ctx := context.Background()
+	chatID, userID := uint(1), uint(2)
+
+	// the chat isn't found, it's not known then
+	mdb.err = ErrMessageChatDoesntExist
+	mc.CheckMember(ctx, &chatID, &userID)
+	if mdb.knewChat || cache.chatExists(chatID) {
+		t.Error("the missing chat is known")
+	}
+
+	// the author isn't, but the chat is found before it
+	mdb.err = ErrMessageUserDoesntExist
+	mc.CheckMember(ctx, &chatID, &userID)
+	mc.CheckMember(ctx, &chatID, &userID)
+	if !mdb.knewChat {
+		t.Error("the found chat isn't passed to the check")
+	}
+}
+
+// fakeChatDB serves the lists of chats and records how it's read
+type fakeChatDB struct {
+	ChatDB
+	chats       []*Chat
+	reads       int
+	readPrimary bool
+}
+
+func (f *fakeChatDB) ByUserID(ctx context.Context, userID *uint) ([]*Chat, int, error) {
+	f.reads++
+	f.readPrimary = readsPrimary(ctx)
+	return f.chats, http.StatusOK, nil
+}
+
+func TestChatCacheByUserID(t *testing.T) {
+	cdb := &fakeChatDB{chats: testChats(1, 2)}
+	cc := newChatCache(cdb, newStorageCache(10, time.Minute))
+	userID := uint(1)
+	ctx := context.Background()
+
+	if _, _, err := cc.ByUserID(ctx, &userID); err != nil {
+		t.Fatal(err)
+	}
+	// the list which is cached isn't read from a replica
+	if cdb.reads != 1 || !cdb.readPrimary {
+		t.Errorf("the miss: %d reads, from the primary is %v", cdb.reads, cdb.readPrimary)
+	}
+
+	chats, _, _ := cc.ByUserID(ctx, &userID)
+	if cdb.reads != 1 || len(chats) != 2 {
+		t.Errorf("the hit: %d reads, %d chats", cdb.reads, len(chats))
+	}
+	// the callers may reorder the list they get
+	chats[0], chats[1] = chats[1], chats[0]
+	if chats, _, _ := cc.ByUserID(ctx, &userID); *chats[0].ID != 1 {
+		t.Error("the cached list is reordered")
+	}
+
+	// X-Read-Primary bypasses the cache and refreshes it
+	cdb.chats = testChats(1, 2, 3)
+	if chats, _, _ := cc.ByUserID(ReadPrimary(ctx), &userID); cdb.reads != 2 || len(chats) != 3 {
+		t.Errorf("ReadPrimary: %d reads, %d chats", cdb.reads, len(chats))
+	}
+	if chats, _, _ := cc.ByUserID(ctx, &userID); cdb.reads != 2 || len(chats) != 3 {
+		t.Errorf("after ReadPrimary: %d reads, %d chats", cdb.reads, len(chats))
+	}
+}
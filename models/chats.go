@@ -1,7 +1,11 @@
 package models
 
 import (
+	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/jinzhu/gorm"
 	_ "github.com/jinzhu/gorm/dialects/postgres"
 	_ "github.com/lib/pq"
@@ -16,6 +20,14 @@ type Chat struct {
 	Users     []*User `gorm:"many2many:chats_users"`
 	CreatedAt *time.Time
 	Messages  []*Message
+
+	// the latest message of the chat, they are updated along with its creation, so the chats can be ordered
+	// by their activity without scanning the messages
+	LastMessageAt *time.Time
+	LastMessageID *uint
+
+	// ArchivedBefore is set once the chat's messages created before it are moved to the archive
+	ArchivedBefore *time.Time
 }
 
 type ChatQueryParams struct {
@@ -24,6 +36,15 @@ type ChatQueryParams struct {
 	UserID  *uint       `json:"user,string"`
 }
 
+// SetUserIDs sets the ids of the chat's users, it is for the callers which don't decode the params from JSON.
+func (cqp *ChatQueryParams) SetUserIDs(ids []uint) {
+	cqp.UserIDs = make([]*stringID, len(ids))
+	for i := range ids {
+		id := stringID(ids[i])
+		cqp.UserIDs[i] = &id
+	}
+}
+
 // A helper type, just because ",string" struct tag doesn't work with slices
 type stringID uint
 
@@ -33,7 +54,7 @@ func (sID *stringID) UnmarshalJSON(b []byte) error {
 		return err
 	}
 
-	v, err := strconv.ParseUint(s, 10, 32)
+	v, err := strconv.ParseUint(s, 10, 64)
 	if err != nil {
 		return err
 	}
@@ -43,6 +64,11 @@ func (sID *stringID) UnmarshalJSON(b []byte) error {
 	return nil
 }
 
+// OpenAPISchema describes stringID for the API specification, since it is decoded from a string.
+func (sID stringID) OpenAPISchema() map[string]interface{} {
+	return map[string]interface{}{"type": "string", "pattern": "^[0-9]+$"}
+}
+
 const (
 	ErrChatNameIsEmpty modelError = "'name' can't be empty"
 	ErrChatNameIsNull  modelError = "'name' can't be null"
@@ -56,13 +82,38 @@ const (
 	ErrChatSomeUsersDontExist modelError = "Some users don't exist"
 )
 
+var (
+	ErrChatUserIsOutOfRange  modelError = modelError(fmt.Sprintf("'user' can't be greater than %d", MaxID))
+	ErrChatUsersIsOutOfRange modelError = modelError(fmt.Sprintf("'users' can't contain ids greater than %d", MaxID))
+)
+
+func init() {
+	describeErrors(map[modelError]errorDescriptor{
+		ErrChatNameIsEmpty: {code: "CHAT_NAME_EMPTY", field: "name"},
+		ErrChatNameIsNull:  {code: "CHAT_NAME_NULL", field: "name"},
+		ErrChatUserIsNull:  {code: "CHAT_USER_NULL", field: "user"},
+
+		ErrChatUsersIsNull:     {code: "CHAT_USERS_NULL", field: "users"},
+		ErrChatUsersIsEmpty:    {code: "CHAT_USERS_EMPTY", field: "users"},
+		ErrChatUsersIDsAreNull: {code: "CHAT_USERS_CONTAIN_NULL", field: "users"},
+
+		ErrChatAlreadyExists:      {code: "CHAT_ALREADY_EXISTS", field: "name"},
+		ErrChatSomeUsersDontExist: {code: "CHAT_USERS_NOT_FOUND", field: "users"},
+
+		ErrChatUserIsOutOfRange:  {code: "CHAT_USER_OUT_OF_RANGE", field: "user", details: map[string]interface{}{"max": MaxID}},
+		ErrChatUsersIsOutOfRange: {code: "CHAT_USERS_OUT_OF_RANGE", field: "users", details: map[string]interface{}{"max": MaxID}},
+	})
+}
+
 type ChatService interface {
 	ChatDB
 }
 
 type ChatDB interface {
-	Create(cqp *ChatQueryParams) (uint, int, error)
-	ByUserID(userID *uint) ([]*Chat, int, error)
+	Create(ctx context.Context, cqp *ChatQueryParams) (uint, int, error)
+	ByUserID(ctx context.Context, userID *uint) ([]*Chat, int, error)
+	// VersionByUserID returns the version of the ByUserID's list without loading it
+	VersionByUserID(ctx context.Context, userID *uint) (*ListVersion, int, error)
 }
 
 var _ ChatService = &chatService{}
@@ -71,12 +122,16 @@ type chatService struct {
 	ChatDB
 }
 
-func NewChatService(db *gorm.DB) ChatService {
-	cg := &chatGorm{
-		db: db,
+// NewChatService creates the service, cache may be nil
+func NewChatService(st *storage, cache *storageCache) ChatService {
+	var cdb ChatDB = &chatGorm{
+		st: st,
+	}
+	if cache != nil {
+		cdb = newChatCache(cdb, cache)
 	}
 
-	cv := newChatValidator(cg)
+	cv := newChatValidator(cdb)
 
 	return &chatService{
 		ChatDB: cv,
@@ -86,87 +141,113 @@ func NewChatService(db *gorm.DB) ChatService {
 var _ ChatDB = &chatGorm{}
 
 type chatGorm struct {
-	db *gorm.DB
+	st *storage
 }
 
-func (cg *chatGorm) Create(cqp *ChatQueryParams) (uint, int, error) {
+func (cg *chatGorm) Create(ctx context.Context, cqp *ChatQueryParams) (uint, int, error) {
+	db := cg.st.WithContext(ctx)
+
 	chat := &Chat{}
-	err := cg.db.Where("name = ?", cqp.Name).First(&chat).Error
+	err := db.Where("name = ?", cqp.Name).First(&chat).Error
+	if err != nil && !gorm.IsRecordNotFoundError(err) {
+		statusCode, err := storageFailure(ctx, err)
+		return 0, statusCode, err
+	}
 	if chat.ID != nil {
 		return 0, http.StatusConflict, ErrChatAlreadyExists
 	}
 
 	var users []*User
-	err = cg.db.Where("id in (?)", cqp.UserIDs).Find(&users).Error
+	err = db.Where("id in (?)", cqp.UserIDs).Find(&users).Error
+	if err != nil {
+		statusCode, err := storageFailure(ctx, err)
+		return 0, statusCode, err
+	}
 	if len(users) != len(cqp.UserIDs) {
 		return 0, http.StatusConflict, ErrChatSomeUsersDontExist
 	}
 
 	chat.Name = cqp.Name
 	chat.Users = users
-	err = cg.db.Create(&chat).Error
+	err = db.Create(&chat).Error
 	if err != nil {
-		return 0, http.StatusInternalServerError, err
+		statusCode, err := storageFailure(ctx, err)
+		return 0, statusCode, err
 	}
 
 	return *chat.ID, http.StatusOK, nil
 }
 
-func (cg *chatGorm) ByUserID(userID *uint) ([]*Chat, int, error) {
+func (cg *chatGorm) ByUserID(ctx context.Context, userID *uint) ([]*Chat, int, error) {
+	db := cg.st.ReadContext(ctx)
+
 	var user User
-	err := cg.db.Where("id = ?", *userID).First(&user).Error
+	err := db.Where("id = ?", *userID).First(&user).Error
 	if err != nil {
 		if gorm.IsRecordNotFoundError(err) {
 			return nil, http.StatusNotFound, ErrMessageUserDoesntExist
 		}
-		return nil, http.StatusInternalServerError, err
+		statusCode, err := storageFailure(ctx, err)
+		return nil, statusCode, err
 	}
 
-	var chatIDs []uint
+	// чаты пользователя упорядочены по последнему сообщению (chats.last_message_at), участники и сообщения
+	// (от позднего к раннему) подгружаются отдельными запросами сразу для всех чатов, так что запросов всегда 4,
+	// сколько бы ни было чатов.
 	var chats []*Chat
-
-	// получаем id чатов пользователя в требуемом порядке
-	// левое соединение нужно на случай отсутствия сообщений в чате.
-	query := `SELECT id FROM (SELECT max(messages.created_at), chats.id
-			FROM chats
-			LEFT JOIN messages on chats.id = messages.chat_id
-			WHERE chats.id in
-			(SELECT chats_users.chat_id FROM chats_users WHERE chats_users.user_id = ?)
-			GROUP BY chats.id
-			ORDER BY max DESC NULLS LAST) as tempp`
-	err = cg.db.
-		Raw(query, *userID).
-		Pluck("id", &chatIDs).Error
+	err = db.
+		Select("chats.*").
+		Joins("JOIN chats_users ON chats_users.chat_id = chats.id AND chats_users.user_id = ?", *userID).
+		Order("chats.last_message_at DESC NULLS LAST").
+		Order("chats.id").
+		Preload("Users").
+		Preload("Messages", func(db *gorm.DB) *gorm.DB {
+			return db.Order("messages.created_at DESC")
+		}).
+		Find(&chats).
+		Error
 	if err != nil {
-		return nil, http.StatusInternalServerError, err
+		statusCode, err := storageFailure(ctx, err)
+		return nil, statusCode, err
 	}
 
-	// чтобы не делать лишних запросов далее, в случае если юзер не состоит ни в каких чатах
-	if chatIDs == nil {
+	if len(chats) == 0 {
 		return nil, http.StatusOK, nil
 	}
 
-	// получаем чаты пользователя с отсортированными сообщениями в них от позднего к раннему
-	// todo можно ли сделать так, чтоб выражение "where in" выбирало в том порядке, что имеется в chatIDs?
-	//  если да, то можно тогда сделать одним запросом то, что ниже
-	for i := range chatIDs {
-		var chat Chat
-		err = cg.db.
-			Preload("Users").
-			Preload("Messages", func(db *gorm.DB) *gorm.DB {
-				return db.Order("messages.created_at DESC")
-			}).
-			Where("id = ?", chatIDs[i]).First(&chat).
-			Error
+	return chats, http.StatusOK, nil
+}
 
-		if err != nil {
-			return nil, http.StatusInternalServerError, err
+func (cg *chatGorm) VersionByUserID(ctx context.Context, userID *uint) (*ListVersion, int, error) {
+	var chats, messages uint
+	var maxChatID, maxMessageID *uint
+	var chatsLatest, messagesLatest sqlTime
+	err := cg.st.ReadContext(ctx).Raw(`
+		SELECT c.n, c.max_id, c.latest, m.n, m.max_id, m.latest
+		FROM users
+		CROSS JOIN (
+			SELECT count(*) AS n, max(chats.id) AS max_id, max(chats.created_at) AS latest
+			FROM chats JOIN chats_users ON chats_users.chat_id = chats.id
+			WHERE chats_users.user_id = ?
+		) c
+		CROSS JOIN (
+			SELECT count(*) AS n, max(messages.id) AS max_id, max(messages.created_at) AS latest
+			FROM messages JOIN chats_users ON chats_users.chat_id = messages.chat_id
+			WHERE chats_users.user_id = ?
+		) m
+		WHERE users.id = ?`, *userID, *userID, *userID).
+		Row().
+		Scan(&chats, &maxChatID, &chatsLatest, &messages, &maxMessageID, &messagesLatest)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, http.StatusNotFound, ErrMessageUserDoesntExist
 		}
-
-		chats = append(chats, &chat)
+		statusCode, err := storageFailure(ctx, err)
+		return nil, statusCode, err
 	}
 
-	return chats, http.StatusOK, nil
+	return newListVersion(chats, maxUint(0, maxChatID), messages, maxUint(0, maxMessageID),
+		later(chatsLatest.Time, messagesLatest.Time)), http.StatusOK, nil
 }
 
 type chatValidator struct {
@@ -179,31 +260,45 @@ func newChatValidator(cdb ChatDB) *chatValidator {
 	}
 }
 
-func (cv *chatValidator) Create(cqp *ChatQueryParams) (uint, int, error) {
+func (cv *chatValidator) Create(ctx context.Context, cqp *ChatQueryParams) (uint, int, error) {
 	statusCode, err := runChatValFns(cqp,
 		cv.chatNameNotNull,
 		cv.chatUsersNotNull,
 		cv.chatNameNotEmpty,
 		cv.chatUsersNotEmpty,
 		cv.chatUsersIDsNotNull,
+		cv.chatUsersInRange,
 		cv.chatUsersRemoveDuplicates)
 
 	if err != nil {
 		return 0, statusCode, err
 	}
 
-	return cv.ChatDB.Create(cqp)
+	return cv.ChatDB.Create(ctx, cqp)
+}
+
+func (cv *chatValidator) ByUserID(ctx context.Context, userID *uint) ([]*Chat, int, error) {
+	cqp := ChatQueryParams{UserID: userID}
+	statusCode, err := runChatValFns(&cqp,
+		cv.chatUserNotNull,
+		cv.chatUserInRange)
+	if err != nil {
+		return nil, statusCode, err
+	}
+
+	return cv.ChatDB.ByUserID(ctx, userID)
 }
 
-func (cv *chatValidator) ByUserID(userID *uint) ([]*Chat, int, error) {
+func (cv *chatValidator) VersionByUserID(ctx context.Context, userID *uint) (*ListVersion, int, error) {
 	cqp := ChatQueryParams{UserID: userID}
 	statusCode, err := runChatValFns(&cqp,
-		cv.chatUserNotNull)
+		cv.chatUserNotNull,
+		cv.chatUserInRange)
 	if err != nil {
 		return nil, statusCode, err
 	}
 
-	return cv.ChatDB.ByUserID(userID)
+	return cv.ChatDB.VersionByUserID(ctx, userID)
 }
 
 type chatValFn func(params *ChatQueryParams) (int, error)
@@ -262,6 +357,22 @@ func (cv *chatValidator) chatUsersIDsNotNull(cqv *ChatQueryParams) (int, error)
 	return http.StatusOK, nil
 }
 
+func (cv *chatValidator) chatUserInRange(cqv *ChatQueryParams) (int, error) {
+	if *cqv.UserID > MaxID {
+		return http.StatusBadRequest, ErrChatUserIsOutOfRange
+	}
+	return http.StatusOK, nil
+}
+
+func (cv *chatValidator) chatUsersInRange(cqv *ChatQueryParams) (int, error) {
+	for i := range cqv.UserIDs {
+		if *cqv.UserIDs[i] > MaxID {
+			return http.StatusBadRequest, ErrChatUsersIsOutOfRange
+		}
+	}
+	return http.StatusOK, nil
+}
+
 func (cv *chatValidator) chatUsersRemoveDuplicates(cqv *ChatQueryParams) (int, error) {
 	seen := make(map[stringID]struct{})
 	for _, item := range cqv.UserIDs {
@@ -0,0 +1,119 @@
+package models
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// FuzzStringIDUnmarshalJSON checks that stringID accepts exactly the JSON strings of the decimal ids
+// which fit into 64 bits, the validators bound them by MaxID, and that the accepted ones survive a round trip
+func FuzzStringIDUnmarshalJSON(f *testing.F) {
+	for _, seed := range []string{`"1"`, `"0"`, `"007"`, `"4294967296"`, `"18446744073709551615"`, `"18446744073709551616"`, `"-1"`, `"+1"`, `" 1"`,
+		`"1e3"`, `"1"`, `1`, `null`, `""`, `"`, `["1"]`, `{}`} {
+		f.Add([]byte(seed))
+	}
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		var id stringID
+		err := id.UnmarshalJSON(b)
+
+		// null decodes into the empty string, which isn't an id anyway
+		var s string
+		isString := json.Unmarshal(b, &s) == nil
+		want, parseErr := strconv.ParseUint(s, 10, 64)
+		valid := isString && parseErr == nil
+
+		if valid != (err == nil) {
+			t.Fatalf("UnmarshalJSON(%q) = %v, want valid=%v", b, err, valid)
+		}
+		if err != nil {
+			return
+		}
+		if uint64(id) != want {
+			t.Fatalf("UnmarshalJSON(%q) = %d, want %d", b, id, want)
+		}
+
+		var again stringID
+		quoted, _ := json.Marshal(strconv.FormatUint(uint64(id), 10))
+		if err := again.UnmarshalJSON(quoted); err != nil || again != id {
+			t.Fatalf("round trip of %d: %d, %v", id, again, err)
+		}
+	})
+}
+
+// queryCounter counts the statements the storage's logger is told about, gorm logs every one of them
+type queryCounter struct{ n int }
+
+func (qc *queryCounter) Write(b []byte) (int, error) {
+	qc.n++
+	return len(b), nil
+}
+
+// countQueries returns the number of the statements fn runs in st
+func countQueries(st *storage, fn func()) int {
+	var qc queryCounter
+	st.setLogger(log.New(&qc, "", 0))
+	defer st.setLogger(log.New(io.Discard, "", 0))
+
+	fn()
+	return qc.n
+}
+
+// seedChats creates n chats of the users 1 and 2 with 5 messages each, the chats' last activity is kept
+// the way createMessage keeps it
+func seedChats(t testing.TB, st *storage, n int) {
+	t.Helper()
+
+	tx := st.db.Begin()
+	for _, name := range []string{"alice", "bob"} {
+		tx.Exec("INSERT INTO users (name, created_at) VALUES (?, ?)", name, time.Now())
+	}
+	now := time.Now().UTC()
+	for i := 1; i <= n; i++ {
+		tx.Exec("INSERT INTO chats (id, name, created_at, last_message_at) VALUES (?, ?, ?, ?)",
+			i, "chat-"+strconv.Itoa(i), now, now.Add(-time.Duration(i)*time.Minute))
+		tx.Exec("INSERT INTO chats_users (chat_id, user_id) VALUES (?, 1), (?, 2)", i, i)
+		for m := 0; m < 5; m++ {
+			tx.Exec("INSERT INTO messages (chat_id, user_id, text, created_at) VALUES (?, 1, ?, ?)",
+				i, "message", now.Add(-time.Duration(i+m)*time.Minute))
+		}
+	}
+	if err := tx.Commit().Error; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestChatsByUserIDQueries checks that the chats are loaded with the same number of queries however many they are
+func TestChatsByUserIDQueries(t *testing.T) {
+	for _, n := range []int{1, 10, 50} {
+		st := newTestStorage(t)
+		seedChats(t, st, n)
+		cg := &chatGorm{st: st}
+
+		userID := uint(1)
+		var chats []*Chat
+		var err error
+		queries := countQueries(st, func() {
+			chats, _, err = cg.ByUserID(context.Background(), &userID)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the user, the chats, their members and their messages
+		if queries != 4 {
+			t.Errorf("%d chats: got %d queries, want 4", n, queries)
+		}
+		if len(chats) != n || *chats[0].ID != 1 || *chats[n-1].ID != uint(n) {
+			t.Fatalf("%d chats: got %d chats in the wrong order", n, len(chats))
+		}
+		if len(chats[0].Users) != 2 || len(chats[0].Messages) != 5 {
+			t.Errorf("%d chats: got %d users and %d messages", n, len(chats[0].Users), len(chats[0].Messages))
+		}
+	}
+}
@@ -1,5 +1,11 @@
 package models
 
+import "math"
+
+// MaxID is the largest id there can be, the ids are Postgres integers, so the larger ones are rejected
+// by the APIs rather than sent to the storage
+const MaxID = math.MaxInt32
+
 type modelError string
 
 func (e modelError) Error() string {
@@ -10,7 +16,58 @@ func (e modelError) Public() string {
 	return e.Error()
 }
 
+// Code returns the stable machine-readable code of the error, clients should rely on it
+// instead of matching the message text.
+func (e modelError) Code() string {
+	if d, ok := errorDescriptors[e]; ok {
+		return d.code
+	}
+	return "UNKNOWN_ERROR"
+}
+
+// Field returns the name of the request field the error relates to, if any.
+func (e modelError) Field() string {
+	return errorDescriptors[e].field
+}
+
+// Details returns the parameters of the error, e.g. the limit the request exceeds, the translations
+// of the message interpolate them.
+func (e modelError) Details() map[string]interface{} {
+	return errorDescriptors[e].details
+}
+
+type errorDescriptor struct {
+	code    string
+	field   string
+	details map[string]interface{}
+}
+
+var errorDescriptors = make(map[modelError]errorDescriptor)
+
+// describeErrors is meant to be called from init() of the files that declare the errors,
+// so the codes are kept right next to the messages.
+func describeErrors(ds map[modelError]errorDescriptor) {
+	for e, d := range ds {
+		errorDescriptors[e] = d
+	}
+}
+
 const (
 	ErrNoSuchEndpointExists modelError = "No such endpoint exists"
 	ErrNoSuchHTTPMethod     modelError = "Wrong http method"
+
+	ErrIdempotencyKeyTooLong    modelError = "Idempotency key must not be longer than 255 characters"
+	ErrIdempotencyKeyInProgress modelError = "The request with this idempotency key is still in progress"
+	ErrIdempotencyKeyReused     modelError = "The idempotency key has already been used with another payload"
 )
+
+func init() {
+	describeErrors(map[modelError]errorDescriptor{
+		ErrNoSuchEndpointExists: {code: "ENDPOINT_NOT_FOUND"},
+		ErrNoSuchHTTPMethod:     {code: "METHOD_NOT_ALLOWED"},
+
+		ErrIdempotencyKeyTooLong:    {code: "IDEMPOTENCY_KEY_TOO_LONG"},
+		ErrIdempotencyKeyInProgress: {code: "IDEMPOTENCY_KEY_IN_PROGRESS"},
+		ErrIdempotencyKeyReused:     {code: "IDEMPOTENCY_KEY_REUSED"},
+	})
+}
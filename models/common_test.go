@@ -0,0 +1,59 @@
+package models
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"regexp"
+	"testing"
+)
+
+var errorCode = regexp.MustCompile(`^[A-Z]+(_[A-Z0-9]+)*$`)
+
+// TestErrorsAreDescribed checks that every modelError declared in the package has its own code
+func TestErrorsAreDescribed(t *testing.T) {
+	pkgs, err := parser.ParseDir(token.NewFileSet(), ".", nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var declared []string
+	for _, f := range pkgs["models"].Files {
+		ast.Inspect(f, func(n ast.Node) bool {
+			spec, ok := n.(*ast.ValueSpec)
+			if !ok {
+				return true
+			}
+			if typ, ok := spec.Type.(*ast.Ident); ok && typ.Name == "modelError" {
+				for _, name := range spec.Names {
+					declared = append(declared, name.Name)
+				}
+			}
+			return true
+		})
+	}
+	if len(declared) != len(errorDescriptors) {
+		t.Errorf("%d errors are declared, %d are described", len(declared), len(errorDescriptors))
+	}
+
+	codes := make(map[string]modelError)
+	for e, d := range errorDescriptors {
+		if !errorCode.MatchString(d.code) {
+			t.Errorf("%q: the code %q isn't UPPER_SNAKE_CASE", e, d.code)
+		}
+		if other, ok := codes[d.code]; ok {
+			t.Errorf("%q and %q share the code %s", e, other, d.code)
+		}
+		codes[d.code] = e
+		if e.Code() != d.code || e.Field() != d.field {
+			t.Errorf("%q: got %s %q", e, e.Code(), e.Field())
+		}
+	}
+}
+
+func TestUndescribedError(t *testing.T) {
+	e := modelError("not described")
+	if e.Code() != "UNKNOWN_ERROR" || e.Field() != "" || e.Public() != "not described" {
+		t.Errorf("got %s %q %q", e.Code(), e.Field(), e.Public())
+	}
+}
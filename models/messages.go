@@ -1,10 +1,15 @@
 package models
 
 import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
 	"github.com/jinzhu/gorm"
 	_ "github.com/jinzhu/gorm/dialects/postgres"
 	_ "github.com/lib/pq"
 	"net/http"
+	"sync"
 	"time"
 )
 
@@ -14,6 +19,9 @@ type Message struct {
 	UserID    *uint   `json:"author,string"` // author
 	Text      *string `gorm:"not null" json:"text"`
 	CreatedAt *time.Time
+
+	// ClientMsgID is an alternative to the Idempotency-Key header, it isn't stored
+	ClientMsgID *string `gorm:"-" json:"client_msg_id,omitempty"`
 }
 
 const (
@@ -25,99 +33,396 @@ const (
 	ErrMessageAuthorIsNull modelError = "'author' can't be null"
 	ErrMessageTextIsNull   modelError = "'text' can't be null"
 	ErrMessageTextIsEmpty  modelError = "'text' can't be empty"
+
+	ErrMessageLimitIsZero modelError = "'limit' must be positive"
+
+	ErrMessageChatIsNotInPath modelError = "'chat' must be the chat of the path or omitted"
 )
 
+var (
+	ErrMessageChatIsOutOfRange   modelError = modelError(fmt.Sprintf("'chat' can't be greater than %d", MaxID))
+	ErrMessageAuthorIsOutOfRange modelError = modelError(fmt.Sprintf("'author' can't be greater than %d", MaxID))
+)
+
+func init() {
+	describeErrors(map[modelError]errorDescriptor{
+		ErrMessageChatDoesntExist: {code: "CHAT_NOT_FOUND", field: "chat"},
+		ErrMessageUserDoesntExist: {code: "USER_NOT_FOUND"},
+		ErrMessageUserIsNotInChat: {code: "USER_NOT_IN_CHAT", field: "author"},
+
+		ErrMessageChatIsNull:   {code: "MESSAGE_CHAT_NULL", field: "chat"},
+		ErrMessageAuthorIsNull: {code: "MESSAGE_AUTHOR_NULL", field: "author"},
+		ErrMessageTextIsNull:   {code: "MESSAGE_TEXT_NULL", field: "text"},
+		ErrMessageTextIsEmpty:  {code: "MESSAGE_TEXT_EMPTY", field: "text"},
+
+		ErrMessageLimitIsZero: {code: "MESSAGE_LIMIT_INVALID", field: "limit"},
+
+		ErrMessageChatIsNotInPath: {code: "MESSAGE_CHAT_MISMATCH", field: "chat"},
+
+		ErrMessageChatIsOutOfRange:   {code: "MESSAGE_CHAT_OUT_OF_RANGE", field: "chat", details: map[string]interface{}{"max": MaxID}},
+		ErrMessageAuthorIsOutOfRange: {code: "MESSAGE_AUTHOR_OUT_OF_RANGE", field: "author", details: map[string]interface{}{"max": MaxID}},
+	})
+}
+
 type MessageService interface {
 	MessageDB
+
+	// Subscribe returns a channel of the messages created in the chat from now on.
+	// The channel is closed if the subscriber doesn't keep up, cancel must be called to release the subscription.
+	// Only the messages created through this instance of the service are delivered.
+	Subscribe(chatID uint) (msgs <-chan *Message, cancel func())
 }
 
 type MessageDB interface {
-	Create(msg *Message) (uint, int, error)
-	ByChatID(chatid *uint) ([]*Message, int, error)
+	Create(ctx context.Context, msg *Message) (uint, int, error)
+	// CreateBatch creates the messages in one transaction if atomic, otherwise one by one
+	CreateBatch(ctx context.Context, msgs []*Message, atomic bool) ([]BatchItem, int, error)
+	// ByChatID returns the chat's messages, the earliest first, if limit isn't nil only the latest limit messages are returned
+	ByChatID(ctx context.Context, chatid *uint, limit *uint) (*MessageHistory, int, error)
+	// ByChatIDs returns the messages of several chats as ByChatID does, all of them read at once, the outcome of
+	// each chat is in the same order as the ids
+	ByChatIDs(ctx context.Context, chatids []*uint, limit *uint) ([]MessageHistoryItem, int, error)
+	// VersionByChatID returns the version of the ByChatID's list without loading it
+	VersionByChatID(ctx context.Context, chatid *uint, limit *uint) (*ListVersion, int, error)
+	// CheckMember checks that the chat and the user exist and the user is in the chat, the way Create checks the author
+	CheckMember(ctx context.Context, chatid *uint, userid *uint) (int, error)
 }
 
 var _ MessageService = &messageService{}
 
 type messageService struct {
 	MessageDB
+	*messageHub
 }
 
-func NewMessageService(db *gorm.DB) MessageService {
-	mg := &messageGorm{
-		db: db,
+// NewMessageService creates the service, cache may be nil
+func NewMessageService(st *storage, cache *storageCache) MessageService {
+	var mdb MessageDB = &messageGorm{
+		st: st,
+	}
+	if cache != nil {
+		mdb = newMessageCache(mdb, cache)
 	}
 
-	mv := newMessageValidator(mg)
+	mv := newMessageValidator(mdb)
+
+	hub := newMessageHub()
+	mn := newMessageNotifier(mv, hub)
 
 	return &messageService{
-		MessageDB: mv,
+		MessageDB:  mn,
+		messageHub: hub,
 	}
 }
 
 var _ MessageDB = &messageGorm{}
 
 type messageGorm struct {
-	db *gorm.DB
+	st *storage
 }
 
-func (mg *messageGorm) Create(msg *Message) (uint, int, error) {
-	var chat Chat
-	err := mg.db.Where("id = ?", msg.ChatID).First(&chat).Error
+func (mg *messageGorm) Create(ctx context.Context, msg *Message) (uint, int, error) {
+	return createMessage(mg.st.WithContext(ctx), msg, knownMember(ctx))
+}
+
+// createMessage skips the lookups of the chat and the author if isMember (it may be nil) reports the author
+// is in the chat, see messageCache
+func createMessage(db *gorm.DB, msg *Message, isMember func(chatID, userID uint) bool) (uint, int, error) {
+	if isMember == nil || !isMember(*msg.ChatID, *msg.UserID) {
+		if statusCode, err := checkMembership(db, msg); err != nil {
+			return 0, statusCode, err
+		}
+	}
+
+	// the id and the time are the storage's, the ones the client sent would let it put the message
+	// in another partition and on top of the chats
+	msg.ID, msg.CreatedAt = nil, nil
+
+	err := transaction(db, func(tx *gorm.DB) error {
+		if err := tx.Create(msg).Error; err != nil {
+			return err
+		}
+
+		// сообщения с более ранним created_at (например, вставленные параллельно) последними не становятся
+		return tx.Model(&Chat{}).
+			Where("id = ? AND (last_message_at IS NULL OR last_message_at <= ?)", *msg.ChatID, *msg.CreatedAt).
+			Updates(map[string]interface{}{"last_message_at": *msg.CreatedAt, "last_message_id": *msg.ID}).
+			Error
+	})
 	if err != nil {
-		if gorm.IsRecordNotFoundError(err) {
-			return 0, http.StatusNotFound, ErrMessageChatDoesntExist
+		statusCode, err := storageFailure(contextOf(db), err)
+		return 0, statusCode, err
+	}
+
+	return *msg.ID, http.StatusOK, nil
+}
+
+// checkMembership checks that the message's chat and author exist and the author is in the chat,
+// the chat isn't looked up if the context's knownChat reports it exists
+func checkMembership(db *gorm.DB, msg *Message) (int, error) {
+	if exists := knownChat(contextOf(db)); exists == nil || !exists(*msg.ChatID) {
+		var chat Chat
+		err := db.Select("id").Where("id = ?", msg.ChatID).First(&chat).Error
+		if err != nil {
+			if gorm.IsRecordNotFoundError(err) {
+				return http.StatusNotFound, ErrMessageChatDoesntExist
+			}
+			return storageFailure(contextOf(db), err)
 		}
-		return 0, http.StatusInternalServerError, err
 	}
 
 	var user User
-	err = mg.db.Where("id = ?", msg.UserID).First(&user).Error
+	err := db.Select("id").Where("id = ?", msg.UserID).First(&user).Error
 	if err != nil {
 		if gorm.IsRecordNotFoundError(err) {
-			return 0, http.StatusNotFound, ErrMessageUserDoesntExist
+			return http.StatusNotFound, ErrMessageUserDoesntExist
 		}
-		return 0, http.StatusInternalServerError, err
+		return storageFailure(contextOf(db), err)
 	}
 
-	err = mg.db.Preload("Users", "id = ?", user.ID).First(&chat).Error
-	if len(chat.Users) == 0 {
-		return 0, http.StatusUnauthorized, ErrMessageUserIsNotInChat
-	}
-
-	err = mg.db.Create(msg).Error
+	var members int
+	err = db.Table("chats_users").Where("chat_id = ? AND user_id = ?", *msg.ChatID, *user.ID).Count(&members).Error
 	if err != nil {
-		return 0, http.StatusInternalServerError, err
+		return storageFailure(contextOf(db), err)
+	}
+	if members == 0 {
+		return http.StatusUnauthorized, ErrMessageUserIsNotInChat
 	}
 
-	return *msg.ID, http.StatusOK, nil
+	return http.StatusOK, nil
+}
+
+func (mg *messageGorm) CreateBatch(ctx context.Context, msgs []*Message, atomic bool) ([]BatchItem, int, error) {
+	return createBatch(mg.st.WithContext(ctx), len(msgs), atomic, func(db *gorm.DB, i int) (uint, int, error) {
+		return createMessage(db, msgs[i], knownMember(ctx))
+	})
+}
+
+// MessageHistory is the chat's messages ByChatID returns
+type MessageHistory struct {
+	Messages []*Message // nil if there are none
+	// ArchivedBefore is the time the chat's messages are archived before, nil if none of them are archived
+	ArchivedBefore *time.Time
 }
 
-func (mg *messageGorm) ByChatID(chatid *uint) ([]*Message, int, error) {
-	var chat User
-	err := mg.db.Where("id = ?", *chatid).First(&chat).Error
+func (mg *messageGorm) ByChatID(ctx context.Context, chatid *uint, limit *uint) (*MessageHistory, int, error) {
+	db := mg.st.ReadContext(ctx)
+
+	var chat Chat
+	err := db.Where("id = ?", *chatid).First(&chat).Error
 	if err != nil {
 		if gorm.IsRecordNotFoundError(err) {
 			return nil, http.StatusNotFound, ErrMessageChatDoesntExist
 		}
-		return nil, http.StatusInternalServerError, err
+		statusCode, err := storageFailure(ctx, err)
+		return nil, statusCode, err
 	}
 
 	var msgs []*Message
-	err = mg.db.
-		Where("chat_id = ?", *chatid).
-		Order("created_at").
-		Find(&msgs).
-		Error
+	if limit == nil {
+		err = db.
+			Where("chat_id = ?", *chatid).
+			Order("created_at").
+			Find(&msgs).
+			Error
+	} else {
+		// берем последние limit сообщений и разворачиваем их, чтобы порядок был как и без лимита
+		err = db.
+			Where("chat_id = ?", *chatid).
+			Order("created_at DESC").
+			Limit(*limit).
+			Find(&msgs).
+			Error
+		for i, j := 0, len(msgs)-1; i < j; i, j = i+1, j-1 {
+			msgs[i], msgs[j] = msgs[j], msgs[i]
+		}
+	}
 
 	if err != nil {
-		return nil, http.StatusInternalServerError, err
+		statusCode, err := storageFailure(ctx, err)
+		return nil, statusCode, err
+	}
+
+	history := &MessageHistory{ArchivedBefore: chat.ArchivedBefore}
+	if len(msgs) > 0 {
+		history.Messages = msgs
+	}
+	return history, http.StatusOK, nil
+}
+
+func (mg *messageGorm) ByChatIDs(ctx context.Context, chatids []*uint, limit *uint) ([]MessageHistoryItem, int, error) {
+	ids := make([]uint, len(chatids))
+	for i := range chatids {
+		ids[i] = *chatids[i]
+	}
+
+	var chats []*Chat
+	var msgs []*Message
+	err := snapshot(mg.st.ReadContext(ctx), func(tx *gorm.DB) error {
+		err := tx.Select("id, archived_before").Where("id IN (?)", ids).Find(&chats).Error
+		if err != nil {
+			return err
+		}
+
+		if limit == nil {
+			return tx.Where("chat_id IN (?)", ids).Order("created_at").Find(&msgs).Error
+		}
+		// последние limit сообщений каждого чата в том же порядке, что и без лимита
+		return tx.Raw(`
+			SELECT id, chat_id, user_id, text, created_at FROM (
+				SELECT messages.*, row_number() OVER (PARTITION BY chat_id ORDER BY created_at DESC) AS n
+				FROM messages
+				WHERE chat_id IN (?)
+			) latest
+			WHERE n <= ?
+			ORDER BY created_at`, ids, *limit).
+			Scan(&msgs).
+			Error
+	})
+	if err != nil {
+		statusCode, err := storageFailure(ctx, err)
+		return nil, statusCode, err
+	}
+
+	histories := make(map[uint]*MessageHistory, len(chats))
+	for _, chat := range chats {
+		histories[*chat.ID] = &MessageHistory{ArchivedBefore: chat.ArchivedBefore}
+	}
+	for _, msg := range msgs {
+		history := histories[*msg.ChatID]
+		history.Messages = append(history.Messages, msg)
+	}
+
+	items := make([]MessageHistoryItem, len(ids))
+	for i, id := range ids {
+		if history, ok := histories[id]; ok {
+			items[i] = MessageHistoryItem{History: history, StatusCode: http.StatusOK}
+		} else {
+			items[i] = MessageHistoryItem{StatusCode: http.StatusNotFound, Err: ErrMessageChatDoesntExist}
+		}
+	}
+	return items, http.StatusOK, nil
+}
+
+func (mg *messageGorm) VersionByChatID(ctx context.Context, chatid *uint, limit *uint) (*ListVersion, int, error) {
+	// те же сообщения, что выбирает ByChatID
+	shown, args := "SELECT id, created_at FROM messages WHERE chat_id = ?", []interface{}{*chatid}
+	if limit != nil {
+		shown, args = shown+" ORDER BY created_at DESC LIMIT ?", append(args, *limit)
+	}
+	args = append(args, *chatid)
+
+	var messages uint
+	var maxMessageID *uint
+	var latest sqlTime
+	err := mg.st.ReadContext(ctx).Raw(`
+		SELECT count(m.id), max(m.id), max(m.created_at)
+		FROM chats LEFT JOIN (`+shown+`) m ON 1 = 1
+		WHERE chats.id = ?
+		GROUP BY chats.id`, args...).
+		Row().
+		Scan(&messages, &maxMessageID, &latest)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, http.StatusNotFound, ErrMessageChatDoesntExist
+		}
+		statusCode, err := storageFailure(ctx, err)
+		return nil, statusCode, err
+	}
+
+	return newListVersion(0, 0, messages, maxUint(0, maxMessageID), latest.Time), http.StatusOK, nil
+}
+
+func (mg *messageGorm) CheckMember(ctx context.Context, chatid *uint, userid *uint) (int, error) {
+	return checkMembership(mg.st.WithContext(ctx), &Message{ChatID: chatid, UserID: userid})
+}
+
+// messageNotifier publishes successfully created messages to the subscribers of their chats
+type messageNotifier struct {
+	MessageDB
+	hub *messageHub
+}
+
+func newMessageNotifier(mdb MessageDB, hub *messageHub) *messageNotifier {
+	return &messageNotifier{
+		MessageDB: mdb,
+		hub:       hub,
+	}
+}
+
+func (mn *messageNotifier) Create(ctx context.Context, msg *Message) (uint, int, error) {
+	id, statusCode, err := mn.MessageDB.Create(ctx, msg)
+	if err == nil {
+		mn.hub.publish(msg)
 	}
+	return id, statusCode, err
+}
+
+// CreateBatch publishes the messages only after all of them are committed
+func (mn *messageNotifier) CreateBatch(ctx context.Context, msgs []*Message, atomic bool) ([]BatchItem, int, error) {
+	items, statusCode, err := mn.MessageDB.CreateBatch(ctx, msgs, atomic)
+	for i, item := range items {
+		if item.Err == nil {
+			mn.hub.publish(msgs[i])
+		}
+	}
+	return items, statusCode, err
+}
+
+// размер буфера подписчика, при переполнении подписка закрывается
+const messageSubscriberBuffer = 64
+
+type messageHub struct {
+	mu   sync.Mutex
+	subs map[uint]map[chan *Message]struct{}
+}
+
+func newMessageHub() *messageHub {
+	return &messageHub{
+		subs: make(map[uint]map[chan *Message]struct{}),
+	}
+}
+
+func (h *messageHub) Subscribe(chatID uint) (<-chan *Message, func()) {
+	ch := make(chan *Message, messageSubscriberBuffer)
+
+	h.mu.Lock()
+	if h.subs[chatID] == nil {
+		h.subs[chatID] = make(map[chan *Message]struct{})
+	}
+	h.subs[chatID][ch] = struct{}{}
+	h.mu.Unlock()
+
+	return ch, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		h.unsubscribe(chatID, ch)
+	}
+}
 
-	if len(msgs) == 0 {
-		return nil, http.StatusOK, nil
+// it assumes that h.mu is locked
+func (h *messageHub) unsubscribe(chatID uint, ch chan *Message) {
+	if _, ok := h.subs[chatID][ch]; !ok {
+		return
 	}
+	delete(h.subs[chatID], ch)
+	if len(h.subs[chatID]) == 0 {
+		delete(h.subs, chatID)
+	}
+	close(ch)
+}
+
+func (h *messageHub) publish(msg *Message) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
 
-	return msgs, http.StatusOK, nil
+	for ch := range h.subs[*msg.ChatID] {
+		select {
+		case ch <- msg:
+		default:
+			h.unsubscribe(*msg.ChatID, ch)
+		}
+	}
 }
 
 type messageValidator struct {
@@ -130,10 +435,12 @@ func newMessageValidator(mdb MessageDB) *messageValidator {
 	}
 }
 
-func (mv *messageValidator) Create(msg *Message) (uint, int, error) {
+func (mv *messageValidator) Create(ctx context.Context, msg *Message) (uint, int, error) {
 	statusCode, err := runMessageValFns(msg,
 		mv.messageChatNotNull,
 		mv.messageAuthorNotNull,
+		mv.messageChatInRange,
+		mv.messageAuthorInRange,
 		mv.messageTextNotNull,
 		mv.messageTextNotEmpty,
 	)
@@ -141,18 +448,124 @@ func (mv *messageValidator) Create(msg *Message) (uint, int, error) {
 		return 0, statusCode, err
 	}
 
-	return mv.MessageDB.Create(msg)
+	return mv.MessageDB.Create(ctx, msg)
 }
 
-func (mv *messageValidator) ByChatID(chatid *uint) ([]*Message, int, error) {
+func (mv *messageValidator) CreateBatch(ctx context.Context, msgs []*Message, atomic bool) ([]BatchItem, int, error) {
+	items, valid, statusCode, err := validateBatch(len(msgs), atomic, func(i int) (int, error) {
+		if msgs[i] == nil {
+			return http.StatusBadRequest, ErrBatchItemIsNull
+		}
+		return runMessageValFns(msgs[i],
+			mv.messageChatNotNull,
+			mv.messageAuthorNotNull,
+			mv.messageChatInRange,
+			mv.messageAuthorInRange,
+			mv.messageTextNotNull,
+			mv.messageTextNotEmpty,
+		)
+	})
+	if err != nil || len(valid) == 0 {
+		return items, statusCode, err
+	}
+
+	batch := make([]*Message, len(valid))
+	for j, i := range valid {
+		batch[j] = msgs[i]
+	}
+
+	created, statusCode, err := mv.MessageDB.CreateBatch(ctx, batch, atomic)
+	if created == nil {
+		return nil, statusCode, err
+	}
+	mergeBatch(items, valid, created)
+
+	return items, statusCode, err
+}
+
+func (mv *messageValidator) ByChatID(ctx context.Context, chatid *uint, limit *uint) (*MessageHistory, int, error) {
 	statusCode, err := runMessageValFns(&Message{ChatID: chatid},
 		mv.messageChatNotNull,
+		mv.messageChatInRange,
 	)
 	if err != nil {
 		return nil, statusCode, err
 	}
 
-	return mv.MessageDB.ByChatID(chatid)
+	if limit != nil && *limit == 0 {
+		return nil, http.StatusBadRequest, ErrMessageLimitIsZero
+	}
+
+	return mv.MessageDB.ByChatID(ctx, chatid, limit)
+}
+
+func (mv *messageValidator) ByChatIDs(ctx context.Context, chatids []*uint, limit *uint) ([]MessageHistoryItem, int, error) {
+	if limit != nil && *limit == 0 {
+		return nil, http.StatusBadRequest, ErrMessageLimitIsZero
+	}
+
+	invalid, valid, statusCode, err := validateBatch(len(chatids), false, func(i int) (int, error) {
+		return runMessageValFns(&Message{ChatID: chatids[i]},
+			mv.messageChatNotNull,
+			mv.messageChatInRange,
+		)
+	})
+	if err != nil {
+		return nil, statusCode, err
+	}
+
+	items := make([]MessageHistoryItem, len(chatids))
+	for i, item := range invalid {
+		items[i] = MessageHistoryItem{StatusCode: item.StatusCode, Err: item.Err}
+	}
+	if len(valid) == 0 {
+		return items, http.StatusOK, nil
+	}
+
+	lookup := make([]*uint, len(valid))
+	for j, i := range valid {
+		lookup[j] = chatids[i]
+	}
+
+	found, statusCode, err := mv.MessageDB.ByChatIDs(ctx, lookup, limit)
+	if err != nil {
+		return nil, statusCode, err
+	}
+	for j, i := range valid {
+		items[i] = found[j]
+	}
+
+	return items, http.StatusOK, nil
+}
+
+func (mv *messageValidator) VersionByChatID(ctx context.Context, chatid *uint, limit *uint) (*ListVersion, int, error) {
+	statusCode, err := runMessageValFns(&Message{ChatID: chatid},
+		mv.messageChatNotNull,
+		mv.messageChatInRange,
+	)
+	if err != nil {
+		return nil, statusCode, err
+	}
+
+	if limit != nil && *limit == 0 {
+		return nil, http.StatusBadRequest, ErrMessageLimitIsZero
+	}
+
+	return mv.MessageDB.VersionByChatID(ctx, chatid, limit)
+}
+
+func (mv *messageValidator) CheckMember(ctx context.Context, chatid *uint, userid *uint) (int, error) {
+	statusCode, err := runMessageValFns(&Message{ChatID: chatid, UserID: userid},
+		mv.messageChatNotNull,
+		mv.messageAuthorNotNull,
+		mv.messageChatInRange,
+		mv.messageAuthorInRange,
+	)
+	if err != nil {
+		return statusCode, err
+	}
+
+	return mv.MessageDB.CheckMember(ctx, chatid, userid)
 }
 
 // валидаторы и нормализаторы
@@ -183,6 +596,20 @@ func (mv *messageValidator) messageAuthorNotNull(msg *Message) (int, error) {
 	return http.StatusOK, nil
 }
 
+func (mv *messageValidator) messageChatInRange(msg *Message) (int, error) {
+	if *msg.ChatID > MaxID {
+		return http.StatusBadRequest, ErrMessageChatIsOutOfRange
+	}
+	return http.StatusOK, nil
+}
+
+func (mv *messageValidator) messageAuthorInRange(msg *Message) (int, error) {
+	if *msg.UserID > MaxID {
+		return http.StatusBadRequest, ErrMessageAuthorIsOutOfRange
+	}
+	return http.StatusOK, nil
+}
+
 func (mv *messageValidator) messageTextNotNull(msg *Message) (int, error) {
 	if msg.Text == nil {
 		return http.StatusBadRequest, ErrMessageTextIsNull
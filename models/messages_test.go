@@ -0,0 +1,203 @@
+package models
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func strPtr(s string) *string { return &s }
+
+// newTestChat creates the chat with its only member in st and returns their ids
+func newTestChat(t *testing.T, st *storage) (chatID, userID uint) {
+	t.Helper()
+
+	user := &User{Name: strPtr("alice")}
+	if err := st.db.Create(user).Error; err != nil {
+		t.Fatal(err)
+	}
+	chat := &Chat{Name: strPtr("chat"), Users: []*User{user}}
+	if err := st.db.Create(chat).Error; err != nil {
+		t.Fatal(err)
+	}
+	return *chat.ID, *user.ID
+}
+
+// TestCreateMessageCanceled checks that the insert's transaction is begun with the request's context,
+// gorm's Begin passes context.Background() instead
+func TestCreateMessageCanceled(t *testing.T) {
+	st := newTestStorage(t)
+	chatID, userID := newTestChat(t, st)
+	member := func(chatID, userID uint) bool { return true }
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	msg := &Message{ChatID: &chatID, UserID: &userID, Text: strPtr("canceled")}
+	if _, statusCode, err := createMessage(st.WithContext(ctx), msg, member); statusCode != StatusClientClosedRequest ||
+		err != ErrRequestCanceled {
+		t.Errorf("canceled: got %d %v", statusCode, err)
+	}
+
+	msg = &Message{ChatID: &chatID, UserID: &userID, Text: strPtr("created")}
+	if _, statusCode, err := createMessage(st.WithContext(context.Background()), msg, member); err != nil {
+		t.Fatalf("got %d %v", statusCode, err)
+	}
+
+	var texts []string
+	if err := st.db.Model(&Message{}).Pluck("text", &texts).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(texts) != 1 || texts[0] != "created" {
+		t.Errorf("got the messages %q", texts)
+	}
+}
+
+// TestCreateMessageIgnoresClientTime checks that the message's id and time are set by the storage, a message
+// from the future would stay on top of the chats
+func TestCreateMessageIgnoresClientTime(t *testing.T) {
+	st := newTestStorage(t)
+	chatID, userID := newTestChat(t, st)
+	member := func(chatID, userID uint) bool { return true }
+
+	id, future := uint(1000), time.Date(2099, 1, 1, 0, 0, 0, 0, time.UTC)
+	msg := &Message{ID: &id, ChatID: &chatID, UserID: &userID, Text: strPtr("hey"), CreatedAt: &future}
+	began := time.Now()
+	if _, statusCode, err := createMessage(st.WithContext(context.Background()), msg, member); err != nil {
+		t.Fatalf("got %d %v", statusCode, err)
+	}
+
+	var chat Chat
+	if err := st.db.First(&chat, chatID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if *msg.ID == id || msg.CreatedAt.After(time.Now()) || msg.CreatedAt.Before(began.Add(-time.Second)) {
+		t.Errorf("the message is created as %d at %v", *msg.ID, msg.CreatedAt)
+	}
+	if chat.LastMessageAt == nil || !chat.LastMessageAt.Equal(*msg.CreatedAt) || *chat.LastMessageID != *msg.ID {
+		t.Errorf("the chat's last message is %v at %v", chat.LastMessageID, chat.LastMessageAt)
+	}
+}
+
+// TestCheckMembershipKnownChat checks that the chat known to exist isn't looked up
+func TestCheckMembershipKnownChat(t *testing.T) {
+	st := newTestStorage(t)
+	chatID, userID := newTestChat(t, st)
+	outsider := &User{Name: strPtr("bob")}
+	if err := st.db.Create(outsider).Error; err != nil {
+		t.Fatal(err)
+	}
+	known := func(uint) bool { return true }
+
+	cases := []struct {
+		name    string
+		ctx     context.Context
+		userID  uint
+		queries int
+		err     error
+	}{
+		{"member", context.Background(), userID, 3, nil},
+		{"member of known chat", withKnownChat(context.Background(), known), userID, 2, nil},
+		{"outsider of known chat", withKnownChat(context.Background(), known), *outsider.ID, 2, ErrMessageUserIsNotInChat},
+	}
+
+	for _, c := range cases {
+		var err error
+		queries := countQueries(st, func() {
+			_, err = checkMembership(st.WithContext(c.ctx), &Message{ChatID: &chatID, UserID: &c.userID})
+		})
+		if err != c.err || queries != c.queries {
+			t.Errorf("%s: got %v in %d queries, want %v in %d", c.name, err, queries, c.err, c.queries)
+		}
+	}
+}
+
+// TestMessagesByChatIDArchive checks that the archive's boundary comes with the messages, from the chat's row
+// the messages are looked up by
+func TestMessagesByChatIDArchive(t *testing.T) {
+	st := newTestStorage(t)
+	chatID, userID := newTestChat(t, st)
+	mg := &messageGorm{st: st}
+	member := func(chatID, userID uint) bool { return true }
+
+	msg := &Message{ChatID: &chatID, UserID: &userID, Text: strPtr("kept")}
+	if _, statusCode, err := createMessage(st.WithContext(context.Background()), msg, member); err != nil {
+		t.Fatalf("got %d %v", statusCode, err)
+	}
+	before := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	if err := st.db.Model(&Chat{}).Where("id = ?", chatID).Update("archived_before", before).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	var history *MessageHistory
+	var err error
+	queries := countQueries(st, func() {
+		history, _, err = mg.ByChatID(context.Background(), &chatID, nil)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if queries != 2 {
+		t.Errorf("got %d queries, want 2", queries)
+	}
+	if len(history.Messages) != 1 || history.ArchivedBefore == nil || !history.ArchivedBefore.Equal(before) {
+		t.Errorf("got %d messages archived before %v", len(history.Messages), history.ArchivedBefore)
+	}
+}
+
+// TestMessagesByChatIDs checks that the chats are looked up with the same number of queries however many they are,
+// and that the limit applies to each of them
+func TestMessagesByChatIDs(t *testing.T) {
+	st := newTestStorage(t)
+	seedChats(t, st, 50)
+	mg := &messageGorm{st: st}
+
+	for _, n := range []int{1, 10, 50} {
+		chatIDs := make([]*uint, n+1)
+		for i := range chatIDs {
+			id := uint(i + 1)
+			chatIDs[i] = &id
+		}
+		// there is no such chat
+		missing := uint(51)
+		chatIDs[n] = &missing
+
+		for _, limit := range []*uint{nil, new(uint)} {
+			if limit != nil {
+				*limit = 2
+			}
+			var items []MessageHistoryItem
+			var err error
+			queries := countQueries(st, func() {
+				items, _, err = mg.ByChatIDs(context.Background(), chatIDs, limit)
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if queries != 2 {
+				t.Errorf("%d chats, limit %v: got %d queries, want 2", n, limit, queries)
+			}
+			if len(items) != n+1 || items[n].StatusCode != http.StatusNotFound || items[n].Err != ErrMessageChatDoesntExist {
+				t.Fatalf("%d chats, limit %v: got %+v", n, limit, items)
+			}
+
+			// the same messages as ByChatID returns for each chat
+			for i, item := range items[:n] {
+				history, _, err := mg.ByChatID(context.Background(), chatIDs[i], limit)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if item.Err != nil || len(item.History.Messages) != len(history.Messages) {
+					t.Fatalf("the chat %d, limit %v: got %+v, want %d messages", *chatIDs[i], limit, item, len(history.Messages))
+				}
+				for j, msg := range item.History.Messages {
+					if *msg.ID != *history.Messages[j].ID {
+						t.Errorf("the chat %d, limit %v: got the message %d at %d, want %d",
+							*chatIDs[i], limit, *msg.ID, j, *history.Messages[j].ID)
+					}
+				}
+			}
+		}
+	}
+}
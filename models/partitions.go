@@ -0,0 +1,262 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Таблица сообщений партиционирована по месяцам created_at (UTC): messages_2006_01 хранит сообщения месяца,
+// messages_default - сообщения месяцев без своей партиции (например, вставленные до обновления хранилища или
+// с датой далеко в прошлом). Партиции на будущие месяцы создает фоновая задача (CreateMessagePartitions),
+// старые отсоединяются и выгружаются в архив (ArchiveMessagePartitions), который перед этим создает партиции
+// прошлых месяцев, застрявших в messages_default, так что их сообщения архивируются вместе с остальными.
+
+const messagePartitionLayout = "messages_2006_01"
+
+// ErrMessagesNotPartitioned is returned by the partitions' methods if the storage is created by the older
+// init_db.sql (see storage/upgrade_partitioning.sql) or isn't Postgres
+var ErrMessagesNotPartitioned = errors.New("the messages table isn't partitioned")
+
+// MessagePartition is a month of the messages, [From, To)
+type MessagePartition struct {
+	Name     string
+	From, To time.Time
+}
+
+func messagePartition(month time.Time) MessagePartition {
+	from := time.Date(month.UTC().Year(), month.UTC().Month(), 1, 0, 0, 0, 0, time.UTC)
+	return MessagePartition{Name: from.Format(messagePartitionLayout), From: from, To: from.AddDate(0, 1, 0)}
+}
+
+// parseMessagePartition recognizes the monthly partitions by their names
+func parseMessagePartition(name string) (MessagePartition, bool) {
+	month, err := time.Parse(messagePartitionLayout, name)
+	if err != nil || month.Format(messagePartitionLayout) != name {
+		return MessagePartition{}, false
+	}
+	return messagePartition(month), true
+}
+
+// CreateMessagePartitions creates the missing partitions of the month of now and of ahead months after it,
+// it returns the created ones
+func (s *Services) CreateMessagePartitions(ctx context.Context, now time.Time, ahead int) ([]MessagePartition, error) {
+	db := s.st.WithContext(ctx)
+
+	attached, err := attachedMessagePartitions(db)
+	if err != nil {
+		return nil, err
+	}
+
+	var created []MessagePartition
+	for i := 0; i <= ahead; i++ {
+		p := messagePartition(messagePartition(now).From.AddDate(0, i, 0))
+		if attached[p.Name] {
+			continue
+		}
+
+		if err := createMessagePartition(db, p); err != nil {
+			return created, fmt.Errorf("can't create the partition %s: %w", p.Name, err)
+		}
+		created = append(created, p)
+	}
+
+	return created, nil
+}
+
+// createMessagePartition moves the month's messages from messages_default (they get there if the partition
+// is created late) into the new table and attaches it, Postgres refuses to create the partition otherwise
+func createMessagePartition(db *gorm.DB, p MessagePartition) error {
+	// имя и границы получены форматированием времени, так что их можно подставлять в запрос
+	from, to := p.From.Format(time.RFC3339), p.To.Format(time.RFC3339)
+
+	return transaction(db, func(tx *gorm.DB) error {
+		err := tx.Exec(fmt.Sprintf(`CREATE TABLE %s (LIKE messages INCLUDING DEFAULTS INCLUDING CONSTRAINTS)`, p.Name)).Error
+		if err != nil {
+			return err
+		}
+
+		err = tx.Exec(fmt.Sprintf(`WITH moved AS (
+				DELETE FROM messages_default WHERE created_at >= '%s' AND created_at < '%s' RETURNING *
+			) INSERT INTO %s SELECT * FROM moved`, from, to, p.Name)).Error
+		if err != nil {
+			return err
+		}
+
+		return tx.Exec(fmt.Sprintf(`ALTER TABLE messages ATTACH PARTITION %s FOR VALUES FROM ('%s') TO ('%s')`,
+			p.Name, from, to)).Error
+	})
+}
+
+// MessageRows iterates over the messages of an archived partition the way sql.Rows does
+type MessageRows struct {
+	db   *gorm.DB
+	rows *sql.Rows
+}
+
+func (mr *MessageRows) Next() bool {
+	return mr.rows.Next()
+}
+
+func (mr *MessageRows) Message() (*Message, error) {
+	var msg Message
+	if err := mr.db.ScanRows(mr.rows, &msg); err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+func (mr *MessageRows) Err() error {
+	return mr.rows.Err()
+}
+
+// ArchiveMessagePartitions detaches the partitions of the months which end before the month of before,
+// marks their chats' history as archived (see Chat.ArchivedBefore), exports each of them and drops it once it's exported.
+// The months whose messages are in messages_default get their partitions first.
+// If the export fails the partition is left detached, it's exported by the next call.
+func (s *Services) ArchiveMessagePartitions(ctx context.Context, before time.Time,
+	export func(p MessagePartition, rows *MessageRows) error) ([]MessagePartition, error) {
+
+	db := s.st.WithContext(ctx)
+
+	attached, err := attachedMessagePartitions(db)
+	if err != nil {
+		return nil, err
+	}
+
+	var tables []string
+	err = db.Raw(`SELECT tablename FROM pg_tables WHERE schemaname = current_schema() AND tablename LIKE 'messages\_%'`).
+		Pluck("tablename", &tables).Error
+	if err != nil {
+		return nil, err
+	}
+
+	var partitions []MessagePartition
+	exists := make(map[string]bool, len(tables))
+	for _, name := range tables {
+		exists[name] = true
+		if p, ok := parseMessagePartition(name); ok && !p.To.After(messagePartition(before).From) {
+			partitions = append(partitions, p)
+		}
+	}
+
+	stuck, err := defaultMessageMonths(db, attached, before)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range stuck {
+		// the partition detached by a failed call is exported first, the messages of its month
+		// inserted since then are archived by the next call
+		if exists[p.Name] {
+			continue
+		}
+		if err := createMessagePartition(db, p); err != nil {
+			return nil, fmt.Errorf("can't create the partition %s: %w", p.Name, err)
+		}
+		attached[p.Name] = true
+		partitions = append(partitions, p)
+	}
+	sort.Slice(partitions, func(i, j int) bool { return partitions[i].From.Before(partitions[j].From) })
+
+	var archived []MessagePartition
+	for _, p := range partitions {
+		if attached[p.Name] {
+			if err := detachMessagePartition(db, p); err != nil {
+				return archived, fmt.Errorf("can't detach the partition %s: %w", p.Name, err)
+			}
+			s.cache.historyArchived()
+		}
+
+		rows, err := db.Raw(fmt.Sprintf(`SELECT * FROM %s ORDER BY created_at, id`, p.Name)).Rows()
+		if err != nil {
+			return archived, fmt.Errorf("can't export the partition %s: %w", p.Name, err)
+		}
+		err = export(p, &MessageRows{db: db, rows: rows})
+		rows.Close()
+		if err != nil {
+			return archived, fmt.Errorf("can't export the partition %s: %w", p.Name, err)
+		}
+
+		if err := db.Exec(fmt.Sprintf(`DROP TABLE %s`, p.Name)).Error; err != nil {
+			return archived, fmt.Errorf("can't drop the exported partition %s: %w", p.Name, err)
+		}
+		archived = append(archived, p)
+	}
+
+	return archived, nil
+}
+
+// defaultMessageMonths returns the partitions of the months before the month of before
+// which have messages in messages_default
+func defaultMessageMonths(db *gorm.DB, attached map[string]bool, before time.Time) ([]MessagePartition, error) {
+	if !attached["messages_default"] {
+		return nil, nil
+	}
+
+	var months []time.Time
+	err := db.Raw(`SELECT DISTINCT date_trunc('month', created_at AT TIME ZONE 'UTC') AS month
+			FROM messages_default WHERE created_at < ?`, messagePartition(before).From).
+		Pluck("month", &months).Error
+	if err != nil {
+		return nil, err
+	}
+
+	partitions := make([]MessagePartition, len(months))
+	for i, month := range months {
+		partitions[i] = messagePartition(month)
+	}
+	return partitions, nil
+}
+
+// detachMessagePartition detaches the partition and moves its chats' archive boundary in one transaction,
+// so the chats never miss the messages without reporting that
+func detachMessagePartition(db *gorm.DB, p MessagePartition) error {
+	return transaction(db, func(tx *gorm.DB) error {
+		if err := tx.Exec(fmt.Sprintf(`ALTER TABLE messages DETACH PARTITION %s`, p.Name)).Error; err != nil {
+			return err
+		}
+
+		return tx.Model(&Chat{}).
+			Where(fmt.Sprintf(`id IN (SELECT DISTINCT chat_id FROM %s)`, p.Name)).
+			Where("archived_before IS NULL OR archived_before < ?", p.To).
+			Update("archived_before", p.To).
+			Error
+	})
+}
+
+// attachedMessagePartitions returns the names of the partitions of the messages table
+func attachedMessagePartitions(db *gorm.DB) (map[string]bool, error) {
+	if db.Dialect().GetName() != DialectPostgres {
+		return nil, ErrMessagesNotPartitioned
+	}
+
+	var partitioned int
+	err := db.Raw(`SELECT count(*) FROM pg_partitioned_table WHERE partrelid = 'messages'::regclass`).
+		Row().Scan(&partitioned)
+	if err != nil {
+		return nil, err
+	}
+	if partitioned == 0 {
+		return nil, ErrMessagesNotPartitioned
+	}
+
+	var names []string
+	err = db.Raw(`SELECT child.relname FROM pg_inherits
+			JOIN pg_class child ON child.oid = pg_inherits.inhrelid
+			WHERE pg_inherits.inhparent = 'messages'::regclass`).
+		Pluck("relname", &names).Error
+	if err != nil {
+		return nil, err
+	}
+
+	attached := make(map[string]bool, len(names))
+	for _, name := range names {
+		attached[name] = true
+	}
+	return attached, nil
+}
@@ -0,0 +1,59 @@
+package models
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMessagePartition(t *testing.T) {
+	msk := time.FixedZone("MSK", 3*60*60)
+
+	cases := []struct {
+		month    time.Time
+		name     string
+		from, to string
+	}{
+		{time.Date(2024, 3, 15, 12, 0, 0, 0, time.UTC), "messages_2024_03", "2024-03-01", "2024-04-01"},
+		{time.Date(2024, 12, 31, 23, 59, 59, 0, time.UTC), "messages_2024_12", "2024-12-01", "2025-01-01"},
+		{time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC), "messages_2024_02", "2024-02-01", "2024-03-01"},
+		// the months are the ones of UTC
+		{time.Date(2024, 4, 1, 1, 0, 0, 0, msk), "messages_2024_03", "2024-03-01", "2024-04-01"},
+	}
+
+	for _, c := range cases {
+		p := messagePartition(c.month)
+		if p.Name != c.name || p.From.Format(time.DateOnly) != c.from || p.To.Format(time.DateOnly) != c.to ||
+			p.From.Location() != time.UTC || p.To.Location() != time.UTC {
+			t.Errorf("%v: got %s [%v, %v), want %s [%s, %s)", c.month, p.Name, p.From, p.To, c.name, c.from, c.to)
+		}
+	}
+}
+
+func TestParseMessagePartition(t *testing.T) {
+	cases := []struct {
+		name string
+		ok   bool
+		from string
+	}{
+		{"messages_2024_03", true, "2024-03-01"},
+		{"messages_1999_12", true, "1999-12-01"},
+		{"messages_default", false, ""},
+		{"messages_2024_3", false, ""},
+		{"messages_2024_13", false, ""},
+		{"messages_2024_03_old", false, ""},
+		{"messages_2024_03.tmp", false, ""},
+		{"chats_2024_03", false, ""},
+		{"messages", false, ""},
+	}
+
+	for _, c := range cases {
+		p, ok := parseMessagePartition(c.name)
+		if ok != c.ok {
+			t.Errorf("%s: got ok %v", c.name, ok)
+			continue
+		}
+		if ok && (p.Name != c.name || p.From.Format(time.DateOnly) != c.from || p != messagePartition(p.From)) {
+			t.Errorf("%s: got %+v", c.name, p)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Чтения, которым не нужны только что сделанные записи (ByUserID, ByChatID), идут на реплики
+// по кругу, все остальное, включая проверки внутри записей, - на основную базу. Реплика, не ответившая на пинг
+// или оборвавшая запрос, исключается до следующей успешной проверки, а оборванный запрос повторяется на основной
+// базе; если здоровых реплик нет, читается основная база. Повторить нельзя только запрос, оборвавшийся
+// посреди чтения строк ответа, он получает 503.
+
+type readPrimaryKey struct{}
+
+// ReadPrimary marks ctx so the reads made with it go to the primary, the clients use it to read their own writes
+// which the replicas may not have replayed yet
+func ReadPrimary(ctx context.Context) context.Context {
+	return context.WithValue(ctx, readPrimaryKey{}, true)
+}
+
+func readsPrimary(ctx context.Context) bool {
+	return ctx.Value(readPrimaryKey{}) != nil
+}
+
+type replica struct {
+	name    string
+	sqlDB   *sql.DB
+	healthy atomic.Bool
+}
+
+func (r *replica) setHealthy(healthy bool, err error) {
+	if r.healthy.Swap(healthy) == healthy {
+		return
+	}
+	if healthy {
+		log.Printf("The %s is healthy, the reads are routed to it", r.name)
+	} else {
+		log.Printf("The %s is unhealthy, the reads are routed elsewhere: %v", r.name, err)
+	}
+}
+
+// ReadContext is WithContext for the read-only queries, it runs them on a healthy replica unless
+// ctx is marked with ReadPrimary. The transactions mustn't be begun with it.
+func (st *storage) ReadContext(ctx context.Context) *gorm.DB {
+	if readsPrimary(ctx) {
+		return st.WithContext(ctx)
+	}
+
+	n := len(st.replicas)
+	start := int(st.nextReplica.Add(1))
+	for i := 0; i < n; i++ {
+		r := st.replicas[(start+i)%n]
+		if r.healthy.Load() {
+			return st.open(contextSQL{db: r.sqlDB, ctx: ctx, replica: r, primary: st.sqlDB})
+		}
+	}
+
+	return st.WithContext(ctx)
+}
+
+func (st *storage) addReplica(sqlDB *sql.DB) {
+	st.replicas = append(st.replicas, &replica{
+		name:  fmt.Sprintf("replica #%d", len(st.replicas)+1),
+		sqlDB: sqlDB,
+	})
+}
+
+// checkReplicas pings the replicas right away and then every interval until the storage is closed,
+// all of them at once, so the unreachable ones don't hold the startup up one after another
+func (st *storage) checkReplicas(interval time.Duration) {
+	st.stopChecks = make(chan struct{})
+
+	check := func() {
+		var wg sync.WaitGroup
+		for _, r := range st.replicas {
+			wg.Add(1)
+			go func(r *replica) {
+				defer wg.Done()
+				ctx, cancel := context.WithTimeout(context.Background(), interval)
+				err := r.sqlDB.PingContext(ctx)
+				cancel()
+				r.setHealthy(err == nil, err)
+			}(r)
+		}
+		wg.Wait()
+	}
+	check()
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-st.stopChecks:
+				return
+			case <-ticker.C:
+				check()
+			}
+		}
+	}()
+}
+
+func (st *storage) closeReplicas() {
+	if st.stopChecks != nil {
+		close(st.stopChecks)
+	}
+	for _, r := range st.replicas {
+		if err := r.sqlDB.Close(); err != nil {
+			log.Println(err)
+		}
+	}
+}
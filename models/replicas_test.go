@@ -0,0 +1,227 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// fakeServer is a database the fake driver connects to by its name, every query returns its name
+type fakeServer struct {
+	name      string
+	down      atomic.Bool
+	pingDelay time.Duration
+	queries   atomic.Int32
+}
+
+var fakeServers sync.Map // the names to the *fakeServer
+
+func newFakeServer(t *testing.T, name string) (*fakeServer, *sql.DB) {
+	t.Helper()
+
+	srv := &fakeServer{name: t.Name() + "/" + name}
+	fakeServers.Store(srv.name, srv)
+	db, err := sql.Open("bta-fake", srv.name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+		fakeServers.Delete(srv.name)
+	})
+	return srv, db
+}
+
+// errConnReset is the failure of the connection to the server which is down
+var errConnReset = &net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}
+
+type fakeDriver struct{}
+
+func (fakeDriver) Open(name string) (driver.Conn, error) {
+	srv, ok := fakeServers.Load(name)
+	if !ok {
+		return nil, errors.New("no such server")
+	}
+	return &fakeConn{srv: srv.(*fakeServer)}, nil
+}
+
+func init() {
+	sql.Register("bta-fake", fakeDriver{})
+}
+
+type fakeConn struct {
+	srv *fakeServer
+}
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, errors.New("not supported")
+}
+
+func (c *fakeConn) Close() error { return nil }
+
+func (c *fakeConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("not supported")
+}
+
+func (c *fakeConn) Ping(ctx context.Context) error {
+	select {
+	case <-time.After(c.srv.pingDelay):
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if c.srv.down.Load() {
+		return errConnReset
+	}
+	return nil
+}
+
+func (c *fakeConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	c.srv.queries.Add(1)
+	if c.srv.down.Load() {
+		return nil, errConnReset
+	}
+	return &fakeRows{values: []string{c.srv.name}}, nil
+}
+
+type fakeRows struct {
+	values []string
+}
+
+func (r *fakeRows) Columns() []string { return []string{"name"} }
+
+func (r *fakeRows) Close() error { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	dest[0], r.values = r.values[0], r.values[1:]
+	return nil
+}
+
+// newReplicatedStorage returns the storage of the fake primary with the fake replicas
+func newReplicatedStorage(t *testing.T, replicas ...string) (*storage, *fakeServer, []*fakeServer) {
+	t.Helper()
+
+	primary, primaryDB := newFakeServer(t, "primary")
+	db, err := gorm.Open(DialectPostgres, primaryDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := newStorage(DialectPostgres, db)
+
+	var servers []*fakeServer
+	for _, name := range replicas {
+		srv, replicaDB := newFakeServer(t, name)
+		servers = append(servers, srv)
+		st.addReplica(replicaDB)
+	}
+	return st, primary, servers
+}
+
+// readName returns the name of the server the read is served by
+func readName(t *testing.T, db *gorm.DB) string {
+	t.Helper()
+
+	var name string
+	if err := db.Raw("SELECT name").Row().Scan(&name); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+func TestReadContextRetriesOnPrimary(t *testing.T) {
+	st, primary, replicas := newReplicatedStorage(t, "replica")
+	r := st.replicas[0]
+	r.setHealthy(true, nil)
+
+	if name := readName(t, st.ReadContext(context.Background())); name != replicas[0].name {
+		t.Errorf("healthy replica: the read is served by %s", name)
+	}
+
+	// the replica goes down between the checks
+	replicas[0].down.Store(true)
+	if name := readName(t, st.ReadContext(context.Background())); name != primary.name {
+		t.Errorf("failed replica: the read is served by %s", name)
+	}
+	if r.healthy.Load() {
+		t.Error("the failed replica is still healthy")
+	}
+
+	// the next reads don't try it
+	tried := replicas[0].queries.Load()
+	if name := readName(t, st.ReadContext(context.Background())); name != primary.name || replicas[0].queries.Load() != tried {
+		t.Errorf("unhealthy replica: the read is served by %s, the replica is tried %d times",
+			name, replicas[0].queries.Load()-tried)
+	}
+
+	if name := readName(t, st.ReadContext(ReadPrimary(context.Background()))); name != primary.name {
+		t.Errorf("ReadPrimary: the read is served by %s", name)
+	}
+}
+
+func TestReadContextRoundRobin(t *testing.T) {
+	st, _, replicas := newReplicatedStorage(t, "a", "b")
+	for _, r := range st.replicas {
+		r.setHealthy(true, nil)
+	}
+
+	served := make(map[string]int)
+	for i := 0; i < 4; i++ {
+		served[readName(t, st.ReadContext(context.Background()))]++
+	}
+	if served[replicas[0].name] != 2 || served[replicas[1].name] != 2 {
+		t.Errorf("got %v", served)
+	}
+}
+
+func TestReadContextNoRetryOfCanceled(t *testing.T) {
+	st, primary, replicas := newReplicatedStorage(t, "replica")
+	st.replicas[0].setHealthy(true, nil)
+	replicas[0].down.Store(true)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	db := st.ReadContext(ctx)
+	cancel()
+
+	var name string
+	if err := db.Raw("SELECT name").Row().Scan(&name); err == nil {
+		t.Errorf("got %s", name)
+	}
+	if primary.queries.Load() != 0 {
+		t.Error("the canceled read is retried on the primary")
+	}
+}
+
+func TestCheckReplicas(t *testing.T) {
+	const delay = 200 * time.Millisecond
+	st, _, replicas := newReplicatedStorage(t, "up", "down", "slow")
+	replicas[0].pingDelay = delay
+	replicas[1].pingDelay = delay
+	replicas[1].down.Store(true)
+	replicas[2].pingDelay = time.Hour
+
+	began := time.Now()
+	st.checkReplicas(2 * delay)
+	defer st.closeReplicas()
+
+	// the replicas are pinged at once, the slow one is given up on after the interval
+	if elapsed := time.Since(began); elapsed > 3*delay {
+		t.Errorf("the checks took %v", elapsed)
+	}
+	for i, want := range []bool{true, false, false} {
+		if got := st.replicas[i].healthy.Load(); got != want {
+			t.Errorf("%s: healthy is %v", replicas[i].name, got)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package models
 
 import (
+	"database/sql"
 	"github.com/jinzhu/gorm"
 	_ "github.com/jinzhu/gorm/dialects/postgres"
 	"log"
@@ -15,7 +16,8 @@ type Services struct {
 	Chat    ChatService
 	Message MessageService
 
-	db      *gorm.DB
+	st      *storage
+	cache   *storageCache // nil unless WithCache
 	logFile *os.File
 }
 
@@ -34,10 +36,11 @@ func WithGorm(dialect, connectionInfo string, num int, interval uint) ServicesCo
 	return func(s *Services) error {
 		var err error
 		for i := 0; i < num; i++ {
-			db, err := gorm.Open(dialect, connectionInfo)
+			var db *gorm.DB
+			db, err = gorm.Open(dialect, driverName(dialect), connectionInfo)
 			if err == nil {
 				log.Println("Successfully connected to the storage")
-				s.db = db
+				s.st = newStorage(dialect, db)
 				return nil
 			}
 
@@ -50,6 +53,59 @@ func WithGorm(dialect, connectionInfo string, num int, interval uint) ServicesCo
 	}
 }
 
+// WithReplicas adds the read replicas, the read-only queries are routed to them (see storage.ReadContext).
+// They aren't required to be up: each is pinged every checkInterval and is used only while it responds,
+// the primary serves the reads otherwise. With WithCache the users' chats, the hottest read, are still read
+// from the primary on the cache's misses, see chatCache.ByUserID: the list a lagging replica served would be
+// cached past the invalidations it missed. The replicas take the rest of the reads and the primary only the misses.
+func WithReplicas(dialect string, connectionInfos []string, checkInterval time.Duration) ServicesConfig {
+	return func(s *Services) error {
+		if len(connectionInfos) == 0 {
+			return nil
+		}
+
+		for _, info := range connectionInfos {
+			// sql.Open doesn't connect, it only checks the driver's name
+			db, err := sql.Open(driverName(dialect), info)
+			if err != nil {
+				s.st.closeReplicas()
+				return err
+			}
+			s.st.addReplica(db)
+		}
+		s.st.checkReplicas(checkInterval)
+		return nil
+	}
+}
+
+// WithPool configures the pools of the connections to the storage and its replicas, zero maxOpen, maxLifetime
+// and maxIdleTime mean no limits, zero maxIdle means no idle connections are kept
+func WithPool(maxOpen, maxIdle int, maxLifetime, maxIdleTime time.Duration) ServicesConfig {
+	return func(s *Services) error {
+		dbs := []*sql.DB{s.st.sqlDB}
+		for _, r := range s.st.replicas {
+			dbs = append(dbs, r.sqlDB)
+		}
+
+		for _, db := range dbs {
+			db.SetMaxOpenConns(maxOpen)
+			db.SetMaxIdleConns(maxIdle)
+			db.SetConnMaxLifetime(maxLifetime)
+			db.SetConnMaxIdleTime(maxIdleTime)
+		}
+		return nil
+	}
+}
+
+// WithStatementTimeout tells the storage the statement timeout its connections have (see storage.statementTimeout),
+// so the requests' deadlines only shorten it, 0 means no timeout
+func WithStatementTimeout(timeout time.Duration) ServicesConfig {
+	return func(s *Services) error {
+		s.st.statementTimeout = timeout
+		return nil
+	}
+}
+
 func WithLogMode(mode bool) ServicesConfig {
 	return func(s *Services) error {
 		if mode {
@@ -66,30 +122,47 @@ func WithLogMode(mode bool) ServicesConfig {
 				log.Fatal(err)
 			}
 
-			s.db.SetLogger(log.New(s.logFile, "\r\n", log.LstdFlags))
-			return s.db.LogMode(true).Error
+			s.st.setLogger(log.New(s.logFile, "\r\n", log.LstdFlags))
+			return nil
 		}
 		return nil
 	}
 }
 
+// WithCache caches the chats' membership, the chats known to exist and the users' chats (see storageCache),
+// up to size entries of each kind for ttl each, a list of chats counts as the rows it is loaded from.
+// It must precede WithChat and WithMessage.
+func WithCache(size int, ttl time.Duration) ServicesConfig {
+	return func(s *Services) error {
+		if size > 0 {
+			s.cache = newStorageCache(size, ttl)
+		}
+		return nil
+	}
+}
+
+// CacheStats returns the counters of the caches by their names, nil without WithCache
+func (s *Services) CacheStats() map[string]CacheStats {
+	return s.cache.stats()
+}
+
 func WithUser() ServicesConfig {
 	return func(s *Services) error {
-		s.User = NewUserService(s.db)
+		s.User = NewUserService(s.st)
 		return nil
 	}
 }
 
 func WithChat() ServicesConfig {
 	return func(s *Services) error {
-		s.Chat = NewChatService(s.db)
+		s.Chat = NewChatService(s.st, s.cache)
 		return nil
 	}
 }
 
 func WithMessage() ServicesConfig {
 	return func(s *Services) error {
-		s.Message = NewMessageService(s.db)
+		s.Message = NewMessageService(s.st, s.cache)
 		return nil
 	}
 }
@@ -98,7 +171,7 @@ func WithSetSchema(mode bool) ServicesConfig {
 	return func(s *Services) error {
 
 		if mode {
-			setSchema(s.db)
+			setSchema(s.st.db, s.st.dialect)
 		}
 
 		return nil
@@ -115,22 +188,46 @@ func (s *Services) Close() {
 }
 
 func (s *Services) CloseStorage() {
-	if err := s.db.Close(); err != nil {
+	s.st.closeReplicas()
+	if err := s.st.db.Close(); err != nil {
 		log.Println(err)
 	}
 }
 
-func setSchema(db *gorm.DB) {
+func setSchema(db *gorm.DB, dialect string) {
 
-	db.Debug().Exec("DROP SCHEMA public CASCADE")
-	db.Debug().Exec("CREATE SCHEMA public")
+	if dialect == DialectSQLite {
+		db.Debug().DropTableIfExists("chats_users", &Message{}, &Chat{}, &User{})
+	} else {
+		db.Debug().Exec("DROP SCHEMA public CASCADE")
+		db.Debug().Exec("CREATE SCHEMA public")
+	}
 
 	db.Debug().CreateTable(
 		&User{},
 		&Chat{},
-		&Message{},
 	)
 
-	db.Debug().Model(&Message{}).AddForeignKey("chat_id", "chats(id)", "CASCADE", "CASCADE")
-	db.Debug().Model(&Message{}).AddForeignKey("user_id", "users(id)", "CASCADE", "CASCADE")
+	if dialect == DialectSQLite {
+		// SQLite не умеет добавлять внешние ключи к существующей таблице, поэтому они объявляются сразу
+		db.Debug().Exec(`CREATE TABLE "messages" ("id" integer primary key autoincrement,` +
+			`"chat_id" integer REFERENCES chats(id) ON DELETE CASCADE ON UPDATE CASCADE,` +
+			`"user_id" integer REFERENCES users(id) ON DELETE CASCADE ON UPDATE CASCADE,` +
+			`"text" text NOT NULL,"created_at" datetime NOT NULL)`)
+	} else {
+		// gorm не умеет создавать партиционированные таблицы, см. partitions.go;
+		// ключ партиционирования обязан входить в первичный ключ
+		db.Debug().Exec(`CREATE TABLE "messages" ("id" serial,"chat_id" integer,"user_id" integer,"text" text NOT NULL,` +
+			`"created_at" timestamp with time zone NOT NULL, PRIMARY KEY ("id","created_at")) PARTITION BY RANGE ("created_at")`)
+		db.Debug().Exec(`CREATE TABLE "messages_default" PARTITION OF "messages" DEFAULT`)
+
+		db.Debug().Model(&Message{}).AddForeignKey("chat_id", "chats(id)", "CASCADE", "CASCADE")
+		db.Debug().Model(&Message{}).AddForeignKey("user_id", "users(id)", "CASCADE", "CASCADE")
+	}
+
+	// сообщения чата выбираются по chat_id в порядке created_at, участники чата - по chat_id,
+	// а user_id нужен для каскадного удаления пользователей
+	db.Debug().Model(&Message{}).AddIndex("messages_chat_id_created_at_idx", "chat_id", "created_at")
+	db.Debug().Model(&Message{}).AddIndex("messages_user_id_idx", "user_id")
+	db.Debug().Table("chats_users").AddIndex("chats_users_chat_id_idx", "chat_id")
 }
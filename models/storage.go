@@ -0,0 +1,339 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/lib/pq"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+const (
+	DialectPostgres = "postgres"
+	// DialectSQLite is gorm's name of the SQLite dialect, the storage is opened with the pure-Go driver
+	// (modernc.org/sqlite), so the app builds without cgo
+	DialectSQLite = "sqlite3"
+)
+
+// driverName returns the name of the database/sql driver the dialect's storage is opened with
+func driverName(dialect string) string {
+	if dialect == DialectSQLite {
+		return "sqlite"
+	}
+	return dialect
+}
+
+const (
+	ErrStorageUnavailable modelError = "The storage is unavailable, try again later"
+	ErrStorageTimeout     modelError = "The storage didn't respond in time, try again later"
+	ErrRequestCanceled    modelError = "The request is canceled by the client"
+)
+
+// StatusClientClosedRequest is nginx's status of the requests the clients have given up on, nobody receives it,
+// it only keeps such requests apart from the failures in the logs
+const StatusClientClosedRequest = 499
+
+func init() {
+	describeErrors(map[modelError]errorDescriptor{
+		ErrStorageUnavailable: {code: "STORAGE_UNAVAILABLE"},
+		ErrStorageTimeout:     {code: "STORAGE_TIMEOUT"},
+		ErrRequestCanceled:    {code: "REQUEST_CANCELED"},
+	})
+}
+
+// storageFailure maps an unexpected error of the storage to the response: the connection failures and
+// the timeouts are temporary, so they are reported with 503 to make the clients retry, the rest are internal errors.
+// The queries of the requests the clients have canceled fail the same way as the timed out ones, so ctx tells them apart.
+// database/sql replaces the broken connections itself, so the storage's restart needs no special handling.
+func storageFailure(ctx context.Context, err error) (int, error) {
+	switch {
+	case errors.Is(ctx.Err(), context.Canceled) || errors.Is(err, context.Canceled):
+		return StatusClientClosedRequest, ErrRequestCanceled
+	case isStorageTimeout(err):
+		log.Println(err)
+		return http.StatusServiceUnavailable, ErrStorageTimeout
+	case isStorageUnavailable(err):
+		log.Println(err)
+		return http.StatusServiceUnavailable, ErrStorageUnavailable
+	}
+	return http.StatusInternalServerError, err
+}
+
+// isUniqueViolation reports whether err is a violation of a unique constraint in any of the dialects
+func isUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return pqErr.Code == "23505"
+	}
+
+	var sqliteErr *sqlite.Error
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_UNIQUE || sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_PRIMARYKEY
+	}
+	return false
+}
+
+func isStorageTimeout(err error) bool {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		// query_canceled, it is how statement_timeout and the done contexts are reported
+		return pqErr.Code == "57014"
+	}
+
+	var sqliteErr *sqlite.Error
+	if errors.As(err, &sqliteErr) && sqliteErr.Code() == sqlite3.SQLITE_INTERRUPT {
+		return true
+	}
+	// context.DeadlineExceeded is a net.Error too
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+func isStorageUnavailable(err error) bool {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		// connection_exception, admin_shutdown, crash_shutdown, cannot_connect_now, too_many_connections
+		return pqErr.Code.Class() == "08" || pqErr.Code == "57P01" || pqErr.Code == "57P02" ||
+			pqErr.Code == "57P03" || pqErr.Code == "53300"
+	}
+
+	var sqliteErr *sqlite.Error
+	if errors.As(err, &sqliteErr) {
+		// the database is locked by another writer for longer than busy_timeout, the extended codes keep
+		// the primary one in the lowest byte
+		code := sqliteErr.Code() & 0xff
+		return code == sqlite3.SQLITE_BUSY || code == sqlite3.SQLITE_LOCKED
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return !netErr.Timeout()
+	}
+
+	return errors.Is(err, driver.ErrBadConn) || errors.Is(err, sql.ErrConnDone) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) ||
+		// gorm v1 doesn't wrap the errors of the connection, it is just in case
+		strings.Contains(err.Error(), "connection refused")
+}
+
+// contextSetting is the gorm setting the *gorm.DB of storage.WithContext keeps its context in,
+// the settings are copied to the *gorm.DB derived from it, the transactions' too
+const contextSetting = "bta:context"
+
+// contextOf returns the context of the *gorm.DB handed out by the storage
+func contextOf(db *gorm.DB) context.Context {
+	if ctx, ok := db.Get(contextSetting); ok {
+		return ctx.(context.Context)
+	}
+	return context.Background()
+}
+
+// storage hands out the *gorm.DB bound to the requests' contexts, since gorm v1 has no WithContext:
+// such a *gorm.DB runs the queries with the context, so they are canceled along with the request
+type storage struct {
+	db      *gorm.DB
+	sqlDB   *sql.DB
+	dialect string
+	logger  *log.Logger // nil unless the log mode is on
+
+	// statementTimeout is the limit of the statements the connections have, see contextSQL.BeginTx
+	statementTimeout time.Duration
+
+	// the read replicas, see ReadContext
+	replicas    []*replica
+	nextReplica atomic.Uint32
+	stopChecks  chan struct{}
+}
+
+func newStorage(dialect string, db *gorm.DB) *storage {
+	if dialect == DialectSQLite {
+		db.SetNowFuncOverride(utcNow)
+	}
+	return &storage{
+		db:      db,
+		sqlDB:   db.DB(),
+		dialect: dialect,
+	}
+}
+
+func (st *storage) setLogger(logger *log.Logger) {
+	st.logger = logger
+	st.db.SetLogger(logger)
+	st.db.LogMode(true)
+}
+
+// WithContext returns the *gorm.DB which runs the queries and begins the transactions with ctx
+func (st *storage) WithContext(ctx context.Context) *gorm.DB {
+	return st.open(contextSQL{db: st.sqlDB, ctx: ctx})
+}
+
+func (st *storage) open(c contextSQL) *gorm.DB {
+	c.dialect, c.statementTimeout = st.dialect, st.statementTimeout
+
+	// gorm.Open doesn't connect anywhere if it is given an SQLCommon, so it never fails
+	db, _ := gorm.Open(st.dialect, c)
+	db.InstantSet(contextSetting, c.ctx)
+	if st.dialect == DialectSQLite {
+		// SQLite compares the times as text, so the ones gorm sets must be in the same time zone as the rest
+		db.SetNowFuncOverride(utcNow)
+	}
+	if st.logger != nil {
+		db.SetLogger(st.logger)
+		db.LogMode(true)
+	}
+	return db
+}
+
+func utcNow() time.Time {
+	return time.Now().UTC()
+}
+
+// contextSQL implements gorm.SQLCommon on top of the context-aware methods of *sql.DB
+type contextSQL struct {
+	db  *sql.DB
+	ctx context.Context
+
+	// the replica the queries are run on and the primary they are run again on if the replica fails,
+	// both are nil for the primary
+	replica *replica
+	primary *sql.DB
+
+	dialect          string
+	statementTimeout time.Duration
+}
+
+// retry reports whether the query failed on the replica is to be run again on the primary, it is if the replica
+// is unavailable, which takes it out of the rotation too
+func (c contextSQL) retry(err error) bool {
+	if c.replica == nil || err == nil || !isStorageUnavailable(err) {
+		return false
+	}
+	c.replica.setHealthy(false, err)
+	return c.ctx.Err() == nil
+}
+
+func (c contextSQL) Exec(query string, args ...interface{}) (sql.Result, error) {
+	res, err := c.db.ExecContext(c.ctx, query, args...)
+	if c.retry(err) {
+		return c.primary.ExecContext(c.ctx, query, args...)
+	}
+	return res, err
+}
+
+func (c contextSQL) Prepare(query string) (*sql.Stmt, error) {
+	stmt, err := c.db.PrepareContext(c.ctx, query)
+	if c.retry(err) {
+		return c.primary.PrepareContext(c.ctx, query)
+	}
+	return stmt, err
+}
+
+func (c contextSQL) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	rows, err := c.db.QueryContext(c.ctx, query, args...)
+	if c.retry(err) {
+		return c.primary.QueryContext(c.ctx, query, args...)
+	}
+	return rows, err
+}
+
+func (c contextSQL) QueryRow(query string, args ...interface{}) *sql.Row {
+	row := c.db.QueryRowContext(c.ctx, query, args...)
+	if c.retry(row.Err()) {
+		return c.primary.QueryRowContext(c.ctx, query, args...)
+	}
+	return row
+}
+
+// Begin isn't called by gorm v1, its Begin calls BeginTx with context.Background()
+func (c contextSQL) Begin() (*sql.Tx, error) {
+	return c.BeginTx(c.ctx, nil)
+}
+
+// BeginTx begins the transaction with the context of c instead of ctx, which gorm's Begin passes as
+// context.Background(), so the transaction is rolled back if the request is done before it is committed.
+// In Postgres the transaction's statement timeout is shortened to the time left until the request's deadline,
+// the statements outside the transactions don't need it: lib/pq cancels them in the storage once the context is done.
+// The transaction which can't be begun on a failed replica is begun on the primary, like the queries.
+func (c contextSQL) BeginTx(_ context.Context, opts *sql.TxOptions) (*sql.Tx, error) {
+	ctx := c.ctx
+	tx, err := c.db.BeginTx(ctx, opts)
+	if c.retry(err) {
+		tx, err = c.primary.BeginTx(ctx, opts)
+	}
+	if err != nil || c.dialect != DialectPostgres {
+		return tx, err
+	}
+
+	if timeout, ok := statementTimeout(ctx, c.statementTimeout); ok {
+		// SET doesn't take the parameters
+		_, err = tx.ExecContext(ctx, "SET LOCAL statement_timeout = "+strconv.FormatInt(timeout.Milliseconds(), 10))
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+	return tx, nil
+}
+
+// statementTimeout returns the statement timeout of the request of ctx, it is the time left until the deadline
+// if it's shorter than the limit of the connections (0 means no limit), ok is false if the limit is shorter
+func statementTimeout(ctx context.Context, limit time.Duration) (timeout time.Duration, ok bool) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return 0, false
+	}
+	left := time.Until(deadline)
+	if limit > 0 && left >= limit {
+		return 0, false
+	}
+	// statement_timeout is in milliseconds and 0 turns it off
+	if left < time.Millisecond {
+		left = time.Millisecond
+	}
+	return left, true
+}
+
+// transaction runs fn in a transaction, it joins the one db is already in (e.g. the one of an atomic batch)
+// instead of beginning another, since gorm doesn't support the nested ones
+func transaction(db *gorm.DB, fn func(tx *gorm.DB) error) error {
+	if _, ok := db.CommonDB().(*sql.Tx); ok {
+		return fn(db)
+	}
+
+	tx := db.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+// snapshot runs fn in a read-only transaction which sees the storage as it is at the transaction's first statement,
+// so the statements of fn read the same state. SQLite's transactions see it anyway.
+func snapshot(db *gorm.DB, fn func(tx *gorm.DB) error) error {
+	tx := db.BeginTx(contextOf(db), &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if tx.Error != nil {
+		return tx.Error
+	}
+	// nothing is written, so there is nothing to commit
+	defer tx.Rollback()
+
+	return fn(tx)
+}
@@ -0,0 +1,248 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/lib/pq"
+)
+
+// sqliteBusyError returns the error SQLite fails a write with while another connection holds the write lock
+func sqliteBusyError(t *testing.T) error {
+	t.Helper()
+
+	file := filepath.Join(t.TempDir(), "busy.db")
+	holder, err := sql.Open("sqlite", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer holder.Close()
+	writer, err := sql.Open("sqlite", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer writer.Close()
+
+	if _, err := holder.Exec("CREATE TABLE t (x INTEGER)"); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := holder.Conn(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.ExecContext(context.Background(), "BEGIN IMMEDIATE"); err != nil {
+		t.Fatal(err)
+	}
+	defer conn.ExecContext(context.Background(), "ROLLBACK")
+
+	_, err = writer.Exec("INSERT INTO t VALUES (1)")
+	if err == nil {
+		t.Fatal("the write isn't locked out")
+	}
+	return err
+}
+
+func TestStorageErrorClasses(t *testing.T) {
+	cases := []struct {
+		name                 string
+		err                  error
+		timeout, unavailable bool
+	}{
+		{"query canceled", &pq.Error{Code: "57014"}, true, false},
+		{"deadline", context.DeadlineExceeded, true, false},
+		{"wrapped deadline", fmt.Errorf("query: %w", context.DeadlineExceeded), true, false},
+		{"canceled context", context.Canceled, false, false},
+		{"connection failure", &pq.Error{Code: "08006"}, false, true},
+		{"admin shutdown", &pq.Error{Code: "57P01"}, false, true},
+		{"cannot connect now", &pq.Error{Code: "57P03"}, false, true},
+		{"too many connections", &pq.Error{Code: "53300"}, false, true},
+		{"network", &net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}, false, true},
+		{"network timeout", &net.OpError{Op: "read", Err: context.DeadlineExceeded}, true, false},
+		{"bad connection", driver.ErrBadConn, false, true},
+		{"connection done", sql.ErrConnDone, false, true},
+		{"eof", io.ErrUnexpectedEOF, false, true},
+		{"reset", fmt.Errorf("read: %w", syscall.ECONNRESET), false, true},
+		{"unwrapped refusal", errors.New("dial tcp: connection refused"), false, true},
+		{"sqlite busy", sqliteBusyError(t), false, true},
+		{"unique violation", &pq.Error{Code: "23505"}, false, false},
+		{"syntax", &pq.Error{Code: "42601"}, false, false},
+		{"other", errors.New("failed"), false, false},
+	}
+
+	for _, c := range cases {
+		if got := isStorageTimeout(c.err); got != c.timeout {
+			t.Errorf("%s: isStorageTimeout is %v", c.name, got)
+		}
+		if got := isStorageUnavailable(c.err); got != c.unavailable {
+			t.Errorf("%s: isStorageUnavailable is %v", c.name, got)
+		}
+	}
+}
+
+func TestStorageFailure(t *testing.T) {
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	expired, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	other := errors.New("failed")
+
+	cases := []struct {
+		name       string
+		ctx        context.Context
+		err        error
+		statusCode int
+		want       error
+	}{
+		{"statement timeout", context.Background(), &pq.Error{Code: "57014"}, http.StatusServiceUnavailable, ErrStorageTimeout},
+		{"deadline", expired, &pq.Error{Code: "57014"}, http.StatusServiceUnavailable, ErrStorageTimeout},
+		// lib/pq reports the canceled contexts with the same code as the timeouts
+		{"client canceled", canceled, &pq.Error{Code: "57014"}, StatusClientClosedRequest, ErrRequestCanceled},
+		{"canceled before the query", context.Background(), context.Canceled, StatusClientClosedRequest, ErrRequestCanceled},
+		{"unavailable", context.Background(), driver.ErrBadConn, http.StatusServiceUnavailable, ErrStorageUnavailable},
+		{"internal", context.Background(), other, http.StatusInternalServerError, other},
+	}
+
+	for _, c := range cases {
+		statusCode, err := storageFailure(c.ctx, c.err)
+		if statusCode != c.statusCode || err != c.want {
+			t.Errorf("%s: got %d %v, want %d %v", c.name, statusCode, err, c.statusCode, c.want)
+		}
+	}
+}
+
+func TestStatementTimeout(t *testing.T) {
+	soon, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	late, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	expired, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+
+	cases := []struct {
+		name  string
+		ctx   context.Context
+		limit time.Duration
+		ok    bool
+	}{
+		{"no deadline", context.Background(), 30 * time.Second, false},
+		{"shorter deadline", soon, 30 * time.Second, true},
+		{"longer deadline", late, 30 * time.Second, false},
+		{"no limit", late, 0, true},
+		{"passed deadline", expired, 30 * time.Second, true},
+	}
+
+	for _, c := range cases {
+		deadline, _ := c.ctx.Deadline()
+		left := max(time.Until(deadline), time.Millisecond)
+
+		timeout, ok := statementTimeout(c.ctx, c.limit)
+		if ok != c.ok {
+			t.Errorf("%s: got ok %v", c.name, ok)
+			continue
+		}
+		if ok && (timeout < time.Millisecond || timeout > left) {
+			t.Errorf("%s: got %v", c.name, timeout)
+		}
+	}
+}
+
+// newTestStorage returns the storage of a new SQLite database with the schema
+func newTestStorage(t testing.TB) *storage {
+	t.Helper()
+
+	dsn := "file:" + filepath.Join(t.TempDir(), "bta.db") + "?_pragma=foreign_keys(1)&_txlock=immediate&_time_format=sqlite"
+	db, err := gorm.Open(DialectSQLite, driverName(DialectSQLite), dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	db.SetLogger(log.New(io.Discard, "", 0))
+
+	setSchema(db, DialectSQLite)
+	return newStorage(DialectSQLite, db)
+}
+
+func TestIsUniqueViolation(t *testing.T) {
+	st := newTestStorage(t)
+	db := st.WithContext(context.Background())
+	create := func(name string) error { return db.Create(&User{Name: strPtr(name)}).Error }
+	if err := create("alice"); err != nil {
+		t.Fatal(err)
+	}
+	aliceID, chatID := uint(1), uint(42)
+	missingChat := db.Create(&Message{ChatID: &chatID, UserID: new(uint), Text: strPtr("hey")}).Error
+
+	cases := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"postgres", &pq.Error{Code: "23505"}, true},
+		{"wrapped postgres", fmt.Errorf("insert: %w", &pq.Error{Code: "23505"}), true},
+		{"postgres foreign key", &pq.Error{Code: "23503"}, false},
+		{"sqlite", create("alice"), true},
+		{"sqlite primary key", db.Create(&User{ID: &aliceID, Name: strPtr("bob")}).Error, true},
+		{"sqlite foreign key", missingChat, false},
+		{"other", errors.New("unique"), false},
+		{"nil", nil, false},
+	}
+
+	for _, c := range cases {
+		if got := isUniqueViolation(c.err); got != c.want {
+			t.Errorf("%s (%v): got %v", c.name, c.err, got)
+		}
+	}
+}
+
+// TestSQLiteTimestampsInUTC checks that the times gorm sets are written in UTC whatever the local time zone is,
+// SQLite compares them as text
+func TestSQLiteTimestampsInUTC(t *testing.T) {
+	local := time.Local
+	time.Local = time.FixedZone("MSK", 3*60*60)
+	defer func() { time.Local = local }()
+
+	st := newTestStorage(t)
+	chatID, _ := newTestChat(t, st)
+	if err := st.WithContext(context.Background()).Create(&User{Name: strPtr("bob")}).Error; err != nil {
+		t.Fatal(err)
+	}
+	err := transaction(st.WithContext(context.Background()), func(tx *gorm.DB) error {
+		return tx.Create(&User{Name: strPtr("carol")}).Error
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var times []string
+	err = st.db.Raw(`SELECT CAST(created_at AS TEXT) AS t FROM users
+		UNION ALL SELECT CAST(created_at AS TEXT) FROM chats WHERE id = ?`, chatID).Pluck("t", &times).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(times) != 4 {
+		t.Fatalf("got %q", times)
+	}
+	for _, tm := range times {
+		if !strings.HasSuffix(tm, "+00:00") {
+			t.Errorf("%s isn't in UTC", tm)
+		}
+	}
+
+	if gorm.NowFunc().Location() != time.Local {
+		t.Error("gorm.NowFunc is replaced for the whole process")
+	}
+}
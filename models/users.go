@@ -1,9 +1,9 @@
 package models
 
 import (
+	"context"
 	"github.com/jinzhu/gorm"
 	_ "github.com/jinzhu/gorm/dialects/postgres"
-	"github.com/lib/pq"
 	"net/http"
 	"time"
 )
@@ -25,12 +25,24 @@ const (
 	ErrUserAlreadyExists modelError = "User with this name already exists"
 )
 
+func init() {
+	describeErrors(map[modelError]errorDescriptor{
+		ErrUserNameIsEmpty: {code: "USER_NAME_EMPTY", field: "username"},
+
+		ErrUserNameIsNull: {code: "USER_NAME_NULL", field: "username"},
+
+		ErrUserAlreadyExists: {code: "USER_ALREADY_EXISTS", field: "username"},
+	})
+}
+
 type UserService interface {
 	UserDB
 }
 
 type UserDB interface {
-	Create(user *User) (uint, int, error)
+	Create(ctx context.Context, user *User) (uint, int, error)
+	// CreateBatch creates the users in one transaction if atomic, otherwise one by one
+	CreateBatch(ctx context.Context, users []*User, atomic bool) ([]BatchItem, int, error)
 }
 
 var _ UserService = &userService{}
@@ -39,9 +51,9 @@ type userService struct {
 	UserDB
 }
 
-func NewUserService(db *gorm.DB) UserService {
+func NewUserService(st *storage) UserService {
 	ug := &userGorm{
-		db: db,
+		st: st,
 	}
 
 	uv := newUserValidator(ug)
@@ -54,26 +66,33 @@ func NewUserService(db *gorm.DB) UserService {
 var _ UserDB = &userGorm{}
 
 type userGorm struct {
-	db *gorm.DB
+	st *storage
+}
+
+func (ug *userGorm) Create(ctx context.Context, user *User) (uint, int, error) {
+	return createUser(ug.st.WithContext(ctx), user)
 }
 
-func (ug *userGorm) Create(user *User) (uint, int, error) {
-	err := ug.db.Create(&user).Error
+func createUser(db *gorm.DB, user *User) (uint, int, error) {
+	err := db.Create(&user).Error
 
 	if err != nil {
-		switch e := err.(type) {
-		case *pq.Error:
-			if e.Code == "23505" {
-				return 0, http.StatusConflict, ErrUserAlreadyExists
-			}
+		if isUniqueViolation(err) {
+			return 0, http.StatusConflict, ErrUserAlreadyExists
 		}
-		return 0, http.StatusInternalServerError, err
-
+		statusCode, err := storageFailure(contextOf(db), err)
+		return 0, statusCode, err
 	}
 
 	return *user.ID, http.StatusOK, nil
 }
 
+func (ug *userGorm) CreateBatch(ctx context.Context, users []*User, atomic bool) ([]BatchItem, int, error) {
+	return createBatch(ug.st.WithContext(ctx), len(users), atomic, func(db *gorm.DB, i int) (uint, int, error) {
+		return createUser(db, users[i])
+	})
+}
+
 type userValidator struct {
 	UserDB
 }
@@ -84,7 +103,7 @@ func newUserValidator(udb UserDB) *userValidator {
 	}
 }
 
-func (uv *userValidator) Create(user *User) (uint, int, error) {
+func (uv *userValidator) Create(ctx context.Context, user *User) (uint, int, error) {
 	statusCode, err := runUserValFns(user,
 		uv.userNameNotNull,
 		uv.userNameNotEmpty)
@@ -92,7 +111,34 @@ func (uv *userValidator) Create(user *User) (uint, int, error) {
 		return 0, statusCode, err
 	}
 
-	return uv.UserDB.Create(user)
+	return uv.UserDB.Create(ctx, user)
+}
+
+func (uv *userValidator) CreateBatch(ctx context.Context, users []*User, atomic bool) ([]BatchItem, int, error) {
+	items, valid, statusCode, err := validateBatch(len(users), atomic, func(i int) (int, error) {
+		if users[i] == nil {
+			return http.StatusBadRequest, ErrBatchItemIsNull
+		}
+		return runUserValFns(users[i],
+			uv.userNameNotNull,
+			uv.userNameNotEmpty)
+	})
+	if err != nil || len(valid) == 0 {
+		return items, statusCode, err
+	}
+
+	batch := make([]*User, len(valid))
+	for j, i := range valid {
+		batch[j] = users[i]
+	}
+
+	created, statusCode, err := uv.UserDB.CreateBatch(ctx, batch, atomic)
+	if created == nil {
+		return nil, statusCode, err
+	}
+	mergeBatch(items, valid, created)
+
+	return items, statusCode, err
 }
 
 type userValFn func(*User) (int, error)
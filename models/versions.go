@@ -0,0 +1,101 @@
+package models
+
+import (
+	"fmt"
+	"time"
+)
+
+// Чаты и пользователи не меняются после создания, а сообщения только добавляются (и уходят в архив целиком),
+// так что состояние списка однозначно задают число его чатов и сообщений и их наибольшие id. Версию можно
+// получить одним агрегирующим запросом, не загружая сам список, поэтому условный запрос, на который ответ 304,
+// обходится без загрузки и сериализации списка.
+
+// ListVersion identifies the state of a list, it serves as the list's validator. VersionByUserID and VersionByChatID
+// compute it in the storage, ChatsVersion and MessagesVersion - from the loaded list, the results match.
+type ListVersion struct {
+	Tag          string
+	LastModified *time.Time
+}
+
+func newListVersion(chats, maxChatID, messages, maxMessageID uint, lastModified *time.Time) *ListVersion {
+	return &ListVersion{
+		Tag:          fmt.Sprintf("%d.%d.%d.%d", chats, maxChatID, messages, maxMessageID),
+		LastModified: lastModified,
+	}
+}
+
+// ChatsVersion is VersionByUserID of the loaded chats
+func ChatsVersion(chats []*Chat) *ListVersion {
+	var maxChatID, messages, maxMessageID uint
+	var latest *time.Time
+	for _, chat := range chats {
+		maxChatID = maxUint(maxChatID, chat.ID)
+		latest = later(latest, chat.CreatedAt)
+		for _, msg := range chat.Messages {
+			messages++
+			maxMessageID = maxUint(maxMessageID, msg.ID)
+			latest = later(latest, msg.CreatedAt)
+		}
+	}
+	return newListVersion(uint(len(chats)), maxChatID, messages, maxMessageID, latest)
+}
+
+// MessagesVersion is VersionByChatID of the loaded messages
+func MessagesVersion(msgs []*Message) *ListVersion {
+	var maxMessageID uint
+	var latest *time.Time
+	for _, msg := range msgs {
+		maxMessageID = maxUint(maxMessageID, msg.ID)
+		latest = later(latest, msg.CreatedAt)
+	}
+	return newListVersion(0, 0, uint(len(msgs)), maxMessageID, latest)
+}
+
+func maxUint(a uint, b *uint) uint {
+	if b != nil && *b > a {
+		return *b
+	}
+	return a
+}
+
+// later returns the latest of the times, nil is earlier than anything
+func later(a, b *time.Time) *time.Time {
+	if a == nil || (b != nil && b.After(*a)) {
+		return b
+	}
+	return a
+}
+
+// sqlTimeLayouts are the layouts of the times SQLite returns as text, see sqlTime
+var sqlTimeLayouts = []string{"2006-01-02 15:04:05.999999999-07:00", time.RFC3339Nano, "2006-01-02 15:04:05"}
+
+// sqlTime scans the times the aggregates return, SQLite returns them as text since they lose the column's type
+type sqlTime struct {
+	Time *time.Time
+}
+
+func (t *sqlTime) Scan(v interface{}) error {
+	var s string
+	switch v := v.(type) {
+	case nil:
+		t.Time = nil
+		return nil
+	case time.Time:
+		t.Time = &v
+		return nil
+	case string:
+		s = v
+	case []byte:
+		s = string(v)
+	default:
+		return fmt.Errorf("can't scan %T into a time", v)
+	}
+
+	for _, layout := range sqlTimeLayouts {
+		if parsed, err := time.Parse(layout, s); err == nil {
+			t.Time = &parsed
+			return nil
+		}
+	}
+	return fmt.Errorf("can't parse %q as a time", s)
+}
@@ -0,0 +1,50 @@
+package models
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSQLTimeScan(t *testing.T) {
+	want := time.Date(2020, 1, 4, 10, 1, 0, 500000000, time.UTC)
+
+	for _, v := range []interface{}{
+		want,
+		"2020-01-04 10:01:00.5+00:00",
+		[]byte("2020-01-04 13:01:00.5+03:00"),
+		"2020-01-04T10:01:00.5Z",
+	} {
+		var st sqlTime
+		if err := st.Scan(v); err != nil || st.Time == nil || !st.Time.Equal(want) {
+			t.Errorf("%v: got %v, %v", v, st.Time, err)
+		}
+	}
+
+	st := sqlTime{Time: &want}
+	if err := st.Scan(nil); err != nil || st.Time != nil {
+		t.Errorf("NULL: got %v, %v", st.Time, err)
+	}
+	for _, v := range []interface{}{"yesterday", 42} {
+		if err := st.Scan(v); err == nil {
+			t.Errorf("%v: got %v, want an error", v, st.Time)
+		}
+	}
+}
+
+func TestListVersions(t *testing.T) {
+	id := func(v uint) *uint { return &v }
+	at := func(h int) *time.Time { t := time.Date(2020, 1, 1, h, 0, 0, 0, time.UTC); return &t }
+
+	msgs := []*Message{{ID: id(3), CreatedAt: at(5)}, {ID: id(7), CreatedAt: at(4)}}
+	if v := MessagesVersion(msgs); v.Tag != "0.0.2.7" || !v.LastModified.Equal(*at(5)) {
+		t.Errorf("messages: got %s, %v", v.Tag, v.LastModified)
+	}
+	if v := MessagesVersion(nil); v.Tag != "0.0.0.0" || v.LastModified != nil {
+		t.Errorf("no messages: got %s, %v", v.Tag, v.LastModified)
+	}
+
+	chats := []*Chat{{ID: id(2), CreatedAt: at(6)}, {ID: id(1), CreatedAt: at(1), Messages: msgs}}
+	if v := ChatsVersion(chats); v.Tag != "2.2.2.7" || !v.LastModified.Equal(*at(6)) {
+		t.Errorf("chats: got %s, %v", v.Tag, v.LastModified)
+	}
+}
@@ -0,0 +1,202 @@
+// Package openapi contains a minimal model of an OpenAPI 3 document and a generator
+// of schemas from Go types, which respects encoding/json struct tags.
+package openapi
+
+import (
+	"reflect"
+	"strings"
+	"time"
+)
+
+const Version = "3.0.3"
+
+// Schema is a JSON Schema object, a map is used since only a small part of the specification is needed.
+type Schema map[string]interface{}
+
+type Document struct {
+	OpenAPI    string               `json:"openapi"`
+	Info       Info                 `json:"info"`
+	Paths      map[string]*PathItem `json:"paths"`
+	Components Components           `json:"components"`
+}
+
+type Info struct {
+	Title       string `json:"title"`
+	Version     string `json:"version"`
+	Description string `json:"description,omitempty"`
+}
+
+// PathItem maps lowercased HTTP methods to the operations.
+type PathItem map[string]*Operation
+
+type Operation struct {
+	OperationID string               `json:"operationId"`
+	Summary     string               `json:"summary,omitempty"`
+	Tags        []string             `json:"tags,omitempty"`
+	Parameters  []*Parameter         `json:"parameters,omitempty"`
+	RequestBody *RequestBody         `json:"requestBody,omitempty"`
+	Responses   map[string]*Response `json:"responses"`
+	Deprecated  bool                 `json:"deprecated,omitempty"`
+}
+
+type Parameter struct {
+	Name        string `json:"name"`
+	In          string `json:"in"`
+	Description string `json:"description,omitempty"`
+	Required    bool   `json:"required"`
+	Schema      Schema `json:"schema"`
+}
+
+type RequestBody struct {
+	Required bool                  `json:"required"`
+	Content  map[string]*MediaType `json:"content"`
+}
+
+type Response struct {
+	Description string                `json:"description"`
+	Headers     map[string]*Header    `json:"headers,omitempty"`
+	Content     map[string]*MediaType `json:"content,omitempty"`
+	// ErrorCodes lists the codes which may be reported in ErrorInfo.Code with this response.
+	ErrorCodes []string `json:"x-error-codes,omitempty"`
+}
+
+type Header struct {
+	Description string `json:"description,omitempty"`
+	Schema      Schema `json:"schema"`
+}
+
+type MediaType struct {
+	Schema Schema `json:"schema"`
+}
+
+type Components struct {
+	Schemas map[string]Schema `json:"schemas"`
+}
+
+// Describer is implemented by types whose JSON representation can't be derived from their Go type,
+// e.g. the ones with a custom UnmarshalJSON.
+type Describer interface {
+	OpenAPISchema() map[string]interface{}
+}
+
+var (
+	describerType = reflect.TypeOf((*Describer)(nil)).Elem()
+	timeType      = reflect.TypeOf(time.Time{})
+)
+
+// Generator produces schemas of Go types, named struct types are put into Components
+// and referenced, so recursive types are supported.
+type Generator struct {
+	Components Components
+}
+
+func NewGenerator() *Generator {
+	return &Generator{
+		Components: Components{Schemas: make(map[string]Schema)},
+	}
+}
+
+// SchemaOf returns the schema of v's type, v is only used to obtain the type.
+func (g *Generator) SchemaOf(v interface{}) Schema {
+	return g.schemaOf(reflect.TypeOf(v), false)
+}
+
+func (g *Generator) schemaOf(t reflect.Type, asString bool) Schema {
+	if t.Kind() != reflect.Ptr && t.Implements(describerType) {
+		return Schema(reflect.Zero(t).Interface().(Describer).OpenAPISchema())
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		s := g.schemaOf(t.Elem(), asString)
+		if _, isRef := s["$ref"]; isRef {
+			return Schema{"allOf": []Schema{s}, "nullable": true}
+		}
+		s["nullable"] = true
+		return s
+
+	case reflect.Slice, reflect.Array:
+		return Schema{"type": "array", "items": g.schemaOf(t.Elem(), false)}
+
+	case reflect.Map:
+		return Schema{"type": "object", "additionalProperties": g.schemaOf(t.Elem(), false)}
+
+	case reflect.Bool:
+		if asString {
+			return Schema{"type": "string", "enum": []string{"true", "false"}}
+		}
+		return Schema{"type": "boolean"}
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if asString {
+			return Schema{"type": "string", "pattern": "^-?[0-9]+$"}
+		}
+		return Schema{"type": "integer"}
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if asString {
+			return Schema{"type": "string", "pattern": "^[0-9]+$"}
+		}
+		return Schema{"type": "integer", "minimum": 0}
+
+	case reflect.Float32, reflect.Float64:
+		if asString {
+			return Schema{"type": "string"}
+		}
+		return Schema{"type": "number"}
+
+	case reflect.String:
+		return Schema{"type": "string"}
+
+	case reflect.Interface:
+		return Schema{}
+
+	case reflect.Struct:
+		if t == timeType {
+			return Schema{"type": "string", "format": "date-time"}
+		}
+		if t.Name() == "" {
+			return g.structSchema(t)
+		}
+		name := t.Name()
+		if _, ok := g.Components.Schemas[name]; !ok {
+			// a placeholder breaks the recursion
+			g.Components.Schemas[name] = Schema{}
+			g.Components.Schemas[name] = g.structSchema(t)
+		}
+		return Schema{"$ref": "#/components/schemas/" + name}
+	}
+
+	return Schema{}
+}
+
+func (g *Generator) structSchema(t reflect.Type) Schema {
+	props := make(map[string]Schema)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+
+		name := f.Name
+		asString := false
+		if tag, ok := f.Tag.Lookup("json"); ok {
+			parts := strings.Split(tag, ",")
+			if parts[0] == "-" && len(parts) == 1 {
+				continue
+			}
+			if parts[0] != "" {
+				name = parts[0]
+			}
+			for _, opt := range parts[1:] {
+				if opt == "string" {
+					asString = true
+				}
+			}
+		}
+
+		props[name] = g.schemaOf(f.Type, asString)
+	}
+
+	return Schema{"type": "object", "properties": props}
+}
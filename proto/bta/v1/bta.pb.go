@@ -0,0 +1,933 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.11
+// 	protoc        (unknown)
+// source: bta/v1/bta.proto
+
+// The gRPC counterpart of the JSON HTTP API, the requests go through the same validators,
+// so the behaviour is identical. Optional fields mirror the nullable JSON fields.
+
+package btav1
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	timestamppb "google.golang.org/protobuf/types/known/timestamppb"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type User struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Id            uint64                 `protobuf:"varint,1,opt,name=id,proto3" json:"id,omitempty"`
+	Username      string                 `protobuf:"bytes,2,opt,name=username,proto3" json:"username,omitempty"`
+	CreatedAt     *timestamppb.Timestamp `protobuf:"bytes,3,opt,name=created_at,json=createdAt,proto3" json:"created_at,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *User) Reset() {
+	*x = User{}
+	mi := &file_bta_v1_bta_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *User) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*User) ProtoMessage() {}
+
+func (x *User) ProtoReflect() protoreflect.Message {
+	mi := &file_bta_v1_bta_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use User.ProtoReflect.Descriptor instead.
+func (*User) Descriptor() ([]byte, []int) {
+	return file_bta_v1_bta_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *User) GetId() uint64 {
+	if x != nil {
+		return x.Id
+	}
+	return 0
+}
+
+func (x *User) GetUsername() string {
+	if x != nil {
+		return x.Username
+	}
+	return ""
+}
+
+func (x *User) GetCreatedAt() *timestamppb.Timestamp {
+	if x != nil {
+		return x.CreatedAt
+	}
+	return nil
+}
+
+type Chat struct {
+	state     protoimpl.MessageState `protogen:"open.v1"`
+	Id        uint64                 `protobuf:"varint,1,opt,name=id,proto3" json:"id,omitempty"`
+	Name      string                 `protobuf:"bytes,2,opt,name=name,proto3" json:"name,omitempty"`
+	CreatedAt *timestamppb.Timestamp `protobuf:"bytes,3,opt,name=created_at,json=createdAt,proto3" json:"created_at,omitempty"`
+	Users     []*User                `protobuf:"bytes,4,rep,name=users,proto3" json:"users,omitempty"`
+	// the messages are ordered from the latest to the earliest
+	Messages      []*Message `protobuf:"bytes,5,rep,name=messages,proto3" json:"messages,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Chat) Reset() {
+	*x = Chat{}
+	mi := &file_bta_v1_bta_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Chat) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Chat) ProtoMessage() {}
+
+func (x *Chat) ProtoReflect() protoreflect.Message {
+	mi := &file_bta_v1_bta_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Chat.ProtoReflect.Descriptor instead.
+func (*Chat) Descriptor() ([]byte, []int) {
+	return file_bta_v1_bta_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *Chat) GetId() uint64 {
+	if x != nil {
+		return x.Id
+	}
+	return 0
+}
+
+func (x *Chat) GetName() string {
+	if x != nil {
+		return x.Name
+	}
+	return ""
+}
+
+func (x *Chat) GetCreatedAt() *timestamppb.Timestamp {
+	if x != nil {
+		return x.CreatedAt
+	}
+	return nil
+}
+
+func (x *Chat) GetUsers() []*User {
+	if x != nil {
+		return x.Users
+	}
+	return nil
+}
+
+func (x *Chat) GetMessages() []*Message {
+	if x != nil {
+		return x.Messages
+	}
+	return nil
+}
+
+type Message struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Id            uint64                 `protobuf:"varint,1,opt,name=id,proto3" json:"id,omitempty"`
+	ChatId        uint64                 `protobuf:"varint,2,opt,name=chat_id,json=chatId,proto3" json:"chat_id,omitempty"`
+	AuthorId      uint64                 `protobuf:"varint,3,opt,name=author_id,json=authorId,proto3" json:"author_id,omitempty"`
+	Text          string                 `protobuf:"bytes,4,opt,name=text,proto3" json:"text,omitempty"`
+	CreatedAt     *timestamppb.Timestamp `protobuf:"bytes,5,opt,name=created_at,json=createdAt,proto3" json:"created_at,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Message) Reset() {
+	*x = Message{}
+	mi := &file_bta_v1_bta_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Message) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Message) ProtoMessage() {}
+
+func (x *Message) ProtoReflect() protoreflect.Message {
+	mi := &file_bta_v1_bta_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Message.ProtoReflect.Descriptor instead.
+func (*Message) Descriptor() ([]byte, []int) {
+	return file_bta_v1_bta_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *Message) GetId() uint64 {
+	if x != nil {
+		return x.Id
+	}
+	return 0
+}
+
+func (x *Message) GetChatId() uint64 {
+	if x != nil {
+		return x.ChatId
+	}
+	return 0
+}
+
+func (x *Message) GetAuthorId() uint64 {
+	if x != nil {
+		return x.AuthorId
+	}
+	return 0
+}
+
+func (x *Message) GetText() string {
+	if x != nil {
+		return x.Text
+	}
+	return ""
+}
+
+func (x *Message) GetCreatedAt() *timestamppb.Timestamp {
+	if x != nil {
+		return x.CreatedAt
+	}
+	return nil
+}
+
+type CreateUserRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Username      *string                `protobuf:"bytes,1,opt,name=username,proto3,oneof" json:"username,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *CreateUserRequest) Reset() {
+	*x = CreateUserRequest{}
+	mi := &file_bta_v1_bta_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *CreateUserRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CreateUserRequest) ProtoMessage() {}
+
+func (x *CreateUserRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_bta_v1_bta_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CreateUserRequest.ProtoReflect.Descriptor instead.
+func (*CreateUserRequest) Descriptor() ([]byte, []int) {
+	return file_bta_v1_bta_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *CreateUserRequest) GetUsername() string {
+	if x != nil && x.Username != nil {
+		return *x.Username
+	}
+	return ""
+}
+
+type CreateUserResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Id            uint64                 `protobuf:"varint,1,opt,name=id,proto3" json:"id,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *CreateUserResponse) Reset() {
+	*x = CreateUserResponse{}
+	mi := &file_bta_v1_bta_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *CreateUserResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CreateUserResponse) ProtoMessage() {}
+
+func (x *CreateUserResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_bta_v1_bta_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CreateUserResponse.ProtoReflect.Descriptor instead.
+func (*CreateUserResponse) Descriptor() ([]byte, []int) {
+	return file_bta_v1_bta_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *CreateUserResponse) GetId() uint64 {
+	if x != nil {
+		return x.Id
+	}
+	return 0
+}
+
+type CreateChatRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Name          *string                `protobuf:"bytes,1,opt,name=name,proto3,oneof" json:"name,omitempty"`
+	UserIds       []uint64               `protobuf:"varint,2,rep,packed,name=user_ids,json=userIds,proto3" json:"user_ids,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *CreateChatRequest) Reset() {
+	*x = CreateChatRequest{}
+	mi := &file_bta_v1_bta_proto_msgTypes[5]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *CreateChatRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CreateChatRequest) ProtoMessage() {}
+
+func (x *CreateChatRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_bta_v1_bta_proto_msgTypes[5]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CreateChatRequest.ProtoReflect.Descriptor instead.
+func (*CreateChatRequest) Descriptor() ([]byte, []int) {
+	return file_bta_v1_bta_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *CreateChatRequest) GetName() string {
+	if x != nil && x.Name != nil {
+		return *x.Name
+	}
+	return ""
+}
+
+func (x *CreateChatRequest) GetUserIds() []uint64 {
+	if x != nil {
+		return x.UserIds
+	}
+	return nil
+}
+
+type CreateChatResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Id            uint64                 `protobuf:"varint,1,opt,name=id,proto3" json:"id,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *CreateChatResponse) Reset() {
+	*x = CreateChatResponse{}
+	mi := &file_bta_v1_bta_proto_msgTypes[6]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *CreateChatResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CreateChatResponse) ProtoMessage() {}
+
+func (x *CreateChatResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_bta_v1_bta_proto_msgTypes[6]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CreateChatResponse.ProtoReflect.Descriptor instead.
+func (*CreateChatResponse) Descriptor() ([]byte, []int) {
+	return file_bta_v1_bta_proto_rawDescGZIP(), []int{6}
+}
+
+func (x *CreateChatResponse) GetId() uint64 {
+	if x != nil {
+		return x.Id
+	}
+	return 0
+}
+
+type ListUserChatsRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	UserId        *uint64                `protobuf:"varint,1,opt,name=user_id,json=userId,proto3,oneof" json:"user_id,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ListUserChatsRequest) Reset() {
+	*x = ListUserChatsRequest{}
+	mi := &file_bta_v1_bta_proto_msgTypes[7]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ListUserChatsRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ListUserChatsRequest) ProtoMessage() {}
+
+func (x *ListUserChatsRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_bta_v1_bta_proto_msgTypes[7]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ListUserChatsRequest.ProtoReflect.Descriptor instead.
+func (*ListUserChatsRequest) Descriptor() ([]byte, []int) {
+	return file_bta_v1_bta_proto_rawDescGZIP(), []int{7}
+}
+
+func (x *ListUserChatsRequest) GetUserId() uint64 {
+	if x != nil && x.UserId != nil {
+		return *x.UserId
+	}
+	return 0
+}
+
+type ListUserChatsResponse struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// the chats with the latest messages go first
+	Chats         []*Chat `protobuf:"bytes,1,rep,name=chats,proto3" json:"chats,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ListUserChatsResponse) Reset() {
+	*x = ListUserChatsResponse{}
+	mi := &file_bta_v1_bta_proto_msgTypes[8]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ListUserChatsResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ListUserChatsResponse) ProtoMessage() {}
+
+func (x *ListUserChatsResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_bta_v1_bta_proto_msgTypes[8]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ListUserChatsResponse.ProtoReflect.Descriptor instead.
+func (*ListUserChatsResponse) Descriptor() ([]byte, []int) {
+	return file_bta_v1_bta_proto_rawDescGZIP(), []int{8}
+}
+
+func (x *ListUserChatsResponse) GetChats() []*Chat {
+	if x != nil {
+		return x.Chats
+	}
+	return nil
+}
+
+type CreateMessageRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	ChatId        *uint64                `protobuf:"varint,1,opt,name=chat_id,json=chatId,proto3,oneof" json:"chat_id,omitempty"`
+	AuthorId      *uint64                `protobuf:"varint,2,opt,name=author_id,json=authorId,proto3,oneof" json:"author_id,omitempty"`
+	Text          *string                `protobuf:"bytes,3,opt,name=text,proto3,oneof" json:"text,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *CreateMessageRequest) Reset() {
+	*x = CreateMessageRequest{}
+	mi := &file_bta_v1_bta_proto_msgTypes[9]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *CreateMessageRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CreateMessageRequest) ProtoMessage() {}
+
+func (x *CreateMessageRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_bta_v1_bta_proto_msgTypes[9]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CreateMessageRequest.ProtoReflect.Descriptor instead.
+func (*CreateMessageRequest) Descriptor() ([]byte, []int) {
+	return file_bta_v1_bta_proto_rawDescGZIP(), []int{9}
+}
+
+func (x *CreateMessageRequest) GetChatId() uint64 {
+	if x != nil && x.ChatId != nil {
+		return *x.ChatId
+	}
+	return 0
+}
+
+func (x *CreateMessageRequest) GetAuthorId() uint64 {
+	if x != nil && x.AuthorId != nil {
+		return *x.AuthorId
+	}
+	return 0
+}
+
+func (x *CreateMessageRequest) GetText() string {
+	if x != nil && x.Text != nil {
+		return *x.Text
+	}
+	return ""
+}
+
+type CreateMessageResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Id            uint64                 `protobuf:"varint,1,opt,name=id,proto3" json:"id,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *CreateMessageResponse) Reset() {
+	*x = CreateMessageResponse{}
+	mi := &file_bta_v1_bta_proto_msgTypes[10]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *CreateMessageResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CreateMessageResponse) ProtoMessage() {}
+
+func (x *CreateMessageResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_bta_v1_bta_proto_msgTypes[10]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CreateMessageResponse.ProtoReflect.Descriptor instead.
+func (*CreateMessageResponse) Descriptor() ([]byte, []int) {
+	return file_bta_v1_bta_proto_rawDescGZIP(), []int{10}
+}
+
+func (x *CreateMessageResponse) GetId() uint64 {
+	if x != nil {
+		return x.Id
+	}
+	return 0
+}
+
+type ListChatMessagesRequest struct {
+	state  protoimpl.MessageState `protogen:"open.v1"`
+	ChatId *uint64                `protobuf:"varint,1,opt,name=chat_id,json=chatId,proto3,oneof" json:"chat_id,omitempty"`
+	// if set, only the latest limit messages are returned
+	Limit         *uint64 `protobuf:"varint,2,opt,name=limit,proto3,oneof" json:"limit,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ListChatMessagesRequest) Reset() {
+	*x = ListChatMessagesRequest{}
+	mi := &file_bta_v1_bta_proto_msgTypes[11]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ListChatMessagesRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ListChatMessagesRequest) ProtoMessage() {}
+
+func (x *ListChatMessagesRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_bta_v1_bta_proto_msgTypes[11]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ListChatMessagesRequest.ProtoReflect.Descriptor instead.
+func (*ListChatMessagesRequest) Descriptor() ([]byte, []int) {
+	return file_bta_v1_bta_proto_rawDescGZIP(), []int{11}
+}
+
+func (x *ListChatMessagesRequest) GetChatId() uint64 {
+	if x != nil && x.ChatId != nil {
+		return *x.ChatId
+	}
+	return 0
+}
+
+func (x *ListChatMessagesRequest) GetLimit() uint64 {
+	if x != nil && x.Limit != nil {
+		return *x.Limit
+	}
+	return 0
+}
+
+type ListChatMessagesResponse struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// the earliest messages go first
+	Messages      []*Message `protobuf:"bytes,1,rep,name=messages,proto3" json:"messages,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ListChatMessagesResponse) Reset() {
+	*x = ListChatMessagesResponse{}
+	mi := &file_bta_v1_bta_proto_msgTypes[12]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ListChatMessagesResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ListChatMessagesResponse) ProtoMessage() {}
+
+func (x *ListChatMessagesResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_bta_v1_bta_proto_msgTypes[12]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ListChatMessagesResponse.ProtoReflect.Descriptor instead.
+func (*ListChatMessagesResponse) Descriptor() ([]byte, []int) {
+	return file_bta_v1_bta_proto_rawDescGZIP(), []int{12}
+}
+
+func (x *ListChatMessagesResponse) GetMessages() []*Message {
+	if x != nil {
+		return x.Messages
+	}
+	return nil
+}
+
+type SubscribeMessagesRequest struct {
+	state  protoimpl.MessageState `protogen:"open.v1"`
+	ChatId *uint64                `protobuf:"varint,1,opt,name=chat_id,json=chatId,proto3,oneof" json:"chat_id,omitempty"`
+	// the subscriber, it must be in the chat
+	UserId        *uint64 `protobuf:"varint,2,opt,name=user_id,json=userId,proto3,oneof" json:"user_id,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *SubscribeMessagesRequest) Reset() {
+	*x = SubscribeMessagesRequest{}
+	mi := &file_bta_v1_bta_proto_msgTypes[13]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *SubscribeMessagesRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SubscribeMessagesRequest) ProtoMessage() {}
+
+func (x *SubscribeMessagesRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_bta_v1_bta_proto_msgTypes[13]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SubscribeMessagesRequest.ProtoReflect.Descriptor instead.
+func (*SubscribeMessagesRequest) Descriptor() ([]byte, []int) {
+	return file_bta_v1_bta_proto_rawDescGZIP(), []int{13}
+}
+
+func (x *SubscribeMessagesRequest) GetChatId() uint64 {
+	if x != nil && x.ChatId != nil {
+		return *x.ChatId
+	}
+	return 0
+}
+
+func (x *SubscribeMessagesRequest) GetUserId() uint64 {
+	if x != nil && x.UserId != nil {
+		return *x.UserId
+	}
+	return 0
+}
+
+var File_bta_v1_bta_proto protoreflect.FileDescriptor
+
+const file_bta_v1_bta_proto_rawDesc = "" +
+	"\n" +
+	"\x10bta/v1/bta.proto\x12\x06bta.v1\x1a\x1fgoogle/protobuf/timestamp.proto\"m\n" +
+	"\x04User\x12\x0e\n" +
+	"\x02id\x18\x01 \x01(\x04R\x02id\x12\x1a\n" +
+	"\busername\x18\x02 \x01(\tR\busername\x129\n" +
+	"\n" +
+	"created_at\x18\x03 \x01(\v2\x1a.google.protobuf.TimestampR\tcreatedAt\"\xb6\x01\n" +
+	"\x04Chat\x12\x0e\n" +
+	"\x02id\x18\x01 \x01(\x04R\x02id\x12\x12\n" +
+	"\x04name\x18\x02 \x01(\tR\x04name\x129\n" +
+	"\n" +
+	"created_at\x18\x03 \x01(\v2\x1a.google.protobuf.TimestampR\tcreatedAt\x12\"\n" +
+	"\x05users\x18\x04 \x03(\v2\f.bta.v1.UserR\x05users\x12+\n" +
+	"\bmessages\x18\x05 \x03(\v2\x0f.bta.v1.MessageR\bmessages\"\x9e\x01\n" +
+	"\aMessage\x12\x0e\n" +
+	"\x02id\x18\x01 \x01(\x04R\x02id\x12\x17\n" +
+	"\achat_id\x18\x02 \x01(\x04R\x06chatId\x12\x1b\n" +
+	"\tauthor_id\x18\x03 \x01(\x04R\bauthorId\x12\x12\n" +
+	"\x04text\x18\x04 \x01(\tR\x04text\x129\n" +
+	"\n" +
+	"created_at\x18\x05 \x01(\v2\x1a.google.protobuf.TimestampR\tcreatedAt\"A\n" +
+	"\x11CreateUserRequest\x12\x1f\n" +
+	"\busername\x18\x01 \x01(\tH\x00R\busername\x88\x01\x01B\v\n" +
+	"\t_username\"$\n" +
+	"\x12CreateUserResponse\x12\x0e\n" +
+	"\x02id\x18\x01 \x01(\x04R\x02id\"P\n" +
+	"\x11CreateChatRequest\x12\x17\n" +
+	"\x04name\x18\x01 \x01(\tH\x00R\x04name\x88\x01\x01\x12\x19\n" +
+	"\buser_ids\x18\x02 \x03(\x04R\auserIdsB\a\n" +
+	"\x05_name\"$\n" +
+	"\x12CreateChatResponse\x12\x0e\n" +
+	"\x02id\x18\x01 \x01(\x04R\x02id\"@\n" +
+	"\x14ListUserChatsRequest\x12\x1c\n" +
+	"\auser_id\x18\x01 \x01(\x04H\x00R\x06userId\x88\x01\x01B\n" +
+	"\n" +
+	"\b_user_id\";\n" +
+	"\x15ListUserChatsResponse\x12\"\n" +
+	"\x05chats\x18\x01 \x03(\v2\f.bta.v1.ChatR\x05chats\"\x92\x01\n" +
+	"\x14CreateMessageRequest\x12\x1c\n" +
+	"\achat_id\x18\x01 \x01(\x04H\x00R\x06chatId\x88\x01\x01\x12 \n" +
+	"\tauthor_id\x18\x02 \x01(\x04H\x01R\bauthorId\x88\x01\x01\x12\x17\n" +
+	"\x04text\x18\x03 \x01(\tH\x02R\x04text\x88\x01\x01B\n" +
+	"\n" +
+	"\b_chat_idB\f\n" +
+	"\n" +
+	"_author_idB\a\n" +
+	"\x05_text\"'\n" +
+	"\x15CreateMessageResponse\x12\x0e\n" +
+	"\x02id\x18\x01 \x01(\x04R\x02id\"h\n" +
+	"\x17ListChatMessagesRequest\x12\x1c\n" +
+	"\achat_id\x18\x01 \x01(\x04H\x00R\x06chatId\x88\x01\x01\x12\x19\n" +
+	"\x05limit\x18\x02 \x01(\x04H\x01R\x05limit\x88\x01\x01B\n" +
+	"\n" +
+	"\b_chat_idB\b\n" +
+	"\x06_limit\"G\n" +
+	"\x18ListChatMessagesResponse\x12+\n" +
+	"\bmessages\x18\x01 \x03(\v2\x0f.bta.v1.MessageR\bmessages\"n\n" +
+	"\x18SubscribeMessagesRequest\x12\x1c\n" +
+	"\achat_id\x18\x01 \x01(\x04H\x00R\x06chatId\x88\x01\x01\x12\x1c\n" +
+	"\auser_id\x18\x02 \x01(\x04H\x01R\x06userId\x88\x01\x01B\n" +
+	"\n" +
+	"\b_chat_idB\n" +
+	"\n" +
+	"\b_user_id2R\n" +
+	"\vUserService\x12C\n" +
+	"\n" +
+	"CreateUser\x12\x19.bta.v1.CreateUserRequest\x1a\x1a.bta.v1.CreateUserResponse2\xa0\x01\n" +
+	"\vChatService\x12C\n" +
+	"\n" +
+	"CreateChat\x12\x19.bta.v1.CreateChatRequest\x1a\x1a.bta.v1.CreateChatResponse\x12L\n" +
+	"\rListUserChats\x12\x1c.bta.v1.ListUserChatsRequest\x1a\x1d.bta.v1.ListUserChatsResponse2\xff\x01\n" +
+	"\x0eMessageService\x12L\n" +
+	"\rCreateMessage\x12\x1c.bta.v1.CreateMessageRequest\x1a\x1d.bta.v1.CreateMessageResponse\x12U\n" +
+	"\x10ListChatMessages\x12\x1f.bta.v1.ListChatMessagesRequest\x1a .bta.v1.ListChatMessagesResponse\x12H\n" +
+	"\x11SubscribeMessages\x12 .bta.v1.SubscribeMessagesRequest\x1a\x0f.bta.v1.Message0\x01BDZBgithub.com/nlevankov/backend-trainee-assignment/proto/bta/v1;btav1b\x06proto3"
+
+var (
+	file_bta_v1_bta_proto_rawDescOnce sync.Once
+	file_bta_v1_bta_proto_rawDescData []byte
+)
+
+func file_bta_v1_bta_proto_rawDescGZIP() []byte {
+	file_bta_v1_bta_proto_rawDescOnce.Do(func() {
+		file_bta_v1_bta_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_bta_v1_bta_proto_rawDesc), len(file_bta_v1_bta_proto_rawDesc)))
+	})
+	return file_bta_v1_bta_proto_rawDescData
+}
+
+var file_bta_v1_bta_proto_msgTypes = make([]protoimpl.MessageInfo, 14)
+var file_bta_v1_bta_proto_goTypes = []any{
+	(*User)(nil),                     // 0: bta.v1.User
+	(*Chat)(nil),                     // 1: bta.v1.Chat
+	(*Message)(nil),                  // 2: bta.v1.Message
+	(*CreateUserRequest)(nil),        // 3: bta.v1.CreateUserRequest
+	(*CreateUserResponse)(nil),       // 4: bta.v1.CreateUserResponse
+	(*CreateChatRequest)(nil),        // 5: bta.v1.CreateChatRequest
+	(*CreateChatResponse)(nil),       // 6: bta.v1.CreateChatResponse
+	(*ListUserChatsRequest)(nil),     // 7: bta.v1.ListUserChatsRequest
+	(*ListUserChatsResponse)(nil),    // 8: bta.v1.ListUserChatsResponse
+	(*CreateMessageRequest)(nil),     // 9: bta.v1.CreateMessageRequest
+	(*CreateMessageResponse)(nil),    // 10: bta.v1.CreateMessageResponse
+	(*ListChatMessagesRequest)(nil),  // 11: bta.v1.ListChatMessagesRequest
+	(*ListChatMessagesResponse)(nil), // 12: bta.v1.ListChatMessagesResponse
+	(*SubscribeMessagesRequest)(nil), // 13: bta.v1.SubscribeMessagesRequest
+	(*timestamppb.Timestamp)(nil),    // 14: google.protobuf.Timestamp
+}
+var file_bta_v1_bta_proto_depIdxs = []int32{
+	14, // 0: bta.v1.User.created_at:type_name -> google.protobuf.Timestamp
+	14, // 1: bta.v1.Chat.created_at:type_name -> google.protobuf.Timestamp
+	0,  // 2: bta.v1.Chat.users:type_name -> bta.v1.User
+	2,  // 3: bta.v1.Chat.messages:type_name -> bta.v1.Message
+	14, // 4: bta.v1.Message.created_at:type_name -> google.protobuf.Timestamp
+	1,  // 5: bta.v1.ListUserChatsResponse.chats:type_name -> bta.v1.Chat
+	2,  // 6: bta.v1.ListChatMessagesResponse.messages:type_name -> bta.v1.Message
+	3,  // 7: bta.v1.UserService.CreateUser:input_type -> bta.v1.CreateUserRequest
+	5,  // 8: bta.v1.ChatService.CreateChat:input_type -> bta.v1.CreateChatRequest
+	7,  // 9: bta.v1.ChatService.ListUserChats:input_type -> bta.v1.ListUserChatsRequest
+	9,  // 10: bta.v1.MessageService.CreateMessage:input_type -> bta.v1.CreateMessageRequest
+	11, // 11: bta.v1.MessageService.ListChatMessages:input_type -> bta.v1.ListChatMessagesRequest
+	13, // 12: bta.v1.MessageService.SubscribeMessages:input_type -> bta.v1.SubscribeMessagesRequest
+	4,  // 13: bta.v1.UserService.CreateUser:output_type -> bta.v1.CreateUserResponse
+	6,  // 14: bta.v1.ChatService.CreateChat:output_type -> bta.v1.CreateChatResponse
+	8,  // 15: bta.v1.ChatService.ListUserChats:output_type -> bta.v1.ListUserChatsResponse
+	10, // 16: bta.v1.MessageService.CreateMessage:output_type -> bta.v1.CreateMessageResponse
+	12, // 17: bta.v1.MessageService.ListChatMessages:output_type -> bta.v1.ListChatMessagesResponse
+	2,  // 18: bta.v1.MessageService.SubscribeMessages:output_type -> bta.v1.Message
+	13, // [13:19] is the sub-list for method output_type
+	7,  // [7:13] is the sub-list for method input_type
+	7,  // [7:7] is the sub-list for extension type_name
+	7,  // [7:7] is the sub-list for extension extendee
+	0,  // [0:7] is the sub-list for field type_name
+}
+
+func init() { file_bta_v1_bta_proto_init() }
+func file_bta_v1_bta_proto_init() {
+	if File_bta_v1_bta_proto != nil {
+		return
+	}
+	file_bta_v1_bta_proto_msgTypes[3].OneofWrappers = []any{}
+	file_bta_v1_bta_proto_msgTypes[5].OneofWrappers = []any{}
+	file_bta_v1_bta_proto_msgTypes[7].OneofWrappers = []any{}
+	file_bta_v1_bta_proto_msgTypes[9].OneofWrappers = []any{}
+	file_bta_v1_bta_proto_msgTypes[11].OneofWrappers = []any{}
+	file_bta_v1_bta_proto_msgTypes[13].OneofWrappers = []any{}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_bta_v1_bta_proto_rawDesc), len(file_bta_v1_bta_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   14,
+			NumExtensions: 0,
+			NumServices:   3,
+		},
+		GoTypes:           file_bta_v1_bta_proto_goTypes,
+		DependencyIndexes: file_bta_v1_bta_proto_depIdxs,
+		MessageInfos:      file_bta_v1_bta_proto_msgTypes,
+	}.Build()
+	File_bta_v1_bta_proto = out.File
+	file_bta_v1_bta_proto_goTypes = nil
+	file_bta_v1_bta_proto_depIdxs = nil
+}
@@ -0,0 +1,7 @@
+// Package proto holds the protobuf definitions of the gRPC API, the Go code is generated with
+// protoc-gen-go and protoc-gen-go-grpc:
+//
+//	protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative bta/v1/bta.proto
+package proto
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative bta/v1/bta.proto
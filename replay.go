@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/nlevankov/backend-trainee-assignment/middleware"
+	"github.com/nlevankov/backend-trainee-assignment/views"
+)
+
+// runReplay replays the JSONL traces (see middleware.Trace, APP_RECORD_FILE records them) against a running server
+// or the in-process router and reports the responses which differ from the recorded ones, it returns the exit code
+func runReplay(args []string) int {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s replay [flags] traces.jsonl\n\n"+
+			"Without -target the requests are served in-process by the storage the config points to.\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	target := fs.String("target", "", "the `URL` of a running server, e.g. http://localhost:9000")
+	ignore := fs.String("ignore", "CreatedAt", "comma-separated JSON `keys` whose values aren't compared")
+	failFast := fs.Bool("fail-fast", false, "stop at the first differing response")
+	setSchema := fs.Bool("setschema", false, "WARNING: it is destructive action. Initialize the storage "+
+		"before an in-process replay.")
+	configFlags := RegisterConfigFlags(fs)
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer f.Close()
+
+	var send func(t *middleware.Trace) (int, []byte, error)
+	if *target != "" {
+		send = func(t *middleware.Trace) (int, []byte, error) {
+			return sendTrace(http.DefaultClient, strings.TrimSuffix(*target, "/"), t)
+		}
+	} else {
+		cfg, err := LoadConfig(configFlags)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid config:\n%v\n", err)
+			return 1
+		}
+		views.SetErrorFormat(views.ErrorFormat(cfg.ErrorFormat))
+		views.SetCompressionThreshold(cfg.CompressionThreshold)
+
+		services, err := newServices(cfg, *setSchema)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer services.Close()
+
+		h := newHTTPHandler(cfg, services)
+		send = func(t *middleware.Trace) (int, []byte, error) {
+			return serveTrace(h, t)
+		}
+	}
+
+	r := replayer{send: send, ignore: make(map[string]bool), failFast: *failFast, out: os.Stdout}
+	for _, key := range strings.Split(*ignore, ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			r.ignore[key] = true
+		}
+	}
+
+	if err := r.replay(f); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Fprintf(r.out, "%d passed, %d failed\n", r.passed, r.failed)
+	if r.failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+type replayer struct {
+	send     func(t *middleware.Trace) (status int, body []byte, err error)
+	ignore   map[string]bool
+	failFast bool
+	out      io.Writer
+
+	passed, failed int
+}
+
+func (r *replayer) replay(traces io.Reader) error {
+	sc := bufio.NewScanner(traces)
+	sc.Buffer(nil, 64<<20)
+
+	for line := 1; sc.Scan(); line++ {
+		if len(bytes.TrimSpace(sc.Bytes())) == 0 {
+			continue
+		}
+
+		var t middleware.Trace
+		if err := json.Unmarshal(sc.Bytes(), &t); err != nil {
+			return fmt.Errorf("line %d: %v", line, err)
+		}
+
+		diffs, err := r.check(&t)
+		if err != nil {
+			return fmt.Errorf("line %d: %s %s: %v", line, t.Method, t.Path, err)
+		}
+		if len(diffs) == 0 {
+			r.passed++
+			continue
+		}
+
+		r.failed++
+		fmt.Fprintf(r.out, "FAIL line %d: %s %s\n", line, t.Method, t.Path)
+		for _, d := range diffs {
+			fmt.Fprintf(r.out, "    %s\n", d)
+		}
+		if r.failFast {
+			break
+		}
+	}
+
+	return sc.Err()
+}
+
+// check sends the trace's request and compares the response with the recorded one
+func (r *replayer) check(t *middleware.Trace) ([]string, error) {
+	want, err := t.DecodeResponse()
+	if err != nil {
+		return nil, fmt.Errorf("can't decode the recorded response: %v", err)
+	}
+
+	status, got, err := r.send(t)
+	if err != nil {
+		return nil, err
+	}
+
+	var diffs []string
+	if status != t.Status {
+		diffs = append(diffs, fmt.Sprintf("status: got %d, want %d", status, t.Status))
+	}
+	return append(diffs, diffBodies(got, want, r.ignore)...), nil
+}
+
+func newTraceRequest(t *middleware.Trace, url string) (*http.Request, error) {
+	body, err := t.DecodeBody()
+	if err != nil {
+		return nil, fmt.Errorf("can't decode the recorded body: %v", err)
+	}
+
+	req, err := http.NewRequest(t.Method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range t.Header {
+		req.Header.Set(name, value)
+	}
+	return req, nil
+}
+
+func sendTrace(client *http.Client, target string, t *middleware.Trace) (int, []byte, error) {
+	req, err := newTraceRequest(t, target+t.Path)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+
+	// the transport decompresses the response since it asks for gzip on its own
+	body, err := io.ReadAll(resp.Body)
+	return resp.StatusCode, body, err
+}
+
+func serveTrace(h http.Handler, t *middleware.Trace) (int, []byte, error) {
+	req, err := newTraceRequest(t, t.Path)
+	if err != nil {
+		return 0, nil, err
+	}
+	req.RequestURI = t.Path
+	req.RemoteAddr = "127.0.0.1:0"
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec.Code, rec.Body.Bytes(), nil
+}
+
+// diffBodies compares the JSON bodies value by value skipping the ignored keys, the others byte by byte
+func diffBodies(got, want []byte, ignore map[string]bool) []string {
+	var gotV, wantV interface{}
+	if decodeJSON(got, &gotV) != nil || decodeJSON(want, &wantV) != nil {
+		if !bytes.Equal(got, want) {
+			return []string{fmt.Sprintf("body: got %q, want %q", got, want)}
+		}
+		return nil
+	}
+
+	var diffs []string
+	diffJSON("$", gotV, wantV, ignore, &diffs)
+	return diffs
+}
+
+func decodeJSON(b []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+	if dec.More() {
+		return fmt.Errorf("more than one value")
+	}
+	return nil
+}
+
+func diffJSON(path string, got, want interface{}, ignore map[string]bool, diffs *[]string) {
+	switch w := want.(type) {
+	case map[string]interface{}:
+		g, ok := got.(map[string]interface{})
+		if !ok {
+			break
+		}
+
+		keys := make([]string, 0, len(w)+len(g))
+		for k := range w {
+			keys = append(keys, k)
+		}
+		for k := range g {
+			if _, ok := w[k]; !ok {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			if ignore[k] {
+				continue
+			}
+			gv, gok := g[k]
+			wv, wok := w[k]
+			switch {
+			case !gok:
+				*diffs = append(*diffs, fmt.Sprintf("%s.%s: missing, want %s", path, k, jsonText(wv)))
+			case !wok:
+				*diffs = append(*diffs, fmt.Sprintf("%s.%s: got %s, want none", path, k, jsonText(gv)))
+			default:
+				diffJSON(path+"."+k, gv, wv, ignore, diffs)
+			}
+		}
+		return
+
+	case []interface{}:
+		g, ok := got.([]interface{})
+		if !ok || len(g) != len(w) {
+			break
+		}
+		for i := range w {
+			diffJSON(fmt.Sprintf("%s[%d]", path, i), g[i], w[i], ignore, diffs)
+		}
+		return
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		*diffs = append(*diffs, fmt.Sprintf("%s: got %s, want %s", path, jsonText(got), jsonText(want)))
+	}
+}
+
+func jsonText(v interface{}) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(b)
+}
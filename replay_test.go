@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/nlevankov/backend-trainee-assignment/middleware"
+)
+
+func TestDiffBodies(t *testing.T) {
+	ignore := map[string]bool{"CreatedAt": true}
+
+	cases := []struct {
+		name      string
+		got, want string
+		diffs     []string
+	}{
+		{"equal", `{"result":[{"ID":1,"CreatedAt":"a"}]}`, `{"result":[{"CreatedAt":"b","ID":1}]}`, nil},
+		{"value", `{"result":{"ID":2}}`, `{"result":{"ID":1}}`, []string{"$.result.ID: got 2, want 1"}},
+		{"numbers aren't rounded", `{"id":9007199254740993}`, `{"id":9007199254740992}`,
+			[]string{"$.id: got 9007199254740993, want 9007199254740992"}},
+		{"missing and extra keys", `{"b":1,"c":2}`, `{"a":1,"b":1}`,
+			[]string{`$.a: missing, want 1`, `$.c: got 2, want none`}},
+		{"array element", `[1,{"x":"y"}]`, `[1,{"x":"z"}]`, []string{`$[1].x: got "y", want "z"`}},
+		{"array length", `[1]`, `[1,2]`, []string{`$: got [1], want [1,2]`}},
+		{"types", `{"a":[]}`, `{"a":{}}`, []string{`$.a: got [], want {}`}},
+		{"null", `{"a":null}`, `{"a":1}`, []string{`$.a: got null, want 1`}},
+		{"ignored keys at any depth", `{"CreatedAt":1,"x":{"CreatedAt":2}}`, `{"x":{}}`, nil},
+		{"not JSON", `plain`, `other`, []string{`body: got "plain", want "other"`}},
+		{"equal not JSON", `plain`, `plain`, nil},
+		{"more than one value", `{} {}`, `{}`, []string{`body: got "{} {}", want "{}"`}},
+	}
+
+	for _, c := range cases {
+		if diffs := diffBodies([]byte(c.got), []byte(c.want), ignore); !reflect.DeepEqual(diffs, c.diffs) {
+			t.Errorf("%s: got %q, want %q", c.name, diffs, c.diffs)
+		}
+	}
+}
+
+func TestReplayer(t *testing.T) {
+	traces := strings.Join([]string{
+		`{"method":"GET","path":"/ok","status":200,"response":"{\"result\":1}"}`,
+		``,
+		`{"method":"GET","path":"/status","status":200,"response":"{\"result\":1}"}`,
+		`{"method":"GET","path":"/body","status":200,"response":"{\"result\":2}"}`,
+		`{"method":"GET","path":"/ok","status":200,"response":"{\"result\":1}"}`,
+	}, "\n")
+	send := func(tr *middleware.Trace) (int, []byte, error) {
+		if tr.Path == "/status" {
+			return http.StatusNotFound, []byte(`{"result":1}`), nil
+		}
+		return http.StatusOK, []byte(`{"result":1}`), nil
+	}
+
+	var out bytes.Buffer
+	r := replayer{send: send, out: &out}
+	if err := r.replay(strings.NewReader(traces)); err != nil {
+		t.Fatal(err)
+	}
+	if r.passed != 2 || r.failed != 2 {
+		t.Errorf("got %d passed, %d failed", r.passed, r.failed)
+	}
+	for _, want := range []string{"FAIL line 3: GET /status\n    status: got 404, want 200\n",
+		"FAIL line 4: GET /body\n    $.result: got 1, want 2\n"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("%q isn't reported in:\n%s", want, out.String())
+		}
+	}
+
+	r = replayer{send: send, out: &out, failFast: true}
+	if err := r.replay(strings.NewReader(traces)); err != nil {
+		t.Fatal(err)
+	}
+	if r.passed != 1 || r.failed != 1 {
+		t.Errorf("fail fast: got %d passed, %d failed", r.passed, r.failed)
+	}
+}
+
+func TestReplayerErrors(t *testing.T) {
+	send := func(tr *middleware.Trace) (int, []byte, error) {
+		return 0, nil, errors.New("connection refused")
+	}
+
+	cases := []struct {
+		traces string
+		want   string
+	}{
+		{`{"method":"GET"`, "line 1:"},
+		{`{"method":"GET","path":"/","status":200,"response":"%","response_encoding":"base64"}`,
+			"line 1: GET /: can't decode the recorded response"},
+		{`{"method":"GET","path":"/","status":200}`, "line 1: GET /: connection refused"},
+	}
+
+	for _, c := range cases {
+		r := replayer{send: send, out: &bytes.Buffer{}}
+		if err := r.replay(strings.NewReader(c.traces)); err == nil || !strings.HasPrefix(err.Error(), c.want) {
+			t.Errorf("%s: got %v, want %s", c.traces, err, c.want)
+		}
+	}
+}
@@ -0,0 +1,487 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/mux"
+
+	"github.com/nlevankov/backend-trainee-assignment/controllers"
+	"github.com/nlevankov/backend-trainee-assignment/middleware"
+	"github.com/nlevankov/backend-trainee-assignment/models"
+	"github.com/nlevankov/backend-trainee-assignment/openapi"
+	"github.com/nlevankov/backend-trainee-assignment/views"
+)
+
+// route is both registered in the router and described in the API specification,
+// so a route can't be added without its description.
+type route struct {
+	method  string
+	path    string
+	handler http.HandlerFunc
+	doc     routeDoc
+}
+
+type routeDoc struct {
+	id      string
+	summary string
+	tag     string
+	// body and result are prototypes of the request body and the Result field of the response, nil means none
+	body   interface{}
+	result interface{}
+	// errors which the route may respond with, keyed by HTTP status
+	errors map[int][]error
+	// plain means the response is not wrapped into the {"Result":..,"Error":..} envelope
+	plain bool
+	// query parameters, the path ones are derived from the path
+	query []*openapi.Parameter
+	// successor is the path of the route replacing this deprecated one
+	successor string
+	// conditional means the route supports If-None-Match and If-Modified-Since, see views.RenderConditional
+	conditional bool
+	// batch means the result is an array of views.BatchItem, then result is the type of the result in each of them
+	batch bool
+	// idempotent means the route takes the Idempotency-Key header into account
+	idempotent bool
+	// archived means the response reports the chat's archived history, see controllers.HistoryArchivedHeader
+	archived bool
+	// replicated means the route may read from a replica, see controllers.ReadPrimaryHeader
+	replicated bool
+}
+
+func apiRoutes(usersC *controllers.Users, chatsC *controllers.Chats, messageC *controllers.Message) []route {
+	return append(v1Routes(usersC, chatsC, messageC), legacyRoutes(usersC, chatsC, messageC)...)
+}
+
+// the path variables must be ids, see specPath
+func v1Routes(usersC *controllers.Users, chatsC *controllers.Chats, messageC *controllers.Message) []route {
+	return []route{
+		{http.MethodPost, "/v1/users", usersC.Create, routeDoc{
+			id: "v1CreateUser", summary: "Creates a user", tag: "users",
+			body: models.User{}, result: uint(0), idempotent: true,
+			errors: map[int][]error{
+				http.StatusBadRequest: {models.ErrUserNameIsNull, models.ErrUserNameIsEmpty},
+				http.StatusConflict:   {models.ErrUserAlreadyExists},
+			},
+		}},
+		{http.MethodPost, "/v1/users/batch", usersC.CreateBatch, routeDoc{
+			id: "v1CreateUsers", summary: "Creates the users, each of them is validated as in v1CreateUser", tag: "users",
+			body: []*models.User{}, result: uint(0), batch: true,
+			query: []*openapi.Parameter{partialParam},
+			errors: map[int][]error{
+				http.StatusBadRequest:          {models.ErrBatchIsEmpty, models.ErrBatchIsTooLarge},
+				http.StatusUnprocessableEntity: {models.ErrBatchFailed},
+			},
+		}},
+		{http.MethodGet, "/v1/users/{id:[0-9]+}/chats", chatsC.ListByUser, routeDoc{
+			id: "v1ListUserChats", summary: "Lists the user's chats, the ones with the latest messages first", tag: "chats",
+			result: []*models.Chat{}, conditional: true, replicated: true,
+			errors: map[int][]error{
+				http.StatusNotFound: {models.ErrMessageUserDoesntExist},
+			},
+		}},
+		{http.MethodPost, "/v1/chats", chatsC.Create, routeDoc{
+			id: "v1CreateChat", summary: "Creates a chat with the users", tag: "chats",
+			body: models.ChatQueryParams{}, result: uint(0), idempotent: true,
+			errors: map[int][]error{
+				http.StatusBadRequest: {models.ErrChatNameIsNull, models.ErrChatUsersIsNull, models.ErrChatNameIsEmpty,
+					models.ErrChatUsersIsEmpty, models.ErrChatUsersIDsAreNull, models.ErrChatUsersIsOutOfRange},
+				http.StatusConflict: {models.ErrChatAlreadyExists, models.ErrChatSomeUsersDontExist},
+			},
+		}},
+		{http.MethodPost, "/v1/chats/{id:[0-9]+}/messages", messageC.CreateInChat, routeDoc{
+			id: "v1CreateMessage", summary: "Sends a message to the chat on behalf of the author", tag: "messages",
+			body: models.Message{}, result: uint(0), idempotent: true,
+			errors: map[int][]error{
+				http.StatusBadRequest: {models.ErrMessageAuthorIsNull, models.ErrMessageTextIsNull,
+					models.ErrMessageTextIsEmpty, models.ErrMessageAuthorIsOutOfRange, models.ErrMessageChatIsNotInPath},
+				http.StatusUnauthorized: {models.ErrMessageUserIsNotInChat},
+				http.StatusNotFound:     {models.ErrMessageChatDoesntExist, models.ErrMessageUserDoesntExist},
+			},
+		}},
+		{http.MethodPost, "/v1/messages/batch", messageC.CreateBatch, routeDoc{
+			id: "v1CreateMessages", summary: "Sends the messages, each of them is validated as in v1CreateMessage", tag: "messages",
+			body: []*models.Message{}, result: uint(0), batch: true,
+			query: []*openapi.Parameter{partialParam},
+			errors: map[int][]error{
+				http.StatusBadRequest:          {models.ErrBatchIsEmpty, models.ErrBatchIsTooLarge},
+				http.StatusUnprocessableEntity: {models.ErrBatchFailed},
+			},
+		}},
+		{http.MethodPost, "/v1/messages/lookup", messageC.Lookup, routeDoc{
+			id: "v1LookupMessages", summary: "Lists the messages of several chats as in v1ListChatMessages", tag: "messages",
+			body: models.MessageLookup{}, result: []*models.Message{}, batch: true,
+			errors: map[int][]error{
+				http.StatusBadRequest: {models.ErrBatchIsEmpty, models.ErrBatchIsTooLarge, models.ErrBatchItemIsNull,
+					models.ErrMessageLimitIsZero},
+			},
+		}},
+		{http.MethodGet, "/v1/chats/{id:[0-9]+}/messages", messageC.ListByChat, routeDoc{
+			id: "v1ListChatMessages", summary: "Lists the chat's messages, the earliest first", tag: "messages",
+			result: []*models.Message{}, conditional: true, archived: true, replicated: true,
+			query: []*openapi.Parameter{{
+				Name: "limit", In: "query", Description: "return only the latest limit messages",
+				Schema: openapi.Schema{"type": "integer", "minimum": 1, "maximum": uint32(math.MaxUint32)},
+			}},
+			errors: map[int][]error{
+				http.StatusBadRequest: {models.ErrMessageLimitIsZero},
+				http.StatusNotFound:   {models.ErrMessageChatDoesntExist},
+			},
+		}},
+	}
+}
+
+// partialParam switches the batches from the all or nothing mode to the partial success one
+var partialParam = &openapi.Parameter{
+	Name: "partial", In: "query",
+	Description: "create the valid items even if some items fail, by default none of them is created then",
+	Schema:      openapi.Schema{"type": "boolean", "default": false},
+}
+
+// legacyRoutes are kept for the compatibility with the old clients until they are removed,
+// the responses carry the Deprecation header and the link to the successor.
+func legacyRoutes(usersC *controllers.Users, chatsC *controllers.Chats, messageC *controllers.Message) []route {
+	return []route{
+		{http.MethodPost, "/users/add", usersC.Create, routeDoc{
+			id: "createUser", summary: "Creates a user", tag: "users",
+			body: models.User{}, result: uint(0), idempotent: true, successor: "/v1/users",
+			errors: map[int][]error{
+				http.StatusBadRequest: {models.ErrUserNameIsNull, models.ErrUserNameIsEmpty},
+				http.StatusConflict:   {models.ErrUserAlreadyExists},
+			},
+		}},
+		{http.MethodPost, "/chats/add", chatsC.Create, routeDoc{
+			id: "createChat", summary: "Creates a chat with the users", tag: "chats",
+			body: models.ChatQueryParams{}, result: uint(0), idempotent: true, successor: "/v1/chats",
+			errors: map[int][]error{
+				http.StatusBadRequest: {models.ErrChatNameIsNull, models.ErrChatUsersIsNull, models.ErrChatNameIsEmpty,
+					models.ErrChatUsersIsEmpty, models.ErrChatUsersIDsAreNull, models.ErrChatUsersIsOutOfRange},
+				http.StatusConflict: {models.ErrChatAlreadyExists, models.ErrChatSomeUsersDontExist},
+			},
+		}},
+		{http.MethodPost, "/messages/add", messageC.Create, routeDoc{
+			id: "createMessage", summary: "Sends a message to the chat on behalf of the author", tag: "messages",
+			body: models.Message{}, result: uint(0), idempotent: true, successor: "/v1/chats/{id}/messages",
+			errors: map[int][]error{
+				http.StatusBadRequest: {models.ErrMessageChatIsNull, models.ErrMessageAuthorIsNull,
+					models.ErrMessageTextIsNull, models.ErrMessageTextIsEmpty, models.ErrMessageChatIsOutOfRange,
+					models.ErrMessageAuthorIsOutOfRange},
+				http.StatusUnauthorized: {models.ErrMessageUserIsNotInChat},
+				http.StatusNotFound:     {models.ErrMessageChatDoesntExist, models.ErrMessageUserDoesntExist},
+			},
+		}},
+		{http.MethodPost, "/chats/get", chatsC.ByUserID, routeDoc{
+			id: "listUserChats", summary: "Lists the user's chats, the ones with the latest messages first", tag: "chats",
+			body: models.ChatQueryParams{}, result: []*models.Chat{}, successor: "/v1/users/{id}/chats",
+			conditional: true, replicated: true,
+			errors: map[int][]error{
+				http.StatusBadRequest: {models.ErrChatUserIsNull, models.ErrChatUserIsOutOfRange},
+				http.StatusNotFound:   {models.ErrMessageUserDoesntExist},
+			},
+		}},
+		{http.MethodPost, "/messages/get", messageC.ByChatID, routeDoc{
+			id: "listChatMessages", summary: "Lists the chat's messages, the earliest first", tag: "messages",
+			body: models.Message{}, result: []*models.Message{}, successor: "/v1/chats/{id}/messages",
+			conditional: true, archived: true, replicated: true,
+			errors: map[int][]error{
+				http.StatusBadRequest: {models.ErrMessageChatIsNull, models.ErrMessageChatIsOutOfRange},
+				http.StatusNotFound:   {models.ErrMessageChatDoesntExist},
+			},
+		}},
+	}
+}
+
+// newRouter registers the routes and the API specification built from them at /openapi.json.
+func newRouter(routes []route) *mux.Router {
+	r := mux.NewRouter()
+
+	r.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		views.Render(w, req, nil, http.StatusNotFound, models.ErrNoSuchEndpointExists)
+	})
+	r.MethodNotAllowedHandler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		views.Render(w, req, nil, http.StatusNotFound, models.ErrNoSuchHTTPMethod)
+	})
+
+	routes = append(routes, specRoute(routes))
+	for _, rt := range routes {
+		handler := rt.handler
+		if rt.doc.successor != "" {
+			handler = deprecated(rt.doc.successor, handler)
+		}
+		r.HandleFunc(rt.path, handler).Methods(rt.method)
+	}
+
+	return r
+}
+
+// limitBodies wraps the routes' handlers with controllers.LimitBody, limits are keyed by the routes' paths
+// as they are in the API specification, the rest of the routes get the default limit.
+func limitBodies(routes []route, def int64, limits map[string]int64) []route {
+	limited := make([]route, len(routes))
+	for i, rt := range routes {
+		limit := def
+		if l, ok := limits[specPathOnly(rt.path)]; ok {
+			limit = l
+		}
+		rt.handler = controllers.LimitBody(limit, rt.handler)
+		limited[i] = rt
+	}
+	return limited
+}
+
+func specPathOnly(path string) string {
+	p, _ := specPath(path)
+	return p
+}
+
+func deprecated(successor string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Deprecation", "true")
+		w.Header().Set("Link", fmt.Sprintf("<%s>; rel=\"successor-version\"", successor))
+		h(w, r)
+	}
+}
+
+// specPath converts the router's path template into the OpenAPI one and returns the names of its variables
+func specPath(path string) (string, []string) {
+	var b strings.Builder
+	var vars []string
+	for {
+		start := strings.IndexByte(path, '{')
+		if start == -1 {
+			b.WriteString(path)
+			return b.String(), vars
+		}
+		end := strings.IndexByte(path[start:], '}') + start
+
+		name := strings.SplitN(path[start+1:end], ":", 2)[0]
+		vars = append(vars, name)
+		b.WriteString(path[:start] + "{" + name + "}")
+		path = path[end+1:]
+	}
+}
+
+func specRoute(routes []route) route {
+	rt := route{http.MethodGet, "/openapi.json", nil, routeDoc{
+		id: "getOpenAPISpec", summary: "Returns this document", tag: "meta",
+		result: map[string]interface{}{}, plain: true,
+	}}
+
+	spec, err := json.MarshalIndent(apiSpec(append(routes, rt)), "", "  ")
+	must(err)
+
+	rt.handler = func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if _, err := w.Write(spec); err != nil {
+			log.Println(err)
+		}
+	}
+
+	return rt
+}
+
+func apiSpec(routes []route) *openapi.Document {
+	g := openapi.NewGenerator()
+	g.Components.Schemas["ErrorInfo"] = openapi.Schema{
+		"type": "object",
+		"properties": map[string]openapi.Schema{
+			"Code":    {"type": "string"},
+			"Field":   {"type": "string", "nullable": true},
+			"Details": {"type": "object", "nullable": true},
+		},
+	}
+	g.Components.Schemas["ErrorResponse"] = envelope(nil)
+
+	doc := &openapi.Document{
+		OpenAPI: openapi.Version,
+		Info: openapi.Info{
+			Title:   "backend-trainee-assignment",
+			Version: "1.0.0",
+			Description: "Chat backend. Every response except the plain ones is wrapped into " +
+				`{"Result":..,"Error":..,"ErrorInfo":..}, clients should rely on ErrorInfo.Code.`,
+		},
+		Paths:      make(map[string]*openapi.PathItem),
+		Components: g.Components,
+	}
+
+	for _, rt := range routes {
+		path, vars := specPath(rt.path)
+		item, ok := doc.Paths[path]
+		if !ok {
+			item = &openapi.PathItem{}
+			doc.Paths[path] = item
+		}
+
+		op := operation(g, rt)
+		for _, v := range vars {
+			op.Parameters = append(op.Parameters, &openapi.Parameter{
+				Name: v, In: "path", Required: true,
+				Schema: openapi.Schema{"type": "integer", "minimum": 0, "maximum": math.MaxInt32},
+			})
+		}
+		op.Parameters = append(op.Parameters, rt.doc.query...)
+		(*item)[strings.ToLower(rt.method)] = op
+	}
+
+	return doc
+}
+
+func operation(g *openapi.Generator, rt route) *openapi.Operation {
+	op := &openapi.Operation{
+		OperationID: rt.doc.id,
+		Summary:     rt.doc.summary,
+		Tags:        []string{rt.doc.tag},
+		Responses:   make(map[string]*openapi.Response),
+		Deprecated:  rt.doc.successor != "",
+	}
+
+	if rt.doc.plain {
+		op.Responses["200"] = &openapi.Response{
+			Description: http.StatusText(http.StatusOK),
+			Content:     jsonContent(g.SchemaOf(rt.doc.result)),
+		}
+		return op
+	}
+
+	var result, batchFailed openapi.Schema
+	if rt.doc.result != nil {
+		result = g.SchemaOf(rt.doc.result)
+		if rt.doc.batch {
+			result = batchOf(result)
+			// the failed batch still reports the outcome of every item
+			batchFailed = envelope(batchOf(g.SchemaOf(rt.doc.result)))
+		}
+		result["nullable"] = true
+	}
+	op.Responses["200"] = &openapi.Response{
+		Description: http.StatusText(http.StatusOK),
+		Content:     negotiatedContent(envelope(result)),
+	}
+
+	if rt.doc.archived {
+		op.Responses["200"].Headers = map[string]*openapi.Header{
+			controllers.HistoryArchivedHeader: {
+				Description: "the chat's messages created before this time are archived and aren't listed",
+				Schema:      openapi.Schema{"type": "string"},
+			},
+		}
+	}
+
+	if rt.doc.replicated {
+		op.Parameters = append(op.Parameters, &openapi.Parameter{
+			Name: controllers.ReadPrimaryHeader, In: "header",
+			Description: "true makes the request read from the primary storage, so it sees the client's own writes",
+			Schema:      openapi.Schema{"type": "boolean"},
+		})
+	}
+
+	if rt.doc.conditional {
+		op.Parameters = append(op.Parameters,
+			&openapi.Parameter{Name: "If-None-Match", In: "header", Schema: openapi.Schema{"type": "string"}},
+			&openapi.Parameter{Name: "If-Modified-Since", In: "header", Schema: openapi.Schema{"type": "string"}},
+		)
+		op.Responses["304"] = &openapi.Response{Description: http.StatusText(http.StatusNotModified)}
+	}
+
+	codes := make(map[int][]string)
+	for status, errs := range rt.doc.errors {
+		for _, err := range errs {
+			codes[status] = append(codes[status], err.(views.CodedError).Code())
+		}
+	}
+	if rt.doc.idempotent {
+		op.Parameters = append(op.Parameters, &openapi.Parameter{
+			Name: "Idempotency-Key", In: "header",
+			Schema: openapi.Schema{"type": "string", "maxLength": 255},
+		})
+		codes[http.StatusBadRequest] = append(codes[http.StatusBadRequest], models.ErrIdempotencyKeyTooLong.Code())
+		codes[http.StatusConflict] = append(codes[http.StatusConflict], models.ErrIdempotencyKeyInProgress.Code())
+		codes[http.StatusUnprocessableEntity] = append(codes[http.StatusUnprocessableEntity], models.ErrIdempotencyKeyReused.Code())
+	}
+	if rt.doc.body != nil {
+		body := g.SchemaOf(rt.doc.body)
+		op.RequestBody = &openapi.RequestBody{
+			Required: true,
+			Content:  make(map[string]*openapi.MediaType),
+		}
+		for _, ct := range controllers.BodyContentTypes {
+			op.RequestBody.Content[ct] = &openapi.MediaType{Schema: body}
+		}
+		for status, cs := range controllers.BodyErrorCodes {
+			codes[status] = append(codes[status], cs...)
+		}
+	}
+	if _, vars := specPath(rt.path); len(vars) > 0 || len(rt.doc.query) > 0 {
+		for status, cs := range controllers.ParamErrorCodes {
+			codes[status] = append(codes[status], cs...)
+		}
+	}
+	codes[http.StatusTooManyRequests] = append(codes[http.StatusTooManyRequests], middleware.CodeRateLimited)
+	codes[http.StatusInternalServerError] = append(codes[http.StatusInternalServerError], views.CodeInternal)
+	codes[http.StatusServiceUnavailable] = append(codes[http.StatusServiceUnavailable],
+		models.ErrStorageUnavailable.Code(), models.ErrStorageTimeout.Code())
+
+	for status, cs := range codes {
+		sort.Strings(cs)
+		schema := openapi.Schema{"$ref": "#/components/schemas/ErrorResponse"}
+		if status == http.StatusUnprocessableEntity && batchFailed != nil {
+			schema = batchFailed
+		}
+		op.Responses[fmt.Sprint(status)] = &openapi.Response{
+			Description: http.StatusText(status),
+			Content:     negotiatedContent(schema),
+			ErrorCodes:  cs,
+		}
+	}
+
+	return op
+}
+
+// batchOf describes the results rendered as views.BatchItem
+func batchOf(result openapi.Schema) openapi.Schema {
+	result["nullable"] = true
+	return openapi.Schema{
+		"type": "array",
+		"items": openapi.Schema{
+			"type": "object",
+			"properties": map[string]openapi.Schema{
+				"Status":    {"type": "integer"},
+				"Result":    result,
+				"Error":     {"type": "string", "nullable": true},
+				"ErrorInfo": {"allOf": []openapi.Schema{{"$ref": "#/components/schemas/ErrorInfo"}}, "nullable": true},
+			},
+		},
+	}
+}
+
+func envelope(result openapi.Schema) openapi.Schema {
+	if result == nil {
+		result = openapi.Schema{"nullable": true}
+	}
+	return openapi.Schema{
+		"type": "object",
+		"properties": map[string]openapi.Schema{
+			"Result":    result,
+			"Error":     {"type": "string", "nullable": true},
+			"ErrorInfo": {"allOf": []openapi.Schema{{"$ref": "#/components/schemas/ErrorInfo"}}, "nullable": true},
+		},
+	}
+}
+
+// negotiatedContent describes the responses rendered by views.Render
+func negotiatedContent(s openapi.Schema) map[string]*openapi.MediaType {
+	content := make(map[string]*openapi.MediaType)
+	for _, ct := range views.ResponseContentTypes {
+		content[ct] = &openapi.MediaType{Schema: s}
+	}
+	return content
+}
+
+func jsonContent(s openapi.Schema) map[string]*openapi.MediaType {
+	return map[string]*openapi.MediaType{"application/json": {Schema: s}}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+var update = flag.Bool("update", false, "update the golden files")
+
+const specGolden = "docs/openapi.json"
+
+// TestOpenAPISpecIsUpToDate fails when a route or a model changes without the committed specification
+// being regenerated with "go test -run TestOpenAPISpecIsUpToDate -update".
+func TestOpenAPISpecIsUpToDate(t *testing.T) {
+	r := newRouter(apiRoutes(nil, nil, nil))
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/openapi.json", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /openapi.json: got status %d", w.Code)
+	}
+	got := append(w.Body.Bytes(), '\n')
+
+	if *update {
+		if err := ioutil.WriteFile(specGolden, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want, err := ioutil.ReadFile(specGolden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("%s is out of date, run the test with -update and review the diff", specGolden)
+	}
+}
+
+func TestOpenAPISpecCoversRoutes(t *testing.T) {
+	r := newRouter(apiRoutes(nil, nil, nil))
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/openapi.json", nil))
+
+	var spec struct {
+		Paths map[string]map[string]json.RawMessage
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &spec); err != nil {
+		t.Fatal(err)
+	}
+
+	registered := make(map[string]bool)
+	err := r.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		path, err := route.GetPathTemplate()
+		if err != nil {
+			return err
+		}
+		path, _ = specPath(path)
+		methods, err := route.GetMethods()
+		if err != nil {
+			return err
+		}
+		for _, m := range methods {
+			key := m + " " + path
+			registered[key] = true
+			if _, ok := spec.Paths[path][strings.ToLower(m)]; !ok {
+				t.Errorf("%s is registered but not described", key)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for path, item := range spec.Paths {
+		for m := range item {
+			key := strings.ToUpper(m) + " " + path
+			if !registered[key] {
+				t.Errorf("%s is described but not registered", key)
+			}
+		}
+	}
+}
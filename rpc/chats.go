@@ -0,0 +1,60 @@
+package rpc
+
+import (
+	"context"
+
+	"github.com/nlevankov/backend-trainee-assignment/models"
+	btav1 "github.com/nlevankov/backend-trainee-assignment/proto/bta/v1"
+)
+
+type Chats struct {
+	btav1.UnimplementedChatServiceServer
+	cs models.ChatService
+}
+
+func NewChats(cs models.ChatService) *Chats {
+	return &Chats{
+		cs: cs,
+	}
+}
+
+func (c *Chats) CreateChat(ctx context.Context, req *btav1.CreateChatRequest) (*btav1.CreateChatResponse, error) {
+	cqp := models.ChatQueryParams{Name: req.Name}
+
+	// repeated fields can't be null, so the missing ids are reported as empty ones
+	ids := make([]uint, len(req.UserIds))
+	for i := range req.UserIds {
+		id, err := idArg(&req.UserIds[i], "users")
+		if err != nil {
+			return nil, err
+		}
+		ids[i] = *id
+	}
+	cqp.SetUserIDs(ids)
+
+	id, statusCode, err := c.cs.Create(ctx, &cqp)
+	if err != nil {
+		return nil, toStatus(statusCode, err)
+	}
+
+	return &btav1.CreateChatResponse{Id: uint64(id)}, nil
+}
+
+func (c *Chats) ListUserChats(ctx context.Context, req *btav1.ListUserChatsRequest) (*btav1.ListUserChatsResponse, error) {
+	userID, err := idArg(req.UserId, "user")
+	if err != nil {
+		return nil, err
+	}
+
+	chats, statusCode, err := c.cs.ByUserID(ctx, userID)
+	if err != nil {
+		return nil, toStatus(statusCode, err)
+	}
+
+	resp := &btav1.ListUserChatsResponse{}
+	for _, chat := range chats {
+		resp.Chats = append(resp.Chats, chatToProto(chat))
+	}
+
+	return resp, nil
+}
@@ -0,0 +1,243 @@
+// Package rpc implements the gRPC API on top of the same services the HTTP controllers use.
+package rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/nlevankov/backend-trainee-assignment/models"
+	btav1 "github.com/nlevankov/backend-trainee-assignment/proto/bta/v1"
+	"github.com/nlevankov/backend-trainee-assignment/views"
+)
+
+// ErrorDomain is reported in google.rpc.ErrorInfo along with the error code (as the reason).
+const ErrorDomain = "bta"
+
+// ReadPrimaryKey is the request metadata making the call read from the primary storage rather than a replica
+// if it's true, the clients send it to see their own writes the replicas may lag behind
+const ReadPrimaryKey = "x-read-primary"
+
+// errShuttingDown is the cause of the streams' contexts cancellation by Server.Shutdown
+var errShuttingDown = errors.New("the server is shutting down")
+
+// Server is grpc.Server which ends the streams when it's shut down, they don't end on their own
+type Server struct {
+	*grpc.Server
+
+	streams       context.Context
+	cancelStreams context.CancelCauseFunc
+}
+
+func NewServer(services *models.Services, opts ...grpc.ServerOption) *Server {
+	s := &Server{}
+	s.streams, s.cancelStreams = context.WithCancelCause(context.Background())
+	s.Server = grpc.NewServer(append(opts,
+		grpc.ChainUnaryInterceptor(readYourWrites),
+		grpc.ChainStreamInterceptor(s.endOnShutdown),
+	)...)
+
+	btav1.RegisterUserServiceServer(s, NewUsers(services.User))
+	btav1.RegisterChatServiceServer(s, NewChats(services.Chat))
+	btav1.RegisterMessageServiceServer(s, NewMessages(services.Message))
+
+	return s
+}
+
+// Shutdown cancels the streams' contexts and waits up to timeout for the calls in flight to finish,
+// then it closes the connections anyway
+func (s *Server) Shutdown(timeout time.Duration) {
+	s.cancelStreams(errShuttingDown)
+
+	stopped := make(chan struct{})
+	go func() {
+		s.GracefulStop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-time.After(timeout):
+		log.Printf("The gRPC calls haven't finished in %v, closing the connections", timeout)
+		s.Stop()
+	}
+}
+
+// endOnShutdown cancels the stream's context once Shutdown is called
+func (s *Server) endOnShutdown(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo,
+	handler grpc.StreamHandler) error {
+
+	ctx, cancel := context.WithCancelCause(ss.Context())
+	defer cancel(nil)
+	stop := context.AfterFunc(s.streams, func() { cancel(context.Cause(s.streams)) })
+	defer stop()
+
+	return handler(srv, &serverStream{ServerStream: ss, ctx: ctx})
+}
+
+type serverStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (ss *serverStream) Context() context.Context {
+	return ss.ctx
+}
+
+// WithTimeout sets the deadline of the unary calls which come without a shorter one,
+// the streams aren't limited since they are meant to be long.
+func WithTimeout(timeout time.Duration) grpc.ServerOption {
+	return grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler) (interface{}, error) {
+
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+
+		return handler(ctx, req)
+	})
+}
+
+// readYourWrites honors ReadPrimaryKey, see models.ReadPrimary
+func readYourWrites(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler) (interface{}, error) {
+
+	if values := metadata.ValueFromIncomingContext(ctx, ReadPrimaryKey); len(values) > 0 {
+		if primary, _ := strconv.ParseBool(values[0]); primary {
+			ctx = models.ReadPrimary(ctx)
+		}
+	}
+	return handler(ctx, req)
+}
+
+var grpcCodes = map[int]codes.Code{
+	http.StatusBadRequest:         codes.InvalidArgument,
+	http.StatusUnauthorized:       codes.PermissionDenied,
+	http.StatusNotFound:           codes.NotFound,
+	http.StatusConflict:           codes.AlreadyExists,
+	http.StatusServiceUnavailable: codes.Unavailable,
+
+	models.StatusClientClosedRequest: codes.Canceled,
+}
+
+// toStatus converts the services' error into a gRPC status, the error's code and field
+// are attached as google.rpc.ErrorInfo, it assumes that err != nil
+func toStatus(statusCode int, err error) error {
+	pErr, ok := err.(views.PublicError)
+	if !ok {
+		log.Println(err)
+		return status.Error(codes.Internal, http.StatusText(http.StatusInternalServerError))
+	}
+
+	code, ok := grpcCodes[statusCode]
+	if !ok {
+		code = codes.Unknown
+	}
+
+	info := &errdetails.ErrorInfo{Domain: ErrorDomain, Reason: views.CodeInternal}
+	if cErr, ok := err.(views.CodedError); ok {
+		info.Reason = cErr.Code()
+	}
+	if fErr, ok := err.(views.FieldError); ok && fErr.Field() != "" {
+		info.Metadata = map[string]string{"field": fErr.Field()}
+	}
+
+	st := status.New(code, pErr.Public())
+	if withDetails, err := st.WithDetails(info); err == nil {
+		st = withDetails
+	}
+
+	return st.Err()
+}
+
+// CodeArgumentOutOfRange is the reason of the InvalidArgument status of the numeric arguments
+// which are out of the range the HTTP API accepts
+const CodeArgumentOutOfRange = "ARGUMENT_OUT_OF_RANGE"
+
+// idArg converts the optional id argument, the ids greater than models.MaxID are rejected
+// as they are by the HTTP API
+func idArg(v *uint64, field string) (*uint, error) {
+	return uintArg(v, field, models.MaxID)
+}
+
+// uintArg converts the optional argument, it fails with InvalidArgument if the argument is greater than max
+func uintArg(v *uint64, field string, max uint64) (*uint, error) {
+	if v == nil {
+		return nil, nil
+	}
+	if *v > max {
+		st := status.New(codes.InvalidArgument, fmt.Sprintf("'%s' must not be greater than %d", field, max))
+		info := &errdetails.ErrorInfo{Domain: ErrorDomain, Reason: CodeArgumentOutOfRange,
+			Metadata: map[string]string{"field": field, "max": strconv.FormatUint(max, 10)}}
+		if withDetails, err := st.WithDetails(info); err == nil {
+			st = withDetails
+		}
+		return nil, st.Err()
+	}
+	u := uint(*v)
+	return &u, nil
+}
+
+func timestamp(t *time.Time) *timestamppb.Timestamp {
+	if t == nil {
+		return nil
+	}
+	return timestamppb.New(*t)
+}
+
+func value(v *uint) uint64 {
+	if v == nil {
+		return 0
+	}
+	return uint64(*v)
+}
+
+func text(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+func userToProto(u *models.User) *btav1.User {
+	return &btav1.User{
+		Id:        value(u.ID),
+		Username:  text(u.Name),
+		CreatedAt: timestamp(u.CreatedAt),
+	}
+}
+
+func chatToProto(c *models.Chat) *btav1.Chat {
+	pc := &btav1.Chat{
+		Id:        value(c.ID),
+		Name:      text(c.Name),
+		CreatedAt: timestamp(c.CreatedAt),
+	}
+	for _, u := range c.Users {
+		pc.Users = append(pc.Users, userToProto(u))
+	}
+	for _, m := range c.Messages {
+		pc.Messages = append(pc.Messages, messageToProto(m))
+	}
+	return pc
+}
+
+func messageToProto(m *models.Message) *btav1.Message {
+	return &btav1.Message{
+		Id:        value(m.ID),
+		ChatId:    value(m.ChatID),
+		AuthorId:  value(m.UserID),
+		Text:      text(m.Text),
+		CreatedAt: timestamp(m.CreatedAt),
+	}
+}
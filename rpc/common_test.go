@@ -0,0 +1,77 @@
+package rpc
+
+import (
+	"context"
+	"math"
+	"testing"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/nlevankov/backend-trainee-assignment/models"
+	btav1 "github.com/nlevankov/backend-trainee-assignment/proto/bta/v1"
+)
+
+func TestUintArg(t *testing.T) {
+	if v, err := idArg(nil, "chat"); v != nil || err != nil {
+		t.Errorf("nil: got %v %v", v, err)
+	}
+	if v, err := idArg(uint64Ptr(models.MaxID), "chat"); err != nil || *v != models.MaxID {
+		t.Errorf("MaxID: got %v %v", v, err)
+	}
+	if v, err := uintArg(uint64Ptr(math.MaxUint32), "limit", math.MaxUint32); err != nil || *v != math.MaxUint32 {
+		t.Errorf("the max limit: got %v %v", v, err)
+	}
+
+	_, err := idArg(uint64Ptr(math.MaxUint64), "chat")
+	checkStatus(t, err, codes.InvalidArgument, CodeArgumentOutOfRange)
+	for _, d := range status.Convert(err).Details() {
+		if info, ok := d.(*errdetails.ErrorInfo); ok && (info.Metadata["field"] != "chat" || info.Metadata["max"] != "2147483647") {
+			t.Errorf("got the metadata %v", info.Metadata)
+		}
+	}
+}
+
+// TestArgumentsOutOfRange checks that the calls reject the arguments the storage can't take
+// before reaching the services
+func TestArgumentsOutOfRange(t *testing.T) {
+	m := NewMessages(&fakeMessages{})
+	c := NewChats(nil)
+	ctx := context.Background()
+	tooLarge := uint64Ptr(models.MaxID + 1)
+
+	calls := map[string]func() error{
+		"CreateMessage chat": func() error {
+			_, err := m.CreateMessage(ctx, &btav1.CreateMessageRequest{ChatId: tooLarge, AuthorId: uint64Ptr(1)})
+			return err
+		},
+		"CreateMessage author": func() error {
+			_, err := m.CreateMessage(ctx, &btav1.CreateMessageRequest{ChatId: uint64Ptr(1), AuthorId: tooLarge})
+			return err
+		},
+		"ListChatMessages chat": func() error {
+			_, err := m.ListChatMessages(ctx, &btav1.ListChatMessagesRequest{ChatId: tooLarge})
+			return err
+		},
+		"ListChatMessages limit": func() error {
+			_, err := m.ListChatMessages(ctx, &btav1.ListChatMessagesRequest{ChatId: uint64Ptr(1),
+				Limit: uint64Ptr(math.MaxUint32 + 1)})
+			return err
+		},
+		"CreateChat": func() error {
+			_, err := c.CreateChat(ctx, &btav1.CreateChatRequest{UserIds: []uint64{1, *tooLarge}})
+			return err
+		},
+		"ListUserChats": func() error {
+			_, err := c.ListUserChats(ctx, &btav1.ListUserChatsRequest{UserId: tooLarge})
+			return err
+		},
+	}
+
+	for name, call := range calls {
+		t.Run(name, func(t *testing.T) {
+			checkStatus(t, call(), codes.InvalidArgument, CodeArgumentOutOfRange)
+		})
+	}
+}
@@ -0,0 +1,123 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"math"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/nlevankov/backend-trainee-assignment/models"
+	btav1 "github.com/nlevankov/backend-trainee-assignment/proto/bta/v1"
+)
+
+// HistoryArchivedKey is the response metadata ListChatMessages carries once the chat's earlier messages are archived,
+// the messages created before the time in it (RFC 3339) aren't listed.
+const HistoryArchivedKey = "history-archived-before"
+
+type Messages struct {
+	btav1.UnimplementedMessageServiceServer
+	ms models.MessageService
+}
+
+func NewMessages(ms models.MessageService) *Messages {
+	return &Messages{
+		ms: ms,
+	}
+}
+
+func (m *Messages) CreateMessage(ctx context.Context, req *btav1.CreateMessageRequest) (*btav1.CreateMessageResponse, error) {
+	chatID, err := idArg(req.ChatId, "chat")
+	if err != nil {
+		return nil, err
+	}
+	authorID, err := idArg(req.AuthorId, "author")
+	if err != nil {
+		return nil, err
+	}
+
+	msg := models.Message{
+		ChatID: chatID,
+		UserID: authorID,
+		Text:   req.Text,
+	}
+
+	id, statusCode, err := m.ms.Create(ctx, &msg)
+	if err != nil {
+		return nil, toStatus(statusCode, err)
+	}
+
+	return &btav1.CreateMessageResponse{Id: uint64(id)}, nil
+}
+
+func (m *Messages) ListChatMessages(ctx context.Context, req *btav1.ListChatMessagesRequest) (*btav1.ListChatMessagesResponse, error) {
+	chatID, err := idArg(req.ChatId, "chat")
+	if err != nil {
+		return nil, err
+	}
+	// the same bound as the one of the HTTP API's query parameter
+	limit, err := uintArg(req.Limit, "limit", math.MaxUint32)
+	if err != nil {
+		return nil, err
+	}
+
+	history, statusCode, err := m.ms.ByChatID(ctx, chatID, limit)
+	if err != nil {
+		return nil, toStatus(statusCode, err)
+	}
+
+	// как и в HTTP API, архив истории сообщается в заголовке (метаданных) ответа
+	if history.ArchivedBefore != nil {
+		grpc.SetHeader(ctx, metadata.Pairs(HistoryArchivedKey, history.ArchivedBefore.UTC().Format(time.RFC3339)))
+	}
+
+	resp := &btav1.ListChatMessagesResponse{}
+	for _, msg := range history.Messages {
+		resp.Messages = append(resp.Messages, messageToProto(msg))
+	}
+
+	return resp, nil
+}
+
+func (m *Messages) SubscribeMessages(req *btav1.SubscribeMessagesRequest, stream grpc.ServerStreamingServer[btav1.Message]) error {
+	ctx := stream.Context()
+
+	// как и при отправке сообщения, чат и пользователь должны существовать, а пользователь - состоять в чате
+	chatID, err := idArg(req.ChatId, "chat")
+	if err != nil {
+		return err
+	}
+	userID, err := idArg(req.UserId, "author")
+	if err != nil {
+		return err
+	}
+
+	statusCode, err := m.ms.CheckMember(ctx, chatID, userID)
+	if err != nil {
+		return toStatus(statusCode, err)
+	}
+
+	msgs, cancel := m.ms.Subscribe(*chatID)
+	defer cancel()
+
+	for {
+		select {
+		case <-ctx.Done():
+			if errors.Is(context.Cause(ctx), errShuttingDown) {
+				return status.Error(codes.Unavailable, "The server is shutting down, subscribe again")
+			}
+			return nil
+		case msg, ok := <-msgs:
+			if !ok {
+				return status.Error(codes.ResourceExhausted, "The subscriber doesn't keep up with the messages")
+			}
+			if err := stream.Send(messageToProto(msg)); err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	"github.com/nlevankov/backend-trainee-assignment/models"
+	btav1 "github.com/nlevankov/backend-trainee-assignment/proto/bta/v1"
+)
+
+// fakeMessages is a MessageService of a single chat 1 with a single member 1
+type fakeMessages struct {
+	models.MessageService
+	subscribed chan chan *models.Message
+}
+
+func (fm *fakeMessages) CheckMember(ctx context.Context, chatid *uint, userid *uint) (int, error) {
+	switch {
+	case chatid == nil:
+		return http.StatusBadRequest, models.ErrMessageChatIsNull
+	case userid == nil:
+		return http.StatusBadRequest, models.ErrMessageAuthorIsNull
+	case *chatid != 1:
+		return http.StatusNotFound, models.ErrMessageChatDoesntExist
+	case *userid != 1:
+		return http.StatusUnauthorized, models.ErrMessageUserIsNotInChat
+	}
+	return http.StatusOK, nil
+}
+
+func (fm *fakeMessages) Subscribe(chatID uint) (<-chan *models.Message, func()) {
+	ch := make(chan *models.Message, 1)
+	fm.subscribed <- ch
+	return ch, func() {}
+}
+
+// startServer serves fm over an in-memory listener, the server is shut down at the end of the test
+func startServer(t *testing.T, fm *fakeMessages) (*Server, btav1.MessageServiceClient) {
+	t.Helper()
+
+	lis := bufconn.Listen(1 << 16)
+	s := NewServer(&models.Services{Message: fm})
+	go s.Serve(lis)
+	t.Cleanup(func() { s.Shutdown(time.Second) })
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return s, btav1.NewMessageServiceClient(conn)
+}
+
+func uint64Ptr(v uint64) *uint64 {
+	return &v
+}
+
+func TestSubscribeMessagesChecksMembership(t *testing.T) {
+	fm := &fakeMessages{subscribed: make(chan chan *models.Message, 1)}
+	_, client := startServer(t, fm)
+
+	cases := []struct {
+		name   string
+		req    *btav1.SubscribeMessagesRequest
+		code   codes.Code
+		reason string
+	}{
+		{"no chat", &btav1.SubscribeMessagesRequest{UserId: uint64Ptr(1)}, codes.InvalidArgument, "MESSAGE_CHAT_NULL"},
+		{"no user", &btav1.SubscribeMessagesRequest{ChatId: uint64Ptr(1)}, codes.InvalidArgument, "MESSAGE_AUTHOR_NULL"},
+		{"unknown chat", &btav1.SubscribeMessagesRequest{ChatId: uint64Ptr(2), UserId: uint64Ptr(1)},
+			codes.NotFound, "CHAT_NOT_FOUND"},
+		{"not a member", &btav1.SubscribeMessagesRequest{ChatId: uint64Ptr(1), UserId: uint64Ptr(2)},
+			codes.PermissionDenied, "USER_NOT_IN_CHAT"},
+		{"chat out of range", &btav1.SubscribeMessagesRequest{ChatId: uint64Ptr(1 << 31), UserId: uint64Ptr(1)},
+			codes.InvalidArgument, CodeArgumentOutOfRange},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			stream, err := client.SubscribeMessages(context.Background(), c.req)
+			if err == nil {
+				_, err = stream.Recv()
+			}
+			checkStatus(t, err, c.code, c.reason)
+		})
+	}
+
+	if len(fm.subscribed) != 0 {
+		t.Error("a rejected subscriber is subscribed")
+	}
+}
+
+func TestSubscribeMessagesStreams(t *testing.T) {
+	fm := &fakeMessages{subscribed: make(chan chan *models.Message, 1)}
+	_, client := startServer(t, fm)
+
+	stream, err := client.SubscribeMessages(context.Background(),
+		&btav1.SubscribeMessagesRequest{ChatId: uint64Ptr(1), UserId: uint64Ptr(1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, chatID, userID, text := uint(7), uint(1), uint(1), "hi"
+	(<-fm.subscribed) <- &models.Message{ID: &id, ChatID: &chatID, UserID: &userID, Text: &text}
+
+	msg, err := stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Id != 7 || msg.Text != "hi" {
+		t.Errorf("got %v", msg)
+	}
+}
+
+// TestShutdownEndsStreams checks that an open subscription neither blocks the shutdown
+// nor ends as if the chat has no more messages
+func TestShutdownEndsStreams(t *testing.T) {
+	fm := &fakeMessages{subscribed: make(chan chan *models.Message, 1)}
+	s, client := startServer(t, fm)
+
+	stream, err := client.SubscribeMessages(context.Background(),
+		&btav1.SubscribeMessagesRequest{ChatId: uint64Ptr(1), UserId: uint64Ptr(1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-fm.subscribed
+
+	stopped := make(chan struct{})
+	go func() {
+		s.Shutdown(time.Minute)
+		close(stopped)
+	}()
+
+	_, err = stream.Recv()
+	checkStatus(t, err, codes.Unavailable, "")
+
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the shutdown waits for the stream")
+	}
+}
+
+// TestShutdownTimeout checks that the calls which don't finish in time are cancelled rather than keep the server running
+func TestShutdownTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+
+	lis := bufconn.Listen(1 << 16)
+	s := NewServer(&models.Services{})
+	s.RegisterService(&grpc.ServiceDesc{
+		ServiceName: "test.Stuck",
+		HandlerType: (*interface{})(nil),
+		Methods: []grpc.MethodDesc{{
+			MethodName: "Call",
+			Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error,
+				interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+				// like the storage's queries, the call ends only when its context is cancelled
+				select {
+				case <-ctx.Done():
+				case <-release:
+				}
+				return nil, errors.New("released")
+			},
+		}},
+	}, struct{}{})
+	go s.Serve(lis)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	called := make(chan error, 1)
+	go func() {
+		called <- conn.Invoke(context.Background(), "/test.Stuck/Call", &btav1.CreateMessageRequest{},
+			&btav1.CreateMessageResponse{})
+	}()
+	// the call must be in flight before the shutdown
+	time.Sleep(100 * time.Millisecond)
+
+	start := time.Now()
+	s.Shutdown(100 * time.Millisecond)
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("the shutdown took %v", elapsed)
+	}
+	if err := <-called; status.Code(err) != codes.Unavailable {
+		t.Errorf("got %v, want the call to be aborted", err)
+	}
+}
+
+func checkStatus(t *testing.T, err error, code codes.Code, reason string) {
+	t.Helper()
+
+	st, ok := status.FromError(err)
+	if !ok || st.Code() != code {
+		t.Fatalf("got %v, want %v", err, code)
+	}
+	if reason == "" {
+		return
+	}
+	for _, d := range st.Details() {
+		if info, ok := d.(*errdetails.ErrorInfo); ok && info.Reason == reason && info.Domain == ErrorDomain {
+			return
+		}
+	}
+	t.Errorf("got %v, want the reason %s", st.Details(), reason)
+}
@@ -0,0 +1,30 @@
+package rpc
+
+import (
+	"context"
+
+	"github.com/nlevankov/backend-trainee-assignment/models"
+	btav1 "github.com/nlevankov/backend-trainee-assignment/proto/bta/v1"
+)
+
+type Users struct {
+	btav1.UnimplementedUserServiceServer
+	us models.UserService
+}
+
+func NewUsers(us models.UserService) *Users {
+	return &Users{
+		us: us,
+	}
+}
+
+func (u *Users) CreateUser(ctx context.Context, req *btav1.CreateUserRequest) (*btav1.CreateUserResponse, error) {
+	user := models.User{Name: req.Username}
+
+	id, statusCode, err := u.us.Create(ctx, &user)
+	if err != nil {
+		return nil, toStatus(statusCode, err)
+	}
+
+	return &btav1.CreateUserResponse{Id: uint64(id)}, nil
+}
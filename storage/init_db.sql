@@ -1,6 +1,10 @@
 CREATE TABLE "chats_users" ("user_id" integer,"chat_id" integer, PRIMARY KEY ("user_id","chat_id"));
 CREATE TABLE "users" ("id" serial,"name" text NOT NULL UNIQUE,"created_at" timestamp with time zone , PRIMARY KEY ("id"));
-CREATE TABLE "chats" ("id" serial,"name" text NOT NULL UNIQUE,"created_at" timestamp with time zone , PRIMARY KEY ("id"));
-CREATE TABLE "messages" ("id" serial,"chat_id" integer,"user_id" integer,"text" text NOT NULL,"created_at" timestamp with time zone , PRIMARY KEY ("id"));
+CREATE TABLE "chats" ("id" serial,"name" text NOT NULL UNIQUE,"created_at" timestamp with time zone,"last_message_at" timestamp with time zone,"last_message_id" integer,"archived_before" timestamp with time zone , PRIMARY KEY ("id"));
+CREATE TABLE "messages" ("id" serial,"chat_id" integer,"user_id" integer,"text" text NOT NULL,"created_at" timestamp with time zone NOT NULL, PRIMARY KEY ("id","created_at")) PARTITION BY RANGE ("created_at");
+CREATE TABLE "messages_default" PARTITION OF "messages" DEFAULT;
 ALTER TABLE "messages" ADD CONSTRAINT messages_chat_id_chats_id_foreign FOREIGN KEY (chat_id) REFERENCES chats(id) ON DELETE CASCADE ON UPDATE CASCADE;
-ALTER TABLE "messages" ADD CONSTRAINT messages_user_id_users_id_foreign FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE ON UPDATE CASCADE;
\ No newline at end of file
+ALTER TABLE "messages" ADD CONSTRAINT messages_user_id_users_id_foreign FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE ON UPDATE CASCADE;
+CREATE INDEX messages_chat_id_created_at_idx ON "messages"(chat_id, created_at);
+CREATE INDEX messages_user_id_idx ON "messages"(user_id);
+CREATE INDEX chats_users_chat_id_idx ON "chats_users"(chat_id);
\ No newline at end of file
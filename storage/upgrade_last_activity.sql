@@ -0,0 +1,12 @@
+-- Upgrades the storage created by the older init_db.sql: adds the chats' last activity and the indexes.
+-- Run it while the app is stopped, the app keeps the columns up to date afterwards.
+ALTER TABLE "chats" ADD COLUMN IF NOT EXISTS "last_message_at" timestamp with time zone;
+ALTER TABLE "chats" ADD COLUMN IF NOT EXISTS "last_message_id" integer;
+
+UPDATE "chats" SET last_message_at = latest.created_at, last_message_id = latest.id
+FROM (SELECT DISTINCT ON (chat_id) chat_id, id, created_at FROM "messages" ORDER BY chat_id, created_at DESC, id DESC) AS latest
+WHERE latest.chat_id = chats.id;
+
+CREATE INDEX IF NOT EXISTS messages_chat_id_created_at_idx ON "messages"(chat_id, created_at);
+CREATE INDEX IF NOT EXISTS messages_user_id_idx ON "messages"(user_id);
+CREATE INDEX IF NOT EXISTS chats_users_chat_id_idx ON "chats_users"(chat_id);
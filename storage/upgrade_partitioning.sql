@@ -0,0 +1,41 @@
+-- Upgrades the storage created by the older init_db.sql: partitions the messages by the month of created_at
+-- and adds the chats' archive boundary. Run it in one transaction while the app is stopped,
+-- the app creates the partitions of the upcoming months afterwards.
+BEGIN;
+
+SET LOCAL TimeZone = 'UTC';
+
+ALTER TABLE "chats" ADD COLUMN IF NOT EXISTS "archived_before" timestamp with time zone;
+
+ALTER TABLE "messages" RENAME TO "messages_unpartitioned";
+ALTER TABLE "messages_unpartitioned" RENAME CONSTRAINT "messages_pkey" TO "messages_unpartitioned_pkey";
+ALTER INDEX IF EXISTS messages_chat_id_created_at_idx RENAME TO messages_unpartitioned_chat_id_created_at_idx;
+ALTER INDEX IF EXISTS messages_user_id_idx RENAME TO messages_unpartitioned_user_id_idx;
+ALTER SEQUENCE "messages_id_seq" OWNED BY NONE;
+
+UPDATE "messages_unpartitioned" SET created_at = now() WHERE created_at IS NULL;
+
+CREATE TABLE "messages" ("id" integer NOT NULL DEFAULT nextval('messages_id_seq'),"chat_id" integer,"user_id" integer,"text" text NOT NULL,"created_at" timestamp with time zone NOT NULL, PRIMARY KEY ("id","created_at")) PARTITION BY RANGE ("created_at");
+ALTER SEQUENCE "messages_id_seq" OWNED BY "messages"."id";
+CREATE TABLE "messages_default" PARTITION OF "messages" DEFAULT;
+
+DO $$
+DECLARE
+    month timestamp with time zone;
+BEGIN
+    FOR month IN SELECT DISTINCT date_trunc('month', created_at) FROM "messages_unpartitioned" LOOP
+        EXECUTE format('CREATE TABLE %I PARTITION OF "messages" FOR VALUES FROM (%L) TO (%L)',
+            to_char(month, '"messages_"YYYY_MM'), month, month + interval '1 month');
+    END LOOP;
+END
+$$;
+
+INSERT INTO "messages" SELECT id, chat_id, user_id, text, created_at FROM "messages_unpartitioned";
+DROP TABLE "messages_unpartitioned";
+
+ALTER TABLE "messages" ADD CONSTRAINT messages_chat_id_chats_id_foreign FOREIGN KEY (chat_id) REFERENCES chats(id) ON DELETE CASCADE ON UPDATE CASCADE;
+ALTER TABLE "messages" ADD CONSTRAINT messages_user_id_users_id_foreign FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE ON UPDATE CASCADE;
+CREATE INDEX messages_chat_id_created_at_idx ON "messages"(chat_id, created_at);
+CREATE INDEX messages_user_id_idx ON "messages"(user_id);
+
+COMMIT;
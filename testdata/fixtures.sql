@@ -0,0 +1,20 @@
+-- alice and bob are in "general", alice alone is in "random", carol is in no chats
+INSERT INTO users (id, name, created_at) VALUES
+    (1, 'alice', '2020-01-01 10:00:00+00:00'),
+    (2, 'bob',   '2020-01-01 10:01:00+00:00'),
+    (3, 'carol', '2020-01-01 10:02:00+00:00');
+
+-- the last activity of "general" is its message 2
+INSERT INTO chats (id, name, created_at, last_message_at, last_message_id) VALUES
+    (1, 'general', '2020-01-02 10:00:00+00:00', '2020-01-04 10:01:00+00:00', 2),
+    (2, 'random',  '2020-01-03 10:00:00+00:00', NULL, NULL);
+
+INSERT INTO chats_users (chat_id, user_id) VALUES (1, 1), (1, 2), (2, 1);
+
+INSERT INTO messages (id, chat_id, user_id, text, created_at) VALUES
+    (1, 1, 1, 'hi',    '2020-01-04 10:00:00+00:00'),
+    (2, 1, 2, 'hello', '2020-01-04 10:01:00+00:00');
+
+SELECT setval('users_id_seq', 3);
+SELECT setval('chats_id_seq', 2);
+SELECT setval('messages_id_seq', 2);
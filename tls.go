@@ -0,0 +1,209 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TLSConfig configures the HTTPS listener (and the gRPC one), TLS is off unless CertFile is set
+type TLSConfig struct {
+	Port     uint   `env:"APP_TLS_PORT" yaml:"port" toml:"port"`
+	CertFile string `env:"APP_TLS_CERT_FILE" yaml:"cert_file" toml:"cert_file"`
+	KeyFile  string `env:"APP_TLS_KEY_FILE" yaml:"key_file" toml:"key_file"`
+
+	// ClientCAFile holds the CAs of the internal callers' certificates, ClientAuth is one of clientAuthTypes
+	ClientCAFile string `env:"APP_TLS_CLIENT_CA_FILE" yaml:"client_ca_file" toml:"client_ca_file"`
+	ClientAuth   string `env:"APP_TLS_CLIENT_AUTH" yaml:"client_auth" toml:"client_auth"`
+
+	// ReloadInterval is how often the files are checked for changes, they are checked on handshakes only
+	ReloadInterval time.Duration `env:"APP_TLS_RELOAD_INTERVAL" yaml:"reload_interval" toml:"reload_interval"`
+
+	// PlainHTTP is what the plain HTTP port does when TLS is on, one of plainHTTPModes
+	PlainHTTP string `env:"APP_TLS_PLAIN_HTTP" yaml:"plain_http" toml:"plain_http"`
+}
+
+const (
+	// plainHTTPRedirect redirects the plain HTTP requests to HTTPS
+	plainHTTPRedirect = "redirect"
+	// plainHTTPServe serves the API over plain HTTP too, e.g. for the callers inside the private network
+	plainHTTPServe = "serve"
+	// plainHTTPOff doesn't listen on the plain HTTP port
+	plainHTTPOff = "off"
+)
+
+var plainHTTPModes = []string{plainHTTPRedirect, plainHTTPServe, plainHTTPOff}
+
+var clientAuthTypes = map[string]tls.ClientAuthType{
+	"none":               tls.NoClientCert,
+	"request":            tls.RequestClientCert,
+	"require":            tls.RequireAnyClientCert,
+	"verify_if_given":    tls.VerifyClientCertIfGiven,
+	"require_and_verify": tls.RequireAndVerifyClientCert,
+}
+
+func (c TLSConfig) Enabled() bool {
+	return c.CertFile != ""
+}
+
+func (c TLSConfig) validate() []error {
+	var errs []error
+	auth, ok := clientAuthTypes[c.ClientAuth]
+	if !ok {
+		errs = append(errs, fmt.Errorf("tls.client_auth: unknown client auth %q, use none, request, require, "+
+			"verify_if_given or require_and_verify", c.ClientAuth))
+	}
+	if !c.Enabled() {
+		return errs
+	}
+
+	if c.KeyFile == "" {
+		errs = append(errs, errors.New("tls.key_file: a key file is required along with tls.cert_file"))
+	}
+	if c.Port == 0 {
+		errs = append(errs, errors.New("tls.port: HTTPS port can't be 0"))
+	}
+	if auth >= tls.VerifyClientCertIfGiven && c.ClientCAFile == "" {
+		errs = append(errs, fmt.Errorf("tls.client_ca_file: a client CA file is required for client auth %q", c.ClientAuth))
+	}
+	if c.ReloadInterval <= 0 {
+		errs = append(errs, errors.New("tls.reload_interval: a reload interval must be positive"))
+	}
+	if !slices.Contains(plainHTTPModes, c.PlainHTTP) {
+		errs = append(errs, fmt.Errorf("tls.plain_http: unknown mode %q, use %s", c.PlainHTTP,
+			strings.Join(plainHTTPModes, ", ")))
+	}
+	return errs
+}
+
+// redirectToHTTPS redirects the requests to the same URL on the HTTPS port, 308 keeps the method and the body
+func redirectToHTTPS(port uint) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		u := url.URL{Scheme: "https", Host: net.JoinHostPort(host, strconv.FormatUint(uint64(port), 10)),
+			Path: r.URL.Path, RawPath: r.URL.RawPath, RawQuery: r.URL.RawQuery}
+		http.Redirect(w, r, u.String(), http.StatusPermanentRedirect)
+	})
+}
+
+// certReloader keeps the certificate and the client CAs up to date with their files,
+// so they can be rotated without restarting the app
+type certReloader struct {
+	cfg TLSConfig
+
+	mu        sync.Mutex
+	tlsConfig *tls.Config
+	modTimes  [3]time.Time
+	lastCheck time.Time
+}
+
+// ServerTLSConfig loads the files and returns the config which reloads them once they change
+func (c TLSConfig) ServerTLSConfig() (*tls.Config, error) {
+	r := &certReloader{cfg: c}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	r.lastCheck = time.Now()
+
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return r.current(), nil
+		},
+	}, nil
+}
+
+func (r *certReloader) current() *tls.Config {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(r.lastCheck) >= r.cfg.ReloadInterval {
+		r.lastCheck = now
+		if r.changed() {
+			// со старым сертификатом лучше, чем без него
+			if err := r.load(); err != nil {
+				log.Printf("Can't reload the TLS certificates, the old ones are kept: %v", err)
+			} else {
+				log.Println("The TLS certificates are reloaded")
+			}
+		}
+	}
+
+	return r.tlsConfig
+}
+
+func (r *certReloader) files() [3]string {
+	return [3]string{r.cfg.CertFile, r.cfg.KeyFile, r.cfg.ClientCAFile}
+}
+
+// it assumes that r.mu is locked
+func (r *certReloader) changed() bool {
+	for i, name := range r.files() {
+		if name == "" {
+			continue
+		}
+		fi, err := os.Stat(name)
+		if err == nil && !fi.ModTime().Equal(r.modTimes[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+// it assumes that r.mu is locked or r isn't shared yet
+func (r *certReloader) load() error {
+	var modTimes [3]time.Time
+	for i, name := range r.files() {
+		if name == "" {
+			continue
+		}
+		fi, err := os.Stat(name)
+		if err != nil {
+			return err
+		}
+		modTimes[i] = fi.ModTime()
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.cfg.CertFile, r.cfg.KeyFile)
+	if err != nil {
+		return err
+	}
+
+	cfg := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   clientAuthTypes[r.cfg.ClientAuth],
+		NextProtos:   []string{"h2", "http/1.1"},
+	}
+
+	if r.cfg.ClientCAFile != "" {
+		pem, err := os.ReadFile(r.cfg.ClientCAFile)
+		if err != nil {
+			return err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in %s", r.cfg.ClientCAFile)
+		}
+		cfg.ClientCAs = pool
+	}
+
+	r.tlsConfig = cfg
+	r.modTimes = modTimes
+	return nil
+}
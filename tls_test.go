@@ -0,0 +1,219 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeTestCert writes a self-signed certificate of the name and its key into the files
+func writeTestCert(t *testing.T, certFile, keyFile, name string, modTime time.Time) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IsCA:         true,
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for file, block := range map[string]*pem.Block{
+		certFile: {Type: "CERTIFICATE", Bytes: der},
+		keyFile:  {Type: "EC PRIVATE KEY", Bytes: keyDER},
+	} {
+		if err := os.WriteFile(file, pem.EncodeToMemory(block), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(file, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// servedName returns the common name of the certificate the config serves
+func servedName(t *testing.T, cfg *tls.Config) string {
+	t.Helper()
+
+	current, err := cfg.GetConfigForClient(&tls.ClientHelloInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(current.Certificates[0].Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert.Subject.CommonName
+}
+
+func TestCertReload(t *testing.T) {
+	dir := t.TempDir()
+	c := TLSConfig{
+		CertFile:       filepath.Join(dir, "cert.pem"),
+		KeyFile:        filepath.Join(dir, "key.pem"),
+		ClientAuth:     "none",
+		ReloadInterval: time.Nanosecond,
+	}
+	modTime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	writeTestCert(t, c.CertFile, c.KeyFile, "old", modTime)
+
+	cfg, err := c.ServerTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name := servedName(t, cfg); name != "old" {
+		t.Fatalf("got %s", name)
+	}
+
+	// the files are read again only once their modification time changes
+	writeTestCert(t, c.CertFile, c.KeyFile, "same time", modTime)
+	if name := servedName(t, cfg); name != "old" {
+		t.Errorf("unchanged modification time: got %s, want old", name)
+	}
+
+	writeTestCert(t, c.CertFile, c.KeyFile, "new", modTime.Add(time.Minute))
+	if name := servedName(t, cfg); name != "new" {
+		t.Errorf("changed modification time: got %s, want new", name)
+	}
+
+	// the broken files don't replace the loaded certificate
+	if err := os.WriteFile(c.KeyFile, []byte("broken"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(c.KeyFile, modTime.Add(2*time.Minute), modTime.Add(2*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if name := servedName(t, cfg); name != "new" {
+		t.Errorf("broken key: got %s, want new", name)
+	}
+}
+
+func TestCertReloadInterval(t *testing.T) {
+	dir := t.TempDir()
+	c := TLSConfig{
+		CertFile:       filepath.Join(dir, "cert.pem"),
+		KeyFile:        filepath.Join(dir, "key.pem"),
+		ClientAuth:     "none",
+		ReloadInterval: time.Hour,
+	}
+	modTime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	writeTestCert(t, c.CertFile, c.KeyFile, "old", modTime)
+
+	cfg, err := c.ServerTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestCert(t, c.CertFile, c.KeyFile, "new", modTime.Add(time.Minute))
+	if name := servedName(t, cfg); name != "old" {
+		t.Errorf("within the interval: got %s, want old", name)
+	}
+}
+
+func TestServerTLSConfigErrors(t *testing.T) {
+	dir := t.TempDir()
+	c := TLSConfig{CertFile: filepath.Join(dir, "cert.pem"), KeyFile: filepath.Join(dir, "key.pem"), ClientAuth: "none"}
+
+	if _, err := c.ServerTLSConfig(); err == nil {
+		t.Error("missing files: no error")
+	}
+
+	writeTestCert(t, c.CertFile, c.KeyFile, "cert", time.Now())
+	c.ClientCAFile = c.KeyFile
+	if _, err := c.ServerTLSConfig(); err == nil || !strings.Contains(err.Error(), "no certificates") {
+		t.Errorf("client CA file without certificates: got %v", err)
+	}
+
+	c.ClientCAFile, c.ClientAuth = c.CertFile, "require_and_verify"
+	cfg, err := c.ServerTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	current, _ := cfg.GetConfigForClient(&tls.ClientHelloInfo{})
+	if current.ClientAuth != tls.RequireAndVerifyClientCert || current.ClientCAs == nil {
+		t.Errorf("got client auth %v with CAs %v", current.ClientAuth, current.ClientCAs)
+	}
+}
+
+func TestTLSConfigValidate(t *testing.T) {
+	valid := DefaultConfig().TLS
+	valid.CertFile, valid.KeyFile = "cert.pem", "key.pem"
+
+	cases := []struct {
+		name   string
+		modify func(c *TLSConfig)
+		want   []string
+	}{
+		{"valid", func(c *TLSConfig) {}, nil},
+		{"disabled", func(c *TLSConfig) { *c = DefaultConfig().TLS }, nil},
+		{"disabled with unknown client auth", func(c *TLSConfig) { *c = DefaultConfig().TLS; c.ClientAuth = "x" },
+			[]string{"tls.client_auth"}},
+		{"no key", func(c *TLSConfig) { c.KeyFile = "" }, []string{"tls.key_file"}},
+		{"no port", func(c *TLSConfig) { c.Port = 0 }, []string{"tls.port"}},
+		{"verification without CAs", func(c *TLSConfig) { c.ClientAuth = "verify_if_given" }, []string{"tls.client_ca_file"}},
+		{"verification with CAs", func(c *TLSConfig) { c.ClientAuth, c.ClientCAFile = "require_and_verify", "ca.pem" }, nil},
+		{"no reload interval", func(c *TLSConfig) { c.ReloadInterval = 0 }, []string{"tls.reload_interval"}},
+		{"unknown plain HTTP mode", func(c *TLSConfig) { c.PlainHTTP = "maybe" }, []string{"tls.plain_http"}},
+		{"everything", func(c *TLSConfig) { c.KeyFile, c.Port, c.PlainHTTP = "", 0, "" },
+			[]string{"tls.key_file", "tls.port", "tls.plain_http"}},
+	}
+
+	for _, c := range cases {
+		cfg := valid
+		c.modify(&cfg)
+		errs := cfg.validate()
+		if len(errs) != len(c.want) {
+			t.Errorf("%s: got %v, want %v", c.name, errs, c.want)
+			continue
+		}
+		for i, want := range c.want {
+			if !strings.HasPrefix(errs[i].Error(), want+":") {
+				t.Errorf("%s: got %v, want %s", c.name, errs[i], want)
+			}
+		}
+	}
+}
+
+func TestRedirectToHTTPS(t *testing.T) {
+	cases := []struct {
+		url  string
+		want string
+	}{
+		{"http://example.com:9000/v1/users/1/chats?x=1", "https://example.com:9443/v1/users/1/chats?x=1"},
+		{"http://example.com/messages/add", "https://example.com:9443/messages/add"},
+		{"http://[::1]:9000/a%2Fb", "https://[::1]:9443/a%2Fb"},
+	}
+
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		redirectToHTTPS(9443).ServeHTTP(w, httptest.NewRequest(http.MethodPost, c.url, nil))
+		if w.Code != http.StatusPermanentRedirect || w.Header().Get("Location") != c.want {
+			t.Errorf("%s: got %d to %s, want %d to %s", c.url, w.Code, w.Header().Get("Location"),
+				http.StatusPermanentRedirect, c.want)
+		}
+	}
+}
@@ -0,0 +1,20 @@
+package views
+
+import "net/http"
+
+// BatchItem is the outcome of one item of a batch request,
+// its error is described the same way Render describes the error of a whole request.
+type BatchItem struct {
+	Status    int
+	Result    interface{}
+	Error     *string
+	ErrorInfo *errorInfo
+}
+
+func NewBatchItem(w http.ResponseWriter, r *http.Request, result interface{}, statusCode int, err error) *BatchItem {
+	msg, info := publicError(w, r, err)
+	if err != nil {
+		result = nil
+	}
+	return &BatchItem{Status: statusCode, Result: result, Error: msg, ErrorInfo: info}
+}
@@ -0,0 +1,80 @@
+package views
+
+var catalogRU = map[string][]string{
+	"ENDPOINT_NOT_FOUND": {"Такого эндпоинта не существует"},
+	"METHOD_NOT_ALLOWED": {"Неверный HTTP-метод"},
+	"RATE_LIMITED":       {"Слишком много запросов, повторите через {retry_after} с"},
+
+	"STORAGE_UNAVAILABLE": {"Хранилище недоступно, повторите попытку позже"},
+	"STORAGE_TIMEOUT":     {"Хранилище не ответило вовремя, повторите попытку позже"},
+
+	"IDEMPOTENCY_KEY_TOO_LONG":    {"Ключ идемпотентности не может быть длиннее 255 символов"},
+	"IDEMPOTENCY_KEY_IN_PROGRESS": {"Запрос с таким ключом идемпотентности еще выполняется"},
+	"IDEMPOTENCY_KEY_REUSED":      {"Ключ идемпотентности уже использован с другими данными"},
+
+	// models
+
+	"CHAT_NAME_EMPTY":         {"'{field}' не может быть пустым"},
+	"CHAT_NAME_NULL":          {"'{field}' не может быть null"},
+	"CHAT_USER_NULL":          {"'{field}' не может быть null"},
+	"CHAT_USERS_NULL":         {"'{field}' не может быть null"},
+	"CHAT_USERS_EMPTY":        {"'{field}' не может быть пустым"},
+	"CHAT_USERS_CONTAIN_NULL": {"'{field}' не может содержать null"},
+	"CHAT_ALREADY_EXISTS":     {"Чат с таким именем уже существует"},
+	"CHAT_USERS_NOT_FOUND":    {"Некоторые пользователи не существуют"},
+	"CHAT_USER_OUT_OF_RANGE":  {"'{field}' не может быть больше {max}"},
+	"CHAT_USERS_OUT_OF_RANGE": {"'{field}' не может содержать id больше {max}"},
+
+	"CHAT_NOT_FOUND":      {"Чат с указанным id не существует"},
+	"USER_NOT_FOUND":      {"Пользователь с указанным id не существует"},
+	"USER_NOT_IN_CHAT":    {"Пользователь не состоит в чате"},
+	"MESSAGE_CHAT_NULL":   {"'{field}' не может быть null"},
+	"MESSAGE_AUTHOR_NULL": {"'{field}' не может быть null"},
+	"MESSAGE_TEXT_NULL":   {"'{field}' не может быть null"},
+	"MESSAGE_TEXT_EMPTY":  {"'{field}' не может быть пустым"},
+
+	"MESSAGE_CHAT_OUT_OF_RANGE":   {"'{field}' не может быть больше {max}"},
+	"MESSAGE_AUTHOR_OUT_OF_RANGE": {"'{field}' не может быть больше {max}"},
+	"MESSAGE_CHAT_MISMATCH":       {"'{field}' должен совпадать с чатом из пути или отсутствовать"},
+
+	"MESSAGE_LIMIT_INVALID": {"'{field}' должен быть положительным"},
+
+	"BATCH_EMPTY":            {"Пакет не может быть пустым"},
+	"BATCH_TOO_LARGE":        {"Пакет не может содержать больше {max} элементов"},
+	"BATCH_ITEM_NULL":        {"Пакет не может содержать null"},
+	"BATCH_FAILED":           {"Некоторые элементы пакета не прошли, ни один не создан"},
+	"BATCH_ITEM_ROLLED_BACK": {"Элемент не создан, т.к. другие элементы пакета не прошли"},
+
+	"USER_NAME_EMPTY":     {"'{field}' не может быть пустым"},
+	"USER_NAME_NULL":      {"'{field}' не может быть null"},
+	"USER_ALREADY_EXISTS": {"Пользователь с таким именем уже существует"},
+
+	// decoding of the request body
+
+	"UNSUPPORTED_CONTENT_TYPE":     {"Неподдерживаемое значение заголовка Content-Type: {content_type}"},
+	"UNSUPPORTED_CONTENT_ENCODING": {"Неподдерживаемое значение заголовка Content-Encoding: {content_encoding}"},
+	"BODY_INVALID_ENCODING":        {"Тело запроса не соответствует заявленному Content-Encoding"},
+	"BODY_MALFORMED": {
+		"Тело запроса в формате {content_type} содержит некорректные данные (позиция {position})",
+		"Тело запроса содержит некорректный JSON (позиция {position})",
+		"Тело запроса содержит некорректные данные",
+	},
+	"BODY_INVALID_VALUE":        {"Тело запроса содержит некорректное значение поля '{field}' (позиция {position})"},
+	"BODY_UNKNOWN_FIELD":        {"Тело запроса содержит неизвестное поле '{field}'"},
+	"BODY_EMPTY":                {"Тело запроса не должно быть пустым"},
+	"BODY_TOO_LARGE":            {"Размер тела запроса не должен превышать {limit} байт"},
+	"BODY_INVALID_NUMBER":       {"Попытка преобразовать '{value}' в {type}"},
+	"BODY_INVALID_STRING_VALUE": {"Некорректное значение поля с ,string представлением: {reason}"},
+	"BODY_MULTIPLE_OBJECTS":     {"Тело запроса должно содержать только один JSON-объект"},
+
+	// parsing of the path and query parameters
+
+	"PATH_INVALID_VALUE": {
+		"Параметр пути '{field}' должен быть неотрицательным целым числом не больше {max}",
+		"Параметр пути '{field}' должен быть неотрицательным целым числом",
+	},
+	"QUERY_INVALID_VALUE": {
+		"Параметр запроса '{field}' должен быть неотрицательным целым числом не больше {max}",
+		"Параметр запроса '{field}' должен быть неотрицательным целым числом",
+	},
+}
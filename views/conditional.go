@@ -0,0 +1,85 @@
+package views
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// conditional holds the validators of a cacheable response
+type conditional struct {
+	tag          string
+	lastModified *time.Time
+}
+
+// RenderConditional renders the successful result like Render does, but also sets the ETag (computed from
+// version, which identifies the result's state) and Last-Modified headers and responds with 304 Not Modified
+// if the client's If-None-Match or If-Modified-Since header shows that it already has the same result.
+// The legacy POST routes are pure reads, so the headers are honoured for them the same way as for GET.
+func RenderConditional(w http.ResponseWriter, r *http.Request, result interface{}, version string, lastModified *time.Time) {
+	d := map[string]interface{}{"Result": result, "Error": nil, "ErrorInfo": nil}
+	writeConditional(w, r, http.StatusOK, "", d, &conditional{tag: etag(version), lastModified: lastModified})
+}
+
+// NotModified responds with 304 Not Modified and returns true if the client already has the result
+// of the version, the way RenderConditional would, so the result needn't be loaded to answer such requests.
+func NotModified(w http.ResponseWriter, r *http.Request, version string, lastModified *time.Time) bool {
+	tag := etag(version)
+	if !notModified(r, tag, lastModified) {
+		return false
+	}
+
+	h := w.Header()
+	h.Add("Vary", "Accept, Accept-Encoding, Accept-Language")
+	setValidators(h, tag, lastModified)
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// etag is weak, since the same result is represented differently depending on Accept and Accept-Encoding
+func etag(version string) string {
+	sum := sha256.Sum256([]byte(version))
+	return fmt.Sprintf(`W/"%x"`, sum[:16])
+}
+
+func setValidators(h http.Header, tag string, lastModified *time.Time) {
+	h.Set("ETag", tag)
+	if lastModified != nil {
+		h.Set("Last-Modified", lastModified.UTC().Format(http.TimeFormat))
+	}
+	// клиент может кешировать ответ, но обязан каждый раз его перепроверять
+	h.Set("Cache-Control", "no-cache")
+}
+
+// notModified evaluates the preconditions as described in RFC 7232, If-Modified-Since is only
+// taken into account if there is no If-None-Match
+func notModified(r *http.Request, tag string, lastModified *time.Time) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		return etagMatches(inm, tag)
+	}
+
+	ims := r.Header.Get("If-Modified-Since")
+	if ims == "" || lastModified == nil {
+		return false
+	}
+	t, err := http.ParseTime(ims)
+	if err != nil {
+		return false
+	}
+	return !lastModified.Truncate(time.Second).After(t)
+}
+
+// etagMatches uses the weak comparison, which is the one for If-None-Match
+func etagMatches(header, tag string) bool {
+	if strings.TrimSpace(header) == "*" {
+		return true
+	}
+	for _, candidate := range strings.Split(header, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(candidate), "W/") == strings.TrimPrefix(tag, "W/") {
+			return true
+		}
+	}
+	return false
+}
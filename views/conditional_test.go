@@ -0,0 +1,93 @@
+package views
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestEtagMatches(t *testing.T) {
+	tag := `W/"abc"`
+
+	cases := []struct {
+		header string
+		want   bool
+	}{
+		{`W/"abc"`, true},
+		{`"abc"`, true}, // the comparison is weak
+		{`W/"abd"`, false},
+		{`"abd", W/"abc"`, true},
+		{` "x" ,  "abc" `, true},
+		{`"x", "y"`, false},
+		{`*`, true},
+		{` * `, true},
+		{`abc`, false},
+		{``, false},
+	}
+
+	for _, c := range cases {
+		if got := etagMatches(c.header, tag); got != c.want {
+			t.Errorf("If-None-Match %q: got %v, want %v", c.header, got, c.want)
+		}
+	}
+}
+
+func TestNotModified(t *testing.T) {
+	tag := `W/"abc"`
+	modified := time.Date(2020, 1, 4, 10, 1, 0, 500, time.UTC)
+	at := func(d time.Duration) string { return modified.Add(d).Format(http.TimeFormat) }
+
+	cases := []struct {
+		name         string
+		header       map[string]string
+		lastModified *time.Time
+		want         bool
+	}{
+		{"unconditional", nil, &modified, false},
+		{"same tag", map[string]string{"If-None-Match": `"abc"`}, &modified, true},
+		{"other tag", map[string]string{"If-None-Match": `"abd"`}, &modified, false},
+		{"any", map[string]string{"If-None-Match": "*"}, nil, true},
+		{"same time", map[string]string{"If-Modified-Since": at(0)}, &modified, true},
+		{"later time", map[string]string{"If-Modified-Since": at(time.Hour)}, &modified, true},
+		{"earlier time", map[string]string{"If-Modified-Since": at(-time.Second)}, &modified, false},
+		{"no time", map[string]string{"If-Modified-Since": at(0)}, nil, false},
+		{"invalid time", map[string]string{"If-Modified-Since": "yesterday"}, &modified, false},
+		{"the tag takes precedence", map[string]string{"If-None-Match": `"abd"`, "If-Modified-Since": at(0)},
+			&modified, false},
+	}
+
+	for _, c := range cases {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		for k, v := range c.header {
+			r.Header.Set(k, v)
+		}
+		if got := notModified(r, tag, c.lastModified); got != c.want {
+			t.Errorf("%s: got %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+// TestNotModifiedMatchesRender checks that the 304 NotModified answers with is the one RenderConditional would
+func TestNotModifiedMatchesRender(t *testing.T) {
+	modified := time.Date(2020, 1, 4, 10, 1, 0, 0, time.UTC)
+
+	w := httptest.NewRecorder()
+	RenderConditional(w, httptest.NewRequest(http.MethodGet, "/", nil), []string{"a"}, "1.2", &modified)
+	tag := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || tag == "" || w.Header().Get("Last-Modified") == "" {
+		t.Fatalf("got %d with %v", w.Code, w.Header())
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("If-None-Match", tag)
+	w = httptest.NewRecorder()
+	if !NotModified(w, r, "1.2", &modified) || w.Code != http.StatusNotModified || w.Header().Get("ETag") != tag {
+		t.Errorf("same version: got %d with %v", w.Code, w.Header())
+	}
+
+	w = httptest.NewRecorder()
+	if NotModified(w, r, "1.3", &modified) || len(w.Header()) != 0 {
+		t.Errorf("other version: got %d with %v, want nothing written", w.Code, w.Header())
+	}
+}
@@ -0,0 +1,100 @@
+package views
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/golang/gddo/httputil/header"
+)
+
+// DefaultLanguage is the language the error messages are written in originally,
+// there is no catalog for it, the messages of the errors are used as is.
+const DefaultLanguage = "en"
+
+// catalogs maps a language to the message templates keyed by error code.
+// A template may refer to the error's field as {field} and to any of its details as {<key>}.
+// If there are several templates for a code, the first one whose parameters are all available is used.
+var catalogs = map[string]map[string][]string{
+	"ru": catalogRU,
+}
+
+// negotiateLanguage picks the most preferred language from the Accept-Language header
+// which has a catalog, DefaultLanguage otherwise.
+func negotiateLanguage(r *http.Request) string {
+	if r == nil {
+		return DefaultLanguage
+	}
+
+	specs := header.ParseAccept(r.Header, "Accept-Language")
+	sort.SliceStable(specs, func(i, j int) bool {
+		return specs[i].Q > specs[j].Q
+	})
+
+	for _, spec := range specs {
+		if spec.Q == 0 {
+			continue
+		}
+		lang := strings.ToLower(strings.SplitN(spec.Value, "-", 2)[0])
+		if lang == DefaultLanguage {
+			return lang
+		}
+		if _, ok := catalogs[lang]; ok {
+			return lang
+		}
+	}
+
+	return DefaultLanguage
+}
+
+// translate returns the message for the code in the language, ok is false if there is no suitable template.
+func translate(lang, code string, params map[string]interface{}) (msg string, ok bool) {
+	templates := catalogs[lang][code]
+
+	for _, t := range templates {
+		if msg, ok = interpolate(t, params); ok {
+			return msg, true
+		}
+	}
+
+	return "", false
+}
+
+// interpolate replaces {name} placeholders with the params, ok is false if some of them are missing.
+func interpolate(template string, params map[string]interface{}) (string, bool) {
+	var b strings.Builder
+	rest := template
+	for {
+		start := strings.IndexByte(rest, '{')
+		if start == -1 {
+			b.WriteString(rest)
+			return b.String(), true
+		}
+		end := strings.IndexByte(rest[start:], '}')
+		if end == -1 {
+			b.WriteString(rest)
+			return b.String(), true
+		}
+		end += start
+
+		v, ok := params[rest[start+1:end]]
+		if !ok {
+			return "", false
+		}
+		b.WriteString(rest[:start])
+		b.WriteString(fmt.Sprint(v))
+		rest = rest[end+1:]
+	}
+}
+
+func errorParams(info *errorInfo) map[string]interface{} {
+	params := make(map[string]interface{}, len(info.Details)+1)
+	for k, v := range info.Details {
+		params[k] = v
+	}
+	if info.Field != nil {
+		params["field"] = *info.Field
+	}
+	return params
+}
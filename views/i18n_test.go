@@ -0,0 +1,91 @@
+package views
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNegotiateLanguage(t *testing.T) {
+	cases := []struct {
+		acceptLanguage string
+		want           string
+	}{
+		{"", DefaultLanguage},
+		{"ru", "ru"},
+		{"ru-RU", "ru"},
+		{"RU-ru", "ru"},
+		{"de", DefaultLanguage},
+		{"de, ru;q=0.5", "ru"},
+		{"en-GB, ru;q=0.9", "en"},
+		{"en;q=0.3, ru;q=0.7", "ru"},
+		{"ru;q=0.3, en;q=0.7", "en"},
+		{"ru;q=0", DefaultLanguage},
+		{"ru;q=0, *", DefaultLanguage},
+		{"fr;q=0.9, ru-UA;q=0.8, en;q=0.1", "ru"},
+	}
+
+	for _, c := range cases {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if c.acceptLanguage != "" {
+			r.Header.Set("Accept-Language", c.acceptLanguage)
+		}
+		if got := negotiateLanguage(r); got != c.want {
+			t.Errorf("Accept-Language %q: got %s, want %s", c.acceptLanguage, got, c.want)
+		}
+	}
+
+	if got := negotiateLanguage(nil); got != DefaultLanguage {
+		t.Errorf("no request: got %s, want %s", got, DefaultLanguage)
+	}
+}
+
+func TestInterpolate(t *testing.T) {
+	params := map[string]interface{}{"field": "name", "position": int64(7), "empty": ""}
+
+	cases := []struct {
+		template string
+		want     string
+		ok       bool
+	}{
+		{"no placeholders", "no placeholders", true},
+		{"'{field}' at {position}", "'name' at 7", true},
+		{"{field}{field}", "namename", true},
+		{"[{empty}]", "[]", true},
+		{"'{field}' at {offset}", "", false},
+		{"{}", "", false},
+		{"unclosed {field", "unclosed {field", true},
+		{"{field} and a stray }", "name and a stray }", true},
+	}
+
+	for _, c := range cases {
+		got, ok := interpolate(c.template, params)
+		if got != c.want || ok != c.ok {
+			t.Errorf("interpolate(%q) = %q, %v, want %q, %v", c.template, got, ok, c.want, c.ok)
+		}
+	}
+}
+
+// TestTranslateFallsBack checks that a template with a missing parameter gives way to the next one
+// and that there is no message without a suitable template
+func TestTranslateFallsBack(t *testing.T) {
+	msg, ok := translate("ru", "BODY_MALFORMED", map[string]interface{}{"position": 3})
+	if !ok || msg != "Тело запроса содержит некорректный JSON (позиция 3)" {
+		t.Errorf("with the position: got %q, %v", msg, ok)
+	}
+
+	msg, ok = translate("ru", "BODY_MALFORMED", nil)
+	if !ok || msg != "Тело запроса содержит некорректные данные" {
+		t.Errorf("without the position: got %q, %v", msg, ok)
+	}
+
+	if msg, ok = translate("ru", "BODY_INVALID_VALUE", map[string]interface{}{"field": "name"}); ok {
+		t.Errorf("without the position: got %q, want no message", msg)
+	}
+	if msg, ok = translate("ru", "NO_SUCH_CODE", nil); ok {
+		t.Errorf("unknown code: got %q, want no message", msg)
+	}
+	if msg, ok = translate(DefaultLanguage, "CHAT_NOT_FOUND", nil); ok {
+		t.Errorf("default language: got %q, want the original message to be used", msg)
+	}
+}
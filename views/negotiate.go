@@ -0,0 +1,265 @@
+package views
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/fxamacker/cbor/v2"
+	"github.com/golang/gddo/httputil/header"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+type format struct {
+	mediaTypes []string // the first one is used in Content-Type
+	encode     func(w io.Writer, v interface{}, pretty bool) error
+}
+
+// formats of the responses, the first one is used unless the client asks for another one via the Accept header
+var formats = []format{
+	{[]string{"application/json"}, encodeJSON},
+	{[]string{"application/msgpack", "application/x-msgpack", "application/vnd.msgpack"}, encodeMsgpack},
+	{[]string{"application/cbor"}, encodeCBOR},
+}
+
+// ResponseContentTypes lists the supported content types of the responses.
+var ResponseContentTypes = []string{"application/json", "application/msgpack", "application/cbor"}
+
+// the responses smaller than compressionThreshold bytes aren't compressed, it isn't worth it
+var compressionThreshold = 1024
+
+// SetCompressionThreshold sets the size of a response starting from which it is compressed
+// if the client accepts it, it is meant to be called once on start.
+func SetCompressionThreshold(n int) {
+	compressionThreshold = n
+}
+
+// write encodes v in the format negotiated via the Accept header (JSON if contentType is given,
+// then it is used as is), compresses it according to the Accept-Encoding header if it is worth it and writes it.
+func write(w http.ResponseWriter, r *http.Request, statusCode int, contentType string, v interface{}) {
+	writeConditional(w, r, statusCode, contentType, v, nil)
+}
+
+// writeConditional is write which also handles the conditional requests if cond isn't nil
+func writeConditional(w http.ResponseWriter, r *http.Request, statusCode int, contentType string, v interface{}, cond *conditional) {
+	f := negotiateFormat(r)
+	if contentType == "" {
+		contentType = f.mediaTypes[0]
+	} else {
+		f = formats[0]
+	}
+
+	var body bytes.Buffer
+	if err := f.encode(&body, v, wantsPretty(r)); err != nil {
+		log.Println(err)
+		statusCode = http.StatusInternalServerError
+		body.Reset()
+	}
+
+	h := w.Header()
+	h.Add("Vary", "Accept, Accept-Encoding, Accept-Language")
+
+	if cond != nil && statusCode == http.StatusOK && r != nil {
+		setValidators(h, cond.tag, cond.lastModified)
+		if notModified(r, cond.tag, cond.lastModified) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+
+	h.Set("Content-Type", contentType)
+
+	if body.Len() >= compressionThreshold {
+		if encoding := negotiateEncoding(r); encoding != "" {
+			compressed, err := compress(encoding, body.Bytes())
+			if err == nil {
+				h.Set("Content-Encoding", encoding)
+				body = *compressed
+			} else {
+				log.Println(err)
+			}
+		}
+	}
+
+	h.Set("Content-Length", strconv.Itoa(body.Len()))
+	w.WriteHeader(statusCode)
+	if _, err := w.Write(body.Bytes()); err != nil {
+		log.Println(err)
+	}
+}
+
+func negotiateFormat(r *http.Request) format {
+	if r == nil {
+		return formats[0]
+	}
+
+	specs, refused := acceptSpecs(r, "Accept")
+	for _, spec := range specs {
+		for _, f := range formats {
+			switch spec.Value {
+			case "*/*", "application/*":
+				// the wildcards don't match the formats the client refuses explicitly
+				if !refused[f.mediaTypes[0]] {
+					return f
+				}
+				continue
+			}
+			for _, mt := range f.mediaTypes {
+				if spec.Value == mt {
+					return f
+				}
+			}
+		}
+	}
+
+	// клиенты с неподдерживаемым Accept получают JSON, как было раньше
+	return formats[0]
+}
+
+// negotiateEncoding returns the content coding the response should be compressed with, "" means none
+func negotiateEncoding(r *http.Request) string {
+	if r == nil {
+		return ""
+	}
+
+	specs, refused := acceptSpecs(r, "Accept-Encoding")
+	for _, spec := range specs {
+		switch spec.Value {
+		case "br", "gzip":
+			return spec.Value
+		case "*":
+			// "*" doesn't match the codings with q=0 (RFC 9110, 12.5.3)
+			for _, encoding := range []string{"gzip", "br"} {
+				if !refused[encoding] {
+					return encoding
+				}
+			}
+		}
+	}
+
+	return ""
+}
+
+// acceptSpecs returns the acceptable values of the header, the most preferred first,
+// and the ones refused explicitly with q=0
+func acceptSpecs(r *http.Request, key string) ([]header.AcceptSpec, map[string]bool) {
+	specs := header.ParseAccept(r.Header, key)
+	sort.SliceStable(specs, func(i, j int) bool {
+		return specs[i].Q > specs[j].Q
+	})
+
+	acceptable := specs[:0]
+	refused := make(map[string]bool)
+	for _, spec := range specs {
+		spec.Value = strings.ToLower(spec.Value)
+		if spec.Q > 0 {
+			acceptable = append(acceptable, spec)
+		} else {
+			refused[spec.Value] = true
+		}
+	}
+	return acceptable, refused
+}
+
+func wantsPretty(r *http.Request) bool {
+	if r == nil {
+		return false
+	}
+	pretty, _ := strconv.ParseBool(r.URL.Query().Get("pretty"))
+	return pretty
+}
+
+func compress(encoding string, b []byte) (*bytes.Buffer, error) {
+	var buf bytes.Buffer
+	var zw io.WriteCloser
+	switch encoding {
+	case "br":
+		zw = brotli.NewWriter(&buf)
+	default:
+		zw = gzip.NewWriter(&buf)
+	}
+
+	if _, err := zw.Write(b); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return &buf, nil
+}
+
+func encodeJSON(w io.Writer, v interface{}, pretty bool) error {
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	if pretty {
+		enc.SetIndent("", "  ")
+	}
+	return enc.Encode(v)
+}
+
+func encodeMsgpack(w io.Writer, v interface{}, pretty bool) error {
+	g, err := generic(v)
+	if err != nil {
+		return err
+	}
+	enc := msgpack.NewEncoder(w)
+	enc.UseCompactInts(true)
+	return enc.Encode(g)
+}
+
+func encodeCBOR(w io.Writer, v interface{}, pretty bool) error {
+	g, err := generic(v)
+	if err != nil {
+		return err
+	}
+	return cbor.NewEncoder(w).Encode(g)
+}
+
+// generic converts v into maps, slices and scalars through JSON, so the binary formats
+// have the same field names and representations (e.g. the ",string" ids) as JSON.
+func generic(v interface{}) (interface{}, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var g interface{}
+	if err = dec.Decode(&g); err != nil {
+		return nil, err
+	}
+
+	return numbers(g), nil
+}
+
+// numbers replaces json.Number with integers where possible and with floats otherwise
+func numbers(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k := range v {
+			v[k] = numbers(v[k])
+		}
+	case []interface{}:
+		for i := range v {
+			v[i] = numbers(v[i])
+		}
+	case json.Number:
+		if i, err := strconv.ParseInt(string(v), 10, 64); err == nil {
+			return i
+		}
+		if u, err := strconv.ParseUint(string(v), 10, 64); err == nil {
+			return u
+		}
+		f, _ := v.Float64()
+		return f
+	}
+	return v
+}
@@ -0,0 +1,97 @@
+package views
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	cases := []struct {
+		acceptEncoding string
+		want           string
+	}{
+		{"", ""},
+		{"identity", ""},
+		{"deflate", ""},
+		{"gzip", "gzip"},
+		{"GZIP", "gzip"},
+		{"br", "br"},
+		{"gzip, br", "gzip"},
+		{"gzip;q=0.5, br", "br"},
+		{"br;q=0.1, gzip;q=0.9", "gzip"},
+		{"*", "gzip"},
+		{"gzip;q=0", ""},
+		{"gzip;q=0, *", "br"},
+		{"*, gzip;q=0", "br"},
+		{"gzip;q=0, br;q=0, *", ""},
+		{"*;q=0", ""},
+		{"deflate, *;q=0.5", "gzip"},
+	}
+
+	for _, c := range cases {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if c.acceptEncoding != "" {
+			r.Header.Set("Accept-Encoding", c.acceptEncoding)
+		}
+		if got := negotiateEncoding(r); got != c.want {
+			t.Errorf("Accept-Encoding %q: got %q, want %q", c.acceptEncoding, got, c.want)
+		}
+	}
+}
+
+func TestNegotiateFormat(t *testing.T) {
+	cases := []struct {
+		accept string
+		want   string
+	}{
+		{"", "application/json"},
+		{"text/html", "application/json"},
+		{"application/msgpack", "application/msgpack"},
+		{"application/x-msgpack", "application/msgpack"},
+		{"application/cbor;q=0.9, application/msgpack", "application/msgpack"},
+		{"application/cbor, application/json;q=0.5", "application/cbor"},
+		{"*/*", "application/json"},
+		{"application/*", "application/json"},
+		{"application/json;q=0, */*", "application/msgpack"},
+		{"application/json;q=0, application/msgpack;q=0, application/*", "application/cbor"},
+	}
+
+	for _, c := range cases {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if c.accept != "" {
+			r.Header.Set("Accept", c.accept)
+		}
+		if got := negotiateFormat(r).mediaTypes[0]; got != c.want {
+			t.Errorf("Accept %q: got %s, want %s", c.accept, got, c.want)
+		}
+	}
+}
+
+func TestWriteCompresses(t *testing.T) {
+	defer SetCompressionThreshold(compressionThreshold)
+	SetCompressionThreshold(100)
+	long := strings.Repeat("a", 100)
+
+	for _, c := range []struct {
+		acceptEncoding string
+		result         string
+		want           string
+	}{
+		{"gzip", long, "gzip"},
+		{"gzip", "short", ""}, // the envelope doesn't make it long enough
+		{"gzip;q=0, *", long, "br"},
+		{"gzip;q=0", long, ""},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Accept-Encoding", c.acceptEncoding)
+		w := httptest.NewRecorder()
+		Render(w, r, c.result, http.StatusOK, nil)
+
+		if got := w.Header().Get("Content-Encoding"); got != c.want {
+			t.Errorf("Accept-Encoding %q, %d bytes: got Content-Encoding %q, want %q",
+				c.acceptEncoding, len(c.result), got, c.want)
+		}
+	}
+}
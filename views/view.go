@@ -1,7 +1,6 @@
 package views
 
 import (
-	"encoding/json"
 	"log"
 	"net/http"
 )
@@ -11,24 +10,128 @@ type PublicError interface {
 	Public() string
 }
 
-func RenderJSON(w http.ResponseWriter, result interface{}, StatusCode int, err error) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(StatusCode)
+// CodedError is implemented by public errors which carry a stable machine-readable code.
+type CodedError interface {
+	Code() string
+}
+
+// FieldError is implemented by errors which relate to a particular request field.
+type FieldError interface {
+	Field() string
+}
+
+// DetailedError is implemented by errors which carry additional data, e.g. a position in the request body.
+type DetailedError interface {
+	Details() map[string]interface{}
+}
+
+// CodeInternal is reported for the errors which are not meant to be shown to clients.
+const CodeInternal = "INTERNAL_ERROR"
+
+type ErrorFormat string
+
+const (
+	// ErrorFormatEnvelope renders errors inside the usual {"Error":..,"ErrorInfo":..,"Result":..} envelope.
+	ErrorFormatEnvelope ErrorFormat = "envelope"
+	// ErrorFormatProblem renders errors as RFC 7807 application/problem+json documents.
+	ErrorFormatProblem ErrorFormat = "problem"
+)
+
+var errorFormat = ErrorFormatEnvelope
+
+// SetErrorFormat sets the format the errors are rendered in, it is meant to be called once on start.
+func SetErrorFormat(f ErrorFormat) {
+	errorFormat = f
+}
+
+type errorInfo struct {
+	Code    string
+	Field   *string
+	Details map[string]interface{}
+}
+
+// Render renders the result or the error in the format requested via the Accept header (JSON by default),
+// the error's message is translated into the language requested via the Accept-Language header,
+// if there is a catalog for it. ?pretty=1 makes JSON indented.
+func Render(w http.ResponseWriter, r *http.Request, result interface{}, StatusCode int, err error) {
+	msg, info := publicError(w, r, err)
+
+	if info != nil && errorFormat == ErrorFormatProblem {
+		renderProblem(w, r, StatusCode, result, msg, info)
+		return
+	}
+
+	d := map[string]interface{}{"Result": result, "Error": msg, "ErrorInfo": info}
+	write(w, r, StatusCode, "", d)
+}
 
-	var msg *string
-	if err != nil {
-		if pErr, ok := err.(PublicError); ok {
-			m := pErr.Public()
-			msg = &m
-		} else {
-			log.Println(err)
-		}
+// publicError returns the error's message and description which can be shown to the client
+func publicError(w http.ResponseWriter, r *http.Request, err error) (*string, *errorInfo) {
+	if err == nil {
+		return nil, nil
 	}
 
-	enc := json.NewEncoder(w)
-	enc.SetEscapeHTML(false)
-	d := map[string]interface{}{"Result": result, "Error": msg}
-	if err = enc.Encode(d); err != nil {
+	info := &errorInfo{Code: CodeInternal}
+	pErr, ok := err.(PublicError)
+	if !ok {
 		log.Println(err)
+		return nil, info
+	}
+
+	msg := pErr.Public()
+	describeError(info, err)
+	localize(w, r, &msg, info)
+	return &msg, info
+}
+
+func describeError(info *errorInfo, err error) {
+	if cErr, ok := err.(CodedError); ok {
+		info.Code = cErr.Code()
+	}
+	if fErr, ok := err.(FieldError); ok && fErr.Field() != "" {
+		f := fErr.Field()
+		info.Field = &f
+	}
+	if dErr, ok := err.(DetailedError); ok {
+		info.Details = dErr.Details()
+	}
+}
+
+func localize(w http.ResponseWriter, r *http.Request, msg *string, info *errorInfo) {
+	lang := negotiateLanguage(r)
+	w.Header().Set("Content-Language", lang)
+	if lang == DefaultLanguage {
+		return
+	}
+
+	if m, ok := translate(lang, info.Code, errorParams(info)); ok {
+		*msg = m
+	}
+}
+
+// renderProblem renders the error as described in RFC 7807, the code, the field, the details and the result
+// the error comes with (e.g. the outcomes of the items of a failed batch) are added as extension members.
+func renderProblem(w http.ResponseWriter, r *http.Request, statusCode int, result interface{}, msg *string, info *errorInfo) {
+	d := map[string]interface{}{
+		"type":   "urn:bta:error:" + info.Code,
+		"status": statusCode,
+		"code":   info.Code,
+	}
+	// the non-standard statuses (e.g. 499 of the canceled requests) have no title
+	if title := http.StatusText(statusCode); title != "" {
+		d["title"] = title
+	}
+	if msg != nil {
+		d["detail"] = *msg
+	}
+	if info.Field != nil {
+		d["field"] = *info.Field
+	}
+	if info.Details != nil {
+		d["details"] = info.Details
+	}
+	if result != nil {
+		d["result"] = result
 	}
+	write(w, r, statusCode, "application/problem+json", d)
 }
@@ -0,0 +1,130 @@
+package views
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+// testError is a public error with everything an error can describe itself with
+type testError struct {
+	msg, code, field string
+	details          map[string]interface{}
+}
+
+func (e testError) Error() string                   { return e.msg }
+func (e testError) Public() string                  { return e.msg }
+func (e testError) Code() string                    { return e.code }
+func (e testError) Field() string                   { return e.field }
+func (e testError) Details() map[string]interface{} { return e.details }
+
+// publicOnly is a public error which describes nothing but its message
+type publicOnly string
+
+func (e publicOnly) Error() string  { return string(e) }
+func (e publicOnly) Public() string { return string(e) }
+
+func TestPublicError(t *testing.T) {
+	strPtr := func(s string) *string { return &s }
+
+	cases := []struct {
+		name string
+		err  error
+		msg  *string
+		info *errorInfo
+	}{
+		{"none", nil, nil, nil},
+		// the internal errors are logged, not shown
+		{"internal", errors.New("pq: connection refused"), nil, &errorInfo{Code: CodeInternal}},
+		{"uncoded", publicOnly("Something's wrong"), strPtr("Something's wrong"), &errorInfo{Code: CodeInternal}},
+		{"described", testError{msg: "Bad name", code: "NAME_BAD", field: "name", details: map[string]interface{}{"max": 10}},
+			strPtr("Bad name"), &errorInfo{Code: "NAME_BAD", Field: strPtr("name"), Details: map[string]interface{}{"max": 10}}},
+		// the empty field means there is none
+		{"no field", testError{msg: "Bad", code: "BAD"}, strPtr("Bad"), &errorInfo{Code: "BAD"}},
+	}
+
+	for _, c := range cases {
+		msg, info := publicError(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil), c.err)
+		if !reflect.DeepEqual(msg, c.msg) || !reflect.DeepEqual(info, c.info) {
+			t.Errorf("%s: got %v %+v, want %v %+v", c.name, msg, info, c.msg, c.info)
+		}
+	}
+}
+
+// render renders the result and the error in the format f and decodes the response
+func render(t *testing.T, f ErrorFormat, result interface{}, statusCode int, err error) (*httptest.ResponseRecorder, map[string]interface{}) {
+	t.Helper()
+
+	defer SetErrorFormat(errorFormat)
+	SetErrorFormat(f)
+
+	w := httptest.NewRecorder()
+	Render(w, httptest.NewRequest(http.MethodGet, "/", nil), result, statusCode, err)
+
+	var body map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("can't decode %q: %v", w.Body.String(), err)
+	}
+	return w, body
+}
+
+func TestRenderEnvelope(t *testing.T) {
+	err := testError{msg: "Bad name", code: "NAME_BAD", field: "name", details: map[string]interface{}{"max": 10}}
+	w, body := render(t, ErrorFormatEnvelope, nil, http.StatusBadRequest, err)
+
+	want := map[string]interface{}{
+		"Result": nil,
+		"Error":  "Bad name",
+		"ErrorInfo": map[string]interface{}{
+			"Code": "NAME_BAD", "Field": "name", "Details": map[string]interface{}{"max": float64(10)},
+		},
+	}
+	if w.Code != http.StatusBadRequest || w.Header().Get("Content-Type") != "application/json" || !reflect.DeepEqual(body, want) {
+		t.Errorf("got %d %s %v", w.Code, w.Header().Get("Content-Type"), body)
+	}
+
+	_, body = render(t, ErrorFormatEnvelope, 42, http.StatusOK, nil)
+	want = map[string]interface{}{"Result": float64(42), "Error": nil, "ErrorInfo": nil}
+	if !reflect.DeepEqual(body, want) {
+		t.Errorf("the result: got %v", body)
+	}
+}
+
+func TestRenderProblem(t *testing.T) {
+	err := testError{msg: "Bad name", code: "NAME_BAD", field: "name", details: map[string]interface{}{"max": 10}}
+	w, body := render(t, ErrorFormatProblem, []int{1}, http.StatusBadRequest, err)
+
+	want := map[string]interface{}{
+		"type":    "urn:bta:error:NAME_BAD",
+		"title":   "Bad Request",
+		"status":  float64(http.StatusBadRequest),
+		"code":    "NAME_BAD",
+		"detail":  "Bad name",
+		"field":   "name",
+		"details": map[string]interface{}{"max": float64(10)},
+		"result":  []interface{}{float64(1)},
+	}
+	if w.Code != http.StatusBadRequest || w.Header().Get("Content-Type") != "application/problem+json" || !reflect.DeepEqual(body, want) {
+		t.Errorf("got %d %s %v", w.Code, w.Header().Get("Content-Type"), body)
+	}
+
+	// the internal error has neither the message nor the field
+	_, body = render(t, ErrorFormatProblem, nil, http.StatusInternalServerError, errors.New("boom"))
+	want = map[string]interface{}{
+		"type":   "urn:bta:error:" + CodeInternal,
+		"title":  "Internal Server Error",
+		"status": float64(http.StatusInternalServerError),
+		"code":   CodeInternal,
+	}
+	if !reflect.DeepEqual(body, want) {
+		t.Errorf("the internal error: got %v", body)
+	}
+
+	// the successes are rendered in the envelope anyway
+	if _, body = render(t, ErrorFormatProblem, 42, http.StatusOK, nil); body["Result"] != float64(42) {
+		t.Errorf("the result: got %v", body)
+	}
+}